@@ -52,6 +52,9 @@ type BinlogDMLEvent struct {
 	DML               EventDML
 	WhereColumnValues *sql.ColumnValues
 	NewColumnValues   *sql.ColumnValues
+
+	// 表结构(rows event所在位置有效的版本), 通过它可以按照column name访问Where/New ColumnValues
+	Columns *sql.ColumnList
 }
 
 func NewBinlogDMLEvent(databaseName, tableName string, dml EventDML) *BinlogDMLEvent {
@@ -66,3 +69,31 @@ func NewBinlogDMLEvent(databaseName, tableName string, dml EventDML) *BinlogDMLE
 func (this *BinlogDMLEvent) String() string {
 	return fmt.Sprintf("[%+v on %s:%s]", this.DML, this.DatabaseName, this.TableName)
 }
+
+// NewColumnValue returns the value of given column in the new row image (insert/update)
+func (this *BinlogDMLEvent) NewColumnValue(columnName string) (interface{}, error) {
+	return this.columnValue(this.NewColumnValues, columnName)
+}
+
+// WhereColumnValue returns the value of given column in the old row image (update/delete)
+func (this *BinlogDMLEvent) WhereColumnValue(columnName string) (interface{}, error) {
+	return this.columnValue(this.WhereColumnValues, columnName)
+}
+
+func (this *BinlogDMLEvent) columnValue(columnValues *sql.ColumnValues, columnName string) (interface{}, error) {
+	if this.Columns == nil {
+		return nil, fmt.Errorf("No columns found for %s.%s", this.DatabaseName, this.TableName)
+	}
+	if columnValues == nil {
+		return nil, fmt.Errorf("No row image for column %s in %s event", columnName, this.DML)
+	}
+	ordinal, ok := this.Columns.Ordinals[columnName]
+	if !ok {
+		return nil, fmt.Errorf("Unknown column %s in %s.%s", columnName, this.DatabaseName, this.TableName)
+	}
+	values := columnValues.AbstractValues()
+	if ordinal >= len(values) {
+		return nil, fmt.Errorf("Column %s out of range in %s.%s: %d >= %d", columnName, this.DatabaseName, this.TableName, ordinal, len(values))
+	}
+	return values[ordinal], nil
+}
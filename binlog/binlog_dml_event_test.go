@@ -0,0 +1,41 @@
+package binlog
+
+import (
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+	"github.com/wfxiang08/db-sharding/sql"
+)
+
+// go test github.com/wfxiang08/db-sharding/binlog -v -run "TestBinlogDMLEventColumnValue$"
+func TestBinlogDMLEventColumnValue(t *testing.T) {
+	event := NewBinlogDMLEvent("final", "user_recording_like", UpdateDML)
+	event.WhereColumnValues = sql.ToColumnValues([]interface{}{int64(1), int32(100), int64(6755399444017774), int64(200)})
+	event.NewColumnValues = sql.ToColumnValues([]interface{}{int64(1), int32(101), int64(6755399444017774), int64(201)})
+
+	// 没有表结构
+	_, err := event.NewColumnValue("user_id")
+	test.S(t).ExpectNotNil(err)
+
+	event.Columns = sql.ParseColumnList("id,created_on,user_id,recording_id")
+
+	value, err := event.NewColumnValue("recording_id")
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(value, int64(201))
+
+	value, err = event.WhereColumnValue("recording_id")
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(value, int64(200))
+
+	_, err = event.NewColumnValue("no_such_column")
+	test.S(t).ExpectNotNil(err)
+
+	// delete没有new row image
+	event = NewBinlogDMLEvent("final", "user_recording_like", DeleteDML)
+	event.WhereColumnValues = sql.ToColumnValues([]interface{}{int64(1), int32(100)})
+	event.Columns = sql.ParseColumnList("id,created_on,user_id,recording_id")
+	_, err = event.NewColumnValue("id")
+	test.S(t).ExpectNotNil(err)
+	_, err = event.WhereColumnValue("user_id")
+	test.S(t).ExpectNotNil(err)
+}
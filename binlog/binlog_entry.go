@@ -16,6 +16,7 @@ type BinlogEntry struct {
 	EndLogPos   uint64
 	Timestamp   int64
 	DmlEvent    *BinlogDMLEvent
+	Commit      bool // 事务结束(XID或者COMMIT), DmlEvent为nil; 只有事务中有rows event时才会出现
 }
 
 // NewBinlogEntry creates an empty, ready to go BinlogEntry object
@@ -34,6 +35,13 @@ func NewBinlogEntryAt(coordinates mysql.BinlogCoordinates) *BinlogEntry {
 	return binlogEntry
 }
 
+// NewCommitEntryAt creates an entry marking the end of a transaction
+func NewCommitEntryAt(coordinates mysql.BinlogCoordinates) *BinlogEntry {
+	binlogEntry := NewBinlogEntryAt(coordinates)
+	binlogEntry.Commit = true
+	return binlogEntry
+}
+
 // Duplicate creates and returns a new binlog entry, with some of the attributes pre-assigned
 func (this *BinlogEntry) Duplicate() *BinlogEntry {
 	binlogEntry := NewBinlogEntry(this.Coordinates.LogFile, uint64(this.Coordinates.LogPos))
@@ -44,5 +52,8 @@ func (this *BinlogEntry) Duplicate() *BinlogEntry {
 
 // Duplicate creates and returns a new binlog entry, with some of the attributes pre-assigned
 func (this *BinlogEntry) String() string {
+	if this.Commit {
+		return fmt.Sprintf("[BinlogEntry at %+v; commit]", this.Coordinates)
+	}
 	return fmt.Sprintf("[BinlogEntry at %+v; dml:%+v]", this.Coordinates, this.DmlEvent)
 }
@@ -0,0 +1,96 @@
+package binlog
+
+import (
+	"fmt"
+
+	gomysql "github.com/siddontang/go-mysql/mysql"
+	"github.com/wfxiang08/db-sharding/sql"
+)
+
+// dataType --> TableMapEvent中可能的column类型
+// 注意: CHAR, ENUM, SET在TableMapEvent中都是MYSQL_TYPE_STRING, 各种TEXT/BLOB都是MYSQL_TYPE_BLOB
+var binlogColumnTypes = map[string][]byte{
+	"tinyint":   {gomysql.MYSQL_TYPE_TINY},
+	"bool":      {gomysql.MYSQL_TYPE_TINY},
+	"boolean":   {gomysql.MYSQL_TYPE_TINY},
+	"smallint":  {gomysql.MYSQL_TYPE_SHORT},
+	"mediumint": {gomysql.MYSQL_TYPE_INT24},
+	"int":       {gomysql.MYSQL_TYPE_LONG},
+	"integer":   {gomysql.MYSQL_TYPE_LONG},
+	"bigint":    {gomysql.MYSQL_TYPE_LONGLONG},
+	"serial":    {gomysql.MYSQL_TYPE_LONGLONG},
+	"decimal":   {gomysql.MYSQL_TYPE_NEWDECIMAL, gomysql.MYSQL_TYPE_DECIMAL},
+	"numeric":   {gomysql.MYSQL_TYPE_NEWDECIMAL, gomysql.MYSQL_TYPE_DECIMAL},
+	"dec":       {gomysql.MYSQL_TYPE_NEWDECIMAL, gomysql.MYSQL_TYPE_DECIMAL},
+	"fixed":     {gomysql.MYSQL_TYPE_NEWDECIMAL, gomysql.MYSQL_TYPE_DECIMAL},
+	"float":     {gomysql.MYSQL_TYPE_FLOAT},
+	"double":    {gomysql.MYSQL_TYPE_DOUBLE},
+	"real":      {gomysql.MYSQL_TYPE_DOUBLE},
+
+	"char":      {gomysql.MYSQL_TYPE_STRING},
+	"binary":    {gomysql.MYSQL_TYPE_STRING},
+	"enum":      {gomysql.MYSQL_TYPE_STRING, gomysql.MYSQL_TYPE_ENUM},
+	"set":       {gomysql.MYSQL_TYPE_STRING, gomysql.MYSQL_TYPE_SET},
+	"varchar":   {gomysql.MYSQL_TYPE_VARCHAR, gomysql.MYSQL_TYPE_VAR_STRING},
+	"varbinary": {gomysql.MYSQL_TYPE_VARCHAR, gomysql.MYSQL_TYPE_VAR_STRING},
+
+	"tinyblob":   {gomysql.MYSQL_TYPE_BLOB},
+	"blob":       {gomysql.MYSQL_TYPE_BLOB},
+	"mediumblob": {gomysql.MYSQL_TYPE_BLOB},
+	"longblob":   {gomysql.MYSQL_TYPE_BLOB},
+	"tinytext":   {gomysql.MYSQL_TYPE_BLOB},
+	"text":       {gomysql.MYSQL_TYPE_BLOB},
+	"mediumtext": {gomysql.MYSQL_TYPE_BLOB},
+	"longtext":   {gomysql.MYSQL_TYPE_BLOB},
+	"json":       {gomysql.MYSQL_TYPE_JSON, gomysql.MYSQL_TYPE_BLOB}, // MariaDB中json为longtext
+
+	"date":      {gomysql.MYSQL_TYPE_DATE},
+	"datetime":  {gomysql.MYSQL_TYPE_DATETIME2, gomysql.MYSQL_TYPE_DATETIME},
+	"timestamp": {gomysql.MYSQL_TYPE_TIMESTAMP2, gomysql.MYSQL_TYPE_TIMESTAMP},
+	"time":      {gomysql.MYSQL_TYPE_TIME2, gomysql.MYSQL_TYPE_TIME},
+	"year":      {gomysql.MYSQL_TYPE_YEAR},
+	"bit":       {gomysql.MYSQL_TYPE_BIT},
+
+	"geometry":           {gomysql.MYSQL_TYPE_GEOMETRY},
+	"point":              {gomysql.MYSQL_TYPE_GEOMETRY},
+	"linestring":         {gomysql.MYSQL_TYPE_GEOMETRY},
+	"polygon":            {gomysql.MYSQL_TYPE_GEOMETRY},
+	"multipoint":         {gomysql.MYSQL_TYPE_GEOMETRY},
+	"multilinestring":    {gomysql.MYSQL_TYPE_GEOMETRY},
+	"multipolygon":       {gomysql.MYSQL_TYPE_GEOMETRY},
+	"geometrycollection": {gomysql.MYSQL_TYPE_GEOMETRY},
+}
+
+// columnTypeMatches dataType未知(或者不认识)时无法校验, 认为一致
+func columnTypeMatches(dataType string, binlogType byte) bool {
+	binlogTypes, ok := binlogColumnTypes[dataType]
+	if !ok {
+		return true
+	}
+	for _, t := range binlogTypes {
+		if t == binlogType {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRowImage 校验表结构和row image是否一致: 列数, 以及TableMapEvent中的column类型(columnTypes为nil时不校验)
+// 注意: 当前使用的go-mysql不解析TableMapEvent中的column names(binlog_row_metadata=FULL), 无法按照名字校验
+func checkRowImage(columns *sql.ColumnList, columnCount int, columnTypes []byte) error {
+	if columns.Len() != columnCount {
+		return fmt.Errorf("columns: %s, row image columns: %d", columns.String(), columnCount)
+	}
+	if len(columnTypes) == 0 {
+		return nil
+	}
+	if len(columnTypes) != columnCount {
+		return fmt.Errorf("columns: %s, table map columns: %d", columns.String(), len(columnTypes))
+	}
+	for i, column := range columns.Columns() {
+		if !columnTypeMatches(column.DataType, columnTypes[i]) {
+			return fmt.Errorf("column %s is %s, binlog column type: %d", column.Name, column.DataType, columnTypes[i])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,436 @@
+package binlog
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/wfxiang08/db-sharding/sql"
+)
+
+type DDLType int
+
+const (
+	CreateTableDDL DDLType = iota
+	DropTableDDL
+	RenameTableDDL
+	AlterTableDDL
+)
+
+type AlterType int
+
+const (
+	AddColumnAlter AlterType = iota
+	DropColumnAlter
+	ChangeColumnAlter // CHANGE/MODIFY/RENAME COLUMN
+	RenameTableAlter
+)
+
+// AlterSpec 描述ALTER TABLE中影响column列表的一个子句
+type AlterSpec struct {
+	Type        AlterType
+	Column      string
+	NewColumn   string // ChangeColumnAlter
+	NewDatabase string // RenameTableAlter
+	NewTable    string // RenameTableAlter
+	DataType    string // AddColumnAlter, ChangeColumnAlter: 新的column的类型
+	First       bool
+	After       string
+}
+
+// TableDDL 描述一个table的结构变化
+type TableDDL struct {
+	Type         DDLType
+	DatabaseName string
+	TableName    string
+
+	// CreateTableDDL
+	Columns          []string
+	ColumnTypes      []string // 和Columns一一对应, 例如: bigint, varchar
+	LikeDatabaseName string   // CREATE TABLE ... LIKE ...
+	LikeTableName    string
+
+	// RenameTableDDL
+	NewDatabaseName string
+	NewTableName    string
+
+	// AlterTableDDL
+	AlterSpecs []*AlterSpec
+
+	// DDL无法解析, 表结构未知
+	Unknown bool
+}
+
+func (this *TableDDL) String() string {
+	return fmt.Sprintf("[DDL %d on %s.%s]", this.Type, this.DatabaseName, this.TableName)
+}
+
+var (
+	commentPattern          = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	versionedCommentPattern = regexp.MustCompile(`(?s)/\*!\d*(.*?)\*/`)
+
+	createTablePattern = regexp.MustCompile(`(?is)^create\s+table\s+(?:if\s+not\s+exists\s+)?(.*)$`)
+	dropTablePattern   = regexp.MustCompile(`(?is)^drop\s+table\s+(?:if\s+exists\s+)?(.*)$`)
+	renameTablePattern = regexp.MustCompile(`(?is)^rename\s+table\s+(.*)$`)
+	alterTablePattern  = regexp.MustCompile(`(?is)^alter\s+(?:online\s+|offline\s+)?(?:ignore\s+)?table\s+(.*)$`)
+)
+
+// 这些关键字开头的定义不是column
+var nonColumnKeywords = map[string]bool{
+	"PRIMARY": true, "KEY": true, "INDEX": true, "UNIQUE": true, "CONSTRAINT": true,
+	"FOREIGN": true, "FULLTEXT": true, "SPATIAL": true, "CHECK": true, "PARTITION": true,
+}
+
+// ParseDDL 解析QueryEvent中的DDL, 只关注会影响column列表的语句: CREATE/DROP/RENAME/ALTER TABLE
+// 其他语句(BEGIN, TRUNCATE, CREATE INDEX, ...)返回nil
+// defaultDatabase 为QueryEvent中的schema, 用于补全没有指定db的table name
+func ParseDDL(defaultDatabase string, query string) []*TableDDL {
+	query = versionedCommentPattern.ReplaceAllString(query, "$1")
+	query = commentPattern.ReplaceAllString(query, " ")
+	query = strings.TrimSpace(strings.TrimRight(strings.TrimSpace(query), ";"))
+
+	if m := createTablePattern.FindStringSubmatch(query); m != nil {
+		return parseCreateTable(defaultDatabase, m[1])
+	}
+	if m := dropTablePattern.FindStringSubmatch(query); m != nil {
+		return parseDropTable(defaultDatabase, m[1])
+	}
+	if m := renameTablePattern.FindStringSubmatch(query); m != nil {
+		return parseRenameTable(defaultDatabase, m[1])
+	}
+	if m := alterTablePattern.FindStringSubmatch(query); m != nil {
+		return parseAlterTable(defaultDatabase, m[1])
+	}
+	return nil
+}
+
+// CREATE TABLE t (...) / CREATE TABLE t LIKE t2 / CREATE TABLE t SELECT ...
+func parseCreateTable(defaultDatabase string, body string) []*TableDDL {
+	tableName, rest := splitTableName(body)
+	if len(tableName) == 0 {
+		return nil
+	}
+
+	ddl := &TableDDL{Type: CreateTableDDL}
+	ddl.DatabaseName, ddl.TableName = parseTableName(defaultDatabase, tableName)
+
+	tokens := tokenize(rest)
+	if len(tokens) == 1 && strings.HasPrefix(tokens[0], "(") {
+		// CREATE TABLE t (LIKE t2)
+		if likeTokens := tokenize(unwrapParentheses(tokens[0])); len(likeTokens) == 2 && strings.EqualFold(likeTokens[0], "like") {
+			tokens = likeTokens
+		}
+	}
+	if len(tokens) == 2 && strings.EqualFold(tokens[0], "like") {
+		ddl.LikeDatabaseName, ddl.LikeTableName = parseTableName(defaultDatabase, tokens[1])
+		return []*TableDDL{ddl}
+	}
+
+	if len(tokens) == 0 || !strings.HasPrefix(tokens[0], "(") {
+		// CREATE TABLE ... SELECT, 无法从语句中得到column
+		ddl.Unknown = true
+		return []*TableDDL{ddl}
+	}
+
+	for _, definition := range splitTopLevel(unwrapParentheses(tokens[0])) {
+		definitionTokens := tokenize(definition)
+		if len(definitionTokens) == 0 || isNonColumnKeyword(definitionTokens[0]) {
+			continue
+		}
+		ddl.Columns = append(ddl.Columns, unquoteName(definitionTokens[0]))
+		ddl.ColumnTypes = append(ddl.ColumnTypes, parseDataType(definitionTokens, 1))
+	}
+	if len(ddl.Columns) == 0 {
+		ddl.Unknown = true
+	}
+	return []*TableDDL{ddl}
+}
+
+// DROP TABLE t1, t2 [RESTRICT | CASCADE]
+func parseDropTable(defaultDatabase string, body string) []*TableDDL {
+	var result []*TableDDL
+	for _, item := range splitTopLevel(body) {
+		tokens := tokenize(item)
+		if len(tokens) == 0 {
+			continue
+		}
+		ddl := &TableDDL{Type: DropTableDDL}
+		ddl.DatabaseName, ddl.TableName = parseTableName(defaultDatabase, tokens[0])
+		result = append(result, ddl)
+	}
+	return result
+}
+
+// RENAME TABLE t1 TO t2, t3 TO t4
+func parseRenameTable(defaultDatabase string, body string) []*TableDDL {
+	var result []*TableDDL
+	for _, item := range splitTopLevel(body) {
+		tokens := tokenize(item)
+		if len(tokens) != 3 || !strings.EqualFold(tokens[1], "to") {
+			continue
+		}
+		ddl := &TableDDL{Type: RenameTableDDL}
+		ddl.DatabaseName, ddl.TableName = parseTableName(defaultDatabase, tokens[0])
+		ddl.NewDatabaseName, ddl.NewTableName = parseTableName(defaultDatabase, tokens[2])
+		result = append(result, ddl)
+	}
+	return result
+}
+
+// ALTER TABLE t alter_specification [, alter_specification] ...
+func parseAlterTable(defaultDatabase string, body string) []*TableDDL {
+	tableName, rest := splitTableName(body)
+
+	ddl := &TableDDL{Type: AlterTableDDL}
+	ddl.DatabaseName, ddl.TableName = parseTableName(defaultDatabase, tableName)
+
+	for _, specification := range splitTopLevel(rest) {
+		specs, err := parseAlterSpec(defaultDatabase, tokenize(specification))
+		if err != nil {
+			ddl.Unknown = true
+			ddl.AlterSpecs = nil
+			break
+		}
+		ddl.AlterSpecs = append(ddl.AlterSpecs, specs...)
+	}
+	return []*TableDDL{ddl}
+}
+
+func parseAlterSpec(defaultDatabase string, tokens []string) ([]*AlterSpec, error) {
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	keyword := strings.ToUpper(tokens[0])
+	tokens = tokens[1:]
+	switch keyword {
+	case "ADD":
+		if len(tokens) > 0 && strings.EqualFold(tokens[0], "column") {
+			tokens = tokens[1:]
+		}
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("invalid ADD")
+		}
+		if isNonColumnKeyword(tokens[0]) {
+			return nil, nil
+		}
+		if strings.HasPrefix(tokens[0], "(") {
+			// ADD COLUMN (c1 int, c2 int)
+			var specs []*AlterSpec
+			for _, definition := range splitTopLevel(unwrapParentheses(tokens[0])) {
+				definitionTokens := tokenize(definition)
+				if len(definitionTokens) == 0 {
+					continue
+				}
+				specs = append(specs, &AlterSpec{Type: AddColumnAlter, Column: unquoteName(definitionTokens[0]),
+					DataType: parseDataType(definitionTokens, 1)})
+			}
+			return specs, nil
+		}
+		spec := &AlterSpec{Type: AddColumnAlter, Column: unquoteName(tokens[0]), DataType: parseDataType(tokens, 1)}
+		spec.First, spec.After = parseColumnPosition(tokens)
+		return []*AlterSpec{spec}, nil
+
+	case "DROP":
+		if len(tokens) > 0 && strings.EqualFold(tokens[0], "column") {
+			tokens = tokens[1:]
+		}
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("invalid DROP")
+		}
+		if isNonColumnKeyword(tokens[0]) || strings.EqualFold(tokens[0], "default") {
+			return nil, nil
+		}
+		return []*AlterSpec{{Type: DropColumnAlter, Column: unquoteName(tokens[0])}}, nil
+
+	case "CHANGE":
+		if len(tokens) > 0 && strings.EqualFold(tokens[0], "column") {
+			tokens = tokens[1:]
+		}
+		if len(tokens) < 2 {
+			return nil, fmt.Errorf("invalid CHANGE")
+		}
+		spec := &AlterSpec{Type: ChangeColumnAlter, Column: unquoteName(tokens[0]), NewColumn: unquoteName(tokens[1]),
+			DataType: parseDataType(tokens, 2)}
+		spec.First, spec.After = parseColumnPosition(tokens)
+		return []*AlterSpec{spec}, nil
+
+	case "MODIFY":
+		if len(tokens) > 0 && strings.EqualFold(tokens[0], "column") {
+			tokens = tokens[1:]
+		}
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("invalid MODIFY")
+		}
+		spec := &AlterSpec{Type: ChangeColumnAlter, Column: unquoteName(tokens[0]), NewColumn: unquoteName(tokens[0]),
+			DataType: parseDataType(tokens, 1)}
+		spec.First, spec.After = parseColumnPosition(tokens)
+		return []*AlterSpec{spec}, nil
+
+	case "RENAME":
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("invalid RENAME")
+		}
+		switch strings.ToUpper(tokens[0]) {
+		case "INDEX", "KEY":
+			return nil, nil
+		case "COLUMN":
+			// RENAME COLUMN a TO b
+			if len(tokens) != 4 || !strings.EqualFold(tokens[2], "to") {
+				return nil, fmt.Errorf("invalid RENAME COLUMN")
+			}
+			return []*AlterSpec{{Type: ChangeColumnAlter, Column: unquoteName(tokens[1]), NewColumn: unquoteName(tokens[3])}}, nil
+		case "TO", "AS":
+			tokens = tokens[1:]
+		}
+		if len(tokens) != 1 {
+			return nil, fmt.Errorf("invalid RENAME")
+		}
+		spec := &AlterSpec{Type: RenameTableAlter}
+		spec.NewDatabase, spec.NewTable = parseTableName(defaultDatabase, tokens[0])
+		return []*AlterSpec{spec}, nil
+	}
+
+	// ENGINE=, CONVERT TO CHARACTER SET, ALTER COLUMN c SET DEFAULT, ORDER BY, ...
+	// 不影响column列表
+	return nil, nil
+}
+
+// parseDataType column定义中第index个token为类型, 例如: c1 bigint(20) unsigned
+func parseDataType(tokens []string, index int) string {
+	if index >= len(tokens) {
+		return ""
+	}
+	return sql.ParseDataType(tokens[index])
+}
+
+// [FIRST | AFTER col_name]
+func parseColumnPosition(tokens []string) (first bool, after string) {
+	n := len(tokens)
+	if n >= 1 && strings.EqualFold(tokens[n-1], "first") {
+		return true, ""
+	}
+	if n >= 2 && strings.EqualFold(tokens[n-2], "after") {
+		return false, unquoteName(tokens[n-1])
+	}
+	return false, ""
+}
+
+func isNonColumnKeyword(token string) bool {
+	return nonColumnKeywords[strings.ToUpper(token)]
+}
+
+// db.table, `db`.`table`, table
+func parseTableName(defaultDatabase string, token string) (databaseName string, tableName string) {
+	parts := splitTopLevelBy(token, '.')
+	if len(parts) == 2 {
+		return unquoteName(parts[0]), unquoteName(parts[1])
+	}
+	return defaultDatabase, unquoteName(token)
+}
+
+// splitTableName 从语句中切分出table name, table name之后可能直接跟着括号: CREATE TABLE t(a int)
+func splitTableName(s string) (tableName string, rest string) {
+	s = strings.TrimSpace(s)
+	inQuote := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '`' {
+			inQuote = !inQuote
+		} else if !inQuote && (c == '(' || c == ' ' || c == '\t' || c == '\r' || c == '\n') {
+			return s[:i], strings.TrimSpace(s[i:])
+		}
+	}
+	return s, ""
+}
+
+func unquoteName(name string) string {
+	name = strings.TrimSpace(name)
+	if len(name) >= 2 && name[0] == '`' && name[len(name)-1] == '`' {
+		return strings.Replace(name[1:len(name)-1], "``", "`", -1)
+	}
+	return name
+}
+
+func unwrapParentheses(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// splitTopLevel 按照逗号切分, 忽略括号和引号内的逗号
+func splitTopLevel(s string) []string {
+	return splitTopLevelBy(s, ',')
+}
+
+func splitTopLevelBy(s string, separator byte) []string {
+	var result []string
+	depth := 0
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == separator && depth == 0:
+			result = append(result, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); len(last) > 0 {
+		result = append(result, last)
+	}
+	return result
+}
+
+// tokenize 按照空白切分, 引号和括号内的内容作为token的一部分
+func tokenize(s string) []string {
+	var result []string
+	depth := 0
+	var quote byte
+	start := -1
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		isSpace := c == ' ' || c == '\t' || c == '\r' || c == '\n'
+		if start < 0 {
+			if isSpace {
+				continue
+			}
+			start = i
+		}
+		switch {
+		case quote != 0:
+			if c == '\\' && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case isSpace && depth == 0:
+			result = append(result, s[start:i])
+			start = -1
+		}
+	}
+	if start >= 0 {
+		result = append(result, s[start:])
+	}
+	return result
+}
@@ -0,0 +1,169 @@
+package binlog
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/siddontang/go-mysql/replication"
+
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/db-sharding/mysql"
+)
+
+var errStopStreaming = errors.New("stop streaming")
+
+// FileBinlogReader 解析本地的binlog文件(例如: 归档的binlog), 输出和GoMySQLReader一样的BinlogEntry
+// 1. 按照给定的顺序依次解析binlog文件, 全部解析完毕之后StreamEvents返回nil
+// 2. binlog coordinates中的LogFile为文件名(不包含目录)
+type FileBinlogReader struct {
+	files                    []string
+	startCoordinates         mysql.BinlogCoordinates
+	currentCoordinates       mysql.BinlogCoordinates
+	currentCoordinatesMutex  *sync.Mutex
+	LastAppliedRowsEventHint mysql.BinlogCoordinates
+	SchemaHistory            *SchemaHistory // 表结构的变化历史, 为nil时不关联表结构
+
+	inTransaction       bool
+	resumeInTransaction bool // Reconnect之前LastAppliedRowsEventHint所在的事务是否还没有输出Commit
+}
+
+// NewFileBinlogReader files为binlog文件的路径, 需要按照binlog的顺序排列
+func NewFileBinlogReader(files []string) (*FileBinlogReader, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("NewFileBinlogReader: no binlog files")
+	}
+	return &FileBinlogReader{
+		files: files,
+		startCoordinates: mysql.BinlogCoordinates{
+			LogFile: filepath.Base(files[0]),
+			LogPos:  4,
+		},
+		currentCoordinatesMutex: &sync.Mutex{},
+	}, nil
+}
+
+// Seek 从给定的位置开始解析, coordinates.LogFile之前的文件被跳过
+// coordinates应该是事务的开始位置, 否则rows event找不到对应的TableMapEvent
+func (this *FileBinlogReader) Seek(coordinates mysql.BinlogCoordinates) error {
+	if this.fileIndex(coordinates.LogFile) < 0 {
+		return fmt.Errorf("Binlog file not found: %s", coordinates.LogFile)
+	}
+	if coordinates.LogPos < 4 {
+		coordinates.LogPos = 4
+	}
+	this.startCoordinates = coordinates
+	return nil
+}
+
+func (this *FileBinlogReader) fileIndex(logFile string) int {
+	for i, file := range this.files {
+		if filepath.Base(file) == logFile {
+			return i
+		}
+	}
+	return -1
+}
+
+func (this *FileBinlogReader) GetCurrentBinlogCoordinates() *mysql.BinlogCoordinates {
+	this.currentCoordinatesMutex.Lock()
+	defer this.currentCoordinatesMutex.Unlock()
+	returnCoordinates := this.currentCoordinates
+	return &returnCoordinates
+}
+
+func (this *FileBinlogReader) setCurrentCoordinates(logFile string, logPos int64) {
+	this.currentCoordinatesMutex.Lock()
+	defer this.currentCoordinatesMutex.Unlock()
+	this.currentCoordinates.LogFile = logFile
+	this.currentCoordinates.LogPos = logPos
+}
+
+// StreamEvents 解析binlog文件，直到所有的文件处理完毕，或者canStopStreaming返回true
+func (this *FileBinlogReader) StreamEvents(canStopStreaming func() bool, entriesChannel chan<- *BinlogEntry) error {
+	index := this.fileIndex(this.startCoordinates.LogFile)
+	if index < 0 {
+		return fmt.Errorf("Binlog file not found: %s", this.startCoordinates.LogFile)
+	}
+
+	offset := this.startCoordinates.LogPos
+	for _, file := range this.files[index:] {
+		logFile := filepath.Base(file)
+		log.Infof("Parsing binlog file: %s from pos: %d", file, offset)
+		this.setCurrentCoordinates(logFile, offset)
+
+		parser := replication.NewBinlogParser()
+		err := parser.ParseFile(file, offset, func(ev *replication.BinlogEvent) error {
+			// 任何时候都可以中断
+			if canStopStreaming() {
+				return errStopStreaming
+			}
+			return this.handleEvent(logFile, ev, entriesChannel)
+		})
+
+		if err == errStopStreaming {
+			break
+		} else if err != nil {
+			return err
+		}
+		offset = 4
+	}
+	log.Debugf("done streaming events")
+
+	return nil
+}
+
+func (this *FileBinlogReader) handleEvent(logFile string, ev *replication.BinlogEvent, entriesChannel chan<- *BinlogEntry) error {
+	// 更新LogPos, 文件的切换由StreamEvents负责, 不需要处理RotateEvent
+	this.setCurrentCoordinates(logFile, int64(ev.Header.LogPos))
+
+	if rowsEvent, ok := ev.Event.(*replication.RowsEvent); ok {
+		if this.currentCoordinates.SmallerThanOrEquals(&this.LastAppliedRowsEventHint) {
+			log.Debugf("Skipping handled query at %+v", this.currentCoordinates)
+			if this.currentCoordinates.Equals(&this.LastAppliedRowsEventHint) {
+				this.inTransaction = this.resumeInTransaction
+			}
+			return nil
+		}
+		if err := emitRowsEvent(ev, rowsEvent, this.currentCoordinates, this.SchemaHistory, entriesChannel); err != nil {
+			return err
+		}
+		this.inTransaction = true
+		this.LastAppliedRowsEventHint = this.currentCoordinates
+
+	} else if queryEvent, ok := ev.Event.(*replication.QueryEvent); ok {
+		if applyQueryEvent(queryEvent, this.currentCoordinates, this.SchemaHistory) {
+			this.handleCommit(ev, entriesChannel)
+		}
+	} else if _, ok := ev.Event.(*replication.XIDEvent); ok {
+		this.handleCommit(ev, entriesChannel)
+	}
+	return nil
+}
+
+func (this *FileBinlogReader) handleCommit(ev *replication.BinlogEvent, entriesChannel chan<- *BinlogEntry) {
+	if this.inTransaction {
+		this.inTransaction = false
+		emitCommit(ev, this.currentCoordinates, entriesChannel)
+	}
+}
+
+// Reconnect 从当前文件的开头重新解析, 已经处理过的rows event通过LastAppliedRowsEventHint跳过
+// 如果中断发生在rows event和XID之间, 重新读到XID时仍然输出Commit
+func (this *FileBinlogReader) Reconnect() error {
+	current := this.GetCurrentBinlogCoordinates()
+	if len(current.LogFile) == 0 {
+		return nil
+	}
+	// 上次Reconnect之后还没有读到LastAppliedRowsEventHint时, 保留之前的状态
+	if !current.SmallerThan(&this.LastAppliedRowsEventHint) {
+		this.resumeInTransaction = this.inTransaction
+	}
+	this.inTransaction = false
+	return this.Seek(mysql.BinlogCoordinates{LogFile: current.LogFile, LogPos: 4})
+}
+
+func (this *FileBinlogReader) Close() error {
+	return nil
+}
@@ -0,0 +1,145 @@
+package binlog
+
+import (
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+	"github.com/wfxiang08/db-sharding/mysql"
+)
+
+// readBinlogEntries 返回DML entries, 以及事务结束的entries
+func readBinlogEntries(t *testing.T, reader *FileBinlogReader, canStopStreaming func() bool) ([]*BinlogEntry, []*BinlogEntry) {
+	entriesChannel := make(chan *BinlogEntry, 1000)
+	test.S(t).ExpectNil(reader.StreamEvents(canStopStreaming, entriesChannel))
+	close(entriesChannel)
+
+	var entries, commits []*BinlogEntry
+	for entry := range entriesChannel {
+		if entry.Commit {
+			commits = append(commits, entry)
+		} else {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, commits
+}
+
+// go test github.com/wfxiang08/db-sharding/binlog -v -run "TestFileBinlogReader$"
+func TestFileBinlogReader(t *testing.T) {
+	reader, err := NewFileBinlogReader([]string{"testdata/mysql-bin.000066", "testdata/mysql-bin.000070"})
+	test.S(t).ExpectNil(err)
+	// 表结构来自binlog中的create table
+	reader.SchemaHistory = NewSchemaHistory(nil, nil)
+
+	var _ BinlogReader = reader
+	entries, commits := readBinlogEntries(t, reader, func() bool { return false })
+	test.S(t).ExpectEquals(len(entries), 40)
+	test.S(t).ExpectEquals(len(commits), 22)
+	// XID event的位置
+	test.S(t).ExpectEquals(commits[0].Coordinates, mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 660})
+	test.S(t).ExpectTrue(commits[0].DmlEvent == nil)
+	test.S(t).ExpectEquals(*reader.GetCurrentBinlogCoordinates(), mysql.BinlogCoordinates{LogFile: "mysql-bin.000070", LogPos: 4257})
+
+	entry := entries[0]
+	test.S(t).ExpectEquals(entry.Coordinates, mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 629})
+	test.S(t).ExpectEquals(entry.Timestamp, int64(1459344667))
+	test.S(t).ExpectEquals(entry.DmlEvent.DatabaseName, "test")
+	test.S(t).ExpectEquals(entry.DmlEvent.TableName, "samplet")
+	test.S(t).ExpectEquals(entry.DmlEvent.DML, EventDML(InsertDML))
+	test.S(t).ExpectEquals(entry.DmlEvent.Columns.Names(), []string{"id", "license", "name", "b"})
+	value, _ := entry.DmlEvent.NewColumnValue("name")
+	test.S(t).ExpectEquals(value, "a")
+
+	// 一个rows event中的多行数据
+	test.S(t).ExpectEquals(entries[1].Coordinates, entries[2].Coordinates)
+
+	entry = entries[6]
+	test.S(t).ExpectEquals(entry.DmlEvent.DML, EventDML(UpdateDML))
+	value, _ = entry.DmlEvent.WhereColumnValue("id")
+	test.S(t).ExpectEquals(value, int32(5))
+	value, _ = entry.DmlEvent.NewColumnValue("name")
+	test.S(t).ExpectEquals(value, "update")
+
+	test.S(t).ExpectEquals(entries[7].DmlEvent.DML, EventDML(DeleteDML))
+	test.S(t).ExpectEquals(entries[21].Coordinates.LogFile, "mysql-bin.000070")
+}
+
+// go test github.com/wfxiang08/db-sharding/binlog -v -run "TestFileBinlogReaderSeek$"
+func TestFileBinlogReaderSeek(t *testing.T) {
+	reader, err := NewFileBinlogReader([]string{"testdata/mysql-bin.000066", "testdata/mysql-bin.000070"})
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectNotNil(reader.Seek(mysql.BinlogCoordinates{LogFile: "mysql-bin.000067", LogPos: 4}))
+
+	// 从事务的BEGIN开始
+	test.S(t).ExpectNil(reader.Seek(mysql.BinlogCoordinates{LogFile: "mysql-bin.000070", LogPos: 1401}))
+	entries, commits := readBinlogEntries(t, reader, func() bool { return false })
+	test.S(t).ExpectEquals(len(entries), 14)
+	test.S(t).ExpectEquals(len(commits), 8)
+	test.S(t).ExpectEquals(entries[0].Coordinates, mysql.BinlogCoordinates{LogFile: "mysql-bin.000070", LogPos: 1530})
+	test.S(t).ExpectEquals(entries[0].DmlEvent.DML, EventDML(UpdateDML))
+	// 没有SchemaHistory, 不关联表结构
+	test.S(t).ExpectTrue(entries[0].DmlEvent.Columns == nil)
+
+	// 中断之后，重新解析时跳过已经处理过的rows event
+	reader, _ = NewFileBinlogReader([]string{"testdata/mysql-bin.000066"})
+	count := 0
+	entries, commits = readBinlogEntries(t, reader, func() bool {
+		count++
+		return count > 10
+	})
+	test.S(t).ExpectEquals(len(entries), 3)
+	// 第二个事务没有读取到XID
+	test.S(t).ExpectEquals(len(commits), 1)
+
+	test.S(t).ExpectNil(reader.Reconnect())
+	entries, commits = readBinlogEntries(t, reader, func() bool { return false })
+	test.S(t).ExpectEquals(len(entries), 17)
+	test.S(t).ExpectEquals(len(commits), 10)
+	test.S(t).ExpectEquals(entries[0].Coordinates, mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 1074})
+	// 第二个事务的rows event在中断之前已经输出, 重连之后仍然需要输出它的Commit
+	test.S(t).ExpectEquals(commits[0].Coordinates, mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 890})
+}
+
+// go test github.com/wfxiang08/db-sharding/binlog -v -run "TestFileBinlogReaderReconnect$"
+func TestFileBinlogReaderReconnect(t *testing.T) {
+	full, _ := NewFileBinlogReader([]string{"testdata/mysql-bin.000066"})
+	_, allCommits := readBinlogEntries(t, full, func() bool { return false })
+
+	// 中断发生在第一个事务的rows event和XID之间
+	reader, _ := NewFileBinlogReader([]string{"testdata/mysql-bin.000066"})
+	count := 0
+	entries, commits := readBinlogEntries(t, reader, func() bool {
+		count++
+		return count > 6
+	})
+	test.S(t).ExpectEquals(len(entries), 1)
+	test.S(t).ExpectEquals(len(commits), 0)
+
+	// 还没有读到之前的位置时再次中断
+	test.S(t).ExpectNil(reader.Reconnect())
+	count = 0
+	entries, commits = readBinlogEntries(t, reader, func() bool {
+		count++
+		return count > 3
+	})
+	test.S(t).ExpectEquals(len(entries), 0)
+	test.S(t).ExpectEquals(len(commits), 0)
+
+	test.S(t).ExpectNil(reader.Reconnect())
+	entries, commits = readBinlogEntries(t, reader, func() bool { return false })
+	test.S(t).ExpectEquals(len(commits), len(allCommits))
+	test.S(t).ExpectEquals(commits[0].Coordinates, mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 660})
+
+	// 中断发生在XID之后, 不会重复输出Commit
+	reader, _ = NewFileBinlogReader([]string{"testdata/mysql-bin.000066"})
+	count = 0
+	_, commits = readBinlogEntries(t, reader, func() bool {
+		count++
+		return count > 7
+	})
+	test.S(t).ExpectEquals(len(commits), 1)
+	test.S(t).ExpectNil(reader.Reconnect())
+	_, commits = readBinlogEntries(t, reader, func() bool { return false })
+	test.S(t).ExpectEquals(len(commits), len(allCommits)-1)
+	test.S(t).ExpectEquals(commits[0].Coordinates, mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 890})
+}
@@ -7,6 +7,7 @@ package binlog
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 
 	gomysql "github.com/siddontang/go-mysql/mysql"
@@ -25,6 +26,16 @@ type GoMySQLReader struct {
 	currentCoordinates       mysql.BinlogCoordinates
 	currentCoordinatesMutex  *sync.Mutex
 	LastAppliedRowsEventHint mysql.BinlogCoordinates // binlog的坐标
+	SchemaHistory            *SchemaHistory          // 表结构的变化历史, 为nil时不关联表结构
+
+	// GTID模式: 已经执行完毕的GTID, 以及当前事务的GTID(commit之后加入gtidSet)
+	gtidSet     gomysql.GTIDSet
+	pendingGTID string
+
+	// 当前事务中是否输出过rows event, 如果有则在事务结束时输出Commit
+	inTransaction bool
+	// 重连之前LastAppliedRowsEventHint所在的事务是否还没有输出Commit
+	resumeInTransaction bool
 }
 
 func NewGoMySQLReader(connectionConfig *mysql.ConnectionConfig, serverId uint) (binlogReader *GoMySQLReader, err error) {
@@ -57,12 +68,52 @@ func (this *GoMySQLReader) ConnectBinlogStreamer(coordinates mysql.BinlogCoordin
 
 	this.currentCoordinates = coordinates
 	log.Infof("Connecting binlog streamer at %+v", this.currentCoordinates)
+
+	if coordinates.IsGTID() {
+		// Start sync with executed GTID set, 主从切换之后file:pos没有意义, 但是GTID依然有效
+		if this.gtidSet, err = gomysql.ParseMysqlGTIDSet(coordinates.GTIDSet); err != nil {
+			return err
+		}
+		this.binlogStreamer, err = this.binlogSyncer.StartSyncGTID(this.gtidSet)
+		return err
+	}
+
 	// Start sync with sepcified binlog file and position
 	this.binlogStreamer, err = this.binlogSyncer.StartSync(gomysql.Position{this.currentCoordinates.LogFile, uint32(this.currentCoordinates.LogPos)})
 
 	return err
 }
 
+// IsGTIDMode returns true if the streamer was started with a GTID set
+func (this *GoMySQLReader) IsGTIDMode() bool {
+	return this.gtidSet != nil
+}
+
+// commitGTID 事务结束(XID或者DDL), 将当前事务的GTID加入已经执行的GTID集合
+func (this *GoMySQLReader) commitGTID() {
+	if this.gtidSet == nil || len(this.pendingGTID) == 0 {
+		return
+	}
+	if err := this.gtidSet.Update(this.pendingGTID); err != nil {
+		log.ErrorErrorf(err, "Update gtid set failed: %s", this.pendingGTID)
+		return
+	}
+	this.pendingGTID = ""
+
+	this.currentCoordinatesMutex.Lock()
+	defer this.currentCoordinatesMutex.Unlock()
+	this.currentCoordinates.GTIDSet = this.gtidSet.String()
+}
+
+// formatGTID 格式: 3E11FA47-71CA-11E1-9E33-C80AA9429562:23
+func formatGTID(gtidEvent *replication.GTIDEvent) string {
+	sid := gtidEvent.SID
+	if len(sid) != 16 {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x:%d", sid[0:4], sid[4:6], sid[6:8], sid[8:10], sid[10:16], gtidEvent.GNO)
+}
+
 func (this *GoMySQLReader) GetCurrentBinlogCoordinates() *mysql.BinlogCoordinates {
 	this.currentCoordinatesMutex.Lock()
 	defer this.currentCoordinatesMutex.Unlock()
@@ -73,20 +124,60 @@ func (this *GoMySQLReader) GetCurrentBinlogCoordinates() *mysql.BinlogCoordinate
 // StreamEvents
 // 处理Row Event
 // BinlogEvent 中特殊的Event ==> rowsEvent
-//
 func (this *GoMySQLReader) handleRowsEvent(ev *replication.BinlogEvent, rowsEvent *replication.RowsEvent,
 	entriesChannel chan<- *BinlogEntry) error {
 
 	if this.currentCoordinates.SmallerThanOrEquals(&this.LastAppliedRowsEventHint) {
 		log.Debugf("Skipping handled query at %+v", this.currentCoordinates)
+		// 重连之前输出的最后一个rows event, 如果当时事务还没有结束, 则在事务结束时补上Commit
+		if this.currentCoordinates.Equals(&this.LastAppliedRowsEventHint) {
+			this.inTransaction = this.resumeInTransaction
+		}
 		return nil
 	}
 
+	if err := emitRowsEvent(ev, rowsEvent, this.currentCoordinates, this.SchemaHistory, entriesChannel); err != nil {
+		return err
+	}
+	this.inTransaction = true
+
+	// 记录执行过的RowEvent的地址
+	this.LastAppliedRowsEventHint = this.currentCoordinates
+	return nil
+}
+
+// InTransaction 最近输出的rows event所在的事务还没有输出Commit
+func (this *GoMySQLReader) InTransaction() bool {
+	if this.GetCurrentBinlogCoordinates().SmallerThan(&this.LastAppliedRowsEventHint) {
+		// 重连之后还没有读到LastAppliedRowsEventHint
+		return this.resumeInTransaction
+	}
+	return this.inTransaction
+}
+
+// ResumeAfter 重连之后跳过lastApplied以及之前的rows event
+// inTransaction为重连之前的InTransaction(), 保证断开发生在rows event和XID之间时, 事务的Commit不会丢失
+func (this *GoMySQLReader) ResumeAfter(lastApplied mysql.BinlogCoordinates, inTransaction bool) {
+	this.LastAppliedRowsEventHint = lastApplied
+	this.resumeInTransaction = inTransaction
+}
+
+// emitRowsEvent 将rowsEvent中的每一行数据封装成为BinlogEntry
+func emitRowsEvent(ev *replication.BinlogEvent, rowsEvent *replication.RowsEvent, coordinates mysql.BinlogCoordinates,
+	schemaHistory *SchemaHistory, entriesChannel chan<- *BinlogEntry) error {
+
 	dml := ToEventDML(ev.Header.EventType.String())
 	if dml == NotDML {
 		return fmt.Errorf("Unknown DML type: %s", ev.Header.EventType.String())
 	}
 
+	// 使用当前位置有效的表结构解析 @1, @2, ..., @N
+	var columns *sql.ColumnList
+	if schemaHistory != nil && len(rowsEvent.Rows) > 0 {
+		columns = schemaHistory.ResolveColumns(string(rowsEvent.Table.Schema), string(rowsEvent.Table.Table),
+			coordinates, len(rowsEvent.Rows[0]), rowsEvent.Table.ColumnType)
+	}
+
 	for i, row := range rowsEvent.Rows {
 		// UpdateDML 两个Row一组数据，不处理奇数组数据
 		if dml == UpdateDML && i%2 == 1 {
@@ -97,13 +188,14 @@ func (this *GoMySQLReader) handleRowsEvent(ev *replication.BinlogEvent, rowsEven
 
 		// 封装binlogEntry
 		// pos, schema, table, dml
-		binlogEntry := NewBinlogEntryAt(this.currentCoordinates)
+		binlogEntry := NewBinlogEntryAt(coordinates)
 		binlogEntry.Timestamp = int64(ev.Header.Timestamp)
 		binlogEntry.DmlEvent = NewBinlogDMLEvent(
 			string(rowsEvent.Table.Schema),
 			string(rowsEvent.Table.Table),
 			dml,
 		)
+		binlogEntry.DmlEvent.Columns = columns
 
 		// Insert    --> NewColumnValues
 		// UpdateDML --> WhereColumnValues & NewColumnValues
@@ -129,12 +221,50 @@ func (this *GoMySQLReader) handleRowsEvent(ev *replication.BinlogEvent, rowsEven
 		// In reality, reads will be synchronous
 		entriesChannel <- binlogEntry
 	}
-
-	// 记录执行过的RowEvent的地址
-	this.LastAppliedRowsEventHint = this.currentCoordinates
 	return nil
 }
 
+// handleQueryEvent
+// 跟踪DDL, 更新表结构的历史
+func (this *GoMySQLReader) handleQueryEvent(ev *replication.BinlogEvent, queryEvent *replication.QueryEvent,
+	entriesChannel chan<- *BinlogEntry) {
+	if !applyQueryEvent(queryEvent, this.currentCoordinates, this.SchemaHistory) {
+		return
+	}
+
+	// DDL和非事务引擎的COMMIT都是一个独立的事务
+	this.handleCommit(ev, entriesChannel)
+}
+
+// handleCommit 事务结束(XID, COMMIT或者DDL)
+func (this *GoMySQLReader) handleCommit(ev *replication.BinlogEvent, entriesChannel chan<- *BinlogEntry) {
+	this.commitGTID()
+	if this.inTransaction {
+		this.inTransaction = false
+		emitCommit(ev, this.currentCoordinates, entriesChannel)
+	}
+}
+
+// emitCommit 输出事务结束的标记
+func emitCommit(ev *replication.BinlogEvent, coordinates mysql.BinlogCoordinates, entriesChannel chan<- *BinlogEntry) {
+	binlogEntry := NewCommitEntryAt(coordinates)
+	binlogEntry.Timestamp = int64(ev.Header.Timestamp)
+	entriesChannel <- binlogEntry
+}
+
+// applyQueryEvent 将DDL记录到schemaHistory中, BEGIN返回false
+func applyQueryEvent(queryEvent *replication.QueryEvent, coordinates mysql.BinlogCoordinates, schemaHistory *SchemaHistory) bool {
+	query := strings.TrimSpace(string(queryEvent.Query))
+	if strings.EqualFold(query, "BEGIN") {
+		return false
+	}
+
+	if schemaHistory != nil {
+		schemaHistory.ApplyDDLs(coordinates, ParseDDL(string(queryEvent.Schema), query))
+	}
+	return true
+}
+
 // StreamEvents
 func (this *GoMySQLReader) StreamEvents(canStopStreaming func() bool, entriesChannel chan<- *BinlogEntry) error {
 	for {
@@ -171,12 +301,17 @@ func (this *GoMySQLReader) StreamEvents(canStopStreaming func() bool, entriesCha
 			if err := this.handleRowsEvent(ev, rowsEvent, entriesChannel); err != nil {
 				return err
 			}
-		} else if _, ok := ev.Event.(*replication.QueryEvent); ok {
+		} else if queryEvent, ok := ev.Event.(*replication.QueryEvent); ok {
 			// 修改表结构
-			// @1, @2, .., @N 是和当前的表结构对应的，如果表结构变化了，那么@1 <--> column name之间的映射关系可能需要调整
-			// TODO:
-			// gh-ost只所以不关系，是因为这个脚本只是短暂地工作，可以认为表结构的在ost过程中不会变化
-			// sharding也是类似的逻辑，可以认为在sharding过程中表结构相对稳定, 如果处理cache, 则可能需要关注这方面的逻辑
+			// @1, @2, .., @N 是和当前的表结构对应的，如果表结构变化了，那么@1 <--> column name之间的映射关系需要调整
+			// 通过SchemaHistory按照binlog的位置记录表结构的各个版本
+			this.handleQueryEvent(ev, queryEvent, entriesChannel)
+		} else if gtidEvent, ok := ev.Event.(*replication.GTIDEvent); ok {
+			// 下一个事务的GTID
+			this.pendingGTID = formatGTID(gtidEvent)
+		} else if _, ok := ev.Event.(*replication.XIDEvent); ok {
+			// 事务提交
+			this.handleCommit(ev, entriesChannel)
 		}
 	}
 	log.Debugf("done streaming events")
@@ -0,0 +1,472 @@
+package binlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/siddontang/go/ioutil2"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/db-sharding/mysql"
+	"github.com/wfxiang08/db-sharding/sql"
+)
+
+// TableSchema 表结构的一个版本, 对Coordinates之后(包含)的rows event生效
+type TableSchema struct {
+	Coordinates mysql.BinlogCoordinates
+	Columns     *sql.ColumnList // nil: 表被删除，或者DDL无法解析, 表结构未知
+
+	loadFailed bool // 从DB加载的表结构和row image不一致, 不再重复加载，直到下一个DDL
+}
+
+// SchemaLoader 从DB读取当前的表结构
+type SchemaLoader func(databaseName, tableName string) (*sql.ColumnList, error)
+
+// SchemaHistory 记录每个table在binlog中的表结构变化
+// 1. table第一次出现在rows event中时，从DB加载当前的表结构
+// 2. 之后通过QueryEvent中的DDL来推导新的表结构，并按照binlog coordinates记录各个版本
+// 3. rows event使用其所在位置有效的表结构来解析 @1, @2, ... @N
+// 4. 通过Load指定文件之后, 每次变化都保存到文件中; 重启之后从checkpoint开始读取binlog时, 依然使用当时的表结构
+// 5. 版本按照file:pos排序, 只在同一个server的binlog中有效; server变化(GTID模式下主从切换)时参考SetServer
+type SchemaHistory struct {
+	mutex          sync.Mutex
+	loader         SchemaLoader
+	filter         func(databaseName, tableName string) bool
+	tables         map[string][]*TableSchema // db.table --> 按照coordinates升序排列的版本
+	ddlCoordinates mysql.BinlogCoordinates   // 最近一个DDL的位置, 重连之后重复读取的DDL直接忽略
+	serverUUID     string                    // 版本的coordinates所在server的server_uuid
+	filePath       string
+	dirty          bool
+}
+
+// NewSchemaHistory filter为nil表示跟踪所有的table
+func NewSchemaHistory(loader SchemaLoader, filter func(databaseName, tableName string) bool) *SchemaHistory {
+	return &SchemaHistory{
+		loader: loader,
+		filter: filter,
+		tables: make(map[string][]*TableSchema),
+	}
+}
+
+func tableKey(databaseName, tableName string) string {
+	return strings.ToLower(fmt.Sprintf("%s.%s", databaseName, tableName))
+}
+
+func (this *SchemaHistory) match(databaseName, tableName string) bool {
+	return this.filter == nil || this.filter(databaseName, tableName)
+}
+
+func (this *SchemaHistory) tracked(key string) bool {
+	return len(this.tables[key]) > 0
+}
+
+func (this *SchemaHistory) latest(key string) *TableSchema {
+	versions := this.tables[key]
+	if len(versions) == 0 {
+		return nil
+	}
+	return versions[len(versions)-1]
+}
+
+func (this *SchemaHistory) schemaAt(key string, coordinates mysql.BinlogCoordinates) *TableSchema {
+	versions := this.tables[key]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Coordinates.SmallerThanOrEquals(&coordinates) {
+			return versions[i]
+		}
+	}
+	return nil
+}
+
+// addVersion 重连之后binlog会被重复读取, 之前的位置直接忽略
+// 同一个位置的版本被替换: 一个DDL中可能多次修改同一个table, 例如: RENAME TABLE a TO tmp, b TO a, tmp TO b
+func (this *SchemaHistory) addVersion(key string, coordinates mysql.BinlogCoordinates, columns *sql.ColumnList) *TableSchema {
+	latest := this.latest(key)
+	if latest != nil && coordinates.SmallerThan(&latest.Coordinates) {
+		return latest
+	}
+	this.dirty = true
+	if latest != nil && latest.Coordinates.Equals(&coordinates) {
+		latest.Columns = columns
+		latest.loadFailed = false
+		return latest
+	}
+	schema := &TableSchema{Coordinates: coordinates, Columns: columns}
+	this.tables[key] = append(this.tables[key], schema)
+	return schema
+}
+
+// SetServer 连接binlog之前设置server的server_uuid
+// 主从切换之后新master上的file:pos和之前的版本不可比较(新的DDL会被当作重复的DDL忽略), 因此每个table只保留最新的版本,
+// 对新master上的所有位置有效. GTID模式下从已经执行的GTID之后开始读取, 不会再读到之前的rows event
+func (this *SchemaHistory) SetServer(serverUUID string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	defer this.save()
+
+	if this.serverUUID == serverUUID {
+		return
+	}
+	if len(this.serverUUID) > 0 {
+		for key, versions := range this.tables {
+			if len(versions) > 0 {
+				this.tables[key] = []*TableSchema{{Columns: versions[len(versions)-1].Columns}}
+			}
+		}
+		this.ddlCoordinates = mysql.BinlogCoordinates{}
+		log.Infof("Binlog server changed from %s to %s, keep latest schema of %d tables", this.serverUUID, serverUUID,
+			len(this.tables))
+	}
+	this.serverUUID = serverUUID
+	this.dirty = true
+}
+
+// ColumnsAt returns the columns of given table valid at given coordinates, or nil if unknown
+func (this *SchemaHistory) ColumnsAt(databaseName, tableName string, coordinates mysql.BinlogCoordinates) *sql.ColumnList {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if schema := this.schemaAt(tableKey(databaseName, tableName), coordinates); schema != nil {
+		return schema.Columns
+	}
+	return nil
+}
+
+// ResolveColumns 获取rows event对应的表结构, columnCount为row image的列数, columnTypes为TableMapEvent中的column类型
+// 如果没有记录或者表结构未知，则从DB加载; 列数或者类型对不上时返回nil, 避免静默地读错column
+func (this *SchemaHistory) ResolveColumns(databaseName, tableName string, coordinates mysql.BinlogCoordinates,
+	columnCount int, columnTypes []byte) *sql.ColumnList {
+	if !this.match(databaseName, tableName) {
+		return nil
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	defer this.save()
+
+	key := tableKey(databaseName, tableName)
+	schema := this.schemaAt(key, coordinates)
+	if schema != nil {
+		if schema.Columns != nil {
+			err := checkRowImage(schema.Columns, columnCount, columnTypes)
+			if err == nil {
+				return schema.Columns
+			}
+			if !schema.loadFailed {
+				log.ErrorErrorf(err, "Columns mismatch for %s at %s", key, coordinates.DisplayString())
+			}
+		}
+		if schema.loadFailed {
+			return nil
+		}
+	}
+
+	if this.loader == nil {
+		return nil
+	}
+
+	columns, err := this.loader(databaseName, tableName)
+	if err != nil {
+		log.ErrorErrorf(err, "Load columns failed: %s", key)
+		return nil
+	}
+
+	if err := checkRowImage(columns, columnCount, columnTypes); err != nil {
+		log.ErrorErrorf(err, "Loaded columns mismatch for %s at %s", key, coordinates.DisplayString())
+		if schema := this.addVersion(key, coordinates, nil); schema.Columns == nil {
+			schema.loadFailed = true
+		}
+		return nil
+	}
+
+	log.Infof("Columns loaded for %s at %s: %s", key, coordinates.DisplayString(), columns.String())
+	this.addVersion(key, coordinates, columns)
+	return columns
+}
+
+// ApplyDDLs 根据一个QueryEvent中的DDLs推导table的新结构, coordinates为DDL所在的位置
+func (this *SchemaHistory) ApplyDDLs(coordinates mysql.BinlogCoordinates, ddls []*TableDDL) {
+	if len(ddls) == 0 {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	defer this.save()
+
+	if len(this.ddlCoordinates.LogFile) > 0 && !this.ddlCoordinates.SmallerThan(&coordinates) {
+		// 重连之后重复读取的DDL
+		return
+	}
+	this.ddlCoordinates = coordinates
+	this.dirty = true
+
+	for _, ddl := range ddls {
+		this.applyDDL(coordinates, ddl)
+	}
+}
+
+// ApplyDDL 只包含一个DDL的QueryEvent
+func (this *SchemaHistory) ApplyDDL(coordinates mysql.BinlogCoordinates, ddl *TableDDL) {
+	this.ApplyDDLs(coordinates, []*TableDDL{ddl})
+}
+
+func (this *SchemaHistory) applyDDL(coordinates mysql.BinlogCoordinates, ddl *TableDDL) {
+	key := tableKey(ddl.DatabaseName, ddl.TableName)
+	if latest := this.latest(key); latest != nil && coordinates.SmallerThan(&latest.Coordinates) {
+		// 表结构是在DDL之后从DB加载的
+		return
+	}
+
+	switch ddl.Type {
+	case CreateTableDDL:
+		if !this.tracked(key) && !this.match(ddl.DatabaseName, ddl.TableName) {
+			return
+		}
+		var columns *sql.ColumnList
+		if len(ddl.LikeTableName) > 0 {
+			if like := this.latest(tableKey(ddl.LikeDatabaseName, ddl.LikeTableName)); like != nil && like.Columns != nil {
+				columns = newColumnList(like.Columns.Columns())
+			}
+		} else if !ddl.Unknown {
+			columns = sql.NewColumnList(ddl.Columns)
+			for i, name := range ddl.Columns {
+				columns.SetDataType(name, ddl.ColumnTypes[i])
+			}
+		}
+		this.addVersion(key, coordinates, columns)
+
+	case DropTableDDL:
+		if this.tracked(key) {
+			this.addVersion(key, coordinates, nil)
+		}
+
+	case RenameTableDDL:
+		this.renameTable(key, ddl.NewDatabaseName, ddl.NewTableName, coordinates)
+
+	case AlterTableDDL:
+		if !this.tracked(key) {
+			// 还没有出现过的table, 等到rows event时再从DB加载
+			return
+		}
+		latest := this.latest(key)
+		if ddl.Unknown || latest.Columns == nil {
+			log.Errorf("Unknown columns for %s after DDL at %s", key, coordinates.DisplayString())
+			this.addVersion(key, coordinates, nil)
+			return
+		}
+
+		columns, renameSpec, err := applyAlterSpecs(latest.Columns.Columns(), ddl.AlterSpecs)
+		if err != nil {
+			log.ErrorErrorf(err, "Apply DDL failed for %s at %s", key, coordinates.DisplayString())
+			this.addVersion(key, coordinates, nil)
+			return
+		}
+		this.addVersion(key, coordinates, newColumnList(columns))
+		if renameSpec != nil {
+			this.renameTable(key, renameSpec.NewDatabase, renameSpec.NewTable, coordinates)
+		}
+	}
+
+	if latest := this.latest(key); latest != nil && latest.Coordinates.Equals(&coordinates) {
+		log.Infof("Schema of %s changed at %s: %v", key, coordinates.DisplayString(), latest.Columns)
+	}
+}
+
+// renameTable 被rename的table在一个DDL中可能是临时的名字(例如: tmp), 需要记录下来, 否则之后的rename找不到表结构
+func (this *SchemaHistory) renameTable(key string, newDatabaseName, newTableName string, coordinates mysql.BinlogCoordinates) {
+	// 同一个位置的版本会被替换, 先取出columns
+	var columns *sql.ColumnList
+	tracked := this.tracked(key)
+	if tracked {
+		columns = this.latest(key).Columns
+		this.addVersion(key, coordinates, nil)
+	}
+
+	newKey := tableKey(newDatabaseName, newTableName)
+	if tracked || this.tracked(newKey) || this.match(newDatabaseName, newTableName) {
+		this.addVersion(newKey, coordinates, columns)
+	}
+}
+
+// newColumnList 复制column names和类型
+func newColumnList(columns []sql.Column) *sql.ColumnList {
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.Name
+	}
+	result := sql.NewColumnList(names)
+	for _, column := range columns {
+		result.SetDataType(column.Name, column.DataType)
+	}
+	return result
+}
+
+// applyAlterSpecs 在columns上执行ALTER TABLE的子句
+func applyAlterSpecs(columns []sql.Column, specs []*AlterSpec) ([]sql.Column, *AlterSpec, error) {
+	result := append([]sql.Column{}, columns...)
+	var renameSpec *AlterSpec
+
+	indexOf := func(name string) int {
+		for i, column := range result {
+			if strings.EqualFold(column.Name, name) {
+				return i
+			}
+		}
+		return -1
+	}
+	// 按照FIRST/AFTER插入column
+	insert := func(column sql.Column, spec *AlterSpec) error {
+		position := len(result)
+		if spec.First {
+			position = 0
+		} else if len(spec.After) > 0 {
+			after := indexOf(spec.After)
+			if after < 0 {
+				return fmt.Errorf("column %s not found", spec.After)
+			}
+			position = after + 1
+		}
+		result = append(result, sql.Column{})
+		copy(result[position+1:], result[position:])
+		result[position] = column
+		return nil
+	}
+	remove := func(index int) {
+		result = append(result[:index], result[index+1:]...)
+	}
+
+	for _, spec := range specs {
+		switch spec.Type {
+		case AddColumnAlter:
+			if indexOf(spec.Column) >= 0 {
+				return nil, nil, fmt.Errorf("column %s already exists", spec.Column)
+			}
+			if err := insert(sql.Column{Name: spec.Column, DataType: spec.DataType}, spec); err != nil {
+				return nil, nil, err
+			}
+		case DropColumnAlter:
+			index := indexOf(spec.Column)
+			if index < 0 {
+				return nil, nil, fmt.Errorf("column %s not found", spec.Column)
+			}
+			remove(index)
+		case ChangeColumnAlter:
+			index := indexOf(spec.Column)
+			if index < 0 {
+				return nil, nil, fmt.Errorf("column %s not found", spec.Column)
+			}
+			if other := indexOf(spec.NewColumn); other >= 0 && other != index {
+				return nil, nil, fmt.Errorf("column %s already exists", spec.NewColumn)
+			}
+			// RENAME COLUMN不改变类型
+			column := sql.Column{Name: spec.NewColumn, DataType: result[index].DataType}
+			if len(spec.DataType) > 0 {
+				column.DataType = spec.DataType
+			}
+			if spec.First || len(spec.After) > 0 {
+				remove(index)
+				if err := insert(column, spec); err != nil {
+					return nil, nil, err
+				}
+			} else {
+				result[index] = column
+			}
+		case RenameTableAlter:
+			renameSpec = spec
+		}
+	}
+	return result, renameSpec, nil
+}
+
+// schemaHistoryFile 保存到文件中的表结构历史
+type schemaHistoryFile struct {
+	ServerUUID     string                        `json:"server_uuid"`
+	DDLCoordinates mysql.BinlogCoordinates       `json:"ddl_coordinates"`
+	Tables         map[string][]*tableSchemaFile `json:"tables"`
+}
+
+type tableSchemaFile struct {
+	Coordinates mysql.BinlogCoordinates `json:"coordinates"`
+	Columns     []string                `json:"columns"` // nil: 表结构未知
+	DataTypes   []string                `json:"data_types"`
+}
+
+// Load 从文件中恢复表结构的历史, 之后的变化都保存到这个文件中; 文件不存在时从空的历史开始
+func (this *SchemaHistory) Load(filePath string) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.filePath = filePath
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var file schemaHistoryFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("invalid schema history %s: %v", filePath, err)
+	}
+	this.serverUUID = file.ServerUUID
+	this.ddlCoordinates = file.DDLCoordinates
+	this.tables = make(map[string][]*TableSchema)
+	for key, versions := range file.Tables {
+		for _, version := range versions {
+			schema := &TableSchema{Coordinates: version.Coordinates}
+			if version.Columns != nil {
+				if len(version.DataTypes) != len(version.Columns) {
+					return fmt.Errorf("invalid schema history %s: data types of %s", filePath, key)
+				}
+				schema.Columns = sql.NewColumnList(version.Columns)
+				for i, name := range version.Columns {
+					schema.Columns.SetDataType(name, version.DataTypes[i])
+				}
+			}
+			this.tables[key] = append(this.tables[key], schema)
+		}
+	}
+	log.Infof("Schema history loaded from %s, tables: %d", filePath, len(this.tables))
+	return nil
+}
+
+// save 有变化时保存到文件中, 需要持有mutex
+func (this *SchemaHistory) save() {
+	if !this.dirty || len(this.filePath) == 0 {
+		return
+	}
+
+	file := &schemaHistoryFile{
+		ServerUUID:     this.serverUUID,
+		DDLCoordinates: this.ddlCoordinates,
+		Tables:         make(map[string][]*tableSchemaFile),
+	}
+	for key, versions := range this.tables {
+		for _, schema := range versions {
+			version := &tableSchemaFile{Coordinates: schema.Coordinates}
+			if schema.Columns != nil {
+				version.Columns = schema.Columns.Names()
+				version.DataTypes = make([]string, 0, schema.Columns.Len())
+				for _, column := range schema.Columns.Columns() {
+					version.DataTypes = append(version.DataTypes, column.DataType)
+				}
+			}
+			file.Tables[key] = append(file.Tables[key], version)
+		}
+	}
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err == nil {
+		err = ioutil2.WriteFileAtomic(this.filePath, data, 0644)
+	}
+	if err != nil {
+		// 下次变化时重试
+		log.ErrorErrorf(err, "Save schema history to %s failed", this.filePath)
+		return
+	}
+	this.dirty = false
+}
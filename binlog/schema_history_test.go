@@ -0,0 +1,236 @@
+package binlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+	gomysql "github.com/siddontang/go-mysql/mysql"
+	"github.com/wfxiang08/db-sharding/mysql"
+	"github.com/wfxiang08/db-sharding/sql"
+)
+
+func TestParseDDL(t *testing.T) {
+	test.S(t).ExpectEquals(len(ParseDDL("final", "BEGIN")), 0)
+	test.S(t).ExpectEquals(len(ParseDDL("final", "create index idx_user on t(user_id)")), 0)
+
+	ddls := ParseDDL("final", "CREATE TABLE IF NOT EXISTS `user_recording_like`(\n"+
+		"  `id` bigint(20) NOT NULL AUTO_INCREMENT,\n"+
+		"  `created_on` int(11) NOT NULL,\n"+
+		"  `user_id` bigint(20) NOT NULL COMMENT 'a, b',\n"+
+		"  `recording_id` decimal(20,0) NOT NULL,\n"+
+		"  PRIMARY KEY (`id`),\n"+
+		"  UNIQUE KEY `uk` (`user_id`,`recording_id`)\n"+
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4")
+	test.S(t).ExpectEquals(len(ddls), 1)
+	test.S(t).ExpectEquals(ddls[0].Type, CreateTableDDL)
+	test.S(t).ExpectEquals(ddls[0].DatabaseName, "final")
+	test.S(t).ExpectEquals(ddls[0].TableName, "user_recording_like")
+	test.S(t).ExpectEquals(ddls[0].Columns, []string{"id", "created_on", "user_id", "recording_id"})
+	test.S(t).ExpectEquals(ddls[0].ColumnTypes, []string{"bigint", "int", "bigint", "decimal"})
+
+	ddls = ParseDDL("final", "create table t2 like `other`.`t1`")
+	test.S(t).ExpectEquals(ddls[0].LikeDatabaseName, "other")
+	test.S(t).ExpectEquals(ddls[0].LikeTableName, "t1")
+
+	ddls = ParseDDL("final", "DROP TABLE IF EXISTS `t1`,`other`.`t2` /* generated by server */")
+	test.S(t).ExpectEquals(len(ddls), 2)
+	test.S(t).ExpectEquals(ddls[1].DatabaseName, "other")
+	test.S(t).ExpectEquals(ddls[1].TableName, "t2")
+
+	ddls = ParseDDL("final", "rename table t1 to t1_old, t1_new to t1")
+	test.S(t).ExpectEquals(len(ddls), 2)
+	test.S(t).ExpectEquals(ddls[1].TableName, "t1_new")
+	test.S(t).ExpectEquals(ddls[1].NewTableName, "t1")
+
+	ddls = ParseDDL("final", "alter table final.t1 add column c1 int after id, add index idx(c1), drop column c2, "+
+		"change c3 c4 varchar(32) first, modify c5 decimal(10,2) not null, engine=InnoDB")
+	test.S(t).ExpectEquals(ddls[0].Type, AlterTableDDL)
+	test.S(t).ExpectFalse(ddls[0].Unknown)
+	test.S(t).ExpectEquals(len(ddls[0].AlterSpecs), 4)
+	test.S(t).ExpectEquals(*ddls[0].AlterSpecs[0], AlterSpec{Type: AddColumnAlter, Column: "c1", DataType: "int", After: "id"})
+	test.S(t).ExpectEquals(*ddls[0].AlterSpecs[1], AlterSpec{Type: DropColumnAlter, Column: "c2"})
+	test.S(t).ExpectEquals(*ddls[0].AlterSpecs[2], AlterSpec{Type: ChangeColumnAlter, Column: "c3", NewColumn: "c4", DataType: "varchar", First: true})
+	test.S(t).ExpectEquals(*ddls[0].AlterSpecs[3], AlterSpec{Type: ChangeColumnAlter, Column: "c5", NewColumn: "c5", DataType: "decimal"})
+}
+
+func TestSchemaHistory(t *testing.T) {
+	loads := 0
+	history := NewSchemaHistory(func(databaseName, tableName string) (*sql.ColumnList, error) {
+		loads++
+		return sql.ParseColumnList("id,user_id,created_on"), nil
+	}, func(databaseName, tableName string) bool {
+		return tableName != "ignored"
+	})
+
+	c1 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 100}
+	c2 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 200}
+	c3 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 300}
+	c4 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000067", LogPos: 4}
+
+	test.S(t).ExpectTrue(history.ResolveColumns("final", "ignored", c1, 3, nil) == nil)
+	test.S(t).ExpectEquals(history.ResolveColumns("final", "t1", c1, 3, nil).Names(), []string{"id", "user_id", "created_on"})
+	test.S(t).ExpectEquals(loads, 1)
+
+	for _, ddl := range ParseDDL("final", "alter table t1 add column recording_id bigint after user_id") {
+		history.ApplyDDL(c2, ddl)
+	}
+	// 旧的位置依然使用旧的表结构
+	test.S(t).ExpectEquals(history.ColumnsAt("final", "t1", c1).Names(), []string{"id", "user_id", "created_on"})
+	test.S(t).ExpectEquals(history.ResolveColumns("final", "t1", c3, 4, nil).Names(), []string{"id", "user_id", "recording_id", "created_on"})
+	test.S(t).ExpectEquals(loads, 1)
+
+	// 重连之后重复读取的DDL被忽略
+	for _, ddl := range ParseDDL("final", "alter table t1 add column recording_id bigint after user_id") {
+		history.ApplyDDL(c2, ddl)
+	}
+	test.S(t).ExpectEquals(history.ColumnsAt("final", "t1", c3).Len(), 4)
+
+	for _, ddl := range ParseDDL("final", "rename table t1 to t2") {
+		history.ApplyDDL(c4, ddl)
+	}
+	test.S(t).ExpectTrue(history.ColumnsAt("final", "t1", c4) == nil)
+	test.S(t).ExpectEquals(history.ColumnsAt("final", "t2", c4).Len(), 4)
+
+	// row image和表结构对不上，并且从DB也加载不到一致的表结构
+	test.S(t).ExpectTrue(history.ResolveColumns("final", "t2", c4, 5, nil) == nil)
+	test.S(t).ExpectEquals(loads, 2)
+}
+
+// go test github.com/wfxiang08/db-sharding/binlog -v -run "TestSchemaHistoryColumnTypes$"
+func TestSchemaHistoryColumnTypes(t *testing.T) {
+	loads := 0
+	history := NewSchemaHistory(func(databaseName, tableName string) (*sql.ColumnList, error) {
+		loads++
+		columns := sql.ParseColumnList("id,name")
+		columns.SetDataType("id", "bigint")
+		columns.SetDataType("name", "varchar")
+		return columns, nil
+	}, nil)
+
+	c1 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 100}
+	c2 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 200}
+	c3 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 300}
+	c4 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 400}
+	types := []byte{gomysql.MYSQL_TYPE_LONGLONG, gomysql.MYSQL_TYPE_VARCHAR}
+
+	test.S(t).ExpectEquals(history.ResolveColumns("final", "t1", c1, 2, types).Names(), []string{"id", "name"})
+	test.S(t).ExpectEquals(loads, 1)
+
+	// 同样列数的DDL, 但是column的顺序变了: 通过类型发现DDL没有被正确跟踪
+	history.ApplyDDL(c2, &TableDDL{Type: CreateTableDDL, DatabaseName: "final", TableName: "t1",
+		Columns: []string{"name", "id"}, ColumnTypes: []string{"varchar", "bigint"}})
+	test.S(t).ExpectEquals(history.ResolveColumns("final", "t1", c3, 2, types).Names(), []string{"id", "name"})
+	test.S(t).ExpectEquals(loads, 2)
+
+	// DDL修改了类型
+	for _, ddl := range ParseDDL("final", "alter table t1 modify name int") {
+		history.ApplyDDL(c4, ddl)
+	}
+	c5 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 500}
+	test.S(t).ExpectEquals(history.ResolveColumns("final", "t1", c5, 2,
+		[]byte{gomysql.MYSQL_TYPE_LONGLONG, gomysql.MYSQL_TYPE_LONG}).GetDataType("name"), "int")
+	test.S(t).ExpectEquals(loads, 2)
+
+	// 从DB加载的表结构也对不上, 返回nil, 不再重复加载
+	c6 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 600}
+	blobTypes := []byte{gomysql.MYSQL_TYPE_LONGLONG, gomysql.MYSQL_TYPE_BLOB}
+	test.S(t).ExpectTrue(history.ResolveColumns("final", "t1", c6, 2, blobTypes) == nil)
+	test.S(t).ExpectTrue(history.ResolveColumns("final", "t1", c6, 2, blobTypes) == nil)
+	test.S(t).ExpectEquals(loads, 3)
+}
+
+// go test github.com/wfxiang08/db-sharding/binlog -v -run "TestSchemaHistoryRenameSwap$"
+func TestSchemaHistoryRenameSwap(t *testing.T) {
+	history := NewSchemaHistory(nil, func(databaseName, tableName string) bool {
+		return tableName != "tmp"
+	})
+	c1 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 100}
+	c2 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 200}
+	c3 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 300}
+
+	history.ApplyDDLs(c1, ParseDDL("final", "create table a (id bigint, name varchar(32))"))
+	history.ApplyDDLs(c2, ParseDDL("final", "create table b (id bigint, name varchar(32), age int)"))
+	history.ApplyDDLs(c3, ParseDDL("final", "rename table a to tmp, b to a, tmp to b"))
+
+	test.S(t).ExpectEquals(history.ColumnsAt("final", "a", c3).Names(), []string{"id", "name", "age"})
+	test.S(t).ExpectEquals(history.ColumnsAt("final", "b", c3).Names(), []string{"id", "name"})
+	test.S(t).ExpectTrue(history.ColumnsAt("final", "tmp", c3) == nil)
+	test.S(t).ExpectEquals(history.ColumnsAt("final", "a", c2).Len(), 2)
+
+	// 重连之后重复读取的DDL被忽略
+	history.ApplyDDLs(c3, ParseDDL("final", "rename table a to tmp, b to a, tmp to b"))
+	test.S(t).ExpectEquals(history.ColumnsAt("final", "a", c3).Len(), 3)
+}
+
+// go test github.com/wfxiang08/db-sharding/binlog -v -run "TestSchemaHistoryLoad$"
+func TestSchemaHistoryLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema_history")
+	test.S(t).ExpectNil(err)
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "127.0.0.1_3306.schema")
+
+	loader := func(databaseName, tableName string) (*sql.ColumnList, error) {
+		// DB中是最新的表结构
+		return sql.ParseColumnList("id,user_id,recording_id,created_on"), nil
+	}
+	c1 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 100}
+	c2 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 200}
+	c3 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 300}
+
+	history := NewSchemaHistory(loader, nil)
+	test.S(t).ExpectNil(history.Load(filePath))
+	history.ApplyDDLs(c1, ParseDDL("final", "create table t1 (id bigint, user_id bigint, created_on int)"))
+	history.ApplyDDLs(c2, ParseDDL("final", "alter table t1 add column recording_id bigint after user_id"))
+
+	// 重启之后从checkpoint(c1和c2之间)开始读取binlog, 依然使用当时的表结构, 而不是DB中的表结构
+	history = NewSchemaHistory(loader, nil)
+	test.S(t).ExpectNil(history.Load(filePath))
+	columns := history.ResolveColumns("final", "t1", mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 150}, 3,
+		[]byte{gomysql.MYSQL_TYPE_LONGLONG, gomysql.MYSQL_TYPE_LONGLONG, gomysql.MYSQL_TYPE_LONG})
+	test.S(t).ExpectEquals(columns.Names(), []string{"id", "user_id", "created_on"})
+	test.S(t).ExpectEquals(columns.GetDataType("created_on"), "int")
+
+	// 已经记录过的DDL被忽略
+	history.ApplyDDLs(c2, ParseDDL("final", "alter table t1 add column recording_id bigint after user_id"))
+	test.S(t).ExpectEquals(history.ColumnsAt("final", "t1", c3).Names(), []string{"id", "user_id", "recording_id", "created_on"})
+}
+
+// go test github.com/wfxiang08/db-sharding/binlog -v -run "TestSchemaHistoryFailover$"
+func TestSchemaHistoryFailover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema_history")
+	test.S(t).ExpectNil(err)
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "source.schema")
+
+	history := NewSchemaHistory(nil, nil)
+	test.S(t).ExpectNil(history.Load(filePath))
+	history.SetServer("3e11fa47-71ca-11e1-9e33-c80aa9429562")
+	c1 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 100, GTIDSet: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-10"}
+	c2 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 200, GTIDSet: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-11"}
+	history.ApplyDDLs(c1, ParseDDL("final", "create table t1 (id bigint, user_id bigint)"))
+	history.ApplyDDLs(c2, ParseDDL("final", "alter table t1 add column created_on int"))
+
+	// 主从切换之后新master的file:pos更小, 重启之后依然能识别出server的变化
+	history = NewSchemaHistory(nil, nil)
+	test.S(t).ExpectNil(history.Load(filePath))
+	history.SetServer("4f22ab58-82db-22f2-af44-d91bb0530673")
+	c3 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000003", LogPos: 100,
+		GTIDSet: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-11,4f22ab58-82db-22f2-af44-d91bb0530673:1"}
+	c4 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000003", LogPos: 200,
+		GTIDSet: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-11,4f22ab58-82db-22f2-af44-d91bb0530673:1-2"}
+
+	// 切换之前的最新版本对新master上的所有位置有效
+	test.S(t).ExpectEquals(history.ColumnsAt("final", "t1", c3).Names(), []string{"id", "user_id", "created_on"})
+
+	// 新master上的DDL不会被当作重复的DDL忽略
+	history.ApplyDDLs(c4, ParseDDL("final", "alter table t1 add column recording_id bigint after user_id"))
+	test.S(t).ExpectEquals(history.ColumnsAt("final", "t1", c4).Names(), []string{"id", "user_id", "recording_id", "created_on"})
+	test.S(t).ExpectEquals(history.ColumnsAt("final", "t1", c3).Len(), 3)
+
+	// 同一个server重连, 历史保持不变
+	history.SetServer("4f22ab58-82db-22f2-af44-d91bb0530673")
+	test.S(t).ExpectEquals(history.ColumnsAt("final", "t1", c3).Len(), 3)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/db-sharding/conf"
+)
+
+var (
+	mapFile    = flag.String("map", "", "bucket map file")
+	initShards = flag.Int("init", 0, "create the bucket map with bucket % init shards(same as SMHashShard)")
+	aliasFmt   = flag.String("alias", conf.DefaultShardAliasFormat, "alias format of shards")
+	move       = flag.String("move", "", "bucket range to move, eg: 0-127")
+	to         = flag.String("to", "", "move: target shard alias")
+	out        = flag.String("out", "", "move: write the new bucket map to this file, default: overwrite -map")
+	diff       = flag.String("diff", "", "print the buckets to move from -map to this bucket map")
+)
+
+//
+// go build github.com/wfxiang08/db-sharding/cmds/bucket_map
+//
+// 1. 初始化: bucket_map -map buckets.toml -init 32
+// 2. 查看:   bucket_map -map buckets.toml
+// 3. 迁移:   bucket_map -map buckets.toml -move 0-127 -to shard32 -out buckets_new.toml
+// 然后在dbs中配置shard32, 通过user_recording_like -move-from shard0 -bucket-map-to buckets_new.toml拷贝数据
+// (shards的数目按照新的bucket map计算, 这里为33)
+// 4. 比较:   bucket_map -map buckets.toml -diff buckets_new.toml
+//
+func main() {
+	flag.Parse()
+
+	if len(*mapFile) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *initShards > 0 {
+		bucketMap := conf.NewBucketMap(*aliasFmt, *initShards)
+		if err := bucketMap.Save(*mapFile); err != nil {
+			log.PanicErrorf(err, "Save bucket map failed")
+		}
+		log.Printf(color.MagentaString("Bucket map created")+": %s", bucketMap.Summary())
+		return
+	}
+
+	bucketMap, err := conf.LoadBucketMap(*mapFile)
+	if err != nil {
+		log.PanicErrorf(err, "LoadBucketMap failed")
+	}
+	if _, err := bucketMap.ShardNum(*aliasFmt); err != nil {
+		log.PanicErrorf(err, "Invalid bucket map: %s", *mapFile)
+	}
+
+	switch {
+	case len(*move) > 0:
+		start, end, err := parseBucketRange(*move)
+		if err != nil || len(*to) == 0 {
+			log.Panicf("Invalid move: %s, to: %s", *move, *to)
+		}
+		origin, _ := conf.LoadBucketMap(*mapFile)
+		if err := bucketMap.Move(start, end, *to, *aliasFmt); err != nil {
+			log.PanicErrorf(err, "Move buckets failed")
+		}
+		printMoves(origin, bucketMap)
+
+		target := *out
+		if len(target) == 0 {
+			target = *mapFile
+		}
+		if err := bucketMap.Save(target); err != nil {
+			log.PanicErrorf(err, "Save bucket map failed")
+		}
+		log.Printf(color.MagentaString("Bucket map saved")+": %s, %s", target, bucketMap.Summary())
+
+	case len(*diff) > 0:
+		target, err := conf.LoadBucketMap(*diff)
+		if err != nil {
+			log.PanicErrorf(err, "LoadBucketMap failed")
+		}
+		printMoves(bucketMap, target)
+
+	default:
+		for _, r := range bucketMap.Ranges {
+			fmt.Printf("[%d, %d]: %s\n", r.Start, r.End, r.Shard)
+		}
+		shardNum, _ := bucketMap.ShardNum(*aliasFmt)
+		log.Printf(color.MagentaString("Buckets")+": %s, shards: %d", bucketMap.Summary(), shardNum)
+	}
+}
+
+// 格式: start-end 或者 bucket
+func parseBucketRange(value string) (int, int, error) {
+	items := strings.SplitN(value, "-", 2)
+	start, err := strconv.Atoi(strings.TrimSpace(items[0]))
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(items) == 1 {
+		return start, start, nil
+	}
+	end, err := strconv.Atoi(strings.TrimSpace(items[1]))
+	return start, end, err
+}
+
+func printMoves(current *conf.BucketMap, target *conf.BucketMap) {
+	moves := current.Diff(target)
+	for _, move := range moves {
+		log.Printf(color.YellowString("Move buckets")+": %s", move.String())
+	}
+	log.Printf(color.MagentaString("Buckets to move")+": %d ranges", len(moves))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/db-sharding/conf"
+	"github.com/wfxiang08/db-sharding/logic"
+	"github.com/wfxiang08/db-sharding/media_utils"
+)
+
+// migrateFlags copy和stream共享的flags
+type migrateFlags struct {
+	*commandFlags
+	tables          *string
+	replicaServerId *uint
+	dryRun          *bool
+	metaDir         *string
+	binlogInfo      *string
+	gtidSet         *string
+	gtidMode        *bool
+	throttle        *string
+	adminAddr       *string
+	caughtUpDelay   *time.Duration
+	caughtUpWindow  *time.Duration
+}
+
+func newMigrateFlags(name string) *migrateFlags {
+	fs := newCommandFlags(name)
+	return &migrateFlags{
+		commandFlags:    fs,
+		tables:          fs.String("tables", "", "comma separated names of [[table]] to migrate, default all"),
+		replicaServerId: fs.Uint("replica-server-id", 99900, "server id used by gh-ost process. Default: 99900"),
+		dryRun:          fs.Bool("dry", false, "dry run"),
+		metaDir:         fs.String("meta-dir", "", "binlog meta dir"),
+		binlogInfo:      fs.String("bin", "", "binlog position"),
+		gtidSet:         fs.String("gtid", "", "start gtid set, eg: 3E11FA47-71CA-11E1-9E33-C80AA9429562:1-100"),
+		gtidMode:        fs.Bool("gtid-mode", false, "use gtid to track binlog position"),
+		throttle:        fs.String("throttle-alias", "", "throttle alias"),
+		adminAddr:       fs.String("admin-addr", "", "http admin api address for status and control, eg: :8080"),
+		caughtUpDelay:   fs.Duration("caught-up-delay", logic.DefaultCaughtUpDelay, "shards caught up when the binlog delay stays below this"),
+		caughtUpWindow:  fs.Duration("caught-up-window", logic.DefaultCaughtUpWindow, "how long the delay should stay below caught-up-delay"),
+	}
+}
+
+func (this *migrateFlags) checkMetaDir() {
+	if len(*this.metaDir) == 0 || !media_utils.IsDir(*this.metaDir) {
+		log.Panicf("Invalid meta-dir")
+	}
+}
+
+// buildTables 每个表根据配置创建builder和DBHelper, 所有的表共享appliers
+func (this *migrateFlags) buildTables(wg *sync.WaitGroup, dbConfig *conf.DatabaseConfig, cacheSize int64, reorder bool,
+	sortDir string, sortRunSize int, pauseInput *atomic2.Bool, stopInput *atomic2.Bool) ([]*logic.ShardingTable,
+	logic.ShardingAppliers) {
+
+	mappings := selectTables(dbConfig, *this.tables)
+	shardingTables := make([]*logic.ShardingTable, len(mappings))
+	for i, mapping := range mappings {
+		var err error
+		shardingTables[i], err = logic.NewMappingTable(dbConfig, mapping, cacheSize, reorder, sortDir, sortRunSize)
+		if err != nil {
+			log.PanicErrorf(err, "NewMappingTable failed: %s", mapping.Name)
+		}
+	}
+
+	shardingAppliers, host2InputPause := logic.BuildTablesAppliers(wg, logic.BatchReadCount*10, shardingTables,
+		*this.dryRun, dbConfig)
+	if len(*this.throttle) > 0 {
+		logic.StartThrottleCheck(dbConfig, *this.throttle, host2InputPause)
+	}
+	logic.StartLoadThrottle(dbConfig, shardingAppliers, host2InputPause)
+	logic.StartPipelineDelay(shardingAppliers, *this.caughtUpDelay, *this.caughtUpWindow)
+	logic.StartAdminServer(*this.adminAddr, shardingAppliers, host2InputPause, pauseInput, stopInput)
+	return shardingTables, shardingAppliers
+}
+
+// runCopy 批量拷贝:
+// 1. 默认: 只拷贝数据
+// 2. -with-binlog: 拷贝的同时订阅binlog, 拷贝期间被删除/修改的数据通过tombstones跳过或者替换为最新的数据
+// 3. -snapshot: 从一致性快照拷贝数据, 然后从快照对应的binlog位置开始订阅
+func runCopy(args []string) {
+	fs := newMigrateFlags("copy")
+	snapshot := fs.Bool("snapshot", false, "copy from a consistent snapshot, then stream binlog from the snapshot position")
+	withBinlog := fs.Bool("with-binlog", false, "stream binlog during the copy, skip deleted and replace updated rows")
+	reorder := fs.Bool("reorder", true, "sort rows of each shard by reorder_key before insert")
+	resume := fs.Bool("resume", false, "resume from the progress saved in meta-dir; requires -meta-dir and -reorder=false, not supported with -snapshot")
+	cacheSize := fs.Int64("batch-cache", 20000000, "batch process init cache size")
+	sortDir := fs.String("sort-dir", "", "spill sorted runs to this dir, empty for in-memory sort")
+	sortRunSize := fs.Int("sort-run-size", 1000000, "max rows of each shard kept in memory when sort-dir is set")
+	dbConfig := fs.parse(args)
+
+	// reorder模式下所有的数据排序之后才插入, 没有可以续传的进度
+	if *resume && (*reorder || *snapshot || len(*fs.metaDir) == 0) {
+		fmt.Fprintf(os.Stderr, "-resume requires -meta-dir and -reorder=false, not supported with -snapshot\n")
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *snapshot || *withBinlog {
+		fs.checkMetaDir()
+	}
+
+	var stopInput atomic2.Bool
+	var pauseInput atomic2.Bool
+	wg := &sync.WaitGroup{}
+
+	shardingTables, shardingAppliers := fs.buildTables(wg, dbConfig, *cacheSize, *reorder, *sortDir, *sortRunSize,
+		&pauseInput, &stopInput)
+	go logic.ShardingWaitingClose(true, &pauseInput, &stopInput, shardingAppliers)
+
+	if *snapshot {
+		logic.SnapshotCopyAndStreamTables(wg, shardingTables, dbConfig, shardingAppliers,
+			&stopInput, &pauseInput, *fs.replicaServerId, *fs.gtidMode, *fs.metaDir)
+		wg.Wait()
+		return
+	}
+
+	// 直接apply的模式下, 保存拷贝的进度到meta-dir
+	if !*reorder && len(*fs.metaDir) > 0 {
+		for _, table := range shardingTables {
+			var err error
+			table.Progress, err = logic.LoadBatchProgress(*fs.metaDir, table.Origin.DbAlias, table.TableName,
+				logic.TotalShardNum)
+			if err != nil {
+				log.PanicErrorf(err, "LoadBatchProgress failed")
+			}
+			if !*resume {
+				table.Progress.Reset()
+			}
+		}
+	}
+
+	if *withBinlog {
+		logic.BatchShardWithBinlogTables(wg, shardingTables, dbConfig, shardingAppliers,
+			&stopInput, &pauseInput,
+			*fs.replicaServerId, *fs.binlogInfo, *fs.gtidSet, *fs.gtidMode, *fs.metaDir)
+	} else {
+		logic.BatchReadTables(wg, shardingTables, dbConfig, shardingAppliers, &stopInput, &pauseInput)
+		log.Printf(color.MagentaString("Data sharding finished"))
+	}
+	wg.Wait()
+}
+
+// runStream 只订阅binlog(一次只处理一台机器), 所有的表共享一个binlog stream
+func runStream(args []string) {
+	fs := newMigrateFlags("stream")
+	dbConfig := fs.parse(args)
+	fs.checkMetaDir()
+
+	var stopInput atomic2.Bool
+	var pauseInput atomic2.Bool
+	wg := &sync.WaitGroup{}
+
+	shardingTables, shardingAppliers := fs.buildTables(wg, dbConfig, 0, false, "", 0, &pauseInput, &stopInput)
+	go logic.ShardingWaitingClose(false, &pauseInput, &stopInput, shardingAppliers)
+
+	logic.BinlogShardTables(wg, shardingTables, dbConfig, shardingAppliers, &stopInput,
+		*fs.replicaServerId, *fs.binlogInfo, *fs.gtidSet, *fs.gtidMode, *fs.metaDir)
+	wg.Wait()
+}
+
+// selectTables tables中指定的表, 默认为所有的表
+func selectTables(dbConfig *conf.DatabaseConfig, tables string) []*conf.TableMapping {
+	if len(tables) == 0 {
+		if len(dbConfig.Tables) == 0 {
+			log.Panicf("No [[table]] found in config")
+		}
+		return dbConfig.Tables
+	}
+
+	var mappings []*conf.TableMapping
+	for _, name := range strings.Split(tables, ",") {
+		mapping := dbConfig.GetTable(strings.TrimSpace(name))
+		if mapping == nil {
+			log.Panicf("Table mapping not found: %s", name)
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings
+}
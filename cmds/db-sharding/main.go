@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	_ "github.com/jinzhu/gorm/dialects/mysql"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/db-sharding/conf"
+	"github.com/wfxiang08/db-sharding/logic"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string)
+}
+
+var commands = []*command{
+	{"copy", "batch copy [[table]] mappings, -with-binlog/-snapshot keep streaming binlog after the copy", runCopy},
+	{"stream", "stream binlog of [[table]] mappings to shards", runStream},
+	{"verify", "verify rows of source tables and shards by chunk checksums, -repair to fix the differences", runVerify},
+	{"binlog-pos", "print binlog position and gtid set of db aliases", runBinlogPos},
+	{"lag", "print replication lag of master aliases", runLag},
+	{"shard-of", "print the shard of sharding keys", runShardOf},
+}
+
+//
+// go build -o db-sharding github.com/wfxiang08/db-sharding/cmds/db-sharding
+//
+// db-sharding <command> -conf dbs.toml [flags]
+// 表的映射关系在配置文件的[[table]]中描述, 不需要为每个表编写代码
+//
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			cmd.run(os.Args[2:])
+			return
+		}
+	}
+	usage()
+	os.Exit(1)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: db-sharding <command> [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'db-sharding <command> -h' for the flags of a command\n")
+}
+
+// commandFlags 各个命令共享的flags: 配置文件和日志
+type commandFlags struct {
+	*flag.FlagSet
+	conf      *string
+	logPrefix *string
+}
+
+func newCommandFlags(name string) *commandFlags {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	return &commandFlags{
+		FlagSet:   fs,
+		conf:      fs.String("conf", "", "hosts config file"),
+		logPrefix: fs.String("log", "", "log file prefix"),
+	}
+}
+
+// parse 解析flags, 设置日志, 加载配置
+func (this *commandFlags) parse(args []string) *conf.DatabaseConfig {
+	this.Parse(args)
+	logic.ShardingSetupLog(*this.logPrefix)
+
+	if len(*this.conf) == 0 {
+		this.Usage()
+		os.Exit(1)
+	}
+	dbConfig, err := conf.NewConfigWithFile(*this.conf)
+	if err != nil {
+		log.PanicErrorf(err, "NewConfigWithFile failed")
+	}
+	// bucket_map: shards的数目按照bucket map计算
+	logic.SetupBucketMapShards(dbConfig)
+	return dbConfig
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/db-sharding/logic"
+	"github.com/wfxiang08/db-sharding/models"
+)
+
+// runBinlogPos 打印db alias所在机器当前的binlog位置, 可以作为stream的起点
+func runBinlogPos(args []string) {
+	fs := newCommandFlags("binlog-pos")
+	aliases := fs.String("alias", "final", "comma separated db aliases")
+	dbConfig := fs.parse(args)
+
+	logic.PrintBinlogPos(strings.Split(*aliases, ","), dbConfig)
+}
+
+// runLag 检查master到slaves(slave_master_mapping)的延迟, 按照[throttle]的lag_source
+func runLag(args []string) {
+	fs := newCommandFlags("lag")
+	aliases := fs.String("alias", "", "master aliases separated by ;")
+	count := fs.Int("count", 10, "print the lag count times, 0 for forever")
+	interval := fs.Duration("interval", time.Second, "interval between two prints")
+	dbConfig := fs.parse(args)
+
+	if len(*aliases) == 0 {
+		fs.Usage()
+		return
+	}
+	host2PauseInput := make(map[string]*atomic2.Bool)
+	for _, alias := range strings.Split(*aliases, ";") {
+		_, hostname, _ := dbConfig.GetDB(alias)
+		host2PauseInput[hostname] = &atomic2.Bool{}
+	}
+
+	nodes := logic.StartThrottleCheck(dbConfig, *aliases, host2PauseInput)
+	for i := 0; *count <= 0 || i < *count; i++ {
+		time.Sleep(*interval)
+		for _, node := range nodes {
+			log.Printf("Replication lag: %s, %s", node.DbName, node.Lag().String())
+		}
+	}
+}
+
+// runShardOf 按照配置中的sharding算法计算key所在的shard
+func runShardOf(args []string) {
+	fs := newCommandFlags("shard-of")
+	// bucket_map时shards的数目按照bucket map计算
+	fs.IntVar(&logic.TotalShardNum, "shards", logic.TotalShardNum, "number of shards, ignored by bucket_map")
+	fs.StringVar(&logic.ShardAliasFormat, "alias", logic.ShardAliasFormat, "alias format of shards")
+	dbConfig := fs.parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Println("Usage: db-sharding shard-of -conf dbs.toml [flags] key1 key2 ...")
+		return
+	}
+	strategy, err := models.NewShardStrategy(&dbConfig.Sharding, logic.TotalShardNum)
+	if err != nil {
+		log.PanicErrorf(err, "NewShardStrategy failed")
+	}
+
+	for _, arg := range fs.Args() {
+		// 整数的key和DB中读取的int64一致
+		var key interface{} = arg
+		if value, err := strconv.ParseInt(arg, 10, 64); err == nil {
+			key = value
+		}
+		shard, err := strategy.FindForKey(key)
+		if err != nil {
+			fmt.Printf("%s: %s\n", arg, err.Error())
+			continue
+		}
+
+		alias := logic.ShardAlias(shard)
+		location := ""
+		if dbConfig.HasDB(alias) {
+			dbName, hostname, port := dbConfig.GetDB(alias)
+			location = fmt.Sprintf(", %s@%s:%d", dbName, hostname, port)
+		}
+		fmt.Printf("%s: bucket: %d, shard: %d, alias: %s%s\n", arg, models.SMShard(models.HashValue(key)), shard,
+			alias, location)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/fatih/color"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/db-sharding/logic"
+)
+
+// runVerify 依次校验各个表, 有差异(并且没有修复)时exit 1
+func runVerify(args []string) {
+	fs := newCommandFlags("verify")
+	tables := fs.String("tables", "", "comma separated names of [[table]] to verify, default all")
+	chunkSize := fs.Int("chunk-size", 2000, "rows of each chunk")
+	repair := fs.Bool("repair", false, "repair the differences from source tables; with -dry only print the repair sqls")
+	dryRun := fs.Bool("dry", false, "dry run")
+	throttle := fs.String("throttle-alias", "", "throttle alias")
+	dbConfig := fs.parse(args)
+
+	var stopInput atomic2.Bool
+	var pauseInput atomic2.Bool
+	go logic.ShardingWaitingClose(true, &pauseInput, &stopInput, nil)
+
+	// 所有的表共享throttle check
+	hostPauses := logic.ShardHostPauses(dbConfig)
+	if len(*throttle) > 0 {
+		logic.StartThrottleCheck(dbConfig, *throttle, hostPauses)
+	}
+
+	hasDiff := false
+	for _, mapping := range selectTables(dbConfig, *tables) {
+		if len(mapping.RowFilters) > 0 {
+			// 源表中被过滤掉的数据不在shards上
+			log.Printf(color.YellowString("Skip verify table with filters: %s"), mapping.Name)
+			continue
+		}
+		table, err := logic.NewMappingTable(dbConfig, mapping, 0, false, "", 0)
+		if err != nil {
+			log.PanicErrorf(err, "NewMappingTable failed: %s", mapping.Name)
+		}
+		verifier, err := logic.NewVerifier(dbConfig, mapping.SourceAlias, mapping.SourceTable, table.DBHelper, *chunkSize)
+		if err != nil {
+			log.PanicErrorf(err, "NewVerifier failed")
+		}
+		verifier.SetHostPauses(hostPauses)
+
+		result, err := verifier.Run(&stopInput, &pauseInput)
+		if err != nil {
+			log.PanicErrorf(err, "Verify failed: %s", mapping.Name)
+		}
+		log.Printf(color.MagentaString("Verify %s finished")+": chunks: %d, rows: %d, differ chunks: %d, missing: %d, extra: %d, differ: %d",
+			mapping.Name, result.Chunks, result.Rows, result.DifferChunks, result.Missing, result.Extra, result.Differ)
+		if !result.HasDiff() {
+			continue
+		}
+		hasDiff = true
+		if !*repair {
+			continue
+		}
+
+		if result.DiffsOverflow {
+			log.Printf(color.RedString("Too many differences, only %d will be repaired, verify again after repair"), len(result.Diffs))
+		}
+		plan, err := verifier.RepairPlan(result.Diffs)
+		if err != nil {
+			log.PanicErrorf(err, "RepairPlan failed")
+		}
+		// 先打印修复的SQL, dry-run时不执行
+		logic.PrintRepairPlan(plan)
+		if *dryRun {
+			continue
+		}
+
+		wg := &sync.WaitGroup{}
+		shardingAppliers, _ := logic.BuildAppliers(wg, logic.BatchReadCount*10, table.DBHelper, false, dbConfig)
+		logic.Repair(plan, shardingAppliers)
+		for _, applier := range shardingAppliers {
+			applier.Close()
+		}
+		wg.Wait()
+	}
+
+	if hasDiff && !*repair {
+		os.Exit(1)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/jinzhu/gorm"
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/db-sharding/conf"
 	"github.com/wfxiang08/db-sharding/logic"
 	"github.com/wfxiang08/db-sharding/models"
 	"sort"
@@ -12,21 +13,49 @@ type DbHelperRecordingLike struct {
 	shardedModels [][]*UserRecordingLike
 	builder       models.ModelBuilder
 	needReOrder   bool
-	lastId        int64
+	batchReader   *logic.KeysetBatchReader
+	seekValues    []interface{}         // 断点续传的位置
+	sorter        *logic.ExternalSorter // 不为nil时, 数据排序之后写入磁盘, 而不是全部保存在内存中
+	movingFrom    int                   // bucket迁移的源shard, 留在源shard上的数据不需要拷贝; -1表示没有迁移
 }
 
 // 目前每个Helper需要定制的内容:
-// 1. 构造函数
+// 1. 构造函数(model通过struct tag描述sharding sql)
 // 2. ShardFilter
-// 3. BatchRead(如果是以id为主键，则也可以直接拷贝)
+// 3. BatchRead(通过KeysetBatchReader按照unique key分页读取, 可以直接拷贝)
 //
-func NewDbHelperRecordingLike(cacheSize int64, needReOrder bool) *DbHelperRecordingLike {
+// sortDir不为空时使用外部排序, 每个shard在内存中最多保留sortRunSize条数据
+// shardingConfig为nil时使用默认的SMHashShard
+// tableName: 结构和user_recording_like相同的表, 源表和shards上的表同名
+func NewDbHelperRecordingLike(tableName string, cacheSize int64, needReOrder bool, sortDir string, sortRunSize int,
+	shardingConfig *conf.ShardingConfig) *DbHelperRecordingLike {
+
+	builder, err := models.NewStructModelBuilder(tableName, &UserRecordingLike{}, logic.TotalShardNum)
+	if err != nil {
+		log.PanicErrorf(err, "NewStructModelBuilder failed")
+	}
+	strategy, err := models.NewShardStrategy(shardingConfig, logic.TotalShardNum)
+	if err != nil {
+		log.PanicErrorf(err, "NewShardStrategy failed")
+	}
+	builder.SetShardStrategy(strategy)
 
 	result := &DbHelperRecordingLike{
-		builder:       NewUserRecordingLikeBuild(logic.TotalShardNum),
-		lastId:        0,
+		builder:       builder,
 		shardedModels: make([][]*UserRecordingLike, logic.TotalShardNum),
 		needReOrder:   needReOrder,
+		movingFrom:    -1,
+	}
+
+	if needReOrder && len(sortDir) > 0 {
+		result.sorter, err = logic.NewExternalSorter(sortDir, logic.TotalShardNum, sortRunSize, &UserRecordingLike{},
+			func(a, b interface{}) bool {
+				return lessUserRecordingLike(a.(*UserRecordingLike), b.(*UserRecordingLike))
+			})
+		if err != nil {
+			log.PanicErrorf(err, "NewExternalSorter failed")
+		}
+		return result
 	}
 
 	for i := 0; i < logic.TotalShardNum; i++ {
@@ -36,7 +65,15 @@ func NewDbHelperRecordingLike(cacheSize int64, needReOrder bool) *DbHelperRecord
 	return result
 }
 
+// SetMovingFrom bucket迁移: 只拷贝按照新的bucket map离开源shard的数据
+func (this *DbHelperRecordingLike) SetMovingFrom(shardIndex int) {
+	this.movingFrom = shardIndex
+}
+
 func (this *DbHelperRecordingLike) ShardFilter(shardIndex int) bool {
+	if shardIndex == this.movingFrom {
+		return false
+	}
 	if shardIndex != 5 {
 		return true
 	} else {
@@ -45,23 +82,48 @@ func (this *DbHelperRecordingLike) ShardFilter(shardIndex int) bool {
 }
 
 func (this *DbHelperRecordingLike) BatchProcess(db *gorm.DB, tableName string, sourceDBAlias string, sqlApplier models.SqlApplier) (*gorm.DB, int) {
+	if this.batchReader == nil {
+		batchReader, err := logic.NewKeysetBatchReader(db, tableName, logic.BatchReadCount)
+		if err != nil {
+			dbInfo := db.New()
+			dbInfo.AddError(err)
+			return dbInfo, 0
+		}
+		this.batchReader = batchReader
+		if err := this.batchReader.Seek(this.seekValues); err != nil {
+			dbInfo := db.New()
+			dbInfo.AddError(err)
+			return dbInfo, 0
+		}
+	}
+
 	var batchModels []*UserRecordingLike
-	dbInfo := db.Table(tableName).
-		Where("id > ?", this.lastId).
-		Order("id ASC").Limit(logic.BatchReadCount).Find(&batchModels)
+	dbInfo, count := this.batchReader.NextModels(db, &batchModels)
 	if dbInfo.Error != nil {
-		return dbInfo, len(batchModels)
+		return dbInfo, count
 	}
 
-	if len(batchModels) > 0 {
+	if count > 0 {
 		this.batchProcess(batchModels, sqlApplier)
+	}
+
+	return dbInfo, count
+}
 
-		// 更新遍历状态
-		lastItem := batchModels[len(batchModels)-1]
-		this.lastId = lastItem.Id
+func (this *DbHelperRecordingLike) BatchPosition() []interface{} {
+	if this.batchReader == nil {
+		return this.seekValues
 	}
+	return this.batchReader.LastValues()
+}
 
-	return dbInfo, len(batchModels)
+func (this *DbHelperRecordingLike) BatchSeek(lastValues []interface{}) {
+	this.seekValues = lastValues
+	if this.batchReader != nil {
+		if err := this.batchReader.Seek(lastValues); err != nil {
+			log.PanicErrorf(err, "BatchSeek failed")
+		}
+	}
 }
 
 func (this *DbHelperRecordingLike) batchProcess(batchModels []*UserRecordingLike, sqlApplier models.SqlApplier) {
@@ -69,7 +131,12 @@ func (this *DbHelperRecordingLike) batchProcess(batchModels []*UserRecordingLike
 		shardIndex := this.builder.GetShardingIndex4Model(model)
 		if this.ShardFilter(shardIndex) {
 			// 机器人，数据直接扔掉
-			if this.NeedReOrder() {
+			if this.sorter != nil {
+				// 内存满了之后排序，写入磁盘
+				if err := this.sorter.Add(shardIndex, model); err != nil {
+					log.PanicErrorf(err, "ExternalSorter add failed")
+				}
+			} else if this.NeedReOrder() {
 				// 先buffer, 在排序
 				this.shardedModels[shardIndex] = append(this.shardedModels[shardIndex], model)
 			} else {
@@ -94,7 +161,8 @@ func (this *DbHelperRecordingLike) NeedReOrder() bool {
 }
 
 func (this *DbHelperRecordingLike) ShardSort(shard int) {
-	if this.NeedReOrder() {
+	// 外部排序在IterateShard时做merge
+	if this.NeedReOrder() && this.sorter == nil {
 		sort.Sort(UserRecordingLikes(this.shardedModels[shard]))
 	}
 
@@ -102,10 +170,23 @@ func (this *DbHelperRecordingLike) ShardSort(shard int) {
 
 func (this *DbHelperRecordingLike) PrintSummary() {
 	for i := 0; i < logic.TotalShardNum; i++ {
-		log.Printf("SHARDXX %d, total size: %d", i, len(this.shardedModels[i]))
+		log.Printf("SHARDXX %d, total size: %d", i, this.GetShardLen(i))
 	}
 }
 
+// IterateShard 按照排序之后的顺序遍历
+func (this *DbHelperRecordingLike) IterateShard(shard int, onItem func(item interface{}) error) error {
+	if this.sorter != nil {
+		return this.sorter.Iterate(shard, onItem)
+	}
+	for i := range this.shardedModels[shard] {
+		if err := onItem(this.GetShardItem(shard, i, true)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (this *DbHelperRecordingLike) GetShardItem(shard int, index int, clear bool) interface{} {
 	result := this.shardedModels[shard][index]
 	if clear {
@@ -115,9 +196,15 @@ func (this *DbHelperRecordingLike) GetShardItem(shard int, index int, clear bool
 }
 
 func (this *DbHelperRecordingLike) ClearShard(shard int) {
+	if this.sorter != nil {
+		this.sorter.Clear(shard)
+	}
 	this.shardedModels[shard] = nil
 }
 
 func (this *DbHelperRecordingLike) GetShardLen(shard int) int {
+	if this.sorter != nil {
+		return this.sorter.Len(shard)
+	}
 	return len(this.shardedModels[shard])
 }
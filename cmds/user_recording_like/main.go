@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/fatih/color"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 	"github.com/wfxiang08/cyutils/utils/atomic2"
@@ -9,6 +10,10 @@ import (
 	"github.com/wfxiang08/db-sharding/conf"
 	"github.com/wfxiang08/db-sharding/logic"
 	"github.com/wfxiang08/db-sharding/media_utils"
+	"github.com/wfxiang08/db-sharding/models"
+	"os"
+	"path"
+	"strings"
 	"sync"
 )
 
@@ -28,23 +33,60 @@ import (
 // R在读的这一刻就立马被写入新的表中，在一个事务内执行；不存在R过期，并且错误events的情况
 //
 // 批量拷贝 + Event模式分开处理
+// 或者:
+// 1. -snapshot: 从一致性快照拷贝数据, 然后从快照对应的binlog位置开始订阅, 不存在时间窗口
+// 2. -with-binlog: 拷贝的同时订阅binlog, 拷贝期间被删除/修改的数据通过tombstones跳过或者替换为最新的数据
+// 3. -reshard: 老的shards作为源表, 按照-snapshot的方式拷贝到新的shards, -verify/-repair同样支持-reshard
+// 4. -move-from: 按照-bucket-map-to拷贝源shard上迁出的buckets, 方式和-reshard相同
+//
+// -tables: 一次处理多个表, 每个表有自己的builder和批量读取, binlog共享一个stream; -reshard, -move-from, -verify只支持一个表
 //
 var (
 	dbConfigFile    = flag.String("conf", "", "hosts config file")
 	replicaServerId = flag.Uint("replica-server-id", 99900, "server id used by gh-ost process. Default: 99900")
 	logPrefix       = flag.String("log", "", "log file prefix")
 	dryRun          = flag.Bool("dry", false, "dry run")
+	tables          = flag.String("tables", "user_recording_like", "comma separated tables with the structure of user_recording_like, share appliers and one binlog stream")
 
 	batchMode  = flag.Bool("batch-model", false, "batch mode or event mode") // 不处理binlog, 默认是先处理批处理数据，然后再考虑binlog
+	snapshot   = flag.Bool("snapshot", false, "copy from a consistent snapshot, then stream binlog from the snapshot position")
+	withBinlog = flag.Bool("with-binlog", false, "batch mode: stream binlog during the copy, skip deleted and replace updated rows")
 	binlogInfo = flag.String("bin", "", "binlog position")
+	reorder    = flag.Bool("reorder", true, "batch mode: sort rows of each shard before insert")
+	resume     = flag.Bool("resume", false, "batch mode: resume from the progress saved in meta-dir; requires -meta-dir and -reorder=false")
+	gtidSet    = flag.String("gtid", "", "start gtid set, eg: 3E11FA47-71CA-11E1-9E33-C80AA9429562:1-100") // 优先级高于-bin
+	gtidMode   = flag.Bool("gtid-mode", false, "use gtid to track binlog position")
 
 	// 根据数据规模来选择
-	// 如果数据量太大，可以考虑临时找一个大内存的云主机，完事之后再退
-	cacheSize = flag.Int64("batch-cache", 20000000, "batch process init cache size")
+	// 如果数据量太大，可以通过sort-dir使用外部排序, 内存占用: shard数 * sort-run-size
+	cacheSize   = flag.Int64("batch-cache", 20000000, "batch process init cache size")
+	sortDir     = flag.String("sort-dir", "", "spill sorted runs to this dir in batch mode, empty for in-memory sort")
+	sortRunSize = flag.Int("sort-run-size", 1000000, "max rows of each shard kept in memory when sort-dir is set")
 
 	metaDir = flag.String("meta-dir", "", "binlog meta dir")
 
-	throttle = flag.String("throttle-alias", "", "throttle alias")
+	// 校验源表和shards上的数据
+	verify    = flag.Bool("verify", false, "verify rows of source table and shards by chunk checksums")
+	chunkSize = flag.Int("chunk-size", 2000, "verify: rows of each chunk")
+	repair    = flag.Bool("repair", false, "verify, then repair the differences from source table; with -dry only print the repair sqls")
+
+	throttle  = flag.String("throttle-alias", "", "throttle alias")
+	adminAddr = flag.String("admin-addr", "", "http admin api address for status and control, eg: :8080")
+
+	caughtUpDelay  = flag.Duration("caught-up-delay", logic.DefaultCaughtUpDelay, "shards caught up when the binlog delay stays below this")
+	caughtUpWindow = flag.Duration("caught-up-window", logic.DefaultCaughtUpWindow, "how long the delay should stay below caught-up-delay")
+
+	// resharding: 老的shards(source-alias)作为源表, 拷贝并订阅binlog到新的shards(target-alias)
+	reshard      = flag.Bool("reshard", false, "reshard from source shards to target shards: snapshot copy, then stream binlog of each source host")
+	sourceShards = flag.Int("source-shards", 32, "reshard: number of source shards")
+	sourceAlias  = flag.String("source-alias", "shard%d", "reshard: alias format of source shards")
+	targetShards = flag.Int("target-shards", 64, "reshard: number of target shards")
+	targetAlias  = flag.String("target-alias", "new_shard%d", "reshard: alias format of target shards")
+
+	// bucket迁移: 按照新的bucket map, 将源shard上迁出的数据拷贝到新的shards; 切换路由之后通过-purge删除源shard上的数据
+	moveFrom    = flag.String("move-from", "", "move buckets: source shard alias, eg: shard3")
+	bucketMapTo = flag.String("bucket-map-to", "", "move buckets: the new bucket map file")
+	purge       = flag.Bool("purge", false, "move buckets: delete rows moved out of the source shard, after routing switched; with -dry only print")
 )
 
 //
@@ -53,15 +95,19 @@ var (
 func main() {
 	flag.Parse()
 
+	// reorder模式下所有的数据排序之后才插入, 没有可以续传的进度
+	if *resume && (!*batchMode || *reorder || len(*metaDir) == 0) {
+		fmt.Fprintf(os.Stderr, "-resume requires -batch-model, -meta-dir and -reorder=false\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	// 1. 设置日志
 	logic.ShardingSetupLog(*logPrefix)
 
-	originTableName := "user_recording_like"
-	originTable := &logic.OriginTable{
-		TablePattern:    originTableName,
-		DatabasePattern: "*",
-		DbAlias:         "final",
-	}
+	tableNames := strings.Split(*tables, ",")
+	originTableName := tableNames[0]
+	originTable := newOriginTable(originTableName)
 
 	// 2. 解析config
 	dbConfig, err := conf.NewConfigWithFile(*dbConfigFile)
@@ -74,46 +120,255 @@ func main() {
 	var pauseInput atomic2.Bool
 	wg := &sync.WaitGroup{}
 
-	// 3. 创建DbHelper
+	sourceAliases := []string{originTable.DbAlias}
+	if *reshard {
+		if *sourceShards <= 0 || *targetShards <= 0 || *sourceAlias == *targetAlias {
+			log.Panicf("Invalid reshard config, source: %d %s, target: %d %s", *sourceShards, *sourceAlias,
+				*targetShards, *targetAlias)
+		}
+		// 新的shards
+		logic.ShardAliasFormat = *targetAlias
+		logic.TotalShardNum = *targetShards
+		sourceAliases = logic.SourceShardAliases(*sourceAlias, *sourceShards)
+	}
+
+	movingFrom := -1
+	if len(*moveFrom) > 0 {
+		movingFrom = prepareBucketMove(dbConfig)
+		sourceAliases = []string{*moveFrom}
+		if *purge {
+			runPurge(dbConfig, movingFrom, originTableName)
+			return
+		}
+	} else {
+		logic.SetupBucketMapShards(dbConfig)
+	}
+	copySources := *reshard || movingFrom >= 0
+	if len(tableNames) > 1 && (copySources || *verify || *repair) {
+		log.Panicf("Only one table supported with reshard, move-from, verify: %s", *tables)
+	}
+
+	if *verify || *repair {
+		if movingFrom >= 0 {
+			// 其他shards上的数据不在源shard中, 无法校验
+			log.Panicf("Verify not supported with move-from")
+		}
+		runVerify(dbConfig, sourceAliases, originTableName)
+		return
+	}
+
+	// 3. 每个表创建一个DbHelper
 	cacheSizeInt := *cacheSize
-	if !*batchMode {
+	if !*batchMode && !*snapshot && !copySources {
 		cacheSizeInt = 0
 	}
-	dbHelper := NewDbHelperRecordingLike(cacheSizeInt, true)
+	shardingTables := make([]*logic.ShardingTable, len(tableNames))
+	for i, tableName := range tableNames {
+		dir := *sortDir
+		if len(dir) > 0 && len(tableNames) > 1 {
+			dir = path.Join(dir, tableName)
+		}
+		dbHelper := NewDbHelperRecordingLike(tableName, cacheSizeInt, *reorder, dir, *sortRunSize, &dbConfig.Sharding)
+		shardingTables[i] = logic.NewShardingTable(newOriginTable(tableName), tableName, dbHelper)
+	}
 
-	// 4. 准备消费者
-	shardingAppliers, host2InputPause := logic.BuildAppliers(wg, logic.BatchReadCount*10, dbHelper, *dryRun, dbConfig)
+	// 4. 准备消费者(所有的表共享)
+	shardingAppliers, host2InputPause := logic.BuildTablesAppliers(wg, logic.BatchReadCount*10, shardingTables,
+		*dryRun, dbConfig)
 
 	// 控制Throttle
 	if len(*throttle) > 0 {
 		logic.StartThrottleCheck(dbConfig, *throttle, host2InputPause)
 	}
+	logic.StartLoadThrottle(dbConfig, shardingAppliers, host2InputPause)
+
+	// 状态和控制
+	logic.StartPipelineDelay(shardingAppliers, *caughtUpDelay, *caughtUpWindow)
+	logic.StartAdminServer(*adminAddr, shardingAppliers, host2InputPause, &pauseInput, &stopInput)
 
 	// 5. 准备退出
-	go logic.ShardingWaitingClose(*batchMode, &pauseInput, &stopInput, shardingAppliers)
+	go logic.ShardingWaitingClose(*batchMode || *snapshot || copySources, &pauseInput, &stopInput, shardingAppliers)
+
+	if copySources {
+		if len(*metaDir) == 0 || !media_utils.IsDir(*metaDir) {
+			log.Panicf("Invalid meta-dir")
+		}
+		// 每个源shard一个DbHelper, 外部排序的文件按照源shard分开
+		newDBHelper := func(sourceDBAlias string) models.DBHelper {
+			dir := *sortDir
+			if len(dir) > 0 {
+				dir = path.Join(dir, sourceDBAlias)
+			}
+			helper := NewDbHelperRecordingLike(originTableName, cacheSizeInt, *reorder, dir, *sortRunSize, &dbConfig.Sharding)
+			helper.SetMovingFrom(movingFrom)
+			return helper
+		}
+		logic.ReshardCopyAndStream(wg, sourceAliases, originTableName, dbConfig, newDBHelper, shardingAppliers,
+			&stopInput, &pauseInput, *replicaServerId, *gtidMode, *metaDir)
 
-	if *batchMode {
-		// 一尺处理一个Table, 可以并发地处理多个Table
-		logic.BatchReadDB(wg, originTableName, originTable.DbAlias, dbConfig, dbHelper,
-			logic.ShardingAppliers(shardingAppliers),
-			&stopInput, &pauseInput)
+	} else if *snapshot {
+		if len(*metaDir) == 0 || !media_utils.IsDir(*metaDir) {
+			log.Panicf("Invalid meta-dir")
+		}
+		// 从一致性快照拷贝数据, 然后从快照的binlog位置开始订阅binlog
+		logic.SnapshotCopyAndStreamTables(wg, shardingTables, dbConfig, shardingAppliers,
+			&stopInput, &pauseInput, *replicaServerId, *gtidMode, *metaDir)
 
-		// 批量Apply数据
-		logic.ReorderAndApply(dbHelper, shardingAppliers)
-		log.Printf(color.MagentaString("Data sharding finished"))
+	} else if *batchMode {
+		// 直接apply的模式下, 保存拷贝的进度到meta-dir
+		if !*reorder && len(*metaDir) > 0 {
+			for _, table := range shardingTables {
+				table.Progress, err = logic.LoadBatchProgress(*metaDir, table.Origin.DbAlias, table.TableName,
+					logic.TotalShardNum)
+				if err != nil {
+					log.PanicErrorf(err, "LoadBatchProgress failed")
+				}
+				if !*resume {
+					table.Progress.Reset()
+				}
+			}
+		}
+
+		if *withBinlog {
+			if len(*metaDir) == 0 || !media_utils.IsDir(*metaDir) {
+				log.Panicf("Invalid meta-dir")
+			}
+			// 同时订阅binlog, 拷贝期间被删除/修改的数据不会被旧的数据覆盖
+			logic.BatchShardWithBinlogTables(wg, shardingTables, dbConfig, shardingAppliers,
+				&stopInput, &pauseInput,
+				*replicaServerId, *binlogInfo, *gtidSet, *gtidMode, *metaDir)
+		} else {
+			// 依次处理各个Table, 批量Apply数据
+			logic.BatchReadTables(wg, shardingTables, dbConfig, shardingAppliers, &stopInput, &pauseInput)
+			log.Printf(color.MagentaString("Data sharding finished"))
+		}
 
 	} else {
 		if len(*metaDir) == 0 || !media_utils.IsDir(*metaDir) {
 			log.Panicf("Invalid meta-dir")
 		}
-		// 只处理binlog(一次只处理一台机器)
-		logic.BinlogShard4SingleMachine(wg,
-			originTable, dbConfig,
-			dbHelper, shardingAppliers, &stopInput,
-			*replicaServerId, *binlogInfo, *metaDir)
+		// 只处理binlog(一次只处理一台机器), 所有的表共享一个binlog stream
+		logic.BinlogShardTables(wg, shardingTables, dbConfig, shardingAppliers, &stopInput,
+			*replicaServerId, *binlogInfo, *gtidSet, *gtidMode, *metaDir)
 
 	}
 
 	// 等外完成
 	wg.Wait()
 }
+
+func newOriginTable(tableName string) *logic.OriginTable {
+	return &logic.OriginTable{
+		TablePattern:    tableName,
+		DatabasePattern: "*",
+		DbAlias:         "final",
+	}
+}
+
+// prepareBucketMove 路由切换到新的bucket map, 返回源shard的index
+func prepareBucketMove(dbConfig *conf.DatabaseConfig) int {
+	if len(*bucketMapTo) == 0 {
+		log.Panicf("move-from requires bucket-map-to")
+	}
+	target, err := conf.LoadBucketMap(*bucketMapTo)
+	if err != nil {
+		log.PanicErrorf(err, "LoadBucketMap failed")
+	}
+	current := dbConfig.Sharding.BucketMap
+	if current == nil {
+		// 默认的SMHashShard
+		current = conf.NewBucketMap(logic.ShardAliasFormat, logic.TotalShardNum)
+	}
+
+	moves := logic.MovedBuckets(current, target, *moveFrom)
+	if len(moves) == 0 && !*purge {
+		log.Panicf("No buckets moved from %s", *moveFrom)
+	}
+	for _, move := range moves {
+		log.Printf(color.MagentaString("Move buckets")+": %s", move.String())
+	}
+
+	dbConfig.Sharding.Strategy = models.ShardStrategyBucketMap
+	dbConfig.Sharding.BucketMap = target
+	// 迁移到新的shard时, shards的数目按照新的bucket map计算
+	logic.SetupBucketMapShards(dbConfig)
+	source := &conf.BucketRange{Shard: *moveFrom}
+	shard, err := source.ShardIndex(logic.ShardAliasFormat)
+	if err != nil {
+		log.PanicErrorf(err, "Invalid move-from")
+	}
+	return shard
+}
+
+// runPurge 业务切换到新的bucket map之后, 删除源shard上迁出的数据
+func runPurge(dbConfig *conf.DatabaseConfig, shard int, originTableName string) {
+	var stopInput atomic2.Bool
+	var pauseInput atomic2.Bool
+	dbHelper := NewDbHelperRecordingLike(originTableName, 0, false, "", 0, &dbConfig.Sharding)
+
+	verifier, err := logic.NewVerifier(dbConfig, *moveFrom, originTableName, dbHelper, *chunkSize)
+	if err != nil {
+		log.PanicErrorf(err, "NewVerifier failed")
+	}
+	if len(*throttle) > 0 {
+		logic.StartThrottleCheck(dbConfig, *throttle, verifier.HostPauses())
+	}
+	go logic.ShardingWaitingClose(true, &pauseInput, &stopInput, nil)
+
+	purged, err := logic.PurgeMovedRows(verifier, shard, &stopInput, &pauseInput, *dryRun)
+	if err != nil {
+		log.PanicErrorf(err, "Purge failed")
+	}
+	log.Printf(color.MagentaString("Purge finished")+": %s, rows: %d", *moveFrom, purged)
+}
+
+func runVerify(dbConfig *conf.DatabaseConfig, sourceAliases []string, originTableName string) {
+	var stopInput atomic2.Bool
+	var pauseInput atomic2.Bool
+	dbHelper := NewDbHelperRecordingLike(originTableName, 0, false, "", 0, &dbConfig.Sharding)
+
+	verifier, err := logic.NewMultiSourceVerifier(dbConfig, sourceAliases, originTableName, dbHelper, *chunkSize)
+	if err != nil {
+		log.PanicErrorf(err, "NewVerifier failed")
+	}
+	// 主从延迟过大时暂停
+	if len(*throttle) > 0 {
+		logic.StartThrottleCheck(dbConfig, *throttle, verifier.HostPauses())
+	}
+	go logic.ShardingWaitingClose(true, &pauseInput, &stopInput, nil)
+
+	result, err := verifier.Run(&stopInput, &pauseInput)
+	if err != nil {
+		log.PanicErrorf(err, "Verify failed")
+	}
+
+	log.Printf(color.MagentaString("Verify finished")+": chunks: %d, rows: %d, differ chunks: %d, missing: %d, extra: %d, differ: %d",
+		result.Chunks, result.Rows, result.DifferChunks, result.Missing, result.Extra, result.Differ)
+	if !result.HasDiff() {
+		return
+	}
+	if !*repair {
+		os.Exit(1)
+	}
+
+	if result.DiffsOverflow {
+		log.Printf(color.RedString("Too many differences, only %d will be repaired, verify again after repair"), len(result.Diffs))
+	}
+	plan, err := verifier.RepairPlan(result.Diffs)
+	if err != nil {
+		log.PanicErrorf(err, "RepairPlan failed")
+	}
+	// 先打印修复的SQL, dry-run时不执行
+	logic.PrintRepairPlan(plan)
+	if *dryRun {
+		return
+	}
+
+	wg := &sync.WaitGroup{}
+	shardingAppliers, _ := logic.BuildAppliers(wg, logic.BatchReadCount*10, dbHelper, false, dbConfig)
+	logic.Repair(plan, shardingAppliers)
+	for _, applier := range shardingAppliers {
+		applier.Close()
+	}
+	wg.Wait()
+}
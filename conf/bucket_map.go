@@ -0,0 +1,214 @@
+package conf
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/juju/errors"
+	"github.com/siddontang/go/ioutil2"
+)
+
+const (
+	// SMShard: hash value的bits 48-59
+	BucketNum = 4096
+
+	DefaultShardAliasFormat = "shard%d"
+)
+
+// BucketRange [Start, End]之间的bucket(包含End)保存在Shard上
+type BucketRange struct {
+	Start int    `toml:"start"`
+	End   int    `toml:"end"`
+	Shard string `toml:"shard"` // shard alias, 例如: shard3
+}
+
+// BucketMap 逻辑bucket到物理shard的映射, 文件格式:
+//
+//	[[bucket]]
+//	start = 0
+//	end = 127
+//	shard = "shard0"
+//
+// 所有的bucket必须被覆盖, 并且没有重叠
+type BucketMap struct {
+	Ranges []*BucketRange `toml:"bucket"`
+}
+
+func LoadBucketMap(name string) (*BucketMap, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var m BucketMap
+	if _, err := toml.Decode(string(data), &m); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, errors.Annotatef(err, "invalid bucket map: %s", name)
+	}
+	return &m, nil
+}
+
+// NewBucketMap 按照bucket % shardNum生成(和SMHashShard一致)
+func NewBucketMap(shardAliasFormat string, shardNum int) *BucketMap {
+	m := &BucketMap{}
+	for bucket := 0; bucket < BucketNum; bucket++ {
+		m.append(bucket, bucket, fmt.Sprintf(shardAliasFormat, bucket%shardNum))
+	}
+	return m
+}
+
+// Save 原子地写入文件
+func (this *BucketMap) Save(name string) error {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(this); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil2.WriteFileAtomic(name, buf.Bytes(), 0644))
+}
+
+// Validate 按照Start排序, 检查是否覆盖了所有的bucket
+func (this *BucketMap) Validate() error {
+	sort.Slice(this.Ranges, func(i, j int) bool {
+		return this.Ranges[i].Start < this.Ranges[j].Start
+	})
+
+	next := 0
+	for _, r := range this.Ranges {
+		if r.Start > r.End {
+			return fmt.Errorf("invalid bucket range: [%d, %d]", r.Start, r.End)
+		}
+		if r.Start != next {
+			if r.Start < next {
+				return fmt.Errorf("overlapped bucket range: [%d, %d]", r.Start, r.End)
+			}
+			return fmt.Errorf("buckets not mapped: [%d, %d]", next, r.Start-1)
+		}
+		if len(r.Shard) == 0 {
+			return fmt.Errorf("shard of bucket range [%d, %d] not set", r.Start, r.End)
+		}
+		next = r.End + 1
+	}
+	if next != BucketNum {
+		return fmt.Errorf("buckets not mapped: [%d, %d]", next, BucketNum-1)
+	}
+	return nil
+}
+
+// ShardIndex 按照aliasFormat解析shard alias, 例如: shard%d, shard3 --> 3
+// 不符合aliasFormat的alias(例如: new_shard12, shard03)都是无效的
+func (this *BucketRange) ShardIndex(aliasFormat string) (int, error) {
+	var index int
+	if _, err := fmt.Sscanf(this.Shard, aliasFormat, &index); err != nil || index < 0 ||
+		fmt.Sprintf(aliasFormat, index) != this.Shard {
+		return -1, fmt.Errorf("invalid shard alias: %s, expect: %s", this.Shard, aliasFormat)
+	}
+	return index, nil
+}
+
+// ShardNum shards的数目: 最大的shard index + 1
+func (this *BucketMap) ShardNum(aliasFormat string) (int, error) {
+	shardNum := 0
+	for _, r := range this.Ranges {
+		index, err := r.ShardIndex(aliasFormat)
+		if err != nil {
+			return 0, err
+		}
+		if index >= shardNum {
+			shardNum = index + 1
+		}
+	}
+	return shardNum, nil
+}
+
+// ShardOf bucket所在的shard alias
+func (this *BucketMap) ShardOf(bucket int) string {
+	index := sort.Search(len(this.Ranges), func(i int) bool {
+		return this.Ranges[i].End >= bucket
+	})
+	if index < len(this.Ranges) && this.Ranges[index].Start <= bucket {
+		return this.Ranges[index].Shard
+	}
+	return ""
+}
+
+// Move 将[start, end]之间的bucket迁移到shard上, 合并相邻的同一个shard的区间; shard按照aliasFormat校验
+func (this *BucketMap) Move(start, end int, shard string, aliasFormat string) error {
+	if start < 0 || end >= BucketNum || start > end {
+		return fmt.Errorf("invalid bucket range: [%d, %d]", start, end)
+	}
+	target := &BucketRange{Shard: shard}
+	if _, err := target.ShardIndex(aliasFormat); err != nil {
+		return err
+	}
+
+	result := &BucketMap{}
+	for bucket := 0; bucket < BucketNum; bucket++ {
+		if bucket >= start && bucket <= end {
+			result.append(bucket, bucket, shard)
+		} else {
+			result.append(bucket, bucket, this.ShardOf(bucket))
+		}
+	}
+	this.Ranges = result.Ranges
+	return nil
+}
+
+func (this *BucketMap) append(start, end int, shard string) {
+	if n := len(this.Ranges); n > 0 && this.Ranges[n-1].Shard == shard && this.Ranges[n-1].End+1 == start {
+		this.Ranges[n-1].End = end
+		return
+	}
+	this.Ranges = append(this.Ranges, &BucketRange{Start: start, End: end, Shard: shard})
+}
+
+// BucketMove 从From迁移到To的buckets
+type BucketMove struct {
+	BucketRange
+	From string
+}
+
+func (this *BucketMove) String() string {
+	return fmt.Sprintf("[%d, %d]: %s --> %s", this.Start, this.End, this.From, this.Shard)
+}
+
+// Diff 从当前的映射切换到target需要迁移的buckets
+func (this *BucketMap) Diff(target *BucketMap) []*BucketMove {
+	var moves []*BucketMove
+	for bucket := 0; bucket < BucketNum; bucket++ {
+		from, to := this.ShardOf(bucket), target.ShardOf(bucket)
+		if from == to {
+			continue
+		}
+		if n := len(moves); n > 0 && moves[n-1].From == from && moves[n-1].Shard == to && moves[n-1].End+1 == bucket {
+			moves[n-1].End = bucket
+			continue
+		}
+		moves = append(moves, &BucketMove{BucketRange: BucketRange{Start: bucket, End: bucket, Shard: to}, From: from})
+	}
+	return moves
+}
+
+// Summary 每个shard上的bucket数目
+func (this *BucketMap) Summary() string {
+	counts := make(map[string]int)
+	var shards []string
+	for _, r := range this.Ranges {
+		if _, ok := counts[r.Shard]; !ok {
+			shards = append(shards, r.Shard)
+		}
+		counts[r.Shard] += r.End - r.Start + 1
+	}
+	sort.Strings(shards)
+
+	items := make([]string, len(shards))
+	for i, shard := range shards {
+		items[i] = fmt.Sprintf("%s: %d", shard, counts[shard])
+	}
+	return strings.Join(items, ", ")
+}
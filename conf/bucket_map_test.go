@@ -0,0 +1,96 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+)
+
+// go test github.com/wfxiang08/db-sharding/conf -v -run "TestBucketMap$"
+func TestBucketMap(t *testing.T) {
+	m := NewBucketMap("shard%d", 32)
+	test.S(t).ExpectNil(m.Validate())
+	test.S(t).ExpectEquals(m.ShardOf(0), "shard0")
+	test.S(t).ExpectEquals(m.ShardOf(33), "shard1")
+	test.S(t).ExpectEquals(m.ShardOf(4095), "shard31")
+
+	// 迁移之后相邻的区间合并
+	target := NewBucketMap("shard%d", 32)
+	test.S(t).ExpectNil(target.Move(0, 127, "shard32", "shard%d"))
+	test.S(t).ExpectNil(target.Validate())
+	test.S(t).ExpectEquals(target.Ranges[0].Start, 0)
+	test.S(t).ExpectEquals(target.Ranges[0].End, 127)
+	test.S(t).ExpectEquals(target.ShardOf(100), "shard32")
+	test.S(t).ExpectEquals(target.ShardOf(128), "shard0")
+	shardNum, err := target.ShardNum("shard%d")
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(shardNum, 33)
+	test.S(t).ExpectNotNil(target.Move(0, 4096, "shard1", "shard%d"))
+	test.S(t).ExpectNotNil(target.Move(0, 1, "final", "shard%d"))
+
+	moves := m.Diff(target)
+	test.S(t).ExpectEquals(len(moves), 128)
+	test.S(t).ExpectEquals(moves[1].String(), "[1, 1]: shard1 --> shard32")
+
+	// 保存之后重新加载
+	dir, err := ioutil.TempDir("", "bucket_map")
+	test.S(t).ExpectNil(err)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "buckets.toml")
+	test.S(t).ExpectNil(target.Save(file))
+	loaded, err := LoadBucketMap(file)
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(len(m.Diff(loaded)), 128)
+	test.S(t).ExpectEquals(len(target.Diff(loaded)), 0)
+}
+
+// go test github.com/wfxiang08/db-sharding/conf -v -run "TestBucketMapValidate$"
+func TestBucketMapValidate(t *testing.T) {
+	m := &BucketMap{Ranges: []*BucketRange{{Start: 2048, End: 4095, Shard: "shard1"}, {Start: 0, End: 2047, Shard: "shard0"}}}
+	test.S(t).ExpectNil(m.Validate())
+	test.S(t).ExpectEquals(m.Ranges[0].Shard, "shard0")
+
+	m = &BucketMap{Ranges: []*BucketRange{{Start: 0, End: 2047, Shard: "shard0"}, {Start: 2047, End: 4095, Shard: "shard1"}}}
+	test.S(t).ExpectNotNil(m.Validate())
+	m = &BucketMap{Ranges: []*BucketRange{{Start: 0, End: 2047, Shard: "shard0"}}}
+	test.S(t).ExpectNotNil(m.Validate())
+	m = &BucketMap{Ranges: []*BucketRange{{Start: 0, End: 4095, Shard: ""}}}
+	test.S(t).ExpectNotNil(m.Validate())
+	m = &BucketMap{Ranges: []*BucketRange{{Start: 0, End: 4095, Shard: "final"}}}
+	test.S(t).ExpectNil(m.Validate())
+	_, err := m.ShardNum("shard%d")
+	test.S(t).ExpectNotNil(err)
+
+	// shard alias按照alias format解析
+	index, err := (&BucketRange{Shard: "new_shard12"}).ShardIndex("new_shard%d")
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(index, 12)
+	for _, shard := range []string{"new_shard12", "shard", "shard03", "shard3x", "shard-1", "final"} {
+		_, err := (&BucketRange{Shard: shard}).ShardIndex("shard%d")
+		test.S(t).ExpectNotNil(err)
+	}
+}
+
+// go test github.com/wfxiang08/db-sharding/conf -v -run "TestCheckBucketMap$"
+func TestCheckBucketMap(t *testing.T) {
+	dbConfig := &DatabaseConfig{Databases: []string{"shard0:shard_0@db0", "shard1:shard_1@db1"}}
+	m := NewBucketMap("shard%d", 2)
+	shardNum, err := dbConfig.CheckBucketMap(m, "shard%d")
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(shardNum, 2)
+
+	// 新的shard没有配置在dbs中
+	test.S(t).ExpectNil(m.Move(0, 127, "shard2", "shard%d"))
+	_, err = dbConfig.CheckBucketMap(m, "shard%d")
+	test.S(t).ExpectNotNil(err)
+	dbConfig.Databases = append(dbConfig.Databases, "shard2:shard_2@db2")
+	shardNum, err = dbConfig.CheckBucketMap(m, "shard%d")
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(shardNum, 3)
+
+	_, err = dbConfig.CheckBucketMap(m, "new_shard%d")
+	test.S(t).ExpectNotNil(err)
+}
@@ -8,6 +8,7 @@ import (
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
 	"github.com/wfxiang08/db-sharding/mysql"
 	"io/ioutil"
+	"path"
 	"strconv"
 	"strings"
 )
@@ -18,6 +19,29 @@ type DatabaseConfig struct {
 	Password           string     `toml:"password"`
 	SlaveMasterMapping [][]string `toml:"slave_master_mapping"`
 	Master2Slave       map[string]string
+	Master2Slaves      map[string][]string // 一个master可以有多个replicas
+	Sharding           ShardingConfig      `toml:"sharding"`
+	Throttle           ThrottleConfig      `toml:"throttle"`
+	Tables             []*TableMapping     `toml:"table"` // 通用命令迁移的表
+}
+
+// ShardingConfig 分片算法的配置, 例如:
+//
+//	[sharding]
+//	strategy = "range"
+//	ranges = [[0, 10000, 0], [10000, 20000, 1]]
+//
+// strategy: sm_hash(默认), mod, range, consistent_hash, lookup, bucket_map
+type ShardingConfig struct {
+	Strategy      string         `toml:"strategy"`
+	Location      uint64         `toml:"location"`   // sm_hash: 每个DB内的table被拆分的数目
+	Ranges        [][]int64      `toml:"ranges"`     // range: [start, end, shard], 区间为[start, end)
+	Replicas      int            `toml:"replicas"`   // consistent_hash: 每个shard的虚拟节点数
+	Lookup        map[string]int `toml:"lookup"`     // lookup: shard key --> shard
+	BucketMapFile string         `toml:"bucket_map"` // bucket_map: 文件路径, 相对路径相对于配置文件所在的目录
+	BucketMap     *BucketMap     `toml:"-"`
+
+	ShardAliasFormat string `toml:"-"` // bucket_map: 解析shard alias, 默认为DefaultShardAliasFormat
 }
 
 func NewConfigWithFile(name string) (*DatabaseConfig, error) {
@@ -26,7 +50,21 @@ func NewConfigWithFile(name string) (*DatabaseConfig, error) {
 		return nil, errors.Trace(err)
 	}
 
-	return NewConfig(string(data))
+	c, err := NewConfig(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.Sharding.BucketMapFile) > 0 {
+		bucketMapFile := c.Sharding.BucketMapFile
+		if !path.IsAbs(bucketMapFile) {
+			bucketMapFile = path.Join(path.Dir(name), bucketMapFile)
+		}
+		if c.Sharding.BucketMap, err = LoadBucketMap(bucketMapFile); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
 }
 
 func NewConfig(data string) (*DatabaseConfig, error) {
@@ -37,8 +75,28 @@ func NewConfig(data string) (*DatabaseConfig, error) {
 	}
 
 	c.Master2Slave = make(map[string]string)
+	c.Master2Slaves = make(map[string][]string)
 	for _, mapping := range c.SlaveMasterMapping {
+		if len(mapping) != 2 {
+			return nil, errors.Errorf("invalid slave_master_mapping: %v", mapping)
+		}
 		c.Master2Slave[mapping[1]] = mapping[0]
+		c.Master2Slaves[mapping[1]] = append(c.Master2Slaves[mapping[1]], mapping[0])
+	}
+
+	if err := c.Throttle.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	names := make(map[string]bool)
+	for _, table := range c.Tables {
+		if err := table.Validate(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if names[table.Name] {
+			return nil, errors.Errorf("duplicated table mapping: %s", table.Name)
+		}
+		names[table.Name] = true
 	}
 
 	return &c, nil
@@ -58,6 +116,31 @@ func (c *DatabaseConfig) AliasToConnectionConfig(dbAlias string) *mysql.Connecti
 	return sourceConfig
 }
 
+// HasDB alias是否在dbs中
+func (c *DatabaseConfig) HasDB(alias string) bool {
+	for _, db := range c.Databases {
+		if strings.HasPrefix(db, alias+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckBucketMap bucket map中的shard alias按照aliasFormat解析, 所有的shards(0到最大的index)都必须配置在dbs中
+// 返回shards的数目
+func (c *DatabaseConfig) CheckBucketMap(m *BucketMap, aliasFormat string) (int, error) {
+	shardNum, err := m.ShardNum(aliasFormat)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < shardNum; i++ {
+		if alias := fmt.Sprintf(aliasFormat, i); !c.HasDB(alias) {
+			return 0, errors.Errorf("shard %s not found in dbs", alias)
+		}
+	}
+	return shardNum, nil
+}
+
 func (c *DatabaseConfig) GetDB(alias string) (dbName string, hostname string, port int) {
 	for _, db := range c.Databases {
 		// db格式:
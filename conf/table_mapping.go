@@ -0,0 +1,171 @@
+package conf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TableMapping 一个表的迁移配置, 通过通用的命令执行, 不需要为每个表编写代码, 例如:
+//
+//	[[table]]
+//	name = "like"
+//	source_alias = "final"
+//	source_db = "*"
+//	source_table = "user_recording_like"
+//	target_table = "user_recording_like"
+//	shard_key = "user_id"
+//	columns = ["user_id", "recording_id", "created_on"]
+//	primary_key = ["user_id", "recording_id"]
+//	reorder_key = ["user_id", "recording_id"]
+//	skip_shards = [5]
+//	filters = ["created_on > 0"]
+//
+// column在binlog中的位置(ordinal)运行时从源表的结构中读取
+type TableMapping struct {
+	Name        string   `toml:"name"`         // 默认为source_table
+	SourceAlias string   `toml:"source_alias"` // 源表所在的db alias
+	SourceDB    string   `toml:"source_db"`    // binlog中的database pattern: shard_0, shard_*, shard_0,shard_1; 默认为*
+	SourceTable string   `toml:"source_table"` // binlog中的table pattern, 同时也是批量读取的表
+	TargetTable string   `toml:"target_table"` // 默认和source_table相同
+	ShardKey    string   `toml:"shard_key"`
+	Columns     []string `toml:"columns"`     // 拷贝的columns, 默认为源表的所有columns
+	PrimaryKey  []string `toml:"primary_key"` // update/delete的where条件
+	ReorderKey  []string `toml:"reorder_key"` // 批量拷贝时每个shard内的排序, 默认为primary_key
+	SkipShards  []int    `toml:"skip_shards"` // 不拷贝的shards
+	Filters     []string `toml:"filters"`     // 只拷贝满足所有条件的数据, 格式: column op value
+
+	RowFilters []*RowFilter `toml:"-"`
+}
+
+// Validate 检查必须的配置, 设置默认值
+func (this *TableMapping) Validate() error {
+	if len(this.SourceTable) == 0 {
+		return fmt.Errorf("table mapping: source_table required")
+	}
+	if len(this.Name) == 0 {
+		this.Name = this.SourceTable
+	}
+	if len(this.SourceAlias) == 0 || len(this.ShardKey) == 0 || len(this.PrimaryKey) == 0 {
+		return fmt.Errorf("table mapping %s: source_alias, shard_key, primary_key required", this.Name)
+	}
+	if len(this.SourceDB) == 0 {
+		this.SourceDB = "*"
+	}
+	if len(this.TargetTable) == 0 {
+		this.TargetTable = this.SourceTable
+	}
+	if len(this.ReorderKey) == 0 {
+		this.ReorderKey = this.PrimaryKey
+	}
+
+	// shard key, pk必须被拷贝
+	if len(this.Columns) > 0 {
+		columns := make(map[string]bool)
+		for _, column := range this.Columns {
+			columns[column] = true
+		}
+		for _, column := range append([]string{this.ShardKey}, this.PrimaryKey...) {
+			if !columns[column] {
+				return fmt.Errorf("table mapping %s: column %s not in columns", this.Name, column)
+			}
+		}
+	}
+
+	this.RowFilters = nil
+	for _, filter := range this.Filters {
+		rowFilter, err := ParseRowFilter(filter)
+		if err != nil {
+			return fmt.Errorf("table mapping %s: %s", this.Name, err.Error())
+		}
+		this.RowFilters = append(this.RowFilters, rowFilter)
+	}
+	return nil
+}
+
+// GetTable 按照name查找
+func (c *DatabaseConfig) GetTable(name string) *TableMapping {
+	for _, table := range c.Tables {
+		if table.Name == name {
+			return table
+		}
+	}
+	return nil
+}
+
+var rowFilterOps = []string{"<=", ">=", "!=", "=", "<", ">"}
+
+// RowFilter 数据的过滤条件: Column Op Value
+type RowFilter struct {
+	Column string
+	Op     string
+	Value  string
+}
+
+// ParseRowFilter 格式: column op value, 例如: status = 1, name != 'abc'
+func ParseRowFilter(filter string) (*RowFilter, error) {
+	// 第一个出现的op, 位置相同时优先匹配两个字符的op
+	index, op := -1, ""
+	for _, candidate := range rowFilterOps {
+		if i := strings.Index(filter, candidate); i > 0 && (index < 0 || i < index) {
+			index, op = i, candidate
+		}
+	}
+	if index > 0 {
+		result := &RowFilter{
+			Column: strings.TrimSpace(filter[:index]),
+			Op:     op,
+			Value:  strings.Trim(strings.TrimSpace(filter[index+len(op):]), "'\""),
+		}
+		if len(result.Column) > 0 && !strings.Contains(result.Column, " ") {
+			return result, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid filter: %s, expect: column op value", filter)
+}
+
+// Match 数值按照数值比较, 其他按照字符串比较; NULL不满足任何条件
+func (this *RowFilter) Match(value interface{}) bool {
+	if value == nil {
+		return false
+	}
+	var text string
+	if data, ok := value.([]byte); ok {
+		text = string(data)
+	} else {
+		text = fmt.Sprint(value)
+	}
+
+	result := strings.Compare(text, this.Value)
+	x, errX := strconv.ParseFloat(text, 64)
+	y, errY := strconv.ParseFloat(this.Value, 64)
+	if errX == nil && errY == nil {
+		switch {
+		case x < y:
+			result = -1
+		case x > y:
+			result = 1
+		default:
+			result = 0
+		}
+	}
+
+	switch this.Op {
+	case "=":
+		return result == 0
+	case "!=":
+		return result != 0
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	case ">":
+		return result > 0
+	default:
+		return result >= 0
+	}
+}
+
+func (this *RowFilter) String() string {
+	return fmt.Sprintf("%s %s %s", this.Column, this.Op, this.Value)
+}
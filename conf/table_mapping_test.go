@@ -0,0 +1,71 @@
+package conf
+
+import (
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+)
+
+// go test github.com/wfxiang08/db-sharding/conf -v -run "TestTableMapping$"
+func TestTableMapping(t *testing.T) {
+	config, err := NewConfig(`
+dbs = ["final:final@final.test.com"]
+
+[[table]]
+source_alias = "final"
+source_table = "user_recording_like"
+shard_key = "user_id"
+primary_key = ["user_id", "recording_id"]
+filters = ["created_on >= 100", "status != 'deleted'"]
+`)
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(len(config.Tables), 1)
+
+	// 默认值
+	table := config.GetTable("user_recording_like")
+	test.S(t).ExpectNotNil(table)
+	test.S(t).ExpectEquals(table.SourceDB, "*")
+	test.S(t).ExpectEquals(table.TargetTable, "user_recording_like")
+	test.S(t).ExpectEquals(len(table.ReorderKey), 2)
+	test.S(t).ExpectEquals(len(table.RowFilters), 2)
+	test.S(t).ExpectEquals(table.RowFilters[1].String(), "status != deleted")
+
+	// shard key不在columns中, 缺少pk
+	_, err = NewConfig(`
+[[table]]
+source_alias = "final"
+source_table = "t"
+shard_key = "user_id"
+primary_key = ["id"]
+columns = ["id"]
+`)
+	test.S(t).ExpectNotNil(err)
+	_, err = NewConfig(`
+[[table]]
+source_alias = "final"
+source_table = "t"
+shard_key = "user_id"
+`)
+	test.S(t).ExpectNotNil(err)
+}
+
+// go test github.com/wfxiang08/db-sharding/conf -v -run "TestRowFilter$"
+func TestRowFilter(t *testing.T) {
+	filter, err := ParseRowFilter("created_on>=100")
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(filter.Op, ">=")
+	test.S(t).ExpectTrue(filter.Match(int64(100)))
+	test.S(t).ExpectTrue(filter.Match([]byte("1000")))
+	test.S(t).ExpectFalse(filter.Match(int32(99)))
+	test.S(t).ExpectFalse(filter.Match(nil))
+
+	filter, err = ParseRowFilter("name = 'a<=b'")
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(filter.Column, "name")
+	test.S(t).ExpectTrue(filter.Match("a<=b"))
+
+	_, err = ParseRowFilter("created_on")
+	test.S(t).ExpectNotNil(err)
+	_, err = ParseRowFilter("= 1")
+	test.S(t).ExpectNotNil(err)
+}
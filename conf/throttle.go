@@ -0,0 +1,156 @@
+package conf
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	LagSourceHeartbeat   = "heartbeat"    // master上定期更新heartbeat表, 在replicas上读取
+	LagSourceSlaveStatus = "slave_status" // SHOW SLAVE STATUS中的Seconds_Behind_Master, 精度为秒
+
+	DefaultMaxLagMs   = 1500
+	DefaultIntervalMs = 500
+
+	DefaultLoadIntervalMs      = 1000
+	DefaultLoadResumeRatio     = 0.8
+	DefaultLoadResumeIntervals = 3
+)
+
+// ThrottleConfig 主从延迟的throttle, 例如:
+//
+//	[throttle]
+//	max_lag_ms = 1500
+//	resume_lag_ms = 1000
+//	interval_ms = 500
+//	lag_source = "heartbeat"
+//
+// 一个master的replicas在slave_master_mapping中配置, 可以有多个; 延迟取所有replicas中最大的
+// 延迟超过max_lag_ms时暂停, 低于resume_lag_ms之后才恢复, 避免在阈值附近反复暂停/恢复
+// 任意一个replica的延迟未知(连接失败, 复制没有运行, Seconds_Behind_Master为NULL)时也会暂停
+type ThrottleConfig struct {
+	MaxLagMs    int64  `toml:"max_lag_ms"`    // 默认1500ms
+	ResumeLagMs int64  `toml:"resume_lag_ms"` // 默认为max_lag_ms的2/3
+	IntervalMs  int64  `toml:"interval_ms"`   // 检查延迟(以及更新heartbeat)的间隔, 默认500ms
+	LagSource   string `toml:"lag_source"`    // heartbeat(默认), slave_status
+
+	Load LoadThrottleConfig `toml:"load"`
+}
+
+// Validate 检查配置, 设置默认值
+func (this *ThrottleConfig) Validate() error {
+	if this.MaxLagMs == 0 {
+		this.MaxLagMs = DefaultMaxLagMs
+	}
+	if this.ResumeLagMs == 0 {
+		this.ResumeLagMs = this.MaxLagMs * 2 / 3
+	}
+	if this.IntervalMs == 0 {
+		this.IntervalMs = DefaultIntervalMs
+	}
+	if len(this.LagSource) == 0 {
+		this.LagSource = LagSourceHeartbeat
+	}
+
+	if this.MaxLagMs < 0 || this.ResumeLagMs < 0 || this.IntervalMs < 0 {
+		return fmt.Errorf("throttle: negative max_lag_ms, resume_lag_ms or interval_ms")
+	}
+	if this.ResumeLagMs > this.MaxLagMs {
+		return fmt.Errorf("throttle: resume_lag_ms %d greater than max_lag_ms %d", this.ResumeLagMs, this.MaxLagMs)
+	}
+	if this.LagSource != LagSourceHeartbeat && this.LagSource != LagSourceSlaveStatus {
+		return fmt.Errorf("throttle: invalid lag_source: %s", this.LagSource)
+	}
+	return this.Load.Validate()
+}
+
+func (this *ThrottleConfig) MaxLag() time.Duration {
+	return time.Duration(this.MaxLagMs) * time.Millisecond
+}
+
+func (this *ThrottleConfig) ResumeLag() time.Duration {
+	return time.Duration(this.ResumeLagMs) * time.Millisecond
+}
+
+func (this *ThrottleConfig) Interval() time.Duration {
+	return time.Duration(this.IntervalMs) * time.Millisecond
+}
+
+// LoadThresholds shard机器负载的阈值, 0表示不检查
+type LoadThresholds struct {
+	MaxThreadsRunning   int64 `toml:"max_threads_running"`
+	MaxThreadsConnected int64 `toml:"max_threads_connected"`
+	MaxWriteLatencyMs   int64 `toml:"max_write_latency_ms"` // shards上一个batch的执行时间
+}
+
+// Enabled 至少检查一个指标
+func (this LoadThresholds) Enabled() bool {
+	return this.MaxThreadsRunning > 0 || this.MaxThreadsConnected > 0 || this.MaxWriteLatencyMs > 0
+}
+
+func (this LoadThresholds) MaxWriteLatency() time.Duration {
+	return time.Duration(this.MaxWriteLatencyMs) * time.Millisecond
+}
+
+// LoadThrottleConfig shard机器(写入的目标)的负载过高时暂停这台机器上的shards, 例如:
+//
+//	[throttle.load]
+//	max_threads_running = 30
+//	max_threads_connected = 1000
+//	max_write_latency_ms = 2000
+//	interval_ms = 1000
+//	resume_ratio = 0.8
+//	resume_intervals = 3
+//
+//	[throttle.load.hosts."shard01.test.com"]
+//	max_threads_running = 50
+//
+// hosts中的阈值覆盖默认的阈值(0表示使用默认值); 超过阈值时暂停, 连续resume_intervals次检查所有指标都低于阈值*resume_ratio之后才恢复
+type LoadThrottleConfig struct {
+	LoadThresholds
+	IntervalMs      int64                      `toml:"interval_ms"`      // 默认1000ms
+	ResumeRatio     float64                    `toml:"resume_ratio"`     // 默认0.8
+	ResumeIntervals int                        `toml:"resume_intervals"` // 默认3; 暂停期间没有batch执行, 无法观察到write latency
+	Hosts           map[string]*LoadThresholds `toml:"hosts"`
+}
+
+// Validate 检查配置, 设置默认值
+func (this *LoadThrottleConfig) Validate() error {
+	if this.IntervalMs == 0 {
+		this.IntervalMs = DefaultLoadIntervalMs
+	}
+	if this.ResumeRatio == 0 {
+		this.ResumeRatio = DefaultLoadResumeRatio
+	}
+	if this.ResumeIntervals == 0 {
+		this.ResumeIntervals = DefaultLoadResumeIntervals
+	}
+	if this.IntervalMs < 0 || this.ResumeIntervals < 0 {
+		return fmt.Errorf("throttle.load: negative interval_ms or resume_intervals")
+	}
+	if this.ResumeRatio < 0 || this.ResumeRatio > 1 {
+		return fmt.Errorf("throttle.load: resume_ratio should be in (0, 1]")
+	}
+	return nil
+}
+
+// ForHost 机器的阈值
+func (this *LoadThrottleConfig) ForHost(hostname string) LoadThresholds {
+	result := this.LoadThresholds
+	if host, ok := this.Hosts[hostname]; ok && host != nil {
+		if host.MaxThreadsRunning > 0 {
+			result.MaxThreadsRunning = host.MaxThreadsRunning
+		}
+		if host.MaxThreadsConnected > 0 {
+			result.MaxThreadsConnected = host.MaxThreadsConnected
+		}
+		if host.MaxWriteLatencyMs > 0 {
+			result.MaxWriteLatencyMs = host.MaxWriteLatencyMs
+		}
+	}
+	return result
+}
+
+func (this *LoadThrottleConfig) Interval() time.Duration {
+	return time.Duration(this.IntervalMs) * time.Millisecond
+}
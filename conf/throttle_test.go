@@ -0,0 +1,99 @@
+package conf
+
+import (
+	"testing"
+	"time"
+
+	test "github.com/outbrain/golib/tests"
+)
+
+// go test github.com/wfxiang08/db-sharding/conf -v -run "TestThrottleConfig$"
+func TestThrottleConfig(t *testing.T) {
+	// 默认值
+	config, err := NewConfig(`
+slave_master_mapping = [
+    ["slave1.test.com", "master.test.com"],
+    ["slave2.test.com", "master.test.com"],
+]
+`)
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(config.Throttle.MaxLag(), 1500*time.Millisecond)
+	test.S(t).ExpectEquals(config.Throttle.ResumeLag(), 1000*time.Millisecond)
+	test.S(t).ExpectEquals(config.Throttle.Interval(), 500*time.Millisecond)
+	test.S(t).ExpectEquals(config.Throttle.LagSource, LagSourceHeartbeat)
+	test.S(t).ExpectEquals(len(config.Master2Slaves["master.test.com"]), 2)
+	test.S(t).ExpectEquals(config.Master2Slave["master.test.com"], "slave2.test.com")
+
+	config, err = NewConfig(`
+[throttle]
+max_lag_ms = 3000
+interval_ms = 1000
+lag_source = "slave_status"
+`)
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(config.Throttle.ResumeLag(), 2000*time.Millisecond)
+	test.S(t).ExpectEquals(config.Throttle.Interval(), time.Second)
+
+	_, err = NewConfig(`
+[throttle]
+max_lag_ms = 1000
+resume_lag_ms = 2000
+`)
+	test.S(t).ExpectNotNil(err)
+
+	_, err = NewConfig(`
+[throttle]
+lag_source = "unknown"
+`)
+	test.S(t).ExpectNotNil(err)
+
+	_, err = NewConfig(`slave_master_mapping = [["slave1.test.com"]]`)
+	test.S(t).ExpectNotNil(err)
+}
+
+// go test github.com/wfxiang08/db-sharding/conf -v -run "TestLoadThrottleConfig$"
+func TestLoadThrottleConfig(t *testing.T) {
+	config, err := NewConfig(`
+[throttle.load]
+max_threads_running = 30
+max_write_latency_ms = 2000
+
+[throttle.load.hosts."shard01.test.com"]
+max_threads_running = 50
+max_threads_connected = 1000
+`)
+	test.S(t).ExpectNil(err)
+	load := &config.Throttle.Load
+	test.S(t).ExpectEquals(load.Interval(), time.Second)
+	test.S(t).ExpectEquals(load.ResumeRatio, DefaultLoadResumeRatio)
+	test.S(t).ExpectEquals(load.ResumeIntervals, DefaultLoadResumeIntervals)
+
+	// 默认的阈值
+	thresholds := load.ForHost("shard02.test.com")
+	test.S(t).ExpectTrue(thresholds.Enabled())
+	test.S(t).ExpectEquals(thresholds.MaxThreadsRunning, int64(30))
+	test.S(t).ExpectEquals(thresholds.MaxThreadsConnected, int64(0))
+	test.S(t).ExpectEquals(thresholds.MaxWriteLatency(), 2*time.Second)
+
+	// 覆盖默认的阈值
+	thresholds = load.ForHost("shard01.test.com")
+	test.S(t).ExpectEquals(thresholds.MaxThreadsRunning, int64(50))
+	test.S(t).ExpectEquals(thresholds.MaxThreadsConnected, int64(1000))
+	test.S(t).ExpectEquals(thresholds.MaxWriteLatencyMs, int64(2000))
+
+	// 没有配置时不检查
+	config, err = NewConfig(``)
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectFalse(config.Throttle.Load.ForHost("shard01.test.com").Enabled())
+
+	_, err = NewConfig(`
+[throttle.load]
+resume_ratio = 1.5
+`)
+	test.S(t).ExpectNotNil(err)
+	_, err = NewConfig(`
+[throttle.load]
+resume_intervals = -1
+`)
+	test.S(t).ExpectNotNil(err)
+}
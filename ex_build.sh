@@ -1,2 +1,3 @@
 #!/usr/bin/env bash
-go build github.com/wfxiang08/db-sharding/cmds/user_recording_like
\ No newline at end of file
+go build github.com/wfxiang08/db-sharding/cmds/user_recording_like
+go build -o db-sharding github.com/wfxiang08/db-sharding/cmds/db-sharding
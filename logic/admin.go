@@ -0,0 +1,178 @@
+package logic
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/fatih/color"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+)
+
+// AdminServer 内嵌的HTTP服务, 查看状态和控制迁移:
+//
+//	GET  /status                     各个shard的进度, 队列, throttle状态, binlog的位置
+//	POST /pause?shard=N              暂停一个shard; 没有shard时暂停输入和所有的shards
+//	POST /resume?shard=N             恢复
+//	POST /batch-size?size=N&shard=N  修改批量提交的大小; 没有shard时修改所有的shards
+//	POST /stop                       优雅退出(和SIGTERM相同)
+//	GET  /metrics                    Prometheus格式的监控指标
+type AdminServer struct {
+	appliers   ShardingAppliers
+	host2Pause map[string]*atomic2.Bool // throttle的暂停标记
+	pauseInput *atomic2.Bool
+	stopInput  *atomic2.Bool
+	mux        *http.ServeMux
+}
+
+// AdminStatus /status的返回结果
+type AdminStatus struct {
+	Paused    bool              `json:"paused"` // 输入(批量读取)是否暂停
+	Stopping  bool              `json:"stopping"`
+	CaughtUp  bool              `json:"caught_up"` // 所有shards的延迟都持续低于阈值, 可以切换
+	Throttle  map[string]bool   `json:"throttle"`  // shard机器 --> 是否因为主从延迟暂停
+	Shards    []*ShardStatus    `json:"shards"`
+	Streamers []*StreamerStatus `json:"streamers"`
+}
+
+func NewAdminServer(shardingAppliers ShardingAppliers, host2Pause map[string]*atomic2.Bool,
+	pauseInput *atomic2.Bool, stopInput *atomic2.Bool) *AdminServer {
+
+	result := &AdminServer{
+		appliers:   shardingAppliers,
+		host2Pause: host2Pause,
+		pauseInput: pauseInput,
+		stopInput:  stopInput,
+		mux:        http.NewServeMux(),
+	}
+	result.mux.HandleFunc("/status", result.handleStatus)
+	result.mux.HandleFunc("/pause", result.post(func(r *http.Request) error { return result.setPaused(r, true) }))
+	result.mux.HandleFunc("/resume", result.post(func(r *http.Request) error { return result.setPaused(r, false) }))
+	result.mux.HandleFunc("/batch-size", result.post(result.setBatchSize))
+	result.mux.HandleFunc("/stop", result.post(func(r *http.Request) error {
+		StopGracefully(result.stopInput, result.appliers)
+		return nil
+	}))
+	result.mux.Handle("/metrics", NewMetricsHandler(shardingAppliers))
+	return result
+}
+
+// StartAdminServer addr为空时不启动
+func StartAdminServer(addr string, shardingAppliers ShardingAppliers, host2Pause map[string]*atomic2.Bool,
+	pauseInput *atomic2.Bool, stopInput *atomic2.Bool) *AdminServer {
+
+	if len(addr) == 0 {
+		return nil
+	}
+	server := NewAdminServer(shardingAppliers, host2Pause, pauseInput, stopInput)
+	// 端口被占用时直接退出
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.PanicErrorf(err, "Admin server listen failed: %s", addr)
+	}
+	log.Printf(color.MagentaString("Admin server listening on: %s"), addr)
+	go func() {
+		if err := http.Serve(listener, server); err != nil {
+			log.ErrorErrorf(err, "Admin server stopped")
+		}
+	}()
+	return server
+}
+
+func (this *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	this.mux.ServeHTTP(w, r)
+}
+
+// Handle 注册其他的handler, 例如: /metrics
+func (this *AdminServer) Handle(pattern string, handler http.Handler) {
+	this.mux.Handle(pattern, handler)
+}
+
+func (this *AdminServer) Status() *AdminStatus {
+	status := &AdminStatus{
+		Paused:    this.pauseInput.Get(),
+		Stopping:  this.stopInput.Get(),
+		CaughtUp:  this.appliers.CaughtUp(),
+		Throttle:  make(map[string]bool, len(this.host2Pause)),
+		Shards:    make([]*ShardStatus, len(this.appliers)),
+		Streamers: StreamersStatus(),
+	}
+	for host, paused := range this.host2Pause {
+		status.Throttle[host] = paused.Get()
+	}
+	for i, applier := range this.appliers {
+		status.Shards[i] = applier.Status()
+	}
+	return status
+}
+
+func (this *AdminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, this.Status())
+}
+
+// post 控制类的请求只接受POST, 成功之后返回最新的状态
+func (this *AdminServer) post(handler func(r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST required"})
+			return
+		}
+		if err := handler(r); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		log.Printf(color.MagentaString("Admin request")+": %s %s", r.Method, r.URL.String())
+		writeJSON(w, http.StatusOK, this.Status())
+	}
+}
+
+// appliersOf 参数shard指定的applier, 没有指定时为所有的appliers
+func (this *AdminServer) appliersOf(r *http.Request) (ShardingAppliers, bool, error) {
+	value := r.FormValue("shard")
+	if len(value) == 0 {
+		return this.appliers, true, nil
+	}
+	shard, err := strconv.Atoi(value)
+	if err != nil || shard < 0 || shard >= len(this.appliers) {
+		return nil, false, fmt.Errorf("invalid shard: %s", value)
+	}
+	return this.appliers[shard : shard+1], false, nil
+}
+
+func (this *AdminServer) setPaused(r *http.Request, paused bool) error {
+	appliers, all, err := this.appliersOf(r)
+	if err != nil {
+		return err
+	}
+	if all {
+		this.pauseInput.Set(paused)
+	}
+	for _, applier := range appliers {
+		applier.SetPaused(paused)
+	}
+	return nil
+}
+
+func (this *AdminServer) setBatchSize(r *http.Request) error {
+	size, err := strconv.Atoi(r.FormValue("size"))
+	if err != nil || size <= 0 {
+		return fmt.Errorf("invalid size: %s", r.FormValue("size"))
+	}
+	appliers, _, err := this.appliersOf(r)
+	if err != nil {
+		return err
+	}
+	for _, applier := range appliers {
+		applier.SetBatchInsertSize(size)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,88 @@
+package logic
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	"github.com/wfxiang08/db-sharding/models"
+)
+
+func newAdminTestServer(shardNum int) (*AdminServer, ShardingAppliers, *atomic2.Bool) {
+	hostPause := &atomic2.Bool{}
+	appliers := make(ShardingAppliers, shardNum)
+	for i := range appliers {
+		appliers[i] = &ShardingApplier{
+			shardingIndex: i,
+			sqls:          make(chan *models.ShardingSQL, 10),
+			pauseInput:    hostPause,
+		}
+		appliers[i].batchInsertSize.Set(100)
+	}
+	var pauseInput, stopInput atomic2.Bool
+	server := NewAdminServer(appliers, map[string]*atomic2.Bool{"host1": hostPause}, &pauseInput, &stopInput)
+	return server, appliers, &pauseInput
+}
+
+func adminRequest(t *testing.T, server *AdminServer, method string, url string) (int, *AdminStatus) {
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	status := &AdminStatus{}
+	test.S(t).ExpectNil(json.Unmarshal(w.Body.Bytes(), status))
+	return w.Code, status
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestAdminServer$"
+func TestAdminServer(t *testing.T) {
+	server, appliers, pauseInput := newAdminTestServer(4)
+	appliers[2].sqls <- models.NewCommitSQL(2)
+	appliers[2].totalPushed.Incr()
+
+	code, status := adminRequest(t, server, http.MethodGet, "/status")
+	test.S(t).ExpectEquals(code, http.StatusOK)
+	test.S(t).ExpectEquals(len(status.Shards), 4)
+	test.S(t).ExpectEquals(status.Shards[2].QueueDepth, 1)
+	test.S(t).ExpectEquals(status.Shards[2].QueueCapacity, 10)
+	test.S(t).ExpectEquals(status.Shards[2].Pushed, int64(1))
+	test.S(t).ExpectFalse(status.Throttle["host1"])
+
+	// 控制类的请求只接受POST
+	code, _ = adminRequest(t, server, http.MethodGet, "/pause")
+	test.S(t).ExpectEquals(code, http.StatusMethodNotAllowed)
+
+	// 暂停一个shard, 输入不受影响
+	code, status = adminRequest(t, server, http.MethodPost, "/pause?shard=1")
+	test.S(t).ExpectEquals(code, http.StatusOK)
+	test.S(t).ExpectTrue(status.Shards[1].Paused)
+	test.S(t).ExpectFalse(status.Shards[0].Paused)
+	test.S(t).ExpectFalse(pauseInput.Get())
+
+	// 暂停所有的shards和输入
+	adminRequest(t, server, http.MethodPost, "/pause")
+	test.S(t).ExpectTrue(pauseInput.Get())
+	for _, applier := range appliers {
+		test.S(t).ExpectTrue(applier.paused.Get())
+	}
+	adminRequest(t, server, http.MethodPost, "/resume")
+	test.S(t).ExpectFalse(pauseInput.Get())
+	for _, applier := range appliers {
+		test.S(t).ExpectFalse(applier.paused.Get())
+	}
+
+	// 修改batch size
+	code, status = adminRequest(t, server, http.MethodPost, "/batch-size?size=50&shard=3")
+	test.S(t).ExpectEquals(code, http.StatusOK)
+	test.S(t).ExpectEquals(status.Shards[3].BatchInsertSize, int64(50))
+	test.S(t).ExpectEquals(status.Shards[0].BatchInsertSize, int64(100))
+
+	code, _ = adminRequest(t, server, http.MethodPost, "/batch-size?size=0")
+	test.S(t).ExpectEquals(code, http.StatusBadRequest)
+	code, _ = adminRequest(t, server, http.MethodPost, "/pause?shard=4")
+	test.S(t).ExpectEquals(code, http.StatusBadRequest)
+}
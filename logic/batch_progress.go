@@ -0,0 +1,205 @@
+package logic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/siddontang/go/ioutil2"
+	"github.com/wfxiang08/cyutils/utils/errors"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+)
+
+// BatchProgress 批量拷贝的进度, 保存在meta-dir中(和MasterInfo放在一起)
+// 1. LastRead: 最后读取的unique key
+// 2. AppliedKey/AppliedBatch: 每个shard已经提交的最后一批数据的unique key
+// 所有shards都提交了的key之前的数据是安全的, 断点续传时从这里开始
+// key通过json编码保存
+type BatchProgress struct {
+	sync.Mutex
+
+	LastRead     string   `toml:"last_read"`
+	ReadBatch    int64    `toml:"read_batch"`
+	AppliedKey   []string `toml:"applied_key"`
+	AppliedBatch []int64  `toml:"applied_batch"`
+
+	filePath     string
+	lastSaveTime time.Time
+}
+
+func LoadBatchProgress(dataDir string, sourceDBAlias string, tableName string, shardNum int) (*BatchProgress, error) {
+	p := &BatchProgress{
+		AppliedKey:   make([]string, shardNum),
+		AppliedBatch: make([]int64, shardNum),
+	}
+	if len(dataDir) == 0 {
+		return p, nil
+	}
+
+	p.filePath = path.Join(dataDir, fmt.Sprintf("%s_%s.progress", sourceDBAlias, tableName))
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	f, err := os.Open(p.filePath)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Trace(err)
+	} else if os.IsNotExist(errors.Cause(err)) {
+		return p, nil
+	}
+	defer f.Close()
+
+	if _, err = toml.DecodeReader(f, p); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(p.AppliedKey) != shardNum || len(p.AppliedBatch) != shardNum {
+		return nil, fmt.Errorf("Shard num mismatch in %s, expect: %d", p.filePath, shardNum)
+	}
+	return p, nil
+}
+
+// Reset 从头开始拷贝
+func (this *BatchProgress) Reset() {
+	this.Lock()
+	defer this.Unlock()
+
+	this.LastRead = ""
+	this.ReadBatch = 0
+	for i := range this.AppliedKey {
+		this.AppliedKey[i] = ""
+		this.AppliedBatch[i] = 0
+	}
+	this.save(true)
+}
+
+// ResumeKey 所有shards都已经提交的key, nil表示从头开始
+// 各个shard的进度被统一到这个key, 之后读取的batch重新编号
+func (this *BatchProgress) ResumeKey() ([]interface{}, error) {
+	this.Lock()
+	defer this.Unlock()
+
+	resume := 0
+	for i, batch := range this.AppliedBatch {
+		if batch == 0 {
+			return nil, nil
+		}
+		if batch < this.AppliedBatch[resume] {
+			resume = i
+		}
+	}
+
+	key, batch := this.AppliedKey[resume], this.AppliedBatch[resume]
+	for i := range this.AppliedBatch {
+		this.AppliedKey[i] = key
+		this.AppliedBatch[i] = batch
+	}
+	this.LastRead = key
+	this.ReadBatch = batch
+	return decodeBatchKey(key)
+}
+
+// Read 读取了一批数据, 返回batch的编号, 以及编码之后的key
+func (this *BatchProgress) Read(key []interface{}) (int64, string, error) {
+	encoded, err := encodeBatchKey(key)
+	if err != nil {
+		return 0, "", err
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	this.ReadBatch++
+	this.LastRead = encoded
+	this.save(false)
+	return this.ReadBatch, encoded, nil
+}
+
+// Applied shard提交了batch之前的所有数据
+func (this *BatchProgress) Applied(shard int, batch int64, key string) {
+	this.Lock()
+	defer this.Unlock()
+
+	if batch > this.AppliedBatch[shard] {
+		this.AppliedBatch[shard] = batch
+		this.AppliedKey[shard] = key
+	}
+	this.save(false)
+}
+
+func (this *BatchProgress) Close() error {
+	this.Lock()
+	defer this.Unlock()
+	return this.save(true)
+}
+
+func (this *BatchProgress) save(force bool) error {
+	if len(this.filePath) == 0 {
+		return nil
+	}
+
+	// 2s保存一次数据
+	n := time.Now()
+	if !force && n.Sub(this.lastSaveTime) < time.Second*2 {
+		return nil
+	}
+	this.lastSaveTime = n
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(this); err != nil {
+		return errors.Trace(err)
+	}
+
+	err := ioutil2.WriteFileAtomic(this.filePath, buf.Bytes(), 0644)
+	if err != nil {
+		log.Errorf("save batch progress to file %s err %v", this.filePath, err)
+	}
+	return errors.Trace(err)
+}
+
+// encodeBatchKey []byte转换成为string, 避免被json编码为base64
+func encodeBatchKey(key []interface{}) (string, error) {
+	values := make([]interface{}, len(key))
+	for i, value := range key {
+		if data, ok := value.([]byte); ok {
+			values[i] = string(data)
+		} else {
+			values[i] = value
+		}
+	}
+	data, err := json.Marshal(values)
+	return string(data), err
+}
+
+// decodeBatchKey 整数解码为int64/uint64(默认的float64会丢失精度; 字符串和整数列比较时MySQL按照double比较, 同样会丢失精度)
+// 其他的数字(例如: decimal)保留原始的文本
+func decodeBatchKey(encoded string) ([]interface{}, error) {
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+	var key []interface{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(encoded)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&key); err != nil {
+		return nil, err
+	}
+	for i, value := range key {
+		number, ok := value.(json.Number)
+		if !ok {
+			continue
+		}
+		if v, err := strconv.ParseInt(number.String(), 10, 64); err == nil {
+			key[i] = v
+		} else if v, err := strconv.ParseUint(number.String(), 10, 64); err == nil {
+			key[i] = v
+		} else {
+			key[i] = number.String()
+		}
+	}
+	return key, nil
+}
@@ -0,0 +1,59 @@
+package logic
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+)
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestBatchProgress$"
+func TestBatchProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batch_progress")
+	test.S(t).ExpectNil(err)
+	defer os.RemoveAll(dir)
+
+	progress, err := LoadBatchProgress(dir, "final", "user_recording_like", 2)
+	test.S(t).ExpectNil(err)
+
+	batch1, key1, err := progress.Read([]interface{}{int64(6755399444017774), []byte("a")})
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(key1, `[6755399444017774,"a"]`)
+	batch2, key2, _ := progress.Read([]interface{}{int64(6755399444017775), []byte("b")})
+
+	progress.Applied(0, batch1, key1)
+	progress.Applied(1, batch1, key1)
+	progress.Applied(1, batch2, key2)
+	test.S(t).ExpectNil(progress.Close())
+
+	// 重启之后, 从所有shard都提交了的位置开始
+	progress, err = LoadBatchProgress(dir, "final", "user_recording_like", 2)
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(progress.LastRead, key2)
+	resumeKey, err := progress.ResumeKey()
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(resumeKey, []interface{}{int64(6755399444017774), "a"})
+	test.S(t).ExpectEquals(progress.AppliedBatch, []int64{batch1, batch1})
+
+	_, err = LoadBatchProgress(dir, "final", "user_recording_like", 3)
+	test.S(t).ExpectNotNil(err)
+
+	progress.Reset()
+	resumeKey, _ = progress.ResumeKey()
+	test.S(t).ExpectTrue(resumeKey == nil)
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestDecodeBatchKey$"
+func TestDecodeBatchKey(t *testing.T) {
+	// 超过2^53的整数不能丢失精度
+	encoded, err := encodeBatchKey([]interface{}{int64(9007199254740993), uint64(18446744073709551615), int64(-5), "12.50", []byte("b")})
+	test.S(t).ExpectNil(err)
+	key, err := decodeBatchKey(encoded)
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(key, []interface{}{int64(9007199254740993), uint64(18446744073709551615), int64(-5), "12.50", "b"})
+
+	key, err = decodeBatchKey(`[12.5, 1e3]`)
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(key, []interface{}{"12.5", "1e3"})
+}
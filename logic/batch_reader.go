@@ -0,0 +1,256 @@
+package logic
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/db-sharding/mysql"
+	"github.com/wfxiang08/db-sharding/sql"
+)
+
+// KeysetBatchReader 按照unique key(优先PRIMARY)分页读取整个table
+// where k1 > ? or (k1 = ? and k2 > ?) order by k1, k2 limit N
+// 不使用row constructor (k1, k2) > (?, ?), 老版本的MySQL不能用它来做range scan
+// 支持复合主键，以及string类型的主键; 读取的位置保存在lastValues中
+type KeysetBatchReader struct {
+	tableName  string
+	uniqueKey  *sql.UniqueKey
+	batchSize  int
+	lastValues []interface{} // 上一批数据最后一行的unique key, nil表示从头开始
+
+	sqlFirst string
+	sqlNext  string
+}
+
+// NewKeysetBatchReader db为源表所在的database, 也可以是一个事务(例如: 一致性快照)
+func NewKeysetBatchReader(db *gorm.DB, tableName string, batchSize int) (*KeysetBatchReader, error) {
+	var databaseName string
+	if err := db.CommonDB().QueryRow("select database()").Scan(&databaseName); err != nil {
+		return nil, err
+	}
+
+	uniqueKeys, err := mysql.GetUniqueKeys(db.CommonDB(), databaseName, tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	// 允许NULL的unique key不能用来分页
+	for _, uniqueKey := range uniqueKeys {
+		if !uniqueKey.HasNullable {
+			log.Printf("Batch read %s.%s by unique key: %s", databaseName, tableName, uniqueKey.String())
+			return NewKeysetBatchReaderWithKey(tableName, uniqueKey, batchSize), nil
+		}
+	}
+	return nil, fmt.Errorf("No non-nullable unique key found on %s.%s", databaseName, tableName)
+}
+
+func NewKeysetBatchReaderWithKey(tableName string, uniqueKey *sql.UniqueKey, batchSize int) *KeysetBatchReader {
+	result := &KeysetBatchReader{
+		tableName: tableName,
+		uniqueKey: uniqueKey,
+		batchSize: batchSize,
+	}
+	result.buildSQL()
+	return result
+}
+
+func (this *KeysetBatchReader) buildSQL() {
+	names := make([]string, this.uniqueKey.Len())
+	for i, name := range this.uniqueKey.Columns.Names() {
+		names[i] = sql.EscapeName(name)
+	}
+
+	keys := strings.Join(names, ", ")
+	where := keysetWhere(names, ">")
+
+	this.sqlFirst = fmt.Sprintf("select * from %s order by %s limit %d",
+		sql.EscapeName(this.tableName), keys, this.batchSize)
+	this.sqlNext = fmt.Sprintf("select * from %s where %s order by %s limit %d",
+		sql.EscapeName(this.tableName), where, keys, this.batchSize)
+}
+
+func (this *KeysetBatchReader) UniqueKey() *sql.UniqueKey {
+	return this.uniqueKey
+}
+
+// LastValues 最后读取的unique key, 可以用于断点续传
+func (this *KeysetBatchReader) LastValues() []interface{} {
+	return this.lastValues
+}
+
+// Seek 从给定的unique key之后开始读取
+func (this *KeysetBatchReader) Seek(lastValues []interface{}) error {
+	if lastValues == nil {
+		this.lastValues = nil
+		return nil
+	}
+	values, err := this.keyValues(lastValues)
+	if err != nil {
+		return err
+	}
+	this.lastValues = values
+	return nil
+}
+
+// query 当前这一批数据的SQL
+func (this *KeysetBatchReader) query() (string, []interface{}) {
+	if this.lastValues == nil {
+		return this.sqlFirst, nil
+	}
+	return this.sqlNext, keysetArgs(this.lastValues)
+}
+
+// keysetWhere 展开row constructor, names为escape之后的column
+// (k1, k2, k3) > (v1, v2, v3)展开为: k1 > v1 or (k1 = v1 and k2 > v2) or (k1 = v1 and k2 = v2 and k3 > v3)
+// op为<=时, 最后一个column使用<=, 前面的column使用<
+func keysetWhere(names []string, op string) string {
+	strictOp := strings.TrimSuffix(op, "=")
+	conditions := make([]string, len(names))
+	for i := range names {
+		terms := make([]string, 0, i+1)
+		for j := 0; j < i; j++ {
+			terms = append(terms, fmt.Sprintf("%s = ?", names[j]))
+		}
+		if i == len(names)-1 {
+			terms = append(terms, fmt.Sprintf("%s %s ?", names[i], op))
+		} else {
+			terms = append(terms, fmt.Sprintf("%s %s ?", names[i], strictOp))
+		}
+		conditions[i] = strings.Join(terms, " and ")
+		if i > 0 {
+			conditions[i] = "(" + conditions[i] + ")"
+		}
+	}
+	return strings.Join(conditions, " or ")
+}
+
+// keysetArgs keysetWhere的参数, 第i个column对应i+1个参数
+func keysetArgs(values []interface{}) []interface{} {
+	var args []interface{}
+	for i := range values {
+		args = append(args, values[:i+1]...)
+	}
+	return args
+}
+
+// keyValues 按照column的类型转换unique key的值
+// interpolateParams=true时, 读取到的整数为[]byte, 作为参数时变成_binary'123'字符串比较(bigint会丢失精度), 字符串则变成binary比较(和collation的顺序不一致)
+func (this *KeysetBatchReader) keyValues(values []interface{}) ([]interface{}, error) {
+	return keyValues(this.tableName, this.uniqueKey, values)
+}
+
+func keyValues(tableName string, uniqueKey *sql.UniqueKey, values []interface{}) ([]interface{}, error) {
+	if len(values) != uniqueKey.Len() {
+		return nil, fmt.Errorf("Unique key %s of %s has %d columns, got %d values", uniqueKey.String(),
+			tableName, uniqueKey.Len(), len(values))
+	}
+	result := make([]interface{}, len(values))
+	for i, column := range uniqueKey.Columns.Columns() {
+		value, err := keyValue(&column, values[i])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value of unique key column %s.%s: %v", tableName, column.Name, err)
+		}
+		result[i] = value
+	}
+	return result, nil
+}
+
+func keyValue(column *sql.Column, value interface{}) (interface{}, error) {
+	var text string
+	switch v := value.(type) {
+	case []byte:
+		text = string(v)
+	case string:
+		text = v
+	default:
+		return value, nil
+	}
+
+	switch column.DataType {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint":
+		if column.IsUnsigned {
+			return strconv.ParseUint(text, 10, 64)
+		}
+		return strconv.ParseInt(text, 10, 64)
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob":
+		return []byte(text), nil
+	case "":
+		// 类型未知
+		return value, nil
+	}
+	return text, nil
+}
+
+// NextRows 读取下一批数据, 每一行的数据按照table中column的顺序排列(和binlog的row image一致)
+func (this *KeysetBatchReader) NextRows(db *gorm.DB) (*sql.ColumnList, [][]interface{}, error) {
+	query, args := this.query()
+	rows, err := db.CommonDB().Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+	columns := sql.NewColumnList(names)
+
+	var result [][]interface{}
+	for rows.Next() {
+		values := sql.NewColumnValues(len(names))
+		if err := rows.Scan(values.ValuesPointers...); err != nil {
+			return nil, nil, err
+		}
+		result = append(result, values.AbstractValues())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(result) > 0 {
+		lastRow := result[len(result)-1]
+		lastValues := make([]interface{}, this.uniqueKey.Len())
+		for i, name := range this.uniqueKey.Columns.Names() {
+			ordinal, ok := columns.Ordinals[name]
+			if !ok {
+				return nil, nil, fmt.Errorf("Unique key column %s not found in %s", name, this.tableName)
+			}
+			lastValues[i] = lastRow[ordinal]
+		}
+		if this.lastValues, err = this.keyValues(lastValues); err != nil {
+			return nil, nil, err
+		}
+	}
+	return columns, result, nil
+}
+
+// NextModels 读取下一批数据到models中, models为*[]*Model, 通过gorm的column映射读取unique key
+func (this *KeysetBatchReader) NextModels(db *gorm.DB, models interface{}) (*gorm.DB, int) {
+	query, args := this.query()
+	dbInfo := db.Raw(query, args...).Scan(models)
+	if dbInfo.Error != nil {
+		return dbInfo, 0
+	}
+
+	items := reflect.Indirect(reflect.ValueOf(models))
+	count := items.Len()
+	if count > 0 {
+		scope := db.NewScope(items.Index(count - 1).Interface())
+		lastValues := make([]interface{}, this.uniqueKey.Len())
+		for i, name := range this.uniqueKey.Columns.Names() {
+			field, ok := scope.FieldByName(name)
+			if !ok {
+				dbInfo.AddError(fmt.Errorf("Unique key column %s not found in model %s", name, scope.GetModelStruct().ModelType.Name()))
+				return dbInfo, 0
+			}
+			lastValues[i] = field.Field.Interface()
+		}
+		this.lastValues = lastValues
+	}
+	return dbInfo, count
+}
@@ -0,0 +1,64 @@
+package logic
+
+import (
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+	"github.com/wfxiang08/db-sharding/sql"
+)
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestKeysetBatchReaderSQL$"
+func TestKeysetBatchReaderSQL(t *testing.T) {
+	reader := NewKeysetBatchReaderWithKey("user_recording_like", &sql.UniqueKey{
+		Name:    "PRIMARY",
+		Columns: *sql.ParseColumnList("user_id,recording_id"),
+	}, 2000)
+
+	query, args := reader.query()
+	test.S(t).ExpectEquals(query, "select * from `user_recording_like` order by `user_id`, `recording_id` limit 2000")
+	test.S(t).ExpectEquals(len(args), 0)
+
+	test.S(t).ExpectNil(reader.Seek([]interface{}{int64(1), "a"}))
+	query, args = reader.query()
+	test.S(t).ExpectEquals(query, "select * from `user_recording_like` where `user_id` > ? or (`user_id` = ? and `recording_id` > ?) "+
+		"order by `user_id`, `recording_id` limit 2000")
+	test.S(t).ExpectEquals(args, []interface{}{int64(1), int64(1), "a"})
+	test.S(t).ExpectNotNil(reader.Seek([]interface{}{int64(1)}))
+
+	reader = NewKeysetBatchReaderWithKey("user_recording_like", &sql.UniqueKey{
+		Name:    "PRIMARY",
+		Columns: *sql.ParseColumnList("id"),
+	}, 100)
+	reader.Seek([]interface{}{int64(100)})
+	query, _ = reader.query()
+	test.S(t).ExpectEquals(query, "select * from `user_recording_like` where `id` > ? order by `id` limit 100")
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestKeysetBatchReaderKeyValues$"
+func TestKeysetBatchReaderKeyValues(t *testing.T) {
+	columns := sql.ParseColumnList("shard_id,user_id,name,hash")
+	columns.SetDataType("shard_id", "int")
+	columns.SetDataType("user_id", "bigint")
+	columns.SetUnsigned("user_id")
+	columns.SetDataType("name", "varchar")
+	columns.SetDataType("hash", "varbinary")
+	reader := NewKeysetBatchReaderWithKey("t", &sql.UniqueKey{Name: "PRIMARY", Columns: *columns}, 100)
+
+	// interpolateParams=true时读取到的都是[]byte
+	test.S(t).ExpectNil(reader.Seek([]interface{}{[]byte("-3"), []byte("18446744073709551615"), []byte("abc"), []byte{0xff}}))
+	test.S(t).ExpectEquals(reader.LastValues(), []interface{}{int64(-3), uint64(18446744073709551615), "abc", []byte{0xff}})
+	query, args := reader.query()
+	test.S(t).ExpectEquals(query, "select * from `t` where `shard_id` > ? or (`shard_id` = ? and `user_id` > ?) "+
+		"or (`shard_id` = ? and `user_id` = ? and `name` > ?) "+
+		"or (`shard_id` = ? and `user_id` = ? and `name` = ? and `hash` > ?) "+
+		"order by `shard_id`, `user_id`, `name`, `hash` limit 100")
+	test.S(t).ExpectEquals(len(args), 10)
+	test.S(t).ExpectEquals(args[9], []byte{0xff})
+
+	test.S(t).ExpectEquals(keysetWhere([]string{"`a`", "`b`"}, "<="), "`a` < ? or (`a` = ? and `b` <= ?)")
+
+	test.S(t).ExpectNotNil(reader.Seek([]interface{}{"a", "1", "abc", "x"}))
+	test.S(t).ExpectNil(reader.Seek(nil))
+	query, _ = reader.query()
+	test.S(t).ExpectEquals(query, "select * from `t` order by `shard_id`, `user_id`, `name`, `hash` limit 100")
+}
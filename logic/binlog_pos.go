@@ -6,6 +6,7 @@ import (
 	"github.com/outbrain/golib/sqlutils"
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
 	"github.com/wfxiang08/db-sharding/conf"
+	"strings"
 )
 
 func PrintBinlogPos(dbAliases []string, dbConfig *conf.DatabaseConfig) {
@@ -26,6 +27,9 @@ func readCurrentBinlogCoordinates(db *sql.DB, dbAliase string, dbConfig *conf.Da
 	sqlutils.QueryRowsMap(db, query, func(m sqlutils.RowMap) error {
 		_, hostname, _ := dbConfig.GetDB(dbAliase)
 		log.Printf(color.MagentaString("Binlog Info: %s ==> %s:%d"), hostname, m.GetString("File"), m.GetInt64("Position"))
+		if gtidSet := strings.Replace(m.GetString("Executed_Gtid_Set"), "\n", "", -1); len(gtidSet) > 0 {
+			log.Printf(color.MagentaString("GTID Info: %s ==> %s"), hostname, gtidSet)
+		}
 		return nil
 	})
 }
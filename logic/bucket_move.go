@@ -0,0 +1,117 @@
+package logic
+
+import (
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/db-sharding/conf"
+	"github.com/wfxiang08/db-sharding/models"
+)
+
+// bucket迁移的步骤:
+// 1. 生成新的bucket map(cmds/bucket_map), 源shard上的部分buckets指向新的shard
+// 2. 以源shard为源表, 按照新的bucket map拷贝并订阅binlog(ReshardCopyAndStream), 只拷贝离开源shard的数据
+// 3. 追上binlog之后, 业务切换到新的bucket map
+// 4. PurgeMovedRows: 删除源shard上已经迁移走的数据
+
+// SetupBucketMapShards bucket_map: 按照ShardAliasFormat解析bucket map中的shard alias, 并按照bucket map设置TotalShardNum
+// 迁移到新的shard(例如: shard32)时, appliers需要包含新的shard
+func SetupBucketMapShards(dbConfig *conf.DatabaseConfig) {
+	sharding := &dbConfig.Sharding
+	if sharding.Strategy != models.ShardStrategyBucketMap || sharding.BucketMap == nil {
+		return
+	}
+	sharding.ShardAliasFormat = ShardAliasFormat
+	shardNum, err := dbConfig.CheckBucketMap(sharding.BucketMap, ShardAliasFormat)
+	if err != nil {
+		log.PanicErrorf(err, "Invalid bucket map")
+	}
+	if shardNum != TotalShardNum {
+		log.Printf(color.MagentaString("Shards of bucket map")+": %d, default: %d", shardNum, TotalShardNum)
+		TotalShardNum = shardNum
+	}
+}
+
+// MovedBuckets 从源shard迁出的buckets
+func MovedBuckets(current *conf.BucketMap, target *conf.BucketMap, fromAlias string) []*conf.BucketMove {
+	var moves []*conf.BucketMove
+	for _, move := range current.Diff(target) {
+		if move.From == fromAlias {
+			moves = append(moves, move)
+		}
+	}
+	return moves
+}
+
+// PurgeMovedRows 按照chunk读取shard上的数据, 删除按照当前的路由(新的bucket map)已经不属于这个shard的数据
+// verifier的源表为这个shard; dryRun时只打印SQL
+func PurgeMovedRows(verifier *Verifier, shard int, stopInput *atomic2.Bool, pauseInput *atomic2.Bool,
+	dryRun bool) (int, error) {
+
+	start := time.Now()
+	purged := 0
+	chunks := 0
+	var lower []interface{}
+	for !stopInput.Get() {
+		verifier.throttle(stopInput, pauseInput)
+
+		rows, upper, err := verifier.readChunk(lower)
+		if err != nil {
+			return purged, err
+		}
+
+		var sqls []*models.ShardingSQL
+		for _, row := range rows {
+			if verifier.table.GetShardingIndex4Key(row[verifier.shardIndex]) != shard {
+				// 和chunk的上下限一样按照column的类型转换, 否则bigint按照double比较, 可能删除相邻的行
+				key, err := verifier.keyValues(verifier.rowKey(row))
+				if err != nil {
+					return purged, err
+				}
+				sqls = append(sqls, verifier.table.DeleteByKey(key))
+			}
+		}
+		if err := verifier.purge(sqls, dryRun); err != nil {
+			return purged, err
+		}
+		purged += len(sqls)
+		chunks++
+
+		if chunks%100 == 0 || upper == nil {
+			log.Printf(color.GreenString("Purge progress")+": chunks: %d, purged: %d, elapsed: %ds", chunks, purged,
+				int(time.Now().Sub(start).Seconds()))
+		}
+		if upper == nil {
+			break
+		}
+		lower = upper
+	}
+	return purged, nil
+}
+
+// purge 一个chunk的删除在一个事务中执行
+func (this *Verifier) purge(sqls []*models.ShardingSQL, dryRun bool) error {
+	if len(sqls) == 0 {
+		return nil
+	}
+	if dryRun {
+		for _, shardingSQL := range sqls {
+			log.Printf(color.YellowString("Purge")+": %s", shardingSQL.String())
+		}
+		return nil
+	}
+
+	tx, err := this.sourceDBs[0].Begin()
+	if err != nil {
+		return err
+	}
+	for _, shardingSQL := range sqls {
+		if _, err := tx.Exec(shardingSQL.SQL, shardingSQL.Args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,127 @@
+package logic
+
+import (
+	gosql "database/sql"
+	"database/sql/driver"
+	"io"
+	"regexp"
+	"strconv"
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	"github.com/wfxiang08/db-sharding/models"
+	"github.com/wfxiang08/db-sharding/sql"
+)
+
+// purgeDriver 内存中的表: `id` bigint primary key, `name`, 只支持readChunk和purge用到的SQL
+// 和MySQL一样, bigint和字符串参数(interpolateParams=true时的[]byte)按照double比较
+type purgeDriver struct {
+	ids     []int64 // 按照id排序
+	deleted []driver.Value
+}
+
+var purgeTable = &purgeDriver{}
+
+func init() {
+	gosql.Register("purge_test", purgeTable)
+}
+
+func (this *purgeDriver) Open(name string) (driver.Conn, error) { return this, nil }
+func (this *purgeDriver) Prepare(query string) (driver.Stmt, error) {
+	return &purgeStmt{driver: this, query: query}, nil
+}
+func (this *purgeDriver) Close() error              { return nil }
+func (this *purgeDriver) Begin() (driver.Tx, error) { return this, nil }
+func (this *purgeDriver) Commit() error             { return nil }
+func (this *purgeDriver) Rollback() error           { return nil }
+
+type purgeStmt struct {
+	driver *purgeDriver
+	query  string
+}
+
+var purgeLimit = regexp.MustCompile(`limit (\d+)$`)
+
+func (this *purgeStmt) Close() error  { return nil }
+func (this *purgeStmt) NumInput() int { return -1 }
+
+func (this *purgeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	this.driver.deleted = append(this.driver.deleted, args[0])
+	return driver.RowsAffected(1), nil
+}
+
+func (this *purgeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	limit, _ := strconv.Atoi(purgeLimit.FindStringSubmatch(this.query)[1])
+	rows := &purgeRows{}
+	for _, id := range this.driver.ids {
+		if len(rows.values) < limit && (len(args) == 0 || mysqlGreater(id, args[0])) {
+			rows.values = append(rows.values, []driver.Value{[]byte(strconv.FormatInt(id, 10)), []byte("a")})
+		}
+	}
+	return rows, nil
+}
+
+func mysqlGreater(id int64, arg driver.Value) bool {
+	switch v := arg.(type) {
+	case int64:
+		return id > v
+	case []byte:
+		f, _ := strconv.ParseFloat(string(v), 64)
+		return float64(id) > f
+	}
+	return false
+}
+
+type purgeRows struct {
+	values [][]driver.Value
+}
+
+func (this *purgeRows) Columns() []string { return []string{"id", "name"} }
+func (this *purgeRows) Close() error      { return nil }
+func (this *purgeRows) Next(dest []driver.Value) error {
+	if len(this.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, this.values[0])
+	this.values = this.values[1:]
+	return nil
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestPurgeMovedRows$"
+func TestPurgeMovedRows(t *testing.T) {
+	builder, err := models.NewStructModelBuilder("t", &tombstoneModel{}, 4)
+	test.S(t).ExpectNil(err)
+	db, err := gosql.Open("purge_test", "")
+	test.S(t).ExpectNil(err)
+
+	columns := sql.ParseColumnList("id")
+	columns.SetDataType("id", "bigint")
+	verifier := &Verifier{
+		sourceDBs:   []*gosql.DB{db},
+		sourceTable: "t",
+		builder:     builder,
+		table:       builder,
+		chunkSize:   2,
+		columns:     []string{"id", "name"},
+		primaryKey:  []string{"id"},
+		uniqueKey:   &sql.UniqueKey{Name: "PRIMARY", Columns: *columns},
+		keyIndexes:  []int{0},
+		shardIndex:  0,
+	}
+
+	// 2^53之后的bigint在double中不能精确表示: 9007199254740993作为_binary参数时和9007199254740992相等
+	purgeTable.ids = []int64{9007199254740991, 9007199254740992, 9007199254740993, 9007199254740994, 9007199254740995}
+	shard := (builder.GetShardingIndex4Key(int64(9007199254740993)) + 1) % 4
+	var expected []driver.Value
+	for _, id := range purgeTable.ids {
+		if builder.GetShardingIndex4Key(id) != shard {
+			expected = append(expected, id)
+		}
+	}
+
+	purged, err := PurgeMovedRows(verifier, shard, &atomic2.Bool{}, &atomic2.Bool{}, false)
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(purged, len(expected))
+	test.S(t).ExpectEquals(purgeTable.deleted, expected)
+}
@@ -0,0 +1,78 @@
+package logic
+
+import (
+	"sync"
+
+	"github.com/wfxiang08/db-sharding/mysql"
+)
+
+// CheckpointTracker 跟踪已经读取但是还没有提交到shards的binlog事务
+// 只有一个事务以及它之前的所有事务都被各个shard提交之后，它的位置才可以被保存(low watermark)
+// 这样kill -9之后重启，不会跳过任何还没有apply的变化
+type CheckpointTracker struct {
+	mutex     sync.Mutex
+	pending   []*TxCheckpoint // 按照binlog的顺序排列
+	watermark *mysql.BinlogCoordinates
+}
+
+// TxCheckpoint 一个binlog事务, 等待涉及到的shards的确认
+type TxCheckpoint struct {
+	tracker     *CheckpointTracker
+	Coordinates mysql.BinlogCoordinates // 事务结束(XID)的位置
+	remaining   int                     // 还没有确认的shard数
+}
+
+func NewCheckpointTracker() *CheckpointTracker {
+	return &CheckpointTracker{}
+}
+
+// Track 记录一个读取完毕的事务, shardNum为涉及到的shard数
+func (this *CheckpointTracker) Track(coordinates mysql.BinlogCoordinates, shardNum int) *TxCheckpoint {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	checkpoint := &TxCheckpoint{
+		tracker:     this,
+		Coordinates: coordinates,
+		remaining:   shardNum,
+	}
+	this.pending = append(this.pending, checkpoint)
+	this.advance()
+	return checkpoint
+}
+
+// Ack 某个shard已经提交了事务
+func (this *TxCheckpoint) Ack() {
+	this.tracker.mutex.Lock()
+	defer this.tracker.mutex.Unlock()
+
+	this.remaining--
+	this.tracker.advance()
+}
+
+func (this *CheckpointTracker) advance() {
+	for len(this.pending) > 0 && this.pending[0].remaining <= 0 {
+		coordinates := this.pending[0].Coordinates
+		this.watermark = &coordinates
+		this.pending = this.pending[1:]
+	}
+}
+
+// Watermark returns the coordinates before which all transactions have been applied, or nil if none
+func (this *CheckpointTracker) Watermark() *mysql.BinlogCoordinates {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.watermark == nil {
+		return nil
+	}
+	watermark := *this.watermark
+	return &watermark
+}
+
+// PendingCount 还没有完全提交的事务数
+func (this *CheckpointTracker) PendingCount() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return len(this.pending)
+}
@@ -0,0 +1,243 @@
+package logic
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"sync"
+
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+)
+
+// ExternalSorter 按照shard缓存批量读取的数据, 内存中的数据超过runSize时排序之后写入磁盘(sorted run)
+// 遍历时对各个run做k-way merge, 内存占用和数据总量无关: shardNum * runSize
+type ExternalSorter struct {
+	dir       string
+	runSize   int
+	modelType reflect.Type // Model的类型(非指针)
+	less      func(a, b interface{}) bool
+	shards    []*sortedRuns
+}
+
+type sortedRuns struct {
+	mutex  sync.Mutex
+	buffer []interface{} // 还没有写入磁盘的数据
+	runs   []string      // 磁盘上的sorted runs
+	count  int
+}
+
+// NewExternalSorter model为*Model, 通过gob编码写入磁盘, 只有导出的fields会被保存
+func NewExternalSorter(dir string, shardNum int, runSize int, model interface{}, less func(a, b interface{}) bool) (*ExternalSorter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if runSize <= 0 {
+		return nil, fmt.Errorf("NewExternalSorter: invalid run size: %d", runSize)
+	}
+
+	modelType := reflect.TypeOf(model)
+	if modelType.Kind() == reflect.Ptr {
+		modelType = modelType.Elem()
+	}
+
+	result := &ExternalSorter{
+		dir:       dir,
+		runSize:   runSize,
+		modelType: modelType,
+		less:      less,
+		shards:    make([]*sortedRuns, shardNum),
+	}
+	for i := 0; i < shardNum; i++ {
+		result.shards[i] = &sortedRuns{}
+	}
+	return result, nil
+}
+
+// Add 添加一条数据, 内存中的数据满了之后写入磁盘
+func (this *ExternalSorter) Add(shard int, item interface{}) error {
+	runs := this.shards[shard]
+	runs.mutex.Lock()
+	defer runs.mutex.Unlock()
+
+	runs.buffer = append(runs.buffer, item)
+	runs.count++
+	if len(runs.buffer) >= this.runSize {
+		return this.spill(shard, runs)
+	}
+	return nil
+}
+
+func (this *ExternalSorter) sortBuffer(runs *sortedRuns) {
+	sort.SliceStable(runs.buffer, func(i, j int) bool {
+		return this.less(runs.buffer[i], runs.buffer[j])
+	})
+}
+
+// spill 将内存中的数据排序之后写入一个新的run
+func (this *ExternalSorter) spill(shard int, runs *sortedRuns) error {
+	this.sortBuffer(runs)
+
+	fileName := path.Join(this.dir, fmt.Sprintf("shard%02d_run%04d.gob", shard, len(runs.runs)))
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriterSize(f, 1024*1024)
+	encoder := gob.NewEncoder(w)
+	for _, item := range runs.buffer {
+		if err := encoder.Encode(item); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	log.Printf("Shard %d spilled run: %s, size: %d", shard, fileName, len(runs.buffer))
+	runs.runs = append(runs.runs, fileName)
+	runs.buffer = make([]interface{}, 0, this.runSize)
+	return nil
+}
+
+func (this *ExternalSorter) Len(shard int) int {
+	runs := this.shards[shard]
+	runs.mutex.Lock()
+	defer runs.mutex.Unlock()
+	return runs.count
+}
+
+// Iterate 按照less的顺序遍历shard内的所有数据
+func (this *ExternalSorter) Iterate(shard int, onItem func(item interface{}) error) error {
+	runs := this.shards[shard]
+	runs.mutex.Lock()
+	defer runs.mutex.Unlock()
+
+	this.sortBuffer(runs)
+
+	merger := &runMerger{less: this.less}
+	defer merger.close()
+
+	for _, fileName := range runs.runs {
+		f, err := os.Open(fileName)
+		if err != nil {
+			return err
+		}
+		source := &runSource{file: f, decoder: gob.NewDecoder(bufio.NewReaderSize(f, 1024*1024)), modelType: this.modelType}
+		if err := merger.add(source); err != nil {
+			return err
+		}
+	}
+	if err := merger.add(&runSource{buffer: runs.buffer}); err != nil {
+		return err
+	}
+
+	for merger.Len() > 0 {
+		source := merger.sources[0]
+		if err := onItem(source.current); err != nil {
+			return err
+		}
+		if hasNext, err := source.next(); err != nil {
+			return err
+		} else if hasNext {
+			heap.Fix(merger, 0)
+		} else {
+			heap.Pop(merger)
+		}
+	}
+	return nil
+}
+
+// Clear 删除磁盘上的runs, 释放内存
+func (this *ExternalSorter) Clear(shard int) {
+	runs := this.shards[shard]
+	runs.mutex.Lock()
+	defer runs.mutex.Unlock()
+
+	for _, fileName := range runs.runs {
+		if err := os.Remove(fileName); err != nil {
+			log.ErrorErrorf(err, "Remove sorted run failed: %s", fileName)
+		}
+	}
+	runs.runs = nil
+	runs.buffer = nil
+	runs.count = 0
+}
+
+// runSource 一个sorted run(磁盘文件或者内存)
+type runSource struct {
+	file      *os.File
+	decoder   *gob.Decoder
+	modelType reflect.Type
+	buffer    []interface{}
+	current   interface{}
+}
+
+func (this *runSource) next() (bool, error) {
+	if this.decoder == nil {
+		if len(this.buffer) == 0 {
+			return false, nil
+		}
+		this.current = this.buffer[0]
+		this.buffer = this.buffer[1:]
+		return true, nil
+	}
+
+	item := reflect.New(this.modelType).Interface()
+	if err := this.decoder.Decode(item); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	this.current = item
+	return true, nil
+}
+
+// runMerger k-way merge: 以各个source的当前数据构建最小堆
+type runMerger struct {
+	less    func(a, b interface{}) bool
+	sources []*runSource
+	files   []*os.File
+}
+
+func (this *runMerger) add(source *runSource) error {
+	if source.file != nil {
+		this.files = append(this.files, source.file)
+	}
+	if hasNext, err := source.next(); err != nil {
+		return err
+	} else if hasNext {
+		heap.Push(this, source)
+	}
+	return nil
+}
+
+func (this *runMerger) close() {
+	for _, f := range this.files {
+		f.Close()
+	}
+}
+
+func (this *runMerger) Len() int { return len(this.sources) }
+func (this *runMerger) Less(i, j int) bool {
+	return this.less(this.sources[i].current, this.sources[j].current)
+}
+func (this *runMerger) Swap(i, j int) {
+	this.sources[i], this.sources[j] = this.sources[j], this.sources[i]
+}
+func (this *runMerger) Push(x interface{}) {
+	this.sources = append(this.sources, x.(*runSource))
+}
+func (this *runMerger) Pop() interface{} {
+	n := len(this.sources)
+	source := this.sources[n-1]
+	this.sources = this.sources[:n-1]
+	return source
+}
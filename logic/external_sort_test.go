@@ -0,0 +1,60 @@
+package logic
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+)
+
+type sortItem struct {
+	UserId      int64
+	RecordingId int64
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestExternalSorter$"
+func TestExternalSorter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "external_sort")
+	test.S(t).ExpectNil(err)
+	defer os.RemoveAll(dir)
+
+	sorter, err := NewExternalSorter(dir, 2, 100, &sortItem{}, func(a, b interface{}) bool {
+		x, y := a.(*sortItem), b.(*sortItem)
+		return x.UserId < y.UserId || (x.UserId == y.UserId && x.RecordingId < y.RecordingId)
+	})
+	test.S(t).ExpectNil(err)
+
+	for i := 0; i < 1050; i++ {
+		test.S(t).ExpectNil(sorter.Add(0, &sortItem{UserId: rand.Int63n(50), RecordingId: int64(i)}))
+	}
+	test.S(t).ExpectNil(sorter.Add(1, &sortItem{UserId: 1}))
+	test.S(t).ExpectEquals(sorter.Len(0), 1050)
+	test.S(t).ExpectEquals(sorter.Len(1), 1)
+
+	// 10个run在磁盘上, 50条数据在内存中
+	files, _ := ioutil.ReadDir(dir)
+	test.S(t).ExpectEquals(len(files), 10)
+
+	var last *sortItem
+	count := 0
+	err = sorter.Iterate(0, func(item interface{}) error {
+		current := item.(*sortItem)
+		if last != nil {
+			test.S(t).ExpectTrue(last.UserId < current.UserId ||
+				(last.UserId == current.UserId && last.RecordingId < current.RecordingId))
+		}
+		last = current
+		count++
+		return nil
+	})
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(count, 1050)
+
+	sorter.Clear(0)
+	test.S(t).ExpectEquals(sorter.Len(0), 0)
+	_, err = os.Stat(path.Join(dir, "shard00_run0000.gob"))
+	test.S(t).ExpectTrue(os.IsNotExist(err))
+}
@@ -11,22 +11,59 @@ import (
 	"github.com/wfxiang08/db-sharding/mysql"
 	"github.com/wfxiang08/db-sharding/sql"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	LagTableName        = "sharding_heartbeat"
-	MaxLagInMillseconds = time.Millisecond * 1500
+	LagTableName = "sharding_heartbeat"
 )
 
+var (
+	throttlersMutex sync.Mutex
+	throttlers      []*ThrottlerNode // 所有的throttlers, 用于导出主从延迟
+)
+
+var (
+	throttleMutex   sync.Mutex
+	throttleReasons = make(map[*atomic2.Bool]map[string]bool) // pauseInput --> 暂停的原因
+)
+
+// setThrottled 多个throttlers(主从延迟, shard机器的负载)共享一台机器的pauseInput, 所有的原因都解除之后才恢复
+func setThrottled(pauseInput *atomic2.Bool, reason string, throttled bool) {
+	throttleMutex.Lock()
+	defer throttleMutex.Unlock()
+	reasons, ok := throttleReasons[pauseInput]
+	if !ok {
+		reasons = make(map[string]bool)
+		throttleReasons[pauseInput] = reasons
+	}
+	if throttled {
+		reasons[reason] = true
+	} else {
+		delete(reasons, reason)
+	}
+	pauseInput.Set(len(reasons) > 0)
+}
+
+// ThrottlerNodes 已经启动的throttlers
+func ThrottlerNodes() []*ThrottlerNode {
+	throttlersMutex.Lock()
+	defer throttlersMutex.Unlock()
+	return append([]*ThrottlerNode{}, throttlers...)
+}
+
+// ThrottlerNode 检查一个master的所有replicas的延迟, 延迟过大时暂停这台机器上的shards
 type ThrottlerNode struct {
-	master *mysql.ConnectionConfig
-	slave  *mysql.ConnectionConfig
-	DbName string
-	Lag    time.Duration
+	master   *mysql.ConnectionConfig
+	replicas []*mysql.ConnectionConfig
+	DbName   string
+	config   *conf.ThrottleConfig
+	lag      atomic2.Int64 // 所有replicas中最大的延迟
+	paused   bool
 
-	masterDB *db_sql.DB
-	slaveDB  *db_sql.DB
+	masterDB   *db_sql.DB
+	replicaDBs []*db_sql.DB
 
 	pauseInput *atomic2.Bool
 }
@@ -44,29 +81,54 @@ func StartThrottleCheck(dbConfig *conf.DatabaseConfig, masterAlias string, host2
 		}
 
 		master := dbConfig.AliasToConnectionConfig(masterAlias)
-		slave := master.Duplicate()
-
-		slave.Key.Hostname = dbConfig.Master2Slave[master.Key.Hostname]
+		slaves := dbConfig.Master2Slaves[master.Key.Hostname]
+		if len(slaves) == 0 {
+			log.Panicf("No slave found in slave_master_mapping for master: %s", master.Key.Hostname)
+		}
 
 		result := &ThrottlerNode{
-			Lag:        0,
 			master:     master,
-			slave:      slave,
 			DbName:     dbName,
+			config:     &dbConfig.Throttle,
 			pauseInput: pauseInput,
 		}
+		for _, slave := range slaves {
+			replica := master.Duplicate()
+			replica.Key.Hostname = slave
+			result.replicas = append(result.replicas, replica)
+		}
 		result.init()
-		// 更新db
-		go result.updateHeartBeat()
+		if result.useHeartbeat() {
+			// 更新db
+			go result.updateHeartBeat()
+		}
 		// 检查slave的变化
 		go result.collectControlReplicasLag()
 
 		results = append(results, result)
 	}
+
+	throttlersMutex.Lock()
+	throttlers = append(throttlers, results...)
+	throttlersMutex.Unlock()
 	return results
 }
 
+// Lag 所有replicas中最大的延迟
+func (this *ThrottlerNode) Lag() time.Duration {
+	return time.Duration(this.lag.Get())
+}
+
+func (this *ThrottlerNode) useHeartbeat() bool {
+	return this.config.LagSource != conf.LagSourceSlaveStatus
+}
+
 func (this *ThrottlerNode) init() {
+	if !this.useHeartbeat() {
+		// SHOW SLAVE STATUS不需要heartbeat表
+		return
+	}
+
 	// 获取master db
 	dbUri := this.master.GetDBUri(this.DbName)
 	db, _, err := sqlutils.GetDB(dbUri)
@@ -90,17 +152,19 @@ func (this *ThrottlerNode) init() {
 	}
 
 	// 获取slave db
-	dbUri = this.slave.GetDBUri(this.DbName)
-	db, _, err = sqlutils.GetDB(dbUri)
-	if err != nil {
-		log.PanicErrorf(err, "Get Master Db failed")
+	for _, replica := range this.replicas {
+		dbUri = replica.GetDBUri(this.DbName)
+		db, _, err = sqlutils.GetDB(dbUri)
+		if err != nil {
+			log.PanicErrorf(err, "Get Slave Db failed: %s", replica.Key.String())
+		}
+		this.replicaDBs = append(this.replicaDBs, db)
 	}
-	this.slaveDB = db
 }
 
 func (this *ThrottlerNode) updateHeartBeat() {
 
-	ticker := time.NewTicker(time.Millisecond * 500)
+	ticker := time.NewTicker(this.config.Interval())
 	for _ = range ticker.C {
 		//log.Printf("updateHeartBeat")
 		query := fmt.Sprintf(`replace into %s.%s (id, value) values (1, %d)`, sql.EscapeName(this.DbName), sql.EscapeName(LagTableName), time.Now().UnixNano())
@@ -112,31 +176,81 @@ func (this *ThrottlerNode) updateHeartBeat() {
 }
 
 func (this *ThrottlerNode) collectControlReplicasLag() {
-	ticker := time.NewTicker(time.Millisecond * 500)
-	replicationLagQuery := fmt.Sprintf(`select value from %s.%s where id = 1`,
-		sql.EscapeName(this.DbName),
-		sql.EscapeName(LagTableName),
-	)
-	time.Sleep(time.Second) // 保证table创建，数据ok
+	ticker := time.NewTicker(this.config.Interval())
+	if this.useHeartbeat() {
+		time.Sleep(time.Second) // 保证table创建，数据ok
+	}
 
-	var heartbeatValue int64
 	for _ = range ticker.C {
 		//log.Printf("collectControlReplicasLag")
+		this.updateLag(this.replicasLag())
+	}
+}
 
-		if err := this.slaveDB.QueryRow(replicationLagQuery).Scan(&heartbeatValue); err != nil {
-			// 第一次可能没有数据
-			log.ErrorErrorf(err, "replicationLagQuery failed")
-			continue
+// updateLag 根据replicas的延迟暂停/恢复
+// 延迟未知(replica连接失败, 复制没有运行, Seconds_Behind_Master为NULL, 没有heartbeat)时按照超过阈值处理
+func (this *ThrottlerNode) updateLag(lag time.Duration, err error) {
+	var paused bool
+	var reason string
+	if err != nil {
+		// 第一次可能没有数据
+		log.ErrorErrorf(err, "Collect replication lag failed: %s", this.master.Key.Hostname)
+		paused = true
+		reason = "unknown replication lag: " + err.Error()
+	} else {
+		this.lag.Set(int64(lag))
+		paused = shouldThrottle(this.paused, lag, this.config.MaxLag(), this.config.ResumeLag())
+		reason = "replication lag: " + lag.String()
+	}
+
+	if this.paused != paused {
+		this.paused = paused
+		log.Printf(color.BlueString("%s paused: %v")+", %s", this.master.Key.Hostname, paused, reason)
+		setThrottled(this.pauseInput, "replication_lag:"+this.DbName, paused)
+	}
+}
+
+// replicasLag 所有replicas中最大的延迟
+func (this *ThrottlerNode) replicasLag() (time.Duration, error) {
+	var maxLag time.Duration
+	for i, replica := range this.replicas {
+		var lag time.Duration
+		var err error
+		if this.useHeartbeat() {
+			lag, err = this.heartbeatLag(this.replicaDBs[i])
+		} else {
+			lag, err = mysql.GetReplicationLag(replica)
 		}
-		t := time.Now().UnixNano() - heartbeatValue
-		if t > 0 {
-			this.Lag = time.Duration(t)
-
-			paused := this.Lag > MaxLagInMillseconds
-			if this.pauseInput.Get() != paused {
-				log.Printf(color.BlueString("%s paused: %v"), this.master.Key.Hostname, paused)
-				this.pauseInput.Set(paused)
-			}
+		if err != nil {
+			return 0, fmt.Errorf("replica %s: %s", replica.Key.String(), err.Error())
 		}
+		if lag > maxLag {
+			maxLag = lag
+		}
+	}
+	return maxLag, nil
+}
+
+// heartbeatLag 从replica上读取master写入的heartbeat
+func (this *ThrottlerNode) heartbeatLag(replicaDB *db_sql.DB) (time.Duration, error) {
+	replicationLagQuery := fmt.Sprintf(`select value from %s.%s where id = 1`,
+		sql.EscapeName(this.DbName),
+		sql.EscapeName(LagTableName),
+	)
+	var heartbeatValue int64
+	if err := replicaDB.QueryRow(replicationLagQuery).Scan(&heartbeatValue); err != nil {
+		return 0, err
+	}
+	if t := time.Now().UnixNano() - heartbeatValue; t > 0 {
+		return time.Duration(t), nil
+	}
+	return 0, nil
+}
+
+// shouldThrottle 延迟超过maxLag时暂停, 暂停之后延迟低于resumeLag才恢复
+func shouldThrottle(paused bool, lag time.Duration, maxLag time.Duration, resumeLag time.Duration) bool {
+	if paused {
+		return lag >= resumeLag
 	}
+	return lag > maxLag
 }
@@ -4,11 +4,15 @@ import (
 	"github.com/wfxiang08/cyutils/utils/atomic2"
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
 	"github.com/wfxiang08/db-sharding/conf"
+	"github.com/wfxiang08/db-sharding/mysql"
 )
 
 import (
+	"fmt"
 	"testing"
 	"time"
+
+	test "github.com/outbrain/golib/tests"
 )
 
 // go test github.com/wfxiang08/db-sharding/logic -v -run "TestThrottleCheck$"
@@ -28,3 +32,46 @@ func TestThrottleCheck(t *testing.T) {
 	}
 
 }
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestShouldThrottle$"
+func TestShouldThrottle(t *testing.T) {
+	maxLag, resumeLag := 1500*time.Millisecond, 1000*time.Millisecond
+
+	test.S(t).ExpectFalse(shouldThrottle(false, 1500*time.Millisecond, maxLag, resumeLag))
+	test.S(t).ExpectTrue(shouldThrottle(false, 1600*time.Millisecond, maxLag, resumeLag))
+	// 暂停之后, 延迟低于resumeLag才恢复
+	test.S(t).ExpectTrue(shouldThrottle(true, 1200*time.Millisecond, maxLag, resumeLag))
+	test.S(t).ExpectFalse(shouldThrottle(true, 900*time.Millisecond, maxLag, resumeLag))
+	// 没有暂停时, 低于maxLag不会暂停
+	test.S(t).ExpectFalse(shouldThrottle(false, 1200*time.Millisecond, maxLag, resumeLag))
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestThrottlerNodeUpdateLag$"
+func TestThrottlerNodeUpdateLag(t *testing.T) {
+	config := &conf.ThrottleConfig{MaxLagMs: 1500, ResumeLagMs: 1000}
+	pauseInput := &atomic2.Bool{}
+	node := &ThrottlerNode{
+		master:     &mysql.ConnectionConfig{Key: mysql.InstanceKey{Hostname: "master01", Port: 3306}},
+		DbName:     "test",
+		config:     config,
+		pauseInput: pauseInput,
+	}
+
+	node.updateLag(500*time.Millisecond, nil)
+	test.S(t).ExpectFalse(pauseInput.Get())
+	test.S(t).ExpectEquals(node.Lag(), 500*time.Millisecond)
+
+	// replica出错(或者Seconds_Behind_Master为NULL)时延迟未知, 按照超过阈值处理
+	node.updateLag(0, fmt.Errorf("replication not running"))
+	test.S(t).ExpectTrue(pauseInput.Get())
+	// 恢复之后延迟依然需要低于resumeLag
+	node.updateLag(1200*time.Millisecond, nil)
+	test.S(t).ExpectTrue(pauseInput.Get())
+	node.updateLag(800*time.Millisecond, nil)
+	test.S(t).ExpectFalse(pauseInput.Get())
+
+	node.updateLag(2*time.Second, nil)
+	test.S(t).ExpectTrue(pauseInput.Get())
+	node.updateLag(0, fmt.Errorf("sql: no rows in result set"))
+	test.S(t).ExpectTrue(pauseInput.Get())
+}
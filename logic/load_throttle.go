@@ -0,0 +1,222 @@
+package logic
+
+import (
+	db_sql "database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/outbrain/golib/sqlutils"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/db-sharding/conf"
+)
+
+var (
+	loadThrottlersMutex sync.Mutex
+	loadThrottlers      []*LoadThrottler // 所有的load throttlers, 用于导出机器的负载
+)
+
+// LoadThrottlers 已经启动的load throttlers
+func LoadThrottlers() []*LoadThrottler {
+	loadThrottlersMutex.Lock()
+	defer loadThrottlersMutex.Unlock()
+	return append([]*LoadThrottler{}, loadThrottlers...)
+}
+
+// HostLoad 一台shard机器的负载
+type HostLoad struct {
+	ThreadsRunning   int64
+	ThreadsConnected int64
+	WriteLatency     time.Duration // 这台机器上的shards最近一个检查周期内batch的最大执行时间
+}
+
+// LoadThrottler 检查shard机器(写入的目标)的负载, 负载过高时暂停这台机器上的shards
+// 和ThrottlerNode共享pauseInput
+type LoadThrottler struct {
+	Hostname        string
+	appliers        ShardingAppliers // 这台机器上的shards
+	thresholds      conf.LoadThresholds
+	resumeRatio     float64
+	resumeIntervals int
+	interval        time.Duration
+	paused          bool
+	cleanIntervals  int // 暂停之后连续低于恢复阈值的检查次数
+
+	threadsRunning   atomic2.Int64
+	threadsConnected atomic2.Int64
+	writeLatency     atomic2.Int64
+
+	db         *db_sql.DB
+	pauseInput *atomic2.Bool
+}
+
+// StartLoadThrottle 按照[throttle.load]的配置检查shard机器的负载, 没有配置阈值的机器不检查
+func StartLoadThrottle(dbConfig *conf.DatabaseConfig, shardingAppliers ShardingAppliers,
+	host2PauseInput map[string]*atomic2.Bool) []*LoadThrottler {
+
+	loadConfig := &dbConfig.Throttle.Load
+	var results []*LoadThrottler
+	for hostname, pauseInput := range host2PauseInput {
+		thresholds := loadConfig.ForHost(hostname)
+		if !thresholds.Enabled() {
+			continue
+		}
+
+		result := &LoadThrottler{
+			Hostname:        hostname,
+			thresholds:      thresholds,
+			resumeRatio:     loadConfig.ResumeRatio,
+			resumeIntervals: loadConfig.ResumeIntervals,
+			interval:        loadConfig.Interval(),
+			pauseInput:      pauseInput,
+		}
+		for _, applier := range shardingAppliers {
+			if applier.pauseInput == pauseInput {
+				result.appliers = append(result.appliers, applier)
+			}
+		}
+		if len(result.appliers) == 0 {
+			continue
+		}
+
+		// 通过这台机器上的任意一个shard连接
+		dbUri := dbConfig.GetDBUri(ShardAlias(result.appliers[0].shardingIndex))
+		db, _, err := sqlutils.GetDB(dbUri)
+		if err != nil {
+			log.PanicErrorf(err, "Get Shard Db failed: %s", hostname)
+		}
+		result.db = db
+
+		log.Printf(color.MagentaString("Load throttle")+": %s, threads_running: %d, threads_connected: %d, write_latency: %dms",
+			hostname, thresholds.MaxThreadsRunning, thresholds.MaxThreadsConnected, thresholds.MaxWriteLatencyMs)
+		go result.collectLoad()
+		results = append(results, result)
+	}
+
+	loadThrottlersMutex.Lock()
+	loadThrottlers = append(loadThrottlers, results...)
+	loadThrottlersMutex.Unlock()
+	return results
+}
+
+// Load 最近一次检查的负载
+func (this *LoadThrottler) Load() *HostLoad {
+	return &HostLoad{
+		ThreadsRunning:   this.threadsRunning.Get(),
+		ThreadsConnected: this.threadsConnected.Get(),
+		WriteLatency:     time.Duration(this.writeLatency.Get()),
+	}
+}
+
+func (this *LoadThrottler) collectLoad() {
+	ticker := time.NewTicker(this.interval)
+	for _ = range ticker.C {
+		load := &HostLoad{}
+		if err := this.readThreads(load); err != nil {
+			log.ErrorErrorf(err, "Read load failed: %s", this.Hostname)
+			continue
+		}
+		for _, applier := range this.appliers {
+			if latency := applier.takeWriteLatency(); latency > load.WriteLatency {
+				load.WriteLatency = latency
+			}
+		}
+		this.threadsRunning.Set(load.ThreadsRunning)
+		this.threadsConnected.Set(load.ThreadsConnected)
+		this.writeLatency.Set(int64(load.WriteLatency))
+
+		if changed, reason := this.check(load); changed {
+			if this.paused {
+				log.Printf(color.BlueString("%s paused by load")+": %s", this.Hostname, reason)
+			} else {
+				log.Printf(color.BlueString("%s resumed")+", threads_running: %d, threads_connected: %d, write_latency: %s",
+					this.Hostname, load.ThreadsRunning, load.ThreadsConnected, load.WriteLatency.String())
+			}
+			setThrottled(this.pauseInput, "load", this.paused)
+		}
+	}
+}
+
+func (this *LoadThrottler) readThreads(load *HostLoad) error {
+	rows, err := this.db.Query(`SHOW GLOBAL STATUS WHERE Variable_name IN ('Threads_running', 'Threads_connected')`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var value int64
+		if err := rows.Scan(&name, &value); err != nil {
+			return err
+		}
+		switch strings.ToLower(name) {
+		case "threads_running":
+			load.ThreadsRunning = value
+		case "threads_connected":
+			load.ThreadsConnected = value
+		}
+	}
+	return rows.Err()
+}
+
+// check 更新暂停的状态, 返回状态是否改变, 以及超过阈值的指标
+// 暂停期间没有batch执行, write latency总是为0: 连续resumeIntervals次检查都低于恢复的阈值才恢复, 避免恢复之后立即再次暂停
+func (this *LoadThrottler) check(load *HostLoad) (bool, string) {
+	paused, reason := shouldThrottleLoad(this.paused, &this.thresholds, load, this.resumeRatio)
+	if this.paused && !paused {
+		this.cleanIntervals++
+		if this.cleanIntervals < this.resumeIntervals {
+			return false, reason
+		}
+	}
+	this.cleanIntervals = 0
+	if this.paused == paused {
+		return false, reason
+	}
+	this.paused = paused
+	return true, reason
+}
+
+// shouldThrottleLoad 任意一个指标超过阈值时暂停, 暂停之后所有指标都低于阈值*resumeRatio才恢复
+// 返回是否暂停, 以及超过阈值的指标
+func shouldThrottleLoad(paused bool, thresholds *conf.LoadThresholds, load *HostLoad, resumeRatio float64) (bool, string) {
+	ratio := 1.0
+	if paused {
+		ratio = resumeRatio
+	}
+
+	var reasons []string
+	exceeded := func(name string, value int64, threshold int64) {
+		if threshold > 0 && float64(value) > float64(threshold)*ratio {
+			reasons = append(reasons, fmt.Sprintf("%s %d > %d", name, value, threshold))
+		}
+	}
+	exceeded("threads_running", load.ThreadsRunning, thresholds.MaxThreadsRunning)
+	exceeded("threads_connected", load.ThreadsConnected, thresholds.MaxThreadsConnected)
+	exceeded("write_latency_ms", int64(load.WriteLatency/time.Millisecond), thresholds.MaxWriteLatencyMs)
+	return len(reasons) > 0, strings.Join(reasons, ", ")
+}
+
+// observeWriteLatency 记录两次检查之间batch的最大执行时间
+func (this *ShardingApplier) observeWriteLatency(latency time.Duration) {
+	for {
+		current := this.maxWriteLatency.Get()
+		if int64(latency) <= current || this.maxWriteLatency.CompareAndSwap(current, int64(latency)) {
+			return
+		}
+	}
+}
+
+// takeWriteLatency 读取并清零; 暂停期间没有batch执行, 延迟为0(恢复时需要连续多次检查, 参考LoadThrottler.check)
+func (this *ShardingApplier) takeWriteLatency() time.Duration {
+	for {
+		current := this.maxWriteLatency.Get()
+		if this.maxWriteLatency.CompareAndSwap(current, 0) {
+			return time.Duration(current)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package logic
+
+import (
+	"testing"
+	"time"
+
+	test "github.com/outbrain/golib/tests"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	"github.com/wfxiang08/db-sharding/conf"
+)
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestShouldThrottleLoad$"
+func TestShouldThrottleLoad(t *testing.T) {
+	thresholds := &conf.LoadThresholds{MaxThreadsRunning: 30, MaxWriteLatencyMs: 2000}
+
+	paused, _ := shouldThrottleLoad(false, thresholds, &HostLoad{ThreadsRunning: 30, ThreadsConnected: 5000}, 0.8)
+	test.S(t).ExpectFalse(paused)
+
+	paused, reason := shouldThrottleLoad(false, thresholds, &HostLoad{ThreadsRunning: 31, WriteLatency: 3 * time.Second}, 0.8)
+	test.S(t).ExpectTrue(paused)
+	test.S(t).ExpectEquals(reason, "threads_running 31 > 30, write_latency_ms 3000 > 2000")
+
+	// 暂停之后, 所有指标低于阈值*resumeRatio才恢复
+	paused, _ = shouldThrottleLoad(true, thresholds, &HostLoad{ThreadsRunning: 25}, 0.8)
+	test.S(t).ExpectTrue(paused)
+	paused, _ = shouldThrottleLoad(true, thresholds, &HostLoad{ThreadsRunning: 24, WriteLatency: 1700 * time.Millisecond}, 0.8)
+	test.S(t).ExpectTrue(paused)
+	paused, _ = shouldThrottleLoad(true, thresholds, &HostLoad{ThreadsRunning: 24, WriteLatency: time.Second}, 0.8)
+	test.S(t).ExpectFalse(paused)
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestLoadThrottlerCheck$"
+func TestLoadThrottlerCheck(t *testing.T) {
+	throttler := &LoadThrottler{
+		thresholds:      conf.LoadThresholds{MaxThreadsRunning: 30, MaxWriteLatencyMs: 2000},
+		resumeRatio:     0.8,
+		resumeIntervals: 3,
+	}
+
+	changed, reason := throttler.check(&HostLoad{WriteLatency: 3 * time.Second})
+	test.S(t).ExpectTrue(changed)
+	test.S(t).ExpectTrue(throttler.paused)
+	test.S(t).ExpectEquals(reason, "write_latency_ms 3000 > 2000")
+
+	// 暂停期间没有batch执行, write latency为0, 不能立即恢复
+	changed, _ = throttler.check(&HostLoad{})
+	test.S(t).ExpectFalse(changed)
+	changed, _ = throttler.check(&HostLoad{})
+	test.S(t).ExpectFalse(changed)
+	test.S(t).ExpectTrue(throttler.paused)
+
+	// 中间有一次超过恢复的阈值, 重新计数
+	changed, _ = throttler.check(&HostLoad{ThreadsRunning: 25})
+	test.S(t).ExpectFalse(changed)
+	for i := 0; i < 2; i++ {
+		changed, _ = throttler.check(&HostLoad{ThreadsRunning: 10})
+		test.S(t).ExpectFalse(changed)
+	}
+	changed, _ = throttler.check(&HostLoad{ThreadsRunning: 10})
+	test.S(t).ExpectTrue(changed)
+	test.S(t).ExpectFalse(throttler.paused)
+
+	// 没有暂停时超过阈值立即暂停
+	changed, _ = throttler.check(&HostLoad{ThreadsRunning: 31})
+	test.S(t).ExpectTrue(changed)
+	test.S(t).ExpectTrue(throttler.paused)
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestSetThrottled$"
+func TestSetThrottled(t *testing.T) {
+	pauseInput := &atomic2.Bool{}
+
+	// 主从延迟和负载共享pauseInput, 都解除之后才恢复
+	setThrottled(pauseInput, "replication_lag:shard_0", true)
+	setThrottled(pauseInput, "load", true)
+	test.S(t).ExpectTrue(pauseInput.Get())
+	setThrottled(pauseInput, "replication_lag:shard_0", false)
+	test.S(t).ExpectTrue(pauseInput.Get())
+	setThrottled(pauseInput, "load", false)
+	test.S(t).ExpectFalse(pauseInput.Get())
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestApplierWriteLatency$"
+func TestApplierWriteLatency(t *testing.T) {
+	applier := &ShardingApplier{}
+	applier.observeWriteLatency(100 * time.Millisecond)
+	applier.observeWriteLatency(300 * time.Millisecond)
+	applier.observeWriteLatency(200 * time.Millisecond)
+	test.S(t).ExpectEquals(applier.takeWriteLatency(), 300*time.Millisecond)
+	test.S(t).ExpectEquals(applier.takeWriteLatency(), time.Duration(0))
+}
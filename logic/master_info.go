@@ -17,21 +17,23 @@ import (
 type MasterInfo struct {
 	sync.RWMutex
 
-	Name string `toml:"bin_name"`
-	Pos  int64  `toml:"bin_pos"`
+	Name    string `toml:"bin_name"`
+	Pos     int64  `toml:"bin_pos"`
+	GTIDSet string `toml:"gtid_set"` // GTID模式下已经执行的GTID
 
 	filePath     string
 	lastSaveTime time.Time
 }
 
-func LoadMasterInfo(dataDir string, key mysql.InstanceKey) (*MasterInfo, error) {
+// LoadMasterInfo name为源db的alias, 而不是hostname_port: 主从切换(或者域名变化)之后依然使用同一个文件
+func LoadMasterInfo(dataDir string, name string) (*MasterInfo, error) {
 	var m MasterInfo
 
 	if len(dataDir) == 0 {
 		return &m, nil
 	}
 
-	m.filePath = path.Join(dataDir, fmt.Sprintf("%s_%d.info", key.Hostname, key.Port))
+	m.filePath = path.Join(dataDir, fmt.Sprintf("%s.info", name))
 	m.lastSaveTime = time.Now()
 
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
@@ -57,6 +59,7 @@ func (m *MasterInfo) Save(pos *mysql.BinlogCoordinates) error {
 
 	m.Name = pos.LogFile
 	m.Pos = pos.LogPos
+	m.GTIDSet = pos.GTIDSet
 
 	if len(m.filePath) == 0 {
 		return nil
@@ -89,6 +92,7 @@ func (m *MasterInfo) Position() *mysql.BinlogCoordinates {
 	return &mysql.BinlogCoordinates{
 		LogFile: m.Name,
 		LogPos:  m.Pos,
+		GTIDSet: m.GTIDSet,
 	}
 }
 
@@ -0,0 +1,38 @@
+package logic
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+	"github.com/wfxiang08/db-sharding/mysql"
+)
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestMasterInfoName$"
+func TestMasterInfoName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "master_info")
+	test.S(t).ExpectNil(err)
+	defer os.RemoveAll(dir)
+
+	// 之前的版本按照hostname_port命名
+	legacyFile := path.Join(dir, "10.0.0.1_3306.info")
+	test.S(t).ExpectNil(ioutil.WriteFile(legacyFile, []byte("bin_name = \"mysql-bin.000066\"\nbin_pos = 100\n"), 0644))
+
+	connectionConfig := &mysql.ConnectionConfig{Key: mysql.InstanceKey{Hostname: "10.0.0.1", Port: 3306}}
+	streamer := NewEventsStreamer(connectionConfig, MaxRetryNum, 1, dir, "shard0")
+	test.S(t).ExpectNil(streamer.renameLegacyMetaFile("info"))
+	test.S(t).ExpectNil(streamer.renameLegacyMetaFile("schema"))
+
+	masterInfo, err := LoadMasterInfo(dir, "shard0")
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(*masterInfo.Position(), mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 100})
+
+	// 主从切换之后hostname变化, 依然使用源db alias命名的文件
+	connectionConfig.Key.Hostname = "10.0.0.2"
+	test.S(t).ExpectNil(streamer.renameLegacyMetaFile("info"))
+	masterInfo, err = LoadMasterInfo(dir, "shard0")
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(masterInfo.Position().LogPos, int64(100))
+}
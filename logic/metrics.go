@@ -0,0 +1,291 @@
+package logic
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+)
+
+// 监控指标, 以Prometheus的text格式输出(不依赖client库)
+var (
+	metricRowsRead = newCounterVec("sharding_rows_read_total",
+		"Rows read from source tables by batch copy", "source", "table")
+	metricRetries = newCounterVec("sharding_sql_retries_total",
+		"Retries of sql batches", "shard")
+	metricBatchLatency = newHistogramVec("sharding_batch_latency_seconds",
+		"Latency of sql batches executed on shards",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "shard")
+)
+
+type counterValue struct {
+	labels []string
+	value  atomic2.Int64
+}
+
+// counterVec 按照labels区分的计数器
+type counterVec struct {
+	name       string
+	help       string
+	labelNames []string
+	mutex      sync.Mutex
+	values     map[string]*counterValue
+}
+
+func newCounterVec(name string, help string, labelNames ...string) *counterVec {
+	return &counterVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		values:     make(map[string]*counterValue),
+	}
+}
+
+// WithLabels labels的顺序和labelNames一致
+func (this *counterVec) WithLabels(labels ...string) *atomic2.Int64 {
+	key := strings.Join(labels, "\xff")
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	value, ok := this.values[key]
+	if !ok {
+		value = &counterValue{labels: labels}
+		this.values[key] = value
+	}
+	return &value.value
+}
+
+func (this *counterVec) write(w io.Writer) {
+	this.mutex.Lock()
+	values := make([]*counterValue, 0, len(this.values))
+	for _, value := range this.values {
+		values = append(values, value)
+	}
+	this.mutex.Unlock()
+	sort.Slice(values, func(i, j int) bool {
+		return strings.Join(values[i].labels, "\xff") < strings.Join(values[j].labels, "\xff")
+	})
+
+	writeMetricHeader(w, this.name, this.help, "counter")
+	for _, value := range values {
+		writeMetricSample(w, this.name, this.labelNames, value.labels, float64(value.value.Get()))
+	}
+}
+
+type histogramValue struct {
+	labels []string
+	counts []int64 // counts[i]: 落在(buckets[i-1], buckets[i]]中的个数
+	sum    float64
+	count  int64
+}
+
+// histogramVec 按照labels区分的直方图
+type histogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+	mutex      sync.Mutex
+	values     map[string]*histogramValue
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labelNames ...string) *histogramVec {
+	return &histogramVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    buckets,
+		values:     make(map[string]*histogramValue),
+	}
+}
+
+func (this *histogramVec) Observe(value float64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	histogram, ok := this.values[key]
+	if !ok {
+		histogram = &histogramValue{labels: labels, counts: make([]int64, len(this.buckets))}
+		this.values[key] = histogram
+	}
+	histogram.sum += value
+	histogram.count++
+	for i, bucket := range this.buckets {
+		if value <= bucket {
+			histogram.counts[i]++
+			break
+		}
+	}
+}
+
+func (this *histogramVec) write(w io.Writer) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	writeMetricHeader(w, this.name, this.help, "histogram")
+	labelNames := append(append([]string{}, this.labelNames...), "le")
+	keys := make([]string, 0, len(this.values))
+	for key := range this.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		histogram := this.values[key]
+		// bucket是累计的个数
+		cumulative := int64(0)
+		for i, bucket := range this.buckets {
+			cumulative += histogram.counts[i]
+			labels := append(append([]string{}, histogram.labels...), formatMetricValue(bucket))
+			writeMetricSample(w, this.name+"_bucket", labelNames, labels, float64(cumulative))
+		}
+		labels := append(append([]string{}, histogram.labels...), "+Inf")
+		writeMetricSample(w, this.name+"_bucket", labelNames, labels, float64(histogram.count))
+		writeMetricSample(w, this.name+"_sum", this.labelNames, histogram.labels, histogram.sum)
+		writeMetricSample(w, this.name+"_count", this.labelNames, histogram.labels, float64(histogram.count))
+	}
+}
+
+func writeMetricHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeMetricSample(w io.Writer, name string, labelNames []string, labels []string, value float64) {
+	if len(labelNames) == 0 {
+		fmt.Fprintf(w, "%s %s\n", name, formatMetricValue(value))
+		return
+	}
+	pairs := make([]string, len(labelNames))
+	for i, labelName := range labelNames {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, labelName, labelEscaper.Replace(labels[i]))
+	}
+	fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(pairs, ","), formatMetricValue(value))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func boolMetricValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// MetricsHandler /metrics, 计数器之外的指标在抓取时从appliers, throttlers和binlog streams中读取
+type MetricsHandler struct {
+	appliers ShardingAppliers
+}
+
+func NewMetricsHandler(shardingAppliers ShardingAppliers) *MetricsHandler {
+	return &MetricsHandler{appliers: shardingAppliers}
+}
+
+func (this *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	this.WriteMetrics(w)
+}
+
+func (this *MetricsHandler) WriteMetrics(w io.Writer) {
+	metricRowsRead.write(w)
+
+	// 各个shard的进度和队列
+	shards := make([]*ShardStatus, len(this.appliers))
+	for i, applier := range this.appliers {
+		shards[i] = applier.Status()
+	}
+	shardLabel := []string{"shard"}
+	shardGauges := []struct {
+		name       string
+		help       string
+		metricType string
+		value      func(status *ShardStatus) float64
+	}{
+		{"sharding_sql_pushed_total", "Sqls pushed to the queue of shards", "counter",
+			func(status *ShardStatus) float64 { return float64(status.Pushed) }},
+		{"sharding_sql_executed_total", "Sqls executed on shards", "counter",
+			func(status *ShardStatus) float64 { return float64(status.Executed) }},
+		{"sharding_queue_depth", "Sqls waiting in the queue of shards", "gauge",
+			func(status *ShardStatus) float64 { return float64(status.QueueDepth) }},
+		{"sharding_queue_capacity", "Capacity of the queue of shards", "gauge",
+			func(status *ShardStatus) float64 { return float64(status.QueueCapacity) }},
+		{"sharding_queue_fill_ratio", "Queue depth divided by queue capacity", "gauge",
+			func(status *ShardStatus) float64 {
+				if status.QueueCapacity == 0 {
+					return 0
+				}
+				return float64(status.QueueDepth) / float64(status.QueueCapacity)
+			}},
+		{"sharding_shard_paused", "Shard paused by the admin api", "gauge",
+			func(status *ShardStatus) float64 { return boolMetricValue(status.Paused) }},
+		{"sharding_shard_throttled", "Shard paused by the throttler", "gauge",
+			func(status *ShardStatus) float64 { return boolMetricValue(status.Throttled) }},
+		{"sharding_shard_caught_up", "Pipeline delay of the shard stays below the threshold", "gauge",
+			func(status *ShardStatus) float64 { return boolMetricValue(status.CaughtUp) }},
+	}
+	for _, gauge := range shardGauges {
+		writeMetricHeader(w, gauge.name, gauge.help, gauge.metricType)
+		for _, status := range shards {
+			writeMetricSample(w, gauge.name, shardLabel, []string{strconv.Itoa(status.Shard)}, gauge.value(status))
+		}
+	}
+	// 延迟未知的shard不输出
+	writeMetricHeader(w, "sharding_pipeline_delay_seconds", "Now minus the source time of the last committed binlog transaction", "gauge")
+	for _, status := range shards {
+		if status.DelaySeconds >= 0 {
+			writeMetricSample(w, "sharding_pipeline_delay_seconds", shardLabel, []string{strconv.Itoa(status.Shard)},
+				float64(status.DelaySeconds))
+		}
+	}
+	writeMetricHeader(w, "sharding_caught_up", "All shards caught up, safe to cutover", "gauge")
+	writeMetricSample(w, "sharding_caught_up", nil, nil, boolMetricValue(this.appliers.CaughtUp()))
+	metricRetries.write(w)
+	metricBatchLatency.write(w)
+
+	// 主从延迟
+	hostLabels := []string{"host", "db"}
+	writeMetricHeader(w, "sharding_replication_lag_seconds", "Replication lag measured by the throttler", "gauge")
+	for _, node := range ThrottlerNodes() {
+		writeMetricSample(w, "sharding_replication_lag_seconds", hostLabels,
+			[]string{node.master.Key.Hostname, node.DbName}, node.Lag().Seconds())
+	}
+
+	// shard机器的负载
+	loadThrottlers := LoadThrottlers()
+	loadGauges := []struct {
+		name  string
+		help  string
+		value func(load *HostLoad) float64
+	}{
+		{"sharding_host_threads_running", "Threads_running of shard hosts",
+			func(load *HostLoad) float64 { return float64(load.ThreadsRunning) }},
+		{"sharding_host_threads_connected", "Threads_connected of shard hosts",
+			func(load *HostLoad) float64 { return float64(load.ThreadsConnected) }},
+		{"sharding_host_write_latency_seconds", "Max batch latency of shards on the host in the last check interval",
+			func(load *HostLoad) float64 { return load.WriteLatency.Seconds() }},
+	}
+	for _, gauge := range loadGauges {
+		writeMetricHeader(w, gauge.name, gauge.help, "gauge")
+		for _, throttler := range loadThrottlers {
+			writeMetricSample(w, gauge.name, []string{"host"}, []string{throttler.Hostname}, gauge.value(throttler.Load()))
+		}
+	}
+
+	// binlog中最近一个event距离现在的时间
+	writeMetricHeader(w, "sharding_binlog_event_age_seconds", "Age of the last binlog event read by the streamer", "gauge")
+	now := time.Now().Unix()
+	for _, status := range StreamersStatus() {
+		if status.EventTimestamp == 0 {
+			continue
+		}
+		writeMetricSample(w, "sharding_binlog_event_age_seconds", []string{"host"}, []string{status.Host},
+			float64(now-status.EventTimestamp))
+	}
+}
@@ -0,0 +1,80 @@
+package logic
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	"github.com/wfxiang08/db-sharding/models"
+)
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestMetricsFormat$"
+func TestMetricsFormat(t *testing.T) {
+	counter := newCounterVec("test_rows_total", "Test rows", "source", "table")
+	counter.WithLabels("final", "t2").Add(5)
+	counter.WithLabels("final", "t1").Add(3)
+	counter.WithLabels("final", "t1").Incr()
+
+	var buffer bytes.Buffer
+	counter.write(&buffer)
+	test.S(t).ExpectEquals(buffer.String(), `# HELP test_rows_total Test rows
+# TYPE test_rows_total counter
+test_rows_total{source="final",table="t1"} 4
+test_rows_total{source="final",table="t2"} 5
+`)
+
+	histogram := newHistogramVec("test_latency_seconds", "Test latency", []float64{0.1, 1}, "shard")
+	histogram.Observe(0.05, "0")
+	histogram.Observe(0.5, "0")
+	histogram.Observe(2, "0")
+
+	buffer.Reset()
+	histogram.write(&buffer)
+	test.S(t).ExpectEquals(buffer.String(), `# HELP test_latency_seconds Test latency
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{shard="0",le="0.1"} 1
+test_latency_seconds_bucket{shard="0",le="1"} 2
+test_latency_seconds_bucket{shard="0",le="+Inf"} 3
+test_latency_seconds_sum{shard="0"} 2.55
+test_latency_seconds_count{shard="0"} 3
+`)
+
+	// label中的特殊字符
+	buffer.Reset()
+	writeMetricSample(&buffer, "test_gauge", []string{"host"}, []string{`a"b\c`}, 1)
+	test.S(t).ExpectEquals(buffer.String(), `test_gauge{host="a\"b\\c"} 1`+"\n")
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestMetricsHandler$"
+func TestMetricsHandler(t *testing.T) {
+	hostPause := &atomic2.Bool{}
+	hostPause.Set(true)
+	appliers := ShardingAppliers{
+		&ShardingApplier{shardingIndex: 0, sqls: make(chan *models.ShardingSQL, 4), pauseInput: hostPause},
+		&ShardingApplier{shardingIndex: 1, sqls: make(chan *models.ShardingSQL, 4), pauseInput: &atomic2.Bool{}},
+	}
+	appliers[0].sqls <- models.NewCommitSQL(0)
+	appliers[0].totalPushed.Add(10)
+	appliers[0].totalExecuted.Add(7)
+
+	var buffer bytes.Buffer
+	NewMetricsHandler(appliers).WriteMetrics(&buffer)
+	lines := strings.Split(buffer.String(), "\n")
+	contains := func(line string) bool {
+		for _, l := range lines {
+			if l == line {
+				return true
+			}
+		}
+		return false
+	}
+	test.S(t).ExpectTrue(contains(`sharding_sql_pushed_total{shard="0"} 10`))
+	test.S(t).ExpectTrue(contains(`sharding_sql_executed_total{shard="0"} 7`))
+	test.S(t).ExpectTrue(contains(`sharding_queue_depth{shard="0"} 1`))
+	test.S(t).ExpectTrue(contains(`sharding_queue_fill_ratio{shard="0"} 0.25`))
+	test.S(t).ExpectTrue(contains(`sharding_shard_throttled{shard="0"} 1`))
+	test.S(t).ExpectTrue(contains(`sharding_shard_throttled{shard="1"} 0`))
+	test.S(t).ExpectTrue(contains(`# TYPE sharding_replication_lag_seconds gauge`))
+}
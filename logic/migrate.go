@@ -25,15 +25,40 @@ var (
 	BatchInsertSleepMilliseconds = 20
 	BatchReadCount               = 2000
 	BatchWriteCount              = 2000
+	ShardAliasFormat             = conf.DefaultShardAliasFormat // dbs配置中shard的alias, resharding时为新的shard的alias
 )
 
+// ShardAlias 第index个shard在dbs配置中的alias
+func ShardAlias(index int) string {
+	return fmt.Sprintf(ShardAliasFormat, index)
+}
+
 // 原始的Table(每次只考虑单个的db/table, 或者单台机器上的一类tables)
 type OriginTable struct {
 	TablePattern    string // comment or comment*
-	DatabasePattern string // shard_0 or shard_*
+	DatabasePattern string // shard_0 or shard_* or shard_0,shard_1
 	DbAlias         string
 }
 
+// ShardingTable 一次运行中的一个表: 源表, 以及它自己的builder和批量读取(DBHelper)
+// 多个表共享appliers和binlog stream(同一台源机器)
+type ShardingTable struct {
+	Origin    *OriginTable
+	TableName string // 批量读取的源表
+	DBHelper  models.DBHelper
+	Progress  *BatchProgress // 可选: 批量拷贝的进度
+
+	tombstones *TombstoneTracker
+}
+
+func NewShardingTable(originTable *OriginTable, tableName string, dbHelper models.DBHelper) *ShardingTable {
+	return &ShardingTable{
+		Origin:    originTable,
+		TableName: tableName,
+		DBHelper:  dbHelper,
+	}
+}
+
 func ShardingSetupLog(logPrefix string) {
 	// 1. 解析Log相关的配置
 	if len(logPrefix) > 0 {
@@ -70,32 +95,60 @@ func ShardingWaitingClose(batchOnly bool, pauseInput *atomic2.Bool, stopInput *a
 					log.Printf(color.MagentaString("Resume input...."))
 				}
 			} else {
-				// 打印binlog的位置:
-
+				// 打印binlog的位置
+				PrintStreamersStatus()
 			}
 		} else {
-			// 停止输入
-			if stopInput.CompareAndSwap(false, true) {
-				log.Printf(color.MagentaString("Stop input recordings"))
-				go func() {
-					time.Sleep((MaxBinlogDelaySeconds + 1) * time.Second)
-					// 关闭数据输入
-					for i := 0; i < TotalShardNum; i++ {
-						shardingAppliers[i].Close()
-					}
-				}()
-			}
+			StopGracefully(stopInput, shardingAppliers)
 		}
 	}
 }
 
+// StopGracefully 停止输入, 等待binlog中正在处理的事务进入队列之后关闭appliers
+// appliers提交完队列中的数据之后退出
+func StopGracefully(stopInput *atomic2.Bool, shardingAppliers ShardingAppliers) {
+	if stopInput.CompareAndSwap(false, true) {
+		log.Printf(color.MagentaString("Stop input recordings"))
+		go func() {
+			time.Sleep((MaxBinlogDelaySeconds + 1) * time.Second)
+			// 关闭数据输入
+			for _, applier := range shardingAppliers {
+				applier.Close()
+			}
+		}()
+	}
+}
+
+// PrintStreamersStatus 打印binlog streams读取和提交的位置
+func PrintStreamersStatus() {
+	for _, status := range StreamersStatus() {
+		log.Printf(color.MagentaString("Binlog stream %s")+": current: %s, checkpoint: %s, pending transactions: %d",
+			status.Host, status.Current, status.Checkpoint, status.PendingTransactions)
+	}
+}
+
 func BuildAppliers(wg *sync.WaitGroup, cacheSize int, dbHelper models.DBHelper, dryRun bool,
 	dbConfig *conf.DatabaseConfig) (ShardingAppliers, map[string]*atomic2.Bool) {
 	return BuildBatchAppliersWithRepliction(wg, 1, cacheSize, dbHelper, dryRun, dbConfig)
 }
 
+// BuildTablesAppliers 多个表共享appliers: 每个shard一个applier(共享连接), 同一台机器共享throttle的暂停标记
+func BuildTablesAppliers(wg *sync.WaitGroup, cacheSize int, tables []*ShardingTable, dryRun bool,
+	dbConfig *conf.DatabaseConfig) (ShardingAppliers, map[string]*atomic2.Bool) {
+	builders := make([]models.ModelBuilder, len(tables))
+	for i, table := range tables {
+		builders[i] = table.DBHelper.GetBuilder()
+	}
+	return buildAppliers(wg, 1, cacheSize, builders, dryRun, dbConfig)
+}
+
 func BuildBatchAppliersWithRepliction(wg *sync.WaitGroup, replication int, cacheSize int, dbHelper models.DBHelper,
 	dryRun bool, dbConfig *conf.DatabaseConfig) (ShardingAppliers, map[string]*atomic2.Bool) {
+	return buildAppliers(wg, replication, cacheSize, []models.ModelBuilder{dbHelper.GetBuilder()}, dryRun, dbConfig)
+}
+
+func buildAppliers(wg *sync.WaitGroup, replication int, cacheSize int, builders []models.ModelBuilder,
+	dryRun bool, dbConfig *conf.DatabaseConfig) (ShardingAppliers, map[string]*atomic2.Bool) {
 
 	hostname2Pause := make(map[string]*atomic2.Bool)
 	var err error
@@ -105,7 +158,7 @@ func BuildBatchAppliersWithRepliction(wg *sync.WaitGroup, replication int, cache
 
 		dbIndex := i / replication
 
-		_, hostname, _ := dbConfig.GetDB(fmt.Sprintf("shard%d", dbIndex))
+		_, hostname, _ := dbConfig.GetDB(ShardAlias(dbIndex))
 		pauseInput, ok := hostname2Pause[hostname]
 		if !ok {
 			pauseInput = &atomic2.Bool{}
@@ -113,7 +166,7 @@ func BuildBatchAppliersWithRepliction(wg *sync.WaitGroup, replication int, cache
 		}
 
 		shardingAppliers[i], err = NewShardingApplier(dbIndex, BatchWriteCount, cacheSize, dbConfig, dryRun,
-			dbHelper.GetBuilder(), pauseInput)
+			builders, pauseInput)
 		if err != nil {
 			log.PanicErrorf(err, "NewShardingApplier failed")
 		}
@@ -23,20 +23,59 @@ import (
 //    1. 一次插入N(4000左右), 通过statement生成固定的SQL, 然后args一口气传递给mysql;
 //    2. 不便于合并的请求，可以通过Transaction减少mysql端的io
 //
+//
+// progress不为nil时, 保存拷贝的进度; 只有直接apply的模式(不需要重新排序)才能断点续传
+//
 func BatchReadDB(wg *sync.WaitGroup, tableName string, sourceDBAlias string, dbConfig *conf.DatabaseConfig,
 	dbHelper models.DBHelper, shardingAppliers ShardingAppliers,
-	stopInput *atomic2.Bool, pauseInput *atomic2.Bool) {
+	stopInput *atomic2.Bool, pauseInput *atomic2.Bool, progress *BatchProgress) {
 
 	wg.Add(1)
 	defer wg.Done()
-	db, err := gorm.Open("mysql", dbConfig.GetDBUri(sourceDBAlias))
+
+	db, err := openSourceDB(dbConfig, sourceDBAlias)
 	if err != nil {
 		log.ErrorErrorf(err, "Open database failed")
 		return
 	}
+
+	batchRead(db, tableName, sourceDBAlias, dbHelper, shardingAppliers, shardingAppliers, stopInput, pauseInput, progress)
+}
+
+func openSourceDB(dbConfig *conf.DatabaseConfig, sourceDBAlias string) (*gorm.DB, error) {
+	db, err := gorm.Open("mysql", dbConfig.GetDBUri(sourceDBAlias))
+	if err != nil {
+		return nil, err
+	}
 	db.DB().SetConnMaxLifetime(time.Hour * 4)
 	db.DB().SetMaxOpenConns(2) // 设置最大的连接数（防止异常情况干死数据库)
 	db.DB().SetMaxIdleConns(2)
+	return db, nil
+}
+
+// batchRead 从db(连接池或者一致性快照)中读取整个table
+// 读取的数据通过sqlApplier进入队列(例如: 经过TombstoneTracker的过滤), shardingAppliers用于跟踪进度
+func batchRead(db *gorm.DB, tableName string, sourceDBAlias string, dbHelper models.DBHelper,
+	sqlApplier models.SqlApplier, shardingAppliers ShardingAppliers,
+	stopInput *atomic2.Bool, pauseInput *atomic2.Bool, progress *BatchProgress) {
+
+	var seeker models.BatchSeeker
+	if progress != nil {
+		var ok bool
+		if seeker, ok = dbHelper.(models.BatchSeeker); !ok || dbHelper.NeedReOrder() {
+			log.Panicf("Batch progress not supported: reorder mode or BatchSeeker not implemented")
+		}
+		defer progress.Close()
+
+		resumeKey, err := progress.ResumeKey()
+		if err != nil {
+			log.PanicErrorf(err, "Invalid batch progress")
+		}
+		if resumeKey != nil {
+			log.Printf(color.MagentaString("Resume batch read from: %v"), resumeKey)
+			seeker.BatchSeek(resumeKey)
+		}
+	}
 
 	start := time.Now()
 	totalRowsProcessed := int(0)
@@ -52,10 +91,15 @@ func BatchReadDB(wg *sync.WaitGroup, tableName string, sourceDBAlias string, dbC
 			break
 		}
 
+		// 直接apply的模式下, 上一批数据已经进入队列, 之前记录的binlog不再需要
+		if tombstones, ok := sqlApplier.(*TombstoneTracker); ok && !dbHelper.NeedReOrder() {
+			tombstones.Prune()
+		}
+
 		recordCount := 0
 		t0 := time.Now()
 		for i := 0; i < MaxRetryNum; i++ {
-			dbInfo, count := dbHelper.BatchProcess(db, tableName, sourceDBAlias, shardingAppliers)
+			dbInfo, count := dbHelper.BatchProcess(db, tableName, sourceDBAlias, sqlApplier)
 
 			if dbInfo.Error != nil && i != MaxRetryNum-1 {
 				log.ErrorErrorf(dbInfo.Error, "db record read failed")
@@ -73,8 +117,12 @@ func BatchReadDB(wg *sync.WaitGroup, tableName string, sourceDBAlias string, dbC
 		if recordCount == 0 {
 			break
 		} else {
+			if progress != nil {
+				trackBatchProgress(progress, seeker.BatchPosition(), shardingAppliers)
+			}
 
 			totalRowsProcessed += recordCount
+			metricRowsRead.WithLabels(sourceDBAlias, tableName).Add(int64(recordCount))
 			t1 := time.Now()
 			time.Sleep(time.Microsecond * 10)
 
@@ -88,10 +136,34 @@ func BatchReadDB(wg *sync.WaitGroup, tableName string, sourceDBAlias string, dbC
 	log.Printf("Block Read events finished")
 
 }
+
+// trackBatchProgress 在每个shard的队列中插入标记, shard提交了标记之前的数据之后更新进度
+func trackBatchProgress(progress *BatchProgress, key []interface{}, shardingAppliers ShardingAppliers) {
+	batch, encoded, err := progress.Read(key)
+	if err != nil {
+		log.PanicErrorf(err, "Invalid batch key: %v", key)
+	}
+
+	for shard, applier := range shardingAppliers {
+		shard := shard
+		commitSQL := models.NewCommitSQL(shard)
+		commitSQL.OnCommitted = func() {
+			progress.Applied(shard, batch, encoded)
+		}
+		applier.PushSQL(commitSQL)
+	}
+}
+
 func ReorderAndApply(dbHelper models.DBHelper, shardingAppliers ShardingAppliers) {
 	ReorderAndApplyWithStep(dbHelper, shardingAppliers, TotalShardNum)
 }
 func ReorderAndApplyWithStep(dbHelper models.DBHelper, shardingAppliers ShardingAppliers, step int) {
+	reorderAndApply(dbHelper, shardingAppliers, shardingAppliers, step, true)
+}
+
+// reorderAndApply 排序之后的数据通过sqlApplier进入队列; closeAppliers为false时, appliers继续接收binlog的SQL
+func reorderAndApply(dbHelper models.DBHelper, sqlApplier models.SqlApplier, shardingAppliers ShardingAppliers,
+	step int, closeAppliers bool) {
 	dbHelper.PrintSummary()
 
 	if dbHelper.NeedReOrder() {
@@ -111,20 +183,38 @@ func ReorderAndApplyWithStep(dbHelper models.DBHelper, shardingAppliers Sharding
 
 				applier.batchInsertMode.Set(true)
 
-				for j := 0; j < shardLen; j++ {
-					if j%10000 == 0 {
-						log.Printf(color.GreenString("Sharding %d")+" insert progress: %d/%d", shardIndex, j, shardLen)
+				if iterator, ok := dbHelper.(models.ShardIterator); ok {
+					// 按照顺序遍历(例如: 外部排序的k-way merge)
+					j := 0
+					err := iterator.IterateShard(shardIndex, func(item interface{}) error {
+						if j%10000 == 0 {
+							log.Printf(color.GreenString("Sharding %d")+" insert progress: %d/%d", shardIndex, j, shardLen)
+						}
+						j++
+						sqlApplier.PushSQL(dbHelper.GetBuilder().InsertIgnore(item))
+						return nil
+					})
+					if err != nil {
+						log.PanicErrorf(err, "IterateShard failed: %d", shardIndex)
 					}
+				} else {
+					for j := 0; j < shardLen; j++ {
+						if j%10000 == 0 {
+							log.Printf(color.GreenString("Sharding %d")+" insert progress: %d/%d", shardIndex, j, shardLen)
+						}
 
-					sql := dbHelper.GetBuilder().InsertIgnore(dbHelper.GetShardItem(shardIndex, j, true))
-					applier.PushSQL(sql)
+						sql := dbHelper.GetBuilder().InsertIgnore(dbHelper.GetShardItem(shardIndex, j, true))
+						sqlApplier.PushSQL(sql)
+					}
 				}
 
 				// 尽快释放内存
 				dbHelper.ClearShard(shardIndex)
 
 				// 否则由手动关闭(不停订阅binlog)
-				shardingAppliers[shardIndex].Close()
+				if closeAppliers {
+					shardingAppliers[shardIndex].Close()
+				}
 
 				log.Printf(color.CyanString("Sharding %d")+" finished insert ignore", shardIndex)
 			}
@@ -139,3 +229,91 @@ func ReorderAndApplyWithStep(dbHelper models.DBHelper, shardingAppliers Sharding
 
 	}
 }
+
+//
+// BatchShardWithBinlog 批量拷贝的同时订阅binlog(同一个进程, 共享appliers)
+// binlog在批量拷贝开始之前订阅, 期间的变化记录在TombstoneTracker中:
+// 被删除的数据不会被insert ignore重新插入, 被修改的数据使用最新的row image
+// 批量数据全部进入队列之后, 继续订阅binlog, 直到stopInput
+//
+func BatchShardWithBinlog(wg *sync.WaitGroup, originTable *OriginTable, tableName string, dbConfig *conf.DatabaseConfig,
+	dbHelper models.DBHelper, shardingAppliers ShardingAppliers,
+	stopInput *atomic2.Bool, pauseInput *atomic2.Bool, progress *BatchProgress,
+	replicaServerId uint, binlogInfo string, gtidSet string, useGTID bool, metaDir string) {
+
+	table := NewShardingTable(originTable, tableName, dbHelper)
+	table.Progress = progress
+	BatchShardWithBinlogTables(wg, []*ShardingTable{table}, dbConfig, shardingAppliers, stopInput, pauseInput,
+		replicaServerId, binlogInfo, gtidSet, useGTID, metaDir)
+}
+
+// BatchShardWithBinlogTables 多个表(同一台源机器)依次批量拷贝, 共享一个binlog stream, 每个表有自己的tombstones
+func BatchShardWithBinlogTables(wg *sync.WaitGroup, tables []*ShardingTable, dbConfig *conf.DatabaseConfig,
+	shardingAppliers ShardingAppliers, stopInput *atomic2.Bool, pauseInput *atomic2.Bool,
+	replicaServerId uint, binlogInfo string, gtidSet string, useGTID bool, metaDir string) {
+
+	wg.Add(1)
+	defer wg.Done()
+
+	shardingAppliers.StartCopy()
+	for _, table := range tables {
+		table.tombstones = NewTombstoneTracker(table.DBHelper.GetBuilder(), shardingAppliers)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		BinlogShardTables(wg, tables, dbConfig, shardingAppliers, stopInput,
+			replicaServerId, binlogInfo, gtidSet, useGTID, metaDir)
+	}()
+	for _, table := range tables {
+		table.tombstones.WaitStarted()
+	}
+
+	for _, table := range tables {
+		db, err := openSourceDB(dbConfig, table.Origin.DbAlias)
+		if err != nil {
+			log.PanicErrorf(err, "Open database failed")
+		}
+		// 表依次拷贝, 开始读取之后才记录这个表的binlog
+		table.tombstones.Open()
+		batchRead(db, table.TableName, table.Origin.DbAlias, table.DBHelper, table.tombstones, shardingAppliers,
+			stopInput, pauseInput, table.Progress)
+		db.Close()
+		if stopInput.Get() {
+			return
+		}
+		reorderAndApply(table.DBHelper, table.tombstones, shardingAppliers, TotalShardNum, false)
+		// 这个表批量读取的SQL全部进入队列之后, 不再需要tombstones
+		table.tombstones.Close()
+	}
+
+	shardingAppliers.FinishCopy()
+	log.Printf(color.MagentaString("Data sharding finished, keep streaming binlog"))
+}
+
+// BatchReadTables 多个表依次批量拷贝(重新排序之后插入), 共享appliers; 全部完成之后关闭appliers
+func BatchReadTables(wg *sync.WaitGroup, tables []*ShardingTable, dbConfig *conf.DatabaseConfig,
+	shardingAppliers ShardingAppliers, stopInput *atomic2.Bool, pauseInput *atomic2.Bool) {
+
+	wg.Add(1)
+	defer wg.Done()
+
+	for _, table := range tables {
+		db, err := openSourceDB(dbConfig, table.Origin.DbAlias)
+		if err != nil {
+			log.PanicErrorf(err, "Open database failed")
+		}
+		batchRead(db, table.TableName, table.Origin.DbAlias, table.DBHelper, shardingAppliers, shardingAppliers,
+			stopInput, pauseInput, table.Progress)
+		db.Close()
+		if stopInput.Get() {
+			break
+		}
+		reorderAndApply(table.DBHelper, shardingAppliers, shardingAppliers, TotalShardNum, false)
+		log.Printf(color.MagentaString("Table %s finished"), table.TableName)
+	}
+
+	for _, applier := range shardingAppliers {
+		applier.Close()
+	}
+}
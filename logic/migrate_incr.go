@@ -1,6 +1,7 @@
 package logic
 
 import (
+	"fmt"
 	"github.com/fatih/color"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 	"github.com/wfxiang08/cyutils/utils/atomic2"
@@ -9,6 +10,7 @@ import (
 	"github.com/wfxiang08/db-sharding/conf"
 	"github.com/wfxiang08/db-sharding/models"
 	"github.com/wfxiang08/db-sharding/mysql"
+	"github.com/wfxiang08/db-sharding/sql"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,15 +19,42 @@ import (
 //
 // sourceConfig 代表一台mysql db
 // 上面可能有多个db
+// tombstones不为nil时, 同时在进行批量拷贝, binlog中的变化需要被记录
 //
 func BinlogShard4SingleMachine(wg *sync.WaitGroup, originTable *OriginTable, dbConfig *conf.DatabaseConfig,
 	dbHelper models.DBHelper,
 	shardingAppliers ShardingAppliers,
 	stopInput *atomic2.Bool,
-	replicaServerId uint, binlogInfo string, metaDir string) {
+	replicaServerId uint, binlogInfo string, gtidSet string, useGTID bool, metaDir string,
+	tombstones *TombstoneTracker) {
+	table := NewShardingTable(originTable, originTable.TablePattern, dbHelper)
+	table.tombstones = tombstones
+	binlogShard(wg, []*ShardingTable{table}, dbConfig, shardingAppliers, stopInput, replicaServerId, binlogInfo,
+		gtidSet, useGTID, metaDir, nil)
+}
+
+// BinlogShardTables 多个表共享一个binlog stream(必须在同一台机器上), 每个表注册一个listener
+// 所有的表共享一个ShardingTransaction: 涉及多个表的binlog事务仍然整体提交
+func BinlogShardTables(wg *sync.WaitGroup, tables []*ShardingTable, dbConfig *conf.DatabaseConfig,
+	shardingAppliers ShardingAppliers, stopInput *atomic2.Bool,
+	replicaServerId uint, binlogInfo string, gtidSet string, useGTID bool, metaDir string) {
+	binlogShard(wg, tables, dbConfig, shardingAppliers, stopInput, replicaServerId, binlogInfo, gtidSet, useGTID,
+		metaDir, nil)
+}
+
+// binlogShard pushLock不为nil时, 多个binlog stream共享shardingAppliers, 事务整体进入applier的队列
+func binlogShard(wg *sync.WaitGroup, tables []*ShardingTable, dbConfig *conf.DatabaseConfig,
+	shardingAppliers ShardingAppliers, stopInput *atomic2.Bool,
+	replicaServerId uint, binlogInfo string, gtidSet string, useGTID bool, metaDir string,
+	pushLock sync.Locker) {
 
 	// binlog一次只处理一台机器
-	_, hostname, port := dbConfig.GetDB(originTable.DbAlias)
+	_, hostname, port := dbConfig.GetDB(tables[0].Origin.DbAlias)
+	for _, table := range tables[1:] {
+		if _, h, p := dbConfig.GetDB(table.Origin.DbAlias); h != hostname || p != port {
+			log.Panicf("Tables of one binlog stream must be on the same host: %s:%d, %s:%d", hostname, port, h, p)
+		}
+	}
 	sourceConfig := &mysql.ConnectionConfig{
 		Key:  mysql.InstanceKey{Hostname: hostname, Port: port},
 		User: dbConfig.User, Password: dbConfig.Password,
@@ -44,16 +73,81 @@ func BinlogShard4SingleMachine(wg *sync.WaitGroup, originTable *OriginTable, dbC
 	// 初始化stream
 	defer wg.Done()
 
-	eventsStreamer := NewEventsStreamer(sourceConfig, MaxRetryNum, replicaServerId, metaDir)
+	// meta-dir中的文件按照源db的alias命名, 主从切换之后hostname可能变化
+	eventsStreamer := NewEventsStreamer(sourceConfig, MaxRetryNum, replicaServerId, metaDir, tables[0].Origin.DbAlias)
+	eventsStreamer.UseGTID = useGTID || len(gtidSet) > 0
 
-	if err := eventsStreamer.InitDBConnections(binlogFile, binlogPos); err != nil {
+	if err := eventsStreamer.InitDBConnections(binlogFile, binlogPos, gtidSet); err != nil {
 		log.PanicErrorf(err, "InitDBConnections failed")
 	}
+	registerStreamer(eventsStreamer)
+	defer unregisterStreamer(eventsStreamer)
+
+	// 一个binlog事务在各个shard上整体提交
+	transaction := NewShardingTransaction(shardingAppliers, eventsStreamer.Checkpoint())
+	if pushLock != nil {
+		transaction.SetPushLock(pushLock)
+	}
+	for _, table := range tables {
+		addTableListener(eventsStreamer, transaction, table)
+	}
+
+	for _, table := range tables {
+		if table.tombstones != nil {
+			table.tombstones.Start()
+		}
+	}
+
+	log.Debugf("Beginning streaming")
+	err := eventsStreamer.StreamEvents(func() bool {
+		return stopInput.Get()
+	})
+
+	// 出错，就直接PanicAbort
+	if err != nil {
+		log.Panicf("Streaming events")
+	} else {
+		log.Debugf("Done streaming")
+	}
+}
 
-	eventsStreamer.AddListener(false, originTable.DatabasePattern, originTable.TablePattern, func(binlogEntry *binlog.BinlogEntry) error {
+// addTableListener 将一个表的binlog events转换成为SQL, 加入到transaction中
+// 一个事务涉及多个表时, 每个listener都会收到Commit, 之后的Commit没有涉及到任何shard
+func addTableListener(eventsStreamer *EventsStreamer, transaction *ShardingTransaction, table *ShardingTable) {
+	dbHelper := table.DBHelper
+	tombstones := table.tombstones
+	// 已经校验过的表结构
+	checkedColumns := make(map[*sql.ColumnList]bool)
+
+	eventsStreamer.AddListener(false, table.Origin.DatabasePattern, table.Origin.TablePattern, func(binlogEntry *binlog.BinlogEntry) error {
+
+		if binlogEntry.Commit {
+			transaction.CommitAt(binlogEntry.Coordinates, binlogEntry.Timestamp)
+			return nil
+		}
 
 		event := binlogEntry.DmlEvent
 
+		// 表结构和builder不一致，继续执行会导致数据被写错, 直接中断
+		// 表结构未知(和row image对不上)时无法校验, 同样中断
+		if checker, ok := dbHelper.GetBuilder().(models.ColumnsChecker); ok && !checkedColumns[event.Columns] {
+			if event.Columns == nil {
+				log.PanicErrorf(fmt.Errorf("unknown columns at %s", binlogEntry.Coordinates.DisplayString()),
+					"CheckColumns failed for %s.%s", event.DatabaseName, event.TableName)
+			}
+			if err := checker.CheckColumns(event.Columns); err != nil {
+				log.PanicErrorf(err, "CheckColumns failed for %s.%s", event.DatabaseName, event.TableName)
+			}
+			checkedColumns[event.Columns] = true
+		}
+
+		// 只同步满足条件的数据
+		if matcher, ok := dbHelper.GetBuilder().(models.RowMatcher); ok {
+			if event = filterEvent(matcher, event); event == nil {
+				return nil
+			}
+		}
+
 		var shardingSQL *models.ShardingSQL
 		// 将各种DML操作转换成为SQL
 		switch event.DML {
@@ -68,22 +162,53 @@ func BinlogShard4SingleMachine(wg *sync.WaitGroup, originTable *OriginTable, dbC
 		// 分配工作
 		if shardingSQL != nil {
 			log.Printf(color.MagentaString("Binlog Entry to shard%02d")+": %s", shardingSQL.ShardingIndex, shardingSQL.String())
-			if dbHelper.ShardFilter(shardingSQL.ShardingIndex) {
-				shardingAppliers.PushSQL(shardingSQL)
+			push := func() {
+				if dbHelper.ShardFilter(shardingSQL.ShardingIndex) {
+					transaction.PushSQL(shardingSQL)
+				}
+			}
+			if tombstones != nil {
+				tombstones.RecordAndPush(event, push)
+			} else {
+				push()
 			}
 		}
 		return nil
 	})
+}
 
-	log.Debugf("Beginning streaming")
-	err := eventsStreamer.StreamEvents(func() bool {
-		return stopInput.Get()
-	})
+// filterEvent 按照过滤条件改写event, 返回nil表示跳过:
+// update之后不再满足条件的数据相当于被删除, update之前不满足条件的数据相当于被插入
+func filterEvent(matcher models.RowMatcher, event *binlog.BinlogDMLEvent) *binlog.BinlogDMLEvent {
+	switch event.DML {
+	case binlog.InsertDML:
+		if !matcher.MatchRow(event.NewColumnValues.AbstractValues()) {
+			return nil
+		}
+	case binlog.DeleteDML:
+		if !matcher.MatchRow(event.WhereColumnValues.AbstractValues()) {
+			return nil
+		}
+	case binlog.UpdateDML:
+		before := matcher.MatchRow(event.WhereColumnValues.AbstractValues())
+		after := matcher.MatchRow(event.NewColumnValues.AbstractValues())
+		if before && after {
+			return event
+		}
 
-	// 出错，就直接PanicAbort
-	if err != nil {
-		log.Panicf("Streaming events")
-	} else {
-		log.Debugf("Done streaming")
+		var rewritten *binlog.BinlogDMLEvent
+		switch {
+		case after:
+			rewritten = binlog.NewBinlogDMLEvent(event.DatabaseName, event.TableName, binlog.InsertDML)
+			rewritten.NewColumnValues = event.NewColumnValues
+		case before:
+			rewritten = binlog.NewBinlogDMLEvent(event.DatabaseName, event.TableName, binlog.DeleteDML)
+			rewritten.WhereColumnValues = event.WhereColumnValues
+		default:
+			return nil
+		}
+		rewritten.Columns = event.Columns
+		return rewritten
 	}
+	return event
 }
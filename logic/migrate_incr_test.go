@@ -0,0 +1,37 @@
+package logic
+
+import (
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+	"github.com/wfxiang08/db-sharding/binlog"
+)
+
+// 第二个column为"ok"的数据满足条件
+type nameMatcher struct{}
+
+func (this nameMatcher) MatchRow(row []interface{}) bool {
+	return row[1] == "ok"
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestFilterEvent$"
+func TestFilterEvent(t *testing.T) {
+	matcher := nameMatcher{}
+
+	event := newTombstoneEvent(binlog.InsertDML, nil, []interface{}{int64(1), "ok"})
+	test.S(t).ExpectTrue(filterEvent(matcher, event) == event)
+	test.S(t).ExpectNil(filterEvent(matcher, newTombstoneEvent(binlog.InsertDML, nil, []interface{}{int64(1), "no"})))
+	test.S(t).ExpectNil(filterEvent(matcher, newTombstoneEvent(binlog.DeleteDML, []interface{}{int64(1), "no"}, nil)))
+
+	// 更新之后满足条件: 插入
+	event = filterEvent(matcher, newTombstoneEvent(binlog.UpdateDML, []interface{}{int64(1), "no"}, []interface{}{int64(1), "ok"}))
+	test.S(t).ExpectTrue(event.DML == binlog.InsertDML)
+	test.S(t).ExpectEquals(event.NewColumnValues.AbstractValues(), []interface{}{int64(1), "ok"})
+
+	// 更新之后不再满足条件: 删除
+	event = filterEvent(matcher, newTombstoneEvent(binlog.UpdateDML, []interface{}{int64(1), "ok"}, []interface{}{int64(1), "no"}))
+	test.S(t).ExpectTrue(event.DML == binlog.DeleteDML)
+	test.S(t).ExpectEquals(event.WhereColumnValues.AbstractValues(), []interface{}{int64(1), "ok"})
+
+	test.S(t).ExpectNil(filterEvent(matcher, newTombstoneEvent(binlog.UpdateDML, []interface{}{int64(1), "no"}, []interface{}{int64(2), "no"})))
+}
@@ -0,0 +1,186 @@
+package logic
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+	"github.com/outbrain/golib/sqlutils"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/db-sharding/conf"
+	"github.com/wfxiang08/db-sharding/models"
+	"github.com/wfxiang08/db-sharding/mysql"
+)
+
+// ReshardHost 同一台机器上的源shards, 共享一个一致性快照和一个binlog stream
+type ReshardHost struct {
+	Key     mysql.InstanceKey
+	Aliases []string
+	DbNames []string
+}
+
+// GroupReshardSources 按照机器对源shards分组, 保持aliases的顺序
+func GroupReshardSources(dbConfig *conf.DatabaseConfig, sourceAliases []string) []*ReshardHost {
+	var hosts []*ReshardHost
+	key2Host := make(map[mysql.InstanceKey]*ReshardHost)
+	for _, alias := range sourceAliases {
+		dbName, hostname, port := dbConfig.GetDB(alias)
+		key := mysql.InstanceKey{Hostname: hostname, Port: port}
+		host, ok := key2Host[key]
+		if !ok {
+			host = &ReshardHost{Key: key}
+			key2Host[key] = host
+			hosts = append(hosts, host)
+		}
+		host.Aliases = append(host.Aliases, alias)
+		host.DbNames = append(host.DbNames, dbName)
+	}
+	return hosts
+}
+
+// SourceShardAliases 老的shards: shard0, ..., shardN-1
+func SourceShardAliases(sourceAliasFormat string, sourceShardNum int) []string {
+	aliases := make([]string, sourceShardNum)
+	for i := 0; i < sourceShardNum; i++ {
+		aliases[i] = fmt.Sprintf(sourceAliasFormat, i)
+	}
+	return aliases
+}
+
+//
+// ReshardCopyAndStream 在线resharding: N个老的shards --> TotalShardNum个新的shards(alias为ShardAliasFormat)
+// 1. 每台源机器打开一个一致性快照, 依次拷贝上面的各个源shard(USE db), 记录快照对应的binlog位置
+// 2. 所有的源机器拷贝完毕, 并且新的shards提交之后, 关闭批量插入模式
+// 3. 每台源机器从快照的位置开始订阅binlog(追数据), 多个stream的事务在pushLock内整体进入appliers的队列
+// 每一行数据只存在于一个源shard上, 不同stream之间不需要保证顺序
+// newDBHelper: 每个源shard一个DBHelper(批量读取的状态不能共享), builder的sharding对应新的shards
+//
+func ReshardCopyAndStream(wg *sync.WaitGroup, sourceAliases []string, tableName string, dbConfig *conf.DatabaseConfig,
+	newDBHelper func(sourceDBAlias string) models.DBHelper, shardingAppliers ShardingAppliers,
+	stopInput *atomic2.Bool, pauseInput *atomic2.Bool,
+	replicaServerId uint, useGTID bool, metaDir string) {
+
+	wg.Add(1)
+	defer wg.Done()
+
+	shardingAppliers.StartCopy()
+	hosts := GroupReshardSources(dbConfig, sourceAliases)
+	log.Printf(color.MagentaString("Reshard %d source shards on %d hosts to %d shards: %s"), len(sourceAliases),
+		len(hosts), TotalShardNum, ShardAlias(0))
+
+	var copied sync.WaitGroup
+	var hostsWg sync.WaitGroup
+	var switchOnce sync.Once
+	var pushLock sync.Mutex
+
+	copied.Add(len(hosts))
+	for i, host := range hosts {
+		hostsWg.Add(1)
+		go func(i int, host *ReshardHost) {
+			defer hostsWg.Done()
+
+			coordinates := reshardCopyHost(host, tableName, dbConfig, newDBHelper, shardingAppliers, stopInput, pauseInput,
+				useGTID)
+			copied.Done()
+			copied.Wait()
+
+			if stopInput.Get() {
+				log.Printf(color.MagentaString("Reshard copy stopped, binlog position of %s: %s, gtid: %s"),
+					host.Key.String(), coordinates.DisplayString(), coordinates.GTIDSet)
+				return
+			}
+
+			// 批量插入的SQL全部提交之后才能切换到binlog
+			switchOnce.Do(func() {
+				shardingAppliers.FinishCopy()
+				log.Printf(color.MagentaString("Reshard copy finished, start streaming"))
+			})
+
+			// 所有的机器拷贝完毕之后才开始订阅binlog, 这段时间内快照位置所在的binlog可能已经被purge
+			if err := checkSnapshotBinlog(dbConfig, host.Aliases[0], coordinates); err != nil {
+				log.PanicErrorf(err, "Reshard streaming %s failed", host.Key.String())
+			}
+
+			gtidSet := ""
+			if useGTID {
+				gtidSet = coordinates.GTIDSet
+			}
+			originTable := &OriginTable{
+				TablePattern:    tableName,
+				DatabasePattern: strings.Join(host.DbNames, ","),
+				DbAlias:         host.Aliases[0],
+			}
+			log.Printf(color.MagentaString("Reshard streaming %s from: %s, gtid: %s"), host.Key.String(),
+				coordinates.DisplayString(), coordinates.GTIDSet)
+
+			// 每个stream使用不同的server id
+			table := NewShardingTable(originTable, tableName, newDBHelper(host.Aliases[0]))
+			binlogShard(wg, []*ShardingTable{table}, dbConfig, shardingAppliers, stopInput, replicaServerId+uint(i),
+				fmt.Sprintf("%s:%d", coordinates.LogFile, coordinates.LogPos), gtidSet, useGTID, metaDir, &pushLock)
+		}(i, host)
+	}
+	hostsWg.Wait()
+}
+
+// checkSnapshotBinlog 快照位置所在的binlog文件在源机器上是否依然存在
+func checkSnapshotBinlog(dbConfig *conf.DatabaseConfig, alias string, coordinates *mysql.BinlogCoordinates) error {
+	db, _, err := sqlutils.GetDB(dbConfig.GetDBUri(alias))
+	if err != nil {
+		return err
+	}
+	logFiles, err := mysql.GetBinaryLogs(db)
+	if err != nil {
+		return err
+	}
+	for _, logFile := range logFiles {
+		if logFile == coordinates.LogFile {
+			return nil
+		}
+	}
+	if len(logFiles) == 0 {
+		return fmt.Errorf("No binary logs found on %s, is log_bin enabled?", alias)
+	}
+	return fmt.Errorf("Binlog %s of the snapshot has been purged on %s (oldest: %s) while waiting for other hosts to "+
+		"finish copying, increase binlog retention (binlog_expire_logs_seconds/expire_logs_days) and reshard again",
+		coordinates.LogFile, alias, logFiles[0])
+}
+
+// reshardCopyHost 在一个一致性快照中依次拷贝一台机器上的源shards, 返回快照对应的binlog位置
+func reshardCopyHost(host *ReshardHost, tableName string, dbConfig *conf.DatabaseConfig,
+	newDBHelper func(sourceDBAlias string) models.DBHelper, shardingAppliers ShardingAppliers,
+	stopInput *atomic2.Bool, pauseInput *atomic2.Bool, useGTID bool) *mysql.BinlogCoordinates {
+
+	snapshot, err := OpenConsistentSnapshot(dbConfig.GetDBUri(host.Aliases[0]))
+	if err != nil {
+		log.PanicErrorf(err, "OpenConsistentSnapshot failed: %s", host.Key.String())
+	}
+	defer snapshot.Close()
+	if useGTID && len(snapshot.Coordinates.GTIDSet) == 0 {
+		log.Panicf("GTID mode requires Executed_Gtid_Set in show master status: %s", host.Key.String())
+	}
+
+	db, err := snapshot.GormDB()
+	if err != nil {
+		log.PanicErrorf(err, "Open snapshot failed: %s", host.Key.String())
+	}
+
+	for i, alias := range host.Aliases {
+		if stopInput.Get() {
+			break
+		}
+		// 快照对整台机器有效
+		if err := snapshot.UseDatabase(host.DbNames[i]); err != nil {
+			log.PanicErrorf(err, "Use database failed: %s", host.DbNames[i])
+		}
+
+		dbHelper := newDBHelper(alias)
+		batchRead(db, tableName, alias, dbHelper, shardingAppliers, shardingAppliers, stopInput, pauseInput, nil)
+		if !stopInput.Get() {
+			reorderAndApply(dbHelper, shardingAppliers, shardingAppliers, TotalShardNum, false)
+		}
+		log.Printf(color.MagentaString("Reshard source %s copied"), alias)
+	}
+	return snapshot.Coordinates
+}
@@ -0,0 +1,228 @@
+package logic
+
+import (
+	"context"
+	gosql "database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/fatih/color"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/mysql"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	"github.com/wfxiang08/cyutils/utils/errors"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/db-sharding/conf"
+	"github.com/wfxiang08/db-sharding/models"
+	"github.com/wfxiang08/db-sharding/mysql"
+	"github.com/wfxiang08/db-sharding/sql"
+)
+
+// ConsistentSnapshot 在一个独占的连接上打开一致性快照(REPEATABLE READ), 并记录快照对应的binlog位置
+// 和mysqldump --single-transaction --master-data的做法一样:
+// FLUSH TABLES WITH READ LOCK; START TRANSACTION WITH CONSISTENT SNAPSHOT; SHOW MASTER STATUS; UNLOCK TABLES
+// 全局读锁期间没有事务提交, 因此快照和binlog位置严格对应; 需要RELOAD权限
+type ConsistentSnapshot struct {
+	db          *gosql.DB
+	conn        *gosql.Conn
+	Coordinates *mysql.BinlogCoordinates
+}
+
+func OpenConsistentSnapshot(uri string) (*ConsistentSnapshot, error) {
+	db, err := gosql.Open("mysql", uri)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, errors.Trace(err)
+	}
+	result := &ConsistentSnapshot{db: db, conn: conn}
+
+	if _, err := conn.ExecContext(ctx, "SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
+		result.Close()
+		return nil, errors.Trace(err)
+	}
+	if _, err := conn.ExecContext(ctx, "FLUSH TABLES WITH READ LOCK"); err != nil {
+		result.Close()
+		return nil, errors.Trace(err)
+	}
+
+	// 持有全局读锁时开启快照, 读取binlog的位置
+	err = func() error {
+		defer conn.ExecContext(ctx, "UNLOCK TABLES")
+
+		if _, err := conn.ExecContext(ctx, "START TRANSACTION WITH CONSISTENT SNAPSHOT"); err != nil {
+			return err
+		}
+		// 全局读锁对所有的连接有效, 可以通过连接池读取
+		coordinates, err := mysql.GetSelfBinlogCoordinates(db)
+		if err != nil {
+			return err
+		}
+		if coordinates == nil || len(coordinates.LogFile) == 0 {
+			return fmt.Errorf("Binlog not enabled, show master status returned nothing")
+		}
+		result.Coordinates = coordinates
+		return nil
+	}()
+	if err != nil {
+		result.Close()
+		return nil, errors.Trace(err)
+	}
+
+	log.Printf(color.MagentaString("Consistent snapshot opened at: %s, gtid: %s"),
+		result.Coordinates.DisplayString(), result.Coordinates.GTIDSet)
+	return result, nil
+}
+
+// GormDB 通过gorm读取快照中的数据; 所有的请求都在同一个连接上串行执行
+func (this *ConsistentSnapshot) GormDB() (*gorm.DB, error) {
+	return gorm.Open("mysql", &snapshotConn{conn: this.conn})
+}
+
+// UseDatabase 快照对整台机器上的所有db有效, 切换当前的db(KeysetBatchReader通过database()读取表结构)
+func (this *ConsistentSnapshot) UseDatabase(dbName string) error {
+	_, err := this.conn.ExecContext(context.Background(), "USE "+sql.EscapeName(dbName))
+	return err
+}
+
+// Close 结束快照对应的事务
+func (this *ConsistentSnapshot) Close() error {
+	ctx := context.Background()
+	this.conn.ExecContext(ctx, "COMMIT")
+	this.conn.Close()
+	return this.db.Close()
+}
+
+// snapshotConn 将*sql.Conn适配成为gorm.SQLCommon
+type snapshotConn struct {
+	conn *gosql.Conn
+}
+
+func (this *snapshotConn) Exec(query string, args ...interface{}) (gosql.Result, error) {
+	return this.conn.ExecContext(context.Background(), query, args...)
+}
+
+func (this *snapshotConn) Prepare(query string) (*gosql.Stmt, error) {
+	return this.conn.PrepareContext(context.Background(), query)
+}
+
+func (this *snapshotConn) Query(query string, args ...interface{}) (*gosql.Rows, error) {
+	return this.conn.QueryContext(context.Background(), query, args...)
+}
+
+func (this *snapshotConn) QueryRow(query string, args ...interface{}) *gosql.Row {
+	return this.conn.QueryRowContext(context.Background(), query, args...)
+}
+
+//
+// SnapshotCopyAndStream 批量拷贝和binlog的无缝衔接:
+// 1. 打开一致性快照, 记录快照对应的binlog位置
+// 2. 从快照中批量拷贝数据(reorder模式下排序之后再插入)
+// 3. 等待所有的shards提交之后, 从记录的binlog位置开始订阅binlog
+// 快照之后的所有变化都在binlog中, 不存在读取数据和binlog之间的时间窗口; 拷贝期间binlog不能被清理
+//
+func SnapshotCopyAndStream(wg *sync.WaitGroup, originTable *OriginTable, tableName string, dbConfig *conf.DatabaseConfig,
+	dbHelper models.DBHelper, shardingAppliers ShardingAppliers,
+	stopInput *atomic2.Bool, pauseInput *atomic2.Bool,
+	replicaServerId uint, useGTID bool, metaDir string) {
+
+	table := NewShardingTable(originTable, tableName, dbHelper)
+	SnapshotCopyAndStreamTables(wg, []*ShardingTable{table}, dbConfig, shardingAppliers, stopInput, pauseInput,
+		replicaServerId, useGTID, metaDir)
+}
+
+// checkSnapshotTables 所有的表都需要在同一台源机器上(host:port一致), 否则其他机器上的表不在快照中
+func checkSnapshotTables(tables []*ShardingTable, dbConfig *conf.DatabaseConfig) error {
+	if len(tables) == 0 {
+		return fmt.Errorf("no tables to copy")
+	}
+	for _, table := range tables {
+		if !dbConfig.HasDB(table.Origin.DbAlias) {
+			return fmt.Errorf("db alias not found: %s, table: %s", table.Origin.DbAlias, table.TableName)
+		}
+	}
+	_, snapshotHost, snapshotPort := dbConfig.GetDB(tables[0].Origin.DbAlias)
+	for _, table := range tables {
+		_, hostname, port := dbConfig.GetDB(table.Origin.DbAlias)
+		if hostname != snapshotHost || port != snapshotPort {
+			return fmt.Errorf("table %s(%s) on %s:%d, not on the snapshot host %s:%d", table.TableName,
+				table.Origin.DbAlias, hostname, port, snapshotHost, snapshotPort)
+		}
+	}
+	return nil
+}
+
+// SnapshotCopyAndStreamTables 同一台源机器上的多个表: 在一个快照中依次拷贝, 然后共享一个binlog stream
+func SnapshotCopyAndStreamTables(wg *sync.WaitGroup, tables []*ShardingTable, dbConfig *conf.DatabaseConfig,
+	shardingAppliers ShardingAppliers, stopInput *atomic2.Bool, pauseInput *atomic2.Bool,
+	replicaServerId uint, useGTID bool, metaDir string) {
+
+	wg.Add(1)
+	defer wg.Done()
+
+	// 快照和binlog stream都只在tables[0]所在的机器上
+	if err := checkSnapshotTables(tables, dbConfig); err != nil {
+		log.PanicErrorf(err, "SnapshotCopyAndStreamTables failed")
+	}
+
+	shardingAppliers.StartCopy()
+	snapshot, err := OpenConsistentSnapshot(dbConfig.GetDBUri(tables[0].Origin.DbAlias))
+	if err != nil {
+		log.PanicErrorf(err, "OpenConsistentSnapshot failed")
+	}
+	coordinates := snapshot.Coordinates
+	if useGTID && len(coordinates.GTIDSet) == 0 {
+		snapshot.Close()
+		log.Panicf("GTID mode requires Executed_Gtid_Set in show master status")
+	}
+
+	db, err := snapshot.GormDB()
+	if err != nil {
+		snapshot.Close()
+		log.PanicErrorf(err, "Open snapshot failed")
+	}
+
+	// 快照不支持断点续传
+	for _, table := range tables {
+		if stopInput.Get() {
+			break
+		}
+		// 快照对整台机器有效, 不同的表可以在不同的db中
+		dbName, _, _ := dbConfig.GetDB(table.Origin.DbAlias)
+		if err := snapshot.UseDatabase(dbName); err != nil {
+			snapshot.Close()
+			log.PanicErrorf(err, "Use database failed: %s", dbName)
+		}
+		batchRead(db, table.TableName, table.Origin.DbAlias, table.DBHelper, shardingAppliers, shardingAppliers,
+			stopInput, pauseInput, nil)
+	}
+	// 尽快结束长事务
+	snapshot.Close()
+
+	if stopInput.Get() {
+		log.Printf(color.MagentaString("Batch copy stopped, binlog position of snapshot: %s, gtid: %s"),
+			coordinates.DisplayString(), coordinates.GTIDSet)
+		return
+	}
+
+	for _, table := range tables {
+		reorderAndApply(table.DBHelper, shardingAppliers, shardingAppliers, TotalShardNum, false)
+	}
+
+	// 批量插入的SQL全部提交之后才能切换到binlog
+	shardingAppliers.FinishCopy()
+	log.Printf(color.MagentaString("Data sharding finished, start streaming from: %s, gtid: %s"),
+		coordinates.DisplayString(), coordinates.GTIDSet)
+
+	gtidSet := ""
+	if useGTID {
+		gtidSet = coordinates.GTIDSet
+	}
+	binlogShard(wg, tables, dbConfig, shardingAppliers, stopInput, replicaServerId,
+		fmt.Sprintf("%s:%d", coordinates.LogFile, coordinates.LogPos), gtidSet, useGTID, metaDir, nil)
+}
@@ -0,0 +1,28 @@
+package logic
+
+import (
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+	"github.com/wfxiang08/db-sharding/conf"
+)
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestCheckSnapshotTables$"
+func TestCheckSnapshotTables(t *testing.T) {
+	dbConfig := &conf.DatabaseConfig{Databases: []string{
+		"a:db1@source01@3306",
+		"b:db2@source01@3306",
+		"c:db1@source02@3306",
+		"d:db1@source01@3307",
+	}}
+	table := func(alias string, name string) *ShardingTable {
+		return NewShardingTable(&OriginTable{DbAlias: alias}, name, nil)
+	}
+
+	test.S(t).ExpectNotNil(checkSnapshotTables(nil, dbConfig))
+	// 同一台机器上的不同db
+	test.S(t).ExpectNil(checkSnapshotTables([]*ShardingTable{table("a", "t1"), table("b", "t2")}, dbConfig))
+	test.S(t).ExpectNotNil(checkSnapshotTables([]*ShardingTable{table("a", "t1"), table("c", "t2")}, dbConfig))
+	test.S(t).ExpectNotNil(checkSnapshotTables([]*ShardingTable{table("a", "t1"), table("d", "t2")}, dbConfig))
+	test.S(t).ExpectNotNil(checkSnapshotTables([]*ShardingTable{table("a", "t1"), table("e", "t2")}, dbConfig))
+}
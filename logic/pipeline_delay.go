@@ -0,0 +1,149 @@
+package logic
+
+import (
+	"time"
+
+	"github.com/fatih/color"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+)
+
+const (
+	DefaultCaughtUpDelay  = 5 * time.Second
+	DefaultCaughtUpWindow = 30 * time.Second
+	pipelineDelayLogTicks = 10 // 每10秒打印一次延迟
+)
+
+// PipelineDelay 跟踪各个shard的延迟: now - 最近提交的binlog事务在master上的时间
+// 1. shard的队列中没有等待的SQL时, shard和binlog stream读取的位置一致, 使用stream中最近的event的时间
+// 2. delay持续window都低于threshold时, shard追上了(caught up); 所有的shards都追上之后可以切换
+// 3. 批量拷贝期间(StartCopy到FinishCopy), 数据可能还在读取或者排序, 不会被认为追上
+// 注意: master上没有写入时event的时间不会更新, delay会一直增长; 可以通过-throttle-alias的heartbeat(lag_source = "heartbeat")保证有event
+type PipelineDelay struct {
+	appliers   ShardingAppliers
+	threshold  time.Duration
+	window     time.Duration
+	belowSince []time.Time // delay开始低于threshold的时间
+	caughtUp   bool
+}
+
+func NewPipelineDelay(shardingAppliers ShardingAppliers, threshold time.Duration, window time.Duration) *PipelineDelay {
+	return &PipelineDelay{
+		appliers:   shardingAppliers,
+		threshold:  threshold,
+		window:     window,
+		belowSince: make([]time.Time, len(shardingAppliers)),
+	}
+}
+
+// StartPipelineDelay 每秒更新一次各个shard的延迟
+func StartPipelineDelay(shardingAppliers ShardingAppliers, threshold time.Duration, window time.Duration) *PipelineDelay {
+	result := NewPipelineDelay(shardingAppliers, threshold, window)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		for i := 1; ; i++ {
+			now := <-ticker.C
+			result.update(now, streamEventTimestamp())
+			if i%pipelineDelayLogTicks == 0 {
+				result.printDelay()
+			}
+		}
+	}()
+	return result
+}
+
+// CaughtUp 所有的shards都追上了
+func (this ShardingAppliers) CaughtUp() bool {
+	for _, applier := range this {
+		if !applier.caughtUp.Get() {
+			return false
+		}
+	}
+	return len(this) > 0
+}
+
+// update streamTimestamp为binlog streams读取到的位置(秒), 0表示未知
+func (this *PipelineDelay) update(now time.Time, streamTimestamp int64) {
+	allCaughtUp := len(this.appliers) > 0
+	for shard, applier := range this.appliers {
+		copying := applier.copying.Get()
+		timestamp := applier.eventTimestamp.Get()
+		if !copying && applier.isIdle() && streamTimestamp > timestamp {
+			timestamp = streamTimestamp
+		}
+		if timestamp == 0 {
+			// 还没有提交过binlog事务
+			applier.delayKnown.Set(false)
+			applier.caughtUp.Set(false)
+			this.belowSince[shard] = time.Time{}
+			allCaughtUp = false
+			continue
+		}
+
+		delay := now.Unix() - timestamp
+		if delay < 0 {
+			delay = 0
+		}
+		applier.delaySeconds.Set(delay)
+		applier.delayKnown.Set(true)
+
+		if !copying && time.Duration(delay)*time.Second < this.threshold {
+			if this.belowSince[shard].IsZero() {
+				this.belowSince[shard] = now
+			}
+		} else {
+			this.belowSince[shard] = time.Time{}
+		}
+		caughtUp := !this.belowSince[shard].IsZero() && now.Sub(this.belowSince[shard]) >= this.window
+		applier.caughtUp.Set(caughtUp)
+		allCaughtUp = allCaughtUp && caughtUp
+	}
+
+	if this.caughtUp != allCaughtUp {
+		this.caughtUp = allCaughtUp
+		if allCaughtUp {
+			log.Printf(color.MagentaString("Pipeline caught up")+": delay of all shards below %s for %s", this.threshold, this.window)
+		} else {
+			log.Printf(color.YellowString("Pipeline fell behind") + ", not safe to cutover")
+		}
+	}
+}
+
+func (this *PipelineDelay) printDelay() {
+	maxDelay, maxShard, caughtUp, known := int64(0), 0, 0, 0
+	for shard, applier := range this.appliers {
+		if !applier.delayKnown.Get() {
+			continue
+		}
+		known++
+		if delay := applier.delaySeconds.Get(); delay >= maxDelay {
+			maxDelay, maxShard = delay, shard
+		}
+		if applier.caughtUp.Get() {
+			caughtUp++
+		}
+	}
+	if known == 0 {
+		return
+	}
+	log.Printf(color.CyanString("Pipeline delay")+": max %ds at shard %02d, caught up shards: %d/%d",
+		maxDelay, maxShard, caughtUp, len(this.appliers))
+}
+
+// isIdle push的SQL(包括队列中和正在执行的)都已经提交
+func (this *ShardingApplier) isIdle() bool {
+	return this.totalExecuted.Get() >= this.totalPushed.Get()
+}
+
+// streamEventTimestamp 多个binlog streams时取最慢的一个; 有stream还没有读到event时返回0
+func streamEventTimestamp() int64 {
+	result := int64(0)
+	for i, status := range StreamersStatus() {
+		if status.EventTimestamp == 0 {
+			return 0
+		}
+		if i == 0 || status.EventTimestamp < result {
+			result = status.EventTimestamp
+		}
+	}
+	return result
+}
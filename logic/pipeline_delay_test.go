@@ -0,0 +1,96 @@
+package logic
+
+import (
+	"testing"
+	"time"
+
+	test "github.com/outbrain/golib/tests"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	"github.com/wfxiang08/db-sharding/models"
+	"github.com/wfxiang08/db-sharding/mysql"
+)
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestPipelineDelay$"
+func TestPipelineDelay(t *testing.T) {
+	appliers := ShardingAppliers{
+		&ShardingApplier{sqls: make(chan *models.ShardingSQL, 10), pauseInput: &atomic2.Bool{}},
+		&ShardingApplier{shardingIndex: 1, sqls: make(chan *models.ShardingSQL, 10), pauseInput: &atomic2.Bool{}},
+	}
+	now := time.Unix(1000, 0)
+
+	// 事务提交之后才更新shard的时间
+	transaction := NewShardingTransaction(appliers, nil)
+	transaction.PushSQL(&models.ShardingSQL{ShardingIndex: 0, SQL: "sql1"})
+	transaction.CommitAt(mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 100}, 990)
+	applier := appliers[0]
+	applier.bufferSQL(<-applier.sqls)
+	applier.bufferSQL(<-applier.sqls)
+	test.S(t).ExpectEquals(applier.eventTimestamp.Get(), int64(0))
+	applier.ackCommitted()
+	test.S(t).ExpectEquals(applier.eventTimestamp.Get(), int64(990))
+
+	delay := NewPipelineDelay(appliers, 5*time.Second, 10*time.Second)
+	delay.update(now, 0)
+	test.S(t).ExpectEquals(applier.Status().DelaySeconds, int64(10))
+	// shard 1没有提交过binlog事务
+	test.S(t).ExpectEquals(appliers[1].Status().DelaySeconds, int64(-1))
+
+	// shard 0的SQL还没有执行, 不能使用stream的位置
+	delay.update(now, 999)
+	test.S(t).ExpectEquals(applier.Status().DelaySeconds, int64(10))
+	applier.totalExecuted.Set(applier.totalPushed.Get())
+	delay.update(now, 999)
+	test.S(t).ExpectEquals(applier.Status().DelaySeconds, int64(1))
+	test.S(t).ExpectEquals(appliers[1].Status().DelaySeconds, int64(1))
+	test.S(t).ExpectFalse(appliers.CaughtUp())
+
+	// delay持续低于threshold之后才算追上
+	delay.update(now.Add(5*time.Second), 1004)
+	test.S(t).ExpectFalse(appliers.CaughtUp())
+	delay.update(now.Add(10*time.Second), 1009)
+	test.S(t).ExpectTrue(appliers.CaughtUp())
+	test.S(t).ExpectTrue(applier.Status().CaughtUp)
+
+	// 延迟变大之后需要重新计时
+	delay.update(now.Add(20*time.Second), 1010)
+	test.S(t).ExpectFalse(appliers.CaughtUp())
+	delay.update(now.Add(21*time.Second), 1020)
+	test.S(t).ExpectFalse(appliers.CaughtUp())
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestPipelineDelayCopying$"
+func TestPipelineDelayCopying(t *testing.T) {
+	appliers := ShardingAppliers{
+		&ShardingApplier{sqls: make(chan *models.ShardingSQL, 10), pauseInput: &atomic2.Bool{}},
+		&ShardingApplier{shardingIndex: 1, sqls: make(chan *models.ShardingSQL, 10), pauseInput: &atomic2.Bool{}},
+	}
+	now := time.Unix(1000, 0)
+	delay := NewPipelineDelay(appliers, 5*time.Second, 10*time.Second)
+
+	// 批量读取(或者排序)期间appliers都是idle的, 但是拷贝还没有完成
+	appliers.StartCopy()
+	for i := 0; i <= 20; i++ {
+		delay.update(now.Add(time.Duration(i)*time.Second), 1000+int64(i))
+	}
+	test.S(t).ExpectFalse(appliers.CaughtUp())
+	test.S(t).ExpectTrue(appliers[0].Status().Copying)
+	test.S(t).ExpectEquals(appliers[0].Status().DelaySeconds, int64(-1))
+
+	// 已经push但是还没有执行的SQL
+	for _, applier := range appliers {
+		applier.copying.Set(false)
+	}
+	appliers[1].totalPushed.Incr()
+	for i := 21; i <= 40; i++ {
+		delay.update(now.Add(time.Duration(i)*time.Second), 1000+int64(i))
+	}
+	test.S(t).ExpectTrue(appliers[0].Status().CaughtUp)
+	test.S(t).ExpectFalse(appliers[1].Status().CaughtUp)
+	test.S(t).ExpectFalse(appliers.CaughtUp())
+
+	appliers[1].totalExecuted.Incr()
+	for i := 41; i <= 51; i++ {
+		delay.update(now.Add(time.Duration(i)*time.Second), 1000+int64(i))
+	}
+	test.S(t).ExpectTrue(appliers.CaughtUp())
+}
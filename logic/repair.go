@@ -0,0 +1,155 @@
+package logic
+
+import (
+	gosql "database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/fatih/color"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/db-sharding/models"
+	"github.com/wfxiang08/db-sharding/sql"
+)
+
+// RepairPlan 根据校验的结果生成修复的SQL, 每一个key都从源表重新读取(校验之后数据可能又发生了变化):
+// 1. 源表中存在: 通过builder的Insert(replace into)写入正确的shard; 如果出现在错误的shard上, 从错误的shard上删除
+// 2. 源表中不存在: 从shard上删除
+// key按照column的类型转换之后才作为参数, 否则bigint按照double比较, 可能读取/删除相邻的行
+func (this *Verifier) RepairPlan(diffs []*RowDiff) ([]*models.ShardingSQL, error) {
+	var plan []*models.ShardingSQL
+	planned := make(map[string]bool)
+	addSQL := func(shardingSQL *models.ShardingSQL) {
+		// missing + extra(shard错误)对应同一个key
+		key := fmt.Sprintf("%d:%s:%s", shardingSQL.ShardingIndex, shardingSQL.SQL, shardingSQL.RowKey)
+		if !planned[key] {
+			planned[key] = true
+			plan = append(plan, shardingSQL)
+		}
+	}
+
+	var checkedColumns *sql.ColumnList
+	for _, diff := range diffs {
+		key, err := this.keyValues(diff.Key)
+		if err != nil {
+			return nil, err
+		}
+		columns, row, err := this.readSourceRow(key)
+		if err != nil {
+			return nil, err
+		}
+
+		expectedShard := -1
+		if row != nil {
+			// 表结构和builder不一致时, 数据会被写错
+			if checker, ok := this.builder.(models.ColumnsChecker); ok && (checkedColumns == nil || !checkedColumns.Equals(columns)) {
+				if err := checker.CheckColumns(columns); err != nil {
+					return nil, err
+				}
+				checkedColumns = columns
+			}
+			insertSQL := this.builder.Insert(row)
+			expectedShard = insertSQL.ShardingIndex
+			if this.filter(expectedShard) {
+				addSQL(insertSQL)
+			}
+		}
+
+		if diff.Shard != expectedShard {
+			deleteSQL := this.table.DeleteByKey(key)
+			deleteSQL.ShardingIndex = diff.Shard
+			addSQL(deleteSQL)
+		}
+	}
+	return plan, nil
+}
+
+// readSourceRow 按照pk读取源表中完整的一行(和binlog的row image一致), 不存在时返回nil
+// 多个源表时(resharding), 依次在各个源表中查找; key需要经过keyValues转换
+func (this *Verifier) readSourceRow(key []interface{}) (*sql.ColumnList, []interface{}, error) {
+	for _, sourceDB := range this.sourceDBs {
+		columns, row, err := this.readSourceDBRow(sourceDB, key)
+		if err != nil || row != nil || len(this.sourceDBs) == 1 {
+			return columns, row, err
+		}
+	}
+	return nil, nil, nil
+}
+
+func (this *Verifier) readSourceDBRow(sourceDB *gosql.DB, key []interface{}) (*sql.ColumnList, []interface{}, error) {
+	where, args := this.keyWhere(key)
+	query := fmt.Sprintf("select * from %s%s limit 1", sql.EscapeName(this.sourceTable), where)
+	rows, err := sourceDB.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+	columns := sql.NewColumnList(names)
+	if !rows.Next() {
+		return columns, nil, rows.Err()
+	}
+	values := sql.NewColumnValues(len(names))
+	if err := rows.Scan(values.ValuesPointers...); err != nil {
+		return nil, nil, err
+	}
+	row := values.AbstractValues()
+
+	// 确认读取到的就是这个key, 而不是比较时类型转换匹配到的其他行
+	rowKey := make([]interface{}, len(this.primaryKey))
+	for i, name := range this.primaryKey {
+		ordinal, ok := columns.Ordinals[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("Primary key column %s not found in %s", name, this.sourceTable)
+		}
+		rowKey[i] = row[ordinal]
+	}
+	if rowKey, err = this.keyValues(rowKey); err != nil {
+		return nil, nil, err
+	}
+	if !sameKey(key, rowKey) {
+		return nil, nil, fmt.Errorf("Row of key %s not matched in %s, got: %s", rowString(key), this.sourceTable, rowString(rowKey))
+	}
+	return columns, row, nil
+}
+
+// sameKey 整数和binary按照值比较; 字符串是否相等由column的collation决定(例如: 不区分大小写), 不再检查
+func sameKey(key, rowKey []interface{}) bool {
+	for i := range key {
+		if _, ok := key[i].(string); ok {
+			continue
+		}
+		if valueString(key[i]) != valueString(rowKey[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *Verifier) keyWhere(key []interface{}) (string, []interface{}) {
+	conditions := make([]string, len(this.primaryKey))
+	for i, name := range this.primaryKey {
+		conditions[i] = fmt.Sprintf("%s = ?", sql.EscapeName(name))
+	}
+	return " where " + strings.Join(conditions, " and "), key
+}
+
+// PrintRepairPlan dry-run: 只打印修复的SQL
+func PrintRepairPlan(plan []*models.ShardingSQL) {
+	for _, shardingSQL := range plan {
+		log.Printf(color.YellowString("Repair shard%02d")+": %s", shardingSQL.ShardingIndex, shardingSQL.String())
+	}
+	log.Printf(color.MagentaString("Repair plan")+": %d sqls", len(plan))
+}
+
+// Repair 将修复的SQL交给各个shard的applier执行, 所有的SQL提交之后返回
+func Repair(plan []*models.ShardingSQL, shardingAppliers ShardingAppliers) {
+	for _, shardingSQL := range plan {
+		shardingAppliers.PushSQL(shardingSQL)
+	}
+	shardingAppliers.WaitCommitted()
+	log.Printf(color.MagentaString("Repair finished")+": %d sqls", len(plan))
+}
@@ -0,0 +1,231 @@
+package logic
+
+import (
+	"path"
+	"sort"
+
+	"github.com/jinzhu/gorm"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/db-sharding/conf"
+	"github.com/wfxiang08/db-sharding/models"
+	"github.com/wfxiang08/db-sharding/mysql"
+)
+
+// RowDBHelper 通用的DBHelper: 按照行读取源表(*models.RowModel), 配合RowModelBuilder使用, 不需要为每个表编写代码
+type RowDBHelper struct {
+	builder     *models.RowModelBuilder
+	shardedRows [][]*models.RowModel
+	needReOrder bool
+	skipShards  map[int]bool
+	batchReader *KeysetBatchReader
+	seekValues  []interface{}   // 断点续传的位置
+	sorter      *ExternalSorter // 不为nil时, 数据排序之后写入磁盘
+}
+
+// NewRowDBHelper sortDir不为空时使用外部排序, 每个shard在内存中最多保留sortRunSize条数据
+func NewRowDBHelper(builder *models.RowModelBuilder, skipShards []int, cacheSize int64, needReOrder bool,
+	sortDir string, sortRunSize int) (*RowDBHelper, error) {
+
+	result := &RowDBHelper{
+		builder:     builder,
+		shardedRows: make([][]*models.RowModel, TotalShardNum),
+		needReOrder: needReOrder,
+		skipShards:  make(map[int]bool),
+	}
+	for _, shard := range skipShards {
+		result.skipShards[shard] = true
+	}
+
+	if needReOrder && len(sortDir) > 0 {
+		var err error
+		result.sorter, err = NewExternalSorter(sortDir, TotalShardNum, sortRunSize, &models.RowModel{},
+			func(a, b interface{}) bool {
+				return result.less(a, b)
+			})
+		if err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+
+	for i := 0; i < TotalShardNum; i++ {
+		result.shardedRows[i] = make([]*models.RowModel, 0, cacheSize)
+	}
+	return result, nil
+}
+
+// NewMappingTable 根据配置创建ShardingTable: 从源表读取表结构, 生成builder和DBHelper
+func NewMappingTable(dbConfig *conf.DatabaseConfig, mapping *conf.TableMapping, cacheSize int64, needReOrder bool,
+	sortDir string, sortRunSize int) (*ShardingTable, error) {
+
+	db, err := openSourceDB(dbConfig, mapping.SourceAlias)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	dbName, _, _ := dbConfig.GetDB(mapping.SourceAlias)
+	columns, err := mysql.GetTableColumns(db.DB(), dbName, mapping.SourceTable)
+	if err != nil {
+		return nil, err
+	}
+
+	builder, err := models.NewRowModelBuilder(mapping, columns.Names(), TotalShardNum)
+	if err != nil {
+		return nil, err
+	}
+	strategy, err := models.NewShardStrategy(&dbConfig.Sharding, TotalShardNum)
+	if err != nil {
+		return nil, err
+	}
+	builder.SetShardStrategy(strategy)
+
+	// 外部排序的文件按照表分开
+	if len(sortDir) > 0 {
+		sortDir = path.Join(sortDir, mapping.Name)
+	}
+	dbHelper, err := NewRowDBHelper(builder, mapping.SkipShards, cacheSize, needReOrder, sortDir, sortRunSize)
+	if err != nil {
+		return nil, err
+	}
+
+	originTable := &OriginTable{
+		TablePattern:    mapping.SourceTable,
+		DatabasePattern: mapping.SourceDB,
+		DbAlias:         mapping.SourceAlias,
+	}
+	return NewShardingTable(originTable, mapping.SourceTable, dbHelper), nil
+}
+
+func (this *RowDBHelper) less(a, b interface{}) bool {
+	return compareKey(this.builder.ReorderKey(a), this.builder.ReorderKey(b)) < 0
+}
+
+func (this *RowDBHelper) GetBuilder() models.ModelBuilder {
+	return this.builder
+}
+
+func (this *RowDBHelper) ShardFilter(shardIndex int) bool {
+	return !this.skipShards[shardIndex]
+}
+
+func (this *RowDBHelper) BatchProcess(db *gorm.DB, tableName string, sourceDBAlias string, sqlApplier models.SqlApplier) (*gorm.DB, int) {
+	dbInfo := db.New()
+	if this.batchReader == nil {
+		batchReader, err := NewKeysetBatchReader(db, tableName, BatchReadCount)
+		if err != nil {
+			dbInfo.AddError(err)
+			return dbInfo, 0
+		}
+		this.batchReader = batchReader
+		if err := this.batchReader.Seek(this.seekValues); err != nil {
+			dbInfo.AddError(err)
+			return dbInfo, 0
+		}
+	}
+
+	columns, rows, err := this.batchReader.NextRows(db)
+	if err != nil {
+		dbInfo.AddError(err)
+		return dbInfo, 0
+	}
+	// 表结构和配置不一致时中断
+	if len(rows) > 0 {
+		if err := this.builder.CheckColumns(columns); err != nil {
+			dbInfo.AddError(err)
+			return dbInfo, 0
+		}
+	}
+
+	for _, row := range rows {
+		if !this.builder.MatchRow(row) {
+			continue
+		}
+		model := &models.RowModel{Values: row}
+		shardIndex := this.builder.GetShardingIndex4Model(model)
+		if !this.ShardFilter(shardIndex) {
+			continue
+		}
+		if this.sorter != nil {
+			if err := this.sorter.Add(shardIndex, model); err != nil {
+				log.PanicErrorf(err, "ExternalSorter add failed")
+			}
+		} else if this.NeedReOrder() {
+			this.shardedRows[shardIndex] = append(this.shardedRows[shardIndex], model)
+		} else {
+			sqlApplier.PushSQL(this.builder.InsertIgnore(model))
+		}
+	}
+	return dbInfo, len(rows)
+}
+
+func (this *RowDBHelper) BatchPosition() []interface{} {
+	if this.batchReader == nil {
+		return this.seekValues
+	}
+	return this.batchReader.LastValues()
+}
+
+func (this *RowDBHelper) BatchSeek(lastValues []interface{}) {
+	this.seekValues = lastValues
+	if this.batchReader != nil {
+		if err := this.batchReader.Seek(lastValues); err != nil {
+			log.PanicErrorf(err, "BatchSeek failed")
+		}
+	}
+}
+
+func (this *RowDBHelper) NeedReOrder() bool {
+	return this.needReOrder
+}
+
+func (this *RowDBHelper) ShardSort(shard int) {
+	// 外部排序在IterateShard时做merge
+	if this.NeedReOrder() && this.sorter == nil {
+		rows := this.shardedRows[shard]
+		sort.SliceStable(rows, func(i, j int) bool {
+			return this.less(rows[i], rows[j])
+		})
+	}
+}
+
+func (this *RowDBHelper) PrintSummary() {
+	for i := 0; i < TotalShardNum; i++ {
+		log.Printf("SHARDXX %d, total size: %d", i, this.GetShardLen(i))
+	}
+}
+
+// IterateShard 按照排序之后的顺序遍历
+func (this *RowDBHelper) IterateShard(shard int, onItem func(item interface{}) error) error {
+	if this.sorter != nil {
+		return this.sorter.Iterate(shard, onItem)
+	}
+	for i := range this.shardedRows[shard] {
+		if err := onItem(this.GetShardItem(shard, i, true)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *RowDBHelper) GetShardItem(shard int, index int, clear bool) interface{} {
+	result := this.shardedRows[shard][index]
+	if clear {
+		this.shardedRows[shard][index] = nil
+	}
+	return result
+}
+
+func (this *RowDBHelper) ClearShard(shard int) {
+	if this.sorter != nil {
+		this.sorter.Clear(shard)
+	}
+	this.shardedRows[shard] = nil
+}
+
+func (this *RowDBHelper) GetShardLen(shard int) int {
+	if this.sorter != nil {
+		return this.sorter.Len(shard)
+	}
+	return len(this.shardedRows[shard])
+}
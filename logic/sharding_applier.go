@@ -3,7 +3,6 @@ package logic
 import (
 	"database/sql"
 	"encoding/json"
-	"fmt"
 	"github.com/fatih/color"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 	"github.com/wfxiang08/cyutils/utils"
@@ -11,6 +10,7 @@ import (
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
 	"github.com/wfxiang08/db-sharding/conf"
 	"github.com/wfxiang08/db-sharding/models"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,26 +20,43 @@ import (
 type ShardingApplier struct {
 	shardingIndex   int
 	sqlsBuffered    []*models.ShardingSQL
+	sqlsCommitted   int      // sqlsBuffered[:sqlsCommitted]为完整的事务，可以被提交
+	inTransaction   bool     // sqlsBuffered的末尾是一个还没有结束的binlog事务
+	pendingAcks     []func() // 事务结束之后才能回调的标记
+	committedAcks   []func() // sqlsBuffered[:sqlsCommitted]提交之后的回调
 	sqls            chan *models.ShardingSQL
-	batchInsertSize int
+	batchInsertSize atomic2.Int64 // 可以通过admin api修改
 	maxRetries      int
 	db              *sql.DB
 
-	totalPushed   int
-	totalExecuted int
+	totalPushed   atomic2.Int64
+	totalExecuted atomic2.Int64
 	dryRun        bool
 
 	isClosed atomic2.Bool
 
 	batchInsertMode atomic2.Bool
-	builder         models.ModelBuilder
-	pauseInput      *atomic2.Bool
+	builders        []models.ModelBuilder // 多个表共享appliers, 批量插入时按照SQL找到对应的builder
+	segments        map[string]string     // insert SQL --> batch insert segment
+	pauseInput      *atomic2.Bool         // 同一台机器的shards共享, 由throttle控制
+	paused          atomic2.Bool          // 手动暂停这个shard
+
+	eventTimestamp atomic2.Int64 // 最近提交的binlog事务在master上的时间(秒)
+	delaySeconds   atomic2.Int64 // 由PipelineDelay更新
+	delayKnown     atomic2.Bool
+	caughtUp       atomic2.Bool
+	copying        atomic2.Bool // 批量拷贝还没有完成(包括还没有push的数据), 不能认为已经追上
+
+	maxWriteLatency atomic2.Int64 // 由LoadThrottler读取并清零
 }
 
 type ShardingAppliers []*ShardingApplier
 
 // 自动处理Sharding的逻辑
 func (this ShardingAppliers) PushSQL(sql *models.ShardingSQL) {
+	if sql.ShardingIndex < 0 || sql.ShardingIndex >= len(this) {
+		log.Panicf("Invalid sharding index %d of %d shards, sql: %s", sql.ShardingIndex, len(this), sql.String())
+	}
 	this[sql.ShardingIndex].PushSQL(sql)
 }
 
@@ -50,24 +67,53 @@ func (this ShardingAppliers) SetBatchInsertMode(batchInsert bool) {
 	}
 }
 
+// StartCopy 批量拷贝开始, 直到FinishCopy之前shards都不会被认为已经追上
+func (this ShardingAppliers) StartCopy() {
+	for _, applier := range this {
+		applier.copying.Set(true)
+	}
+}
+
+// FinishCopy 等待批量拷贝的SQL全部提交, 然后切换到binlog(关闭批量插入)
+func (this ShardingAppliers) FinishCopy() {
+	this.WaitCommitted()
+	this.SetBatchInsertMode(false)
+	for _, applier := range this {
+		applier.copying.Set(false)
+	}
+}
+
+// WaitCommitted 等待之前push的SQL全部提交(例如: 批量拷贝和binlog之间的切换)
+func (this ShardingAppliers) WaitCommitted() {
+	var wg sync.WaitGroup
+	for shard, applier := range this {
+		wg.Add(1)
+		commitSQL := models.NewCommitSQL(shard)
+		commitSQL.OnCommitted = wg.Done
+		applier.PushSQL(commitSQL)
+	}
+	wg.Wait()
+}
+
 func NewShardingApplier(shardingIndex, batchSize int, cacheSize int, config *conf.DatabaseConfig, dryRun bool,
-	builder models.ModelBuilder, pauseInput *atomic2.Bool) (*ShardingApplier, error) {
+	builders []models.ModelBuilder, pauseInput *atomic2.Bool) (*ShardingApplier, error) {
 	result := &ShardingApplier{
-		shardingIndex:   shardingIndex,
-		sqlsBuffered:    make([]*models.ShardingSQL, 0, batchSize),
-		sqls:            make(chan *models.ShardingSQL, cacheSize), // 多保留一些数据，保证各个shard能并发跑起来
-		batchInsertSize: batchSize,
-		maxRetries:      10,
-		dryRun:          dryRun,
-		builder:         builder,
-		pauseInput:      pauseInput,
+		shardingIndex: shardingIndex,
+		sqlsBuffered:  make([]*models.ShardingSQL, 0, batchSize),
+		sqls:          make(chan *models.ShardingSQL, cacheSize), // 多保留一些数据，保证各个shard能并发跑起来
+		maxRetries:    10,
+		dryRun:        dryRun,
+		builders:      builders,
+		segments:      make(map[string]string),
+		pauseInput:    pauseInput,
 	}
 
+	result.batchInsertSize.Set(int64(batchSize))
 	result.isClosed.Set(false)
 	result.batchInsertMode.Set(false)
 
 	var err error
-	result.db, err = sql.Open("mysql", config.GetDBUri(fmt.Sprintf("shard%d", shardingIndex)))
+	result.db, err = sql.Open("mysql", config.GetDBUri(ShardAlias(shardingIndex)))
 	// 控制一下最大的连接数
 	result.db.SetMaxOpenConns(2)
 	result.db.SetMaxIdleConns(2)
@@ -78,6 +124,57 @@ func NewShardingApplier(shardingIndex, batchSize int, cacheSize int, config *con
 	}
 }
 
+// ShardStatus 一个shard的状态(admin api)
+type ShardStatus struct {
+	Shard           int    `json:"shard"`
+	Alias           string `json:"alias"`
+	Pushed          int64  `json:"pushed"`
+	Executed        int64  `json:"executed"`
+	QueueDepth      int    `json:"queue_depth"`
+	QueueCapacity   int    `json:"queue_capacity"`
+	BatchInsertSize int64  `json:"batch_insert_size"`
+	BatchInsertMode bool   `json:"batch_insert_mode"`
+	Paused          bool   `json:"paused"`
+	Throttled       bool   `json:"throttled"`
+	Closed          bool   `json:"closed"`
+	DelaySeconds    int64  `json:"delay_seconds"` // 最近提交的binlog事务的延迟, -1表示未知
+	Copying         bool   `json:"copying"`
+	CaughtUp        bool   `json:"caught_up"`
+}
+
+func (this *ShardingApplier) Status() *ShardStatus {
+	delaySeconds := int64(-1)
+	if this.delayKnown.Get() {
+		delaySeconds = this.delaySeconds.Get()
+	}
+	return &ShardStatus{
+		Shard:           this.shardingIndex,
+		Alias:           ShardAlias(this.shardingIndex),
+		Pushed:          this.totalPushed.Get(),
+		Executed:        this.totalExecuted.Get(),
+		QueueDepth:      len(this.sqls),
+		QueueCapacity:   cap(this.sqls),
+		BatchInsertSize: this.batchInsertSize.Get(),
+		BatchInsertMode: this.batchInsertMode.Get(),
+		Paused:          this.paused.Get(),
+		Throttled:       this.pauseInput.Get(),
+		Closed:          this.isClosed.Get(),
+		DelaySeconds:    delaySeconds,
+		Copying:         this.copying.Get(),
+		CaughtUp:        this.caughtUp.Get(),
+	}
+}
+
+// SetPaused 手动暂停/恢复这个shard, 和throttle独立
+func (this *ShardingApplier) SetPaused(paused bool) {
+	this.paused.Set(paused)
+}
+
+// SetBatchInsertSize 下一个batch开始生效
+func (this *ShardingApplier) SetBatchInsertSize(batchSize int) {
+	this.batchInsertSize.Set(int64(batchSize))
+}
+
 func (this *ShardingApplier) Close() {
 	if this.isClosed.CompareAndSwap(false, true) {
 		// 表示没有数据了
@@ -88,11 +185,47 @@ func (this *ShardingApplier) Close() {
 // 添加到队列末尾
 func (this *ShardingApplier) PushSQL(sql *models.ShardingSQL) {
 	if sql != nil {
+		// 先计数: 已经从队列中取出, 但是还没有执行的SQL也不是idle
+		if !sql.Commit {
+			this.totalPushed.Incr()
+		}
 		this.sqls <- sql
-		this.totalPushed++
 	}
 }
 
+// bufferSQL 不属于binlog事务的SQL, 单独作为一个事务
+// 如果夹在一个binlog事务的中间(批量拷贝和binlog同时进行), 则和这个事务一起提交
+func (this *ShardingApplier) bufferSQL(shardingSQL *models.ShardingSQL) {
+	if !shardingSQL.Commit {
+		this.sqlsBuffered = append(this.sqlsBuffered, shardingSQL)
+	}
+	if shardingSQL.InTransaction {
+		// binlog事务的SQL, 或者结束标记
+		this.inTransaction = !shardingSQL.Commit
+	}
+	if shardingSQL.Commit && shardingSQL.OnCommitted != nil {
+		this.pendingAcks = append(this.pendingAcks, shardingSQL.OnCommitted)
+	}
+	if shardingSQL.Commit && shardingSQL.Timestamp > 0 {
+		// 和checkpoint一样, 事务提交之后才更新
+		timestamp := shardingSQL.Timestamp
+		this.pendingAcks = append(this.pendingAcks, func() { this.eventTimestamp.Set(timestamp) })
+	}
+	if !this.inTransaction {
+		this.sqlsCommitted = len(this.sqlsBuffered)
+		this.committedAcks = append(this.committedAcks, this.pendingAcks...)
+		this.pendingAcks = this.pendingAcks[0:0]
+	}
+}
+
+// ackCommitted 通知checkpoint: 事务已经提交
+func (this *ShardingApplier) ackCommitted() {
+	for _, ack := range this.committedAcks {
+		ack()
+	}
+	this.committedAcks = this.committedAcks[0:0]
+}
+
 // retryOperation attempts up to `count` attempts at running given function,
 // exiting as soon as it returns with non-error.
 func (this *ShardingApplier) retryOperation(operation func() error, notFatalHint ...bool) (err error) {
@@ -102,6 +235,7 @@ func (this *ShardingApplier) retryOperation(operation func() error, notFatalHint
 			// sleep after previous iteration
 			// 如果遇到异常，最好等待一段时间，否则retry也是失败
 			time.Sleep(1 * time.Second)
+			metricRetries.WithLabels(strconv.Itoa(this.shardingIndex)).Incr()
 		}
 		err = operation()
 		if err == nil {
@@ -125,7 +259,7 @@ func (this *ShardingApplier) Run(wg *sync.WaitGroup) {
 	for true {
 
 		// 暂停，直到状态改变
-		for this.pauseInput.Get() {
+		for this.pauseInput.Get() || this.paused.Get() {
 			log.Printf(color.BlueString("Throttle Pause")+", sleep 1 second for shard: %d", this.shardingIndex)
 			time.Sleep(time.Second)
 		}
@@ -135,7 +269,7 @@ func (this *ShardingApplier) Run(wg *sync.WaitGroup) {
 		select {
 		case shardingSQL, ok := <-this.sqls:
 			if ok {
-				this.sqlsBuffered = append(this.sqlsBuffered, shardingSQL)
+				this.bufferSQL(shardingSQL)
 			} else {
 				// 关闭了，则直接结束
 				channelClosed = true
@@ -145,18 +279,21 @@ func (this *ShardingApplier) Run(wg *sync.WaitGroup) {
 			timeout = true
 		}
 
-		if len(this.sqlsBuffered) >= this.batchInsertSize || (len(this.sqlsBuffered) > 0 && timeout) {
+		// 只提交完整的事务, 一个binlog事务的SQL不会被拆分到两个batch中
+		committed := this.sqlsBuffered[:this.sqlsCommitted]
+		batchInsertSize := int(this.batchInsertSize.Get())
+		if len(committed) >= batchInsertSize || (len(committed) > 0 && timeout) {
 			// 有数据，或timeout
 			batchSQL := func() error {
-				if this.batchInsertMode.Get() {
+				if this.batchInsertMode.Get() && canBatchInsert(committed) {
 					// 如何处理批量插入的问题呢?
-					insertSqls := make([]string, len(this.sqlsBuffered))
-					argsAll := make([]interface{}, 0, len(this.sqlsBuffered)*len(this.sqlsBuffered[0].Args))
-					for idx, shardingSQL := range this.sqlsBuffered {
+					insertSqls := make([]string, len(committed))
+					argsAll := make([]interface{}, 0, len(committed)*len(committed[0].Args))
+					for idx, shardingSQL := range committed {
 						if idx == 0 {
 							insertSqls[idx] = shardingSQL.SQL
 						} else {
-							insertSqls[idx] = this.builder.GetBatchInsertSegment()
+							insertSqls[idx] = this.batchInsertSegment(shardingSQL.SQL)
 						}
 						argsAll = append(argsAll, shardingSQL.Args...)
 					}
@@ -177,7 +314,7 @@ func (this *ShardingApplier) Run(wg *sync.WaitGroup) {
 						return err
 					}
 
-					for _, shardingSQL := range this.sqlsBuffered {
+					for _, shardingSQL := range committed {
 						// 将参数展开
 						// 会不会应为网络round trip很大呢?
 						_, err := tx.Exec(shardingSQL.SQL, shardingSQL.Args...)
@@ -192,15 +329,17 @@ func (this *ShardingApplier) Run(wg *sync.WaitGroup) {
 
 			// log.Printf("Batch update shard: %d", this.shardingIndex)
 			if this.dryRun {
-				data, _ := json.Marshal(this.sqlsBuffered[0].Args)
-				log.Printf("SQL: %s, Args: %s", this.sqlsBuffered[0].SQL, string(data))
+				data, _ := json.Marshal(committed[0].Args)
+				log.Printf("SQL: %s, Args: %s", committed[0].SQL, string(data))
 			} else {
 				t0 := time.Now()
 				// 运行SQL
 				err := this.retryOperation(batchSQL)
 				t1 := time.Now()
+				metricBatchLatency.Observe(t1.Sub(t0).Seconds(), strconv.Itoa(this.shardingIndex))
+				this.observeWriteLatency(t1.Sub(t0))
 				log.Printf(color.CyanString("Shard: %02d")+", sql executed size: %d, elapsed: %.3fms", this.shardingIndex,
-					len(this.sqlsBuffered), utils.ElapsedMillSeconds(t0, t1))
+					len(committed), utils.ElapsedMillSeconds(t0, t1))
 
 				if err != nil {
 					log.PanicErrorf(err, color.RedString("Shard: %d")+", sql executed failed", this.shardingIndex)
@@ -208,22 +347,63 @@ func (this *ShardingApplier) Run(wg *sync.WaitGroup) {
 				}
 			}
 
-			if len(this.sqlsBuffered) >= this.batchInsertSize {
+			if len(committed) >= batchInsertSize {
 				time.Sleep(time.Millisecond * time.Duration(BatchInsertSleepMilliseconds)) // sleep 20ms
 			}
 
-			this.totalExecuted += len(this.sqlsBuffered)
-			this.sqlsBuffered = this.sqlsBuffered[0:0]
+			totalExecuted := this.totalExecuted.Add(int64(len(committed)))
+			// 保留未结束的事务
+			this.sqlsBuffered = append(this.sqlsBuffered[0:0], this.sqlsBuffered[this.sqlsCommitted:]...)
+			this.sqlsCommitted = 0
+			this.ackCommitted()
 
 			log.Printf(color.GreenString("Shard: %02d - apply progress: %.2f%%")+", total_executed: %d/%d", this.shardingIndex,
-				float64(this.totalExecuted)/float64(this.totalPushed)*100,
-				this.totalExecuted, this.totalPushed)
+				float64(totalExecuted)/float64(this.totalPushed.Get())*100,
+				totalExecuted, this.totalPushed.Get())
 
 		} else {
+			// 没有需要提交的SQL
+			if this.sqlsCommitted == 0 && len(this.committedAcks) > 0 {
+				this.ackCommitted()
+			}
+
 			// 没有数据，要么退出，要么继续等待
 			if channelClosed {
+				if len(this.sqlsBuffered) > 0 {
+					// 未结束的事务不能提交, 重启之后从binlog中重新读取
+					log.Printf(color.RedString("Shard: %02d")+", drop uncommitted sqls: %d", this.shardingIndex, len(this.sqlsBuffered))
+				}
 				break
 			}
 		}
 	}
 }
+
+// batchInsertSegment insert SQL以builder的batch insert segment结尾, 例如: values (?, ?, ?)
+// 不同的builder的segment相同时, 使用哪一个builder的结果都一样
+func (this *ShardingApplier) batchInsertSegment(insertSQL string) string {
+	segment, ok := this.segments[insertSQL]
+	if !ok {
+		for _, builder := range this.builders {
+			if candidate := builder.GetBatchInsertSegment(); strings.HasSuffix(insertSQL, candidate) &&
+				len(candidate) > len(segment) {
+				segment = candidate
+			}
+		}
+		if len(segment) == 0 {
+			log.Panicf("No builder found for batch insert: %s", insertSQL)
+		}
+		this.segments[insertSQL] = segment
+	}
+	return segment
+}
+
+// canBatchInsert 只有相同的insert语句才能拼接; 混入了binlog的SQL(或者最新的row image)时, 按照事务执行
+func canBatchInsert(committed []*models.ShardingSQL) bool {
+	for _, shardingSQL := range committed {
+		if shardingSQL.InTransaction || shardingSQL.SQL != committed[0].SQL {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,38 @@
+package logic
+
+import (
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+	"github.com/wfxiang08/db-sharding/models"
+)
+
+type applierModel struct {
+	Id     int64  `sharding:"id,ordinal=0,shard_key,pk"`
+	Name   string `sharding:"name,ordinal=1"`
+	Status int32  `sharding:"status,ordinal=2"`
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestShardingApplierBatchInsertSegment$"
+func TestShardingApplierBatchInsertSegment(t *testing.T) {
+	builder1, err := models.NewStructModelBuilder("t1", &tombstoneModel{}, 4)
+	test.S(t).ExpectNil(err)
+	builder2, err := models.NewStructModelBuilder("t2", &applierModel{}, 4)
+	test.S(t).ExpectNil(err)
+
+	// 多个表共享一个applier
+	applier := &ShardingApplier{
+		builders: []models.ModelBuilder{builder1, builder2},
+		segments: make(map[string]string),
+	}
+
+	sql1 := builder1.InsertIgnore(&tombstoneModel{Id: 1, Name: "a"})
+	sql2 := builder2.InsertIgnore(&applierModel{Id: 1, Name: "a", Status: 1})
+	test.S(t).ExpectEquals(applier.batchInsertSegment(sql1.SQL), builder1.GetBatchInsertSegment())
+	test.S(t).ExpectEquals(applier.batchInsertSegment(sql2.SQL), builder2.GetBatchInsertSegment())
+	test.S(t).ExpectEquals(len(applier.segments), 2)
+
+	// 不同表的insert不能合并成一条SQL
+	test.S(t).ExpectFalse(canBatchInsert([]*models.ShardingSQL{sql1, sql2}))
+	test.S(t).ExpectTrue(canBatchInsert([]*models.ShardingSQL{sql1, sql1}))
+}
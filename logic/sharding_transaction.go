@@ -0,0 +1,82 @@
+package logic
+
+import (
+	"sync"
+
+	"github.com/wfxiang08/db-sharding/models"
+	"github.com/wfxiang08/db-sharding/mysql"
+)
+
+// ShardingTransaction 将一个binlog事务拆分到各个shard上
+// 各个shard上的部分在ShardingApplier中作为一个整体提交, 不会出现只执行了一半的事务
+type ShardingTransaction struct {
+	appliers   ShardingAppliers
+	checkpoint *CheckpointTracker
+	shards     map[int]bool // 当前事务涉及到的shards
+
+	// 多个binlog stream共享appliers时(resharding), 事务的SQL先缓存, commit时在pushLock内一起push,
+	// 避免不同stream的事务在同一个applier中交错
+	pushLock sync.Locker
+	pending  []*models.ShardingSQL
+}
+
+// NewShardingTransaction checkpoint为nil时不跟踪事务的提交
+func NewShardingTransaction(appliers ShardingAppliers, checkpoint *CheckpointTracker) *ShardingTransaction {
+	return &ShardingTransaction{
+		appliers:   appliers,
+		checkpoint: checkpoint,
+		shards:     make(map[int]bool),
+	}
+}
+
+// SetPushLock 多个ShardingTransaction共享同一个pushLock
+func (this *ShardingTransaction) SetPushLock(pushLock sync.Locker) {
+	this.pushLock = pushLock
+}
+
+func (this *ShardingTransaction) PushSQL(sql *models.ShardingSQL) {
+	if sql == nil {
+		return
+	}
+	sql.InTransaction = true
+	this.shards[sql.ShardingIndex] = true
+	if this.pushLock != nil {
+		this.pending = append(this.pending, sql)
+	} else {
+		this.appliers.PushSQL(sql)
+	}
+}
+
+// Commit 通知涉及到的shards: 事务结束, coordinates为事务结束的位置
+// 所有的shards都提交之后, coordinates才会成为checkpoint
+func (this *ShardingTransaction) Commit(coordinates mysql.BinlogCoordinates) {
+	this.CommitAt(coordinates, 0)
+}
+
+// CommitAt timestamp为事务在master上的时间(秒), shards提交之后用于计算延迟; 0表示未知
+func (this *ShardingTransaction) CommitAt(coordinates mysql.BinlogCoordinates, timestamp int64) {
+	var txCheckpoint *TxCheckpoint
+	if this.checkpoint != nil {
+		txCheckpoint = this.checkpoint.Track(coordinates, len(this.shards))
+	}
+
+	if this.pushLock != nil {
+		this.pushLock.Lock()
+		defer this.pushLock.Unlock()
+		for _, sql := range this.pending {
+			this.appliers.PushSQL(sql)
+		}
+		this.pending = nil
+	}
+
+	for shard := range this.shards {
+		commitSQL := models.NewCommitSQL(shard)
+		commitSQL.InTransaction = true
+		commitSQL.Timestamp = timestamp
+		if txCheckpoint != nil {
+			commitSQL.OnCommitted = txCheckpoint.Ack
+		}
+		this.appliers.PushSQL(commitSQL)
+	}
+	this.shards = make(map[int]bool)
+}
@@ -0,0 +1,120 @@
+package logic
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+	"github.com/wfxiang08/db-sharding/models"
+	"github.com/wfxiang08/db-sharding/mysql"
+)
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestShardingTransaction$"
+func TestShardingTransaction(t *testing.T) {
+	appliers := ShardingAppliers{
+		&ShardingApplier{sqls: make(chan *models.ShardingSQL, 10)},
+		&ShardingApplier{sqls: make(chan *models.ShardingSQL, 10)},
+	}
+
+	transaction := NewShardingTransaction(appliers, nil)
+	transaction.PushSQL(&models.ShardingSQL{ShardingIndex: 0, SQL: "sql1"})
+	transaction.PushSQL(&models.ShardingSQL{ShardingIndex: 0, SQL: "sql2"})
+
+	applier := appliers[0]
+	applier.bufferSQL(<-applier.sqls)
+	applier.bufferSQL(<-applier.sqls)
+	// 事务没有结束, 不能提交
+	test.S(t).ExpectEquals(len(applier.sqlsBuffered), 2)
+	test.S(t).ExpectEquals(applier.sqlsCommitted, 0)
+
+	transaction.Commit(mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 660})
+	test.S(t).ExpectEquals(len(applier.sqls), 1)
+	// 没有涉及到的shard不会收到Commit
+	test.S(t).ExpectEquals(len(appliers[1].sqls), 0)
+
+	applier.bufferSQL(<-applier.sqls)
+	test.S(t).ExpectEquals(len(applier.sqlsBuffered), 2)
+	test.S(t).ExpectEquals(applier.sqlsCommitted, 2)
+	test.S(t).ExpectEquals(applier.totalPushed.Get(), int64(2))
+
+	// 非binlog事务的SQL, 单独提交
+	applier.bufferSQL(&models.ShardingSQL{ShardingIndex: 0, SQL: "sql3"})
+	test.S(t).ExpectEquals(applier.sqlsCommitted, 3)
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestCheckpointTracker$"
+func TestCheckpointTracker(t *testing.T) {
+	appliers := ShardingAppliers{
+		&ShardingApplier{sqls: make(chan *models.ShardingSQL, 10)},
+		&ShardingApplier{sqls: make(chan *models.ShardingSQL, 10)},
+	}
+	checkpoint := NewCheckpointTracker()
+	transaction := NewShardingTransaction(appliers, checkpoint)
+
+	c1 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 660}
+	c2 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 890}
+	c3 := mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 1329}
+
+	// 事务1: shard0, shard1
+	transaction.PushSQL(&models.ShardingSQL{ShardingIndex: 0, SQL: "sql1"})
+	transaction.PushSQL(&models.ShardingSQL{ShardingIndex: 1, SQL: "sql2"})
+	transaction.Commit(c1)
+	// 事务2: shard1
+	transaction.PushSQL(&models.ShardingSQL{ShardingIndex: 1, SQL: "sql3"})
+	transaction.Commit(c2)
+	test.S(t).ExpectTrue(checkpoint.Watermark() == nil)
+	test.S(t).ExpectEquals(checkpoint.PendingCount(), 2)
+
+	for _, applier := range appliers {
+		for len(applier.sqls) > 0 {
+			applier.bufferSQL(<-applier.sqls)
+		}
+	}
+
+	// shard1提交了事务1和事务2, 但是shard0还没有提交事务1
+	appliers[1].ackCommitted()
+	test.S(t).ExpectTrue(checkpoint.Watermark() == nil)
+
+	appliers[0].ackCommitted()
+	test.S(t).ExpectEquals(*checkpoint.Watermark(), c2)
+	test.S(t).ExpectEquals(checkpoint.PendingCount(), 0)
+
+	// 没有涉及到任何shard的事务
+	transaction.Commit(c3)
+	test.S(t).ExpectEquals(*checkpoint.Watermark(), c3)
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestShardingTransactionPushLock$"
+func TestShardingTransactionPushLock(t *testing.T) {
+	appliers := ShardingAppliers{
+		&ShardingApplier{sqls: make(chan *models.ShardingSQL, 10)},
+	}
+
+	// 两个binlog stream共享appliers
+	var pushLock sync.Mutex
+	tx1 := NewShardingTransaction(appliers, nil)
+	tx1.SetPushLock(&pushLock)
+	tx2 := NewShardingTransaction(appliers, nil)
+	tx2.SetPushLock(&pushLock)
+
+	tx1.PushSQL(&models.ShardingSQL{ShardingIndex: 0, SQL: "sql1"})
+	tx2.PushSQL(&models.ShardingSQL{ShardingIndex: 0, SQL: "sql2"})
+	tx1.PushSQL(&models.ShardingSQL{ShardingIndex: 0, SQL: "sql3"})
+	// commit之前不进入队列
+	test.S(t).ExpectEquals(len(appliers[0].sqls), 0)
+
+	tx2.Commit(mysql.BinlogCoordinates{LogFile: "mysql-bin.000066", LogPos: 660})
+	tx1.Commit(mysql.BinlogCoordinates{LogFile: "mysql-bin.000077", LogPos: 770})
+
+	var sqls []string
+	for len(appliers[0].sqls) > 0 {
+		sql := <-appliers[0].sqls
+		if sql.Commit {
+			sqls = append(sqls, "commit")
+		} else {
+			sqls = append(sqls, sql.SQL)
+		}
+	}
+	test.S(t).ExpectEquals(strings.Join(sqls, ","), "sql2,commit,sql1,sql3,commit")
+}
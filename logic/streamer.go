@@ -9,9 +9,13 @@ import (
 	gosql "database/sql"
 	"fmt"
 	"github.com/outbrain/golib/sqlutils"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
 	"github.com/wfxiang08/db-sharding/binlog"
 	"github.com/wfxiang08/db-sharding/mysql"
+	"github.com/wfxiang08/db-sharding/sql"
+	"os"
+	"path"
 	"strings"
 	"sync"
 	"time"
@@ -27,6 +31,9 @@ type BinlogEventListener struct {
 
 	dbPattern    bool
 	tablePattern bool
+	databases    map[string]bool // databaseName为多个db: shard_0,shard_1
+
+	inTransaction bool // 当前事务中是否收到过DML
 
 	onDmlEvent func(binlogEntry *binlog.BinlogEntry) error
 }
@@ -34,7 +41,12 @@ type BinlogEventListener struct {
 func (l *BinlogEventListener) init() {
 	l.databaseNameLower = strings.ToLower(l.databaseName)
 	l.tableNameLower = strings.ToLower(l.tableName)
-	if strings.HasSuffix(l.databaseNameLower, "*") {
+	if strings.Contains(l.databaseNameLower, ",") {
+		l.databases = make(map[string]bool)
+		for _, name := range strings.Split(l.databaseNameLower, ",") {
+			l.databases[strings.TrimSpace(name)] = true
+		}
+	} else if strings.HasSuffix(l.databaseNameLower, "*") {
 		l.dbPattern = true
 		l.databaseNameLower = l.databaseNameLower[0 : len(l.databaseNameLower)-1]
 	}
@@ -50,9 +62,14 @@ func (l *BinlogEventListener) init() {
 func (l *BinlogEventListener) Match(db string, table string) bool {
 	db = strings.ToLower(db)
 	// 匹配db
+	// db1,db2
 	// prefix*
 	// full_match
-	if l.dbPattern {
+	if l.databases != nil {
+		if !l.databases[db] {
+			return false
+		}
+	} else if l.dbPattern {
 		if !strings.HasPrefix(db, l.databaseNameLower) {
 			return false
 		}
@@ -77,6 +94,7 @@ const (
 type EventsStreamer struct {
 	connectionConfig         *mysql.ConnectionConfig
 	DatabaseName             string
+	UseGTID                  bool // 没有指定起始位置时，从master当前的Executed_Gtid_Set开始(GTID模式)
 	db                       *gosql.DB
 	maxRetry                 int64
 	initialBinlogCoordinates *mysql.BinlogCoordinates
@@ -86,10 +104,70 @@ type EventsStreamer struct {
 	binlogReader             *binlog.GoMySQLReader
 	serverId                 uint
 	metaDir                  string
+	metaName                 string // meta-dir中的文件名(源db的alias)
 	masterInfo               *MasterInfo
+	schemaHistory            *binlog.SchemaHistory
+	checkpoint               *CheckpointTracker // 已经被shards提交的位置, 保存到masterInfo中
+	eventTimestamp           atomic2.Int64      // 最近一个event在master上的时间(秒)
+}
+
+var (
+	streamersMutex sync.Mutex
+	streamers      []*EventsStreamer // 正在运行的binlog streams, 用于查看状态
+)
+
+func registerStreamer(streamer *EventsStreamer) {
+	streamersMutex.Lock()
+	defer streamersMutex.Unlock()
+	streamers = append(streamers, streamer)
+}
+
+func unregisterStreamer(streamer *EventsStreamer) {
+	streamersMutex.Lock()
+	defer streamersMutex.Unlock()
+	for i, s := range streamers {
+		if s == streamer {
+			streamers = append(streamers[:i], streamers[i+1:]...)
+			break
+		}
+	}
+}
+
+// StreamerStatus 一个binlog stream的状态
+type StreamerStatus struct {
+	Host                string `json:"host"`
+	Current             string `json:"current"`    // 已经读取的位置
+	Checkpoint          string `json:"checkpoint"` // shards已经提交的位置(重启之后从这里开始)
+	PendingTransactions int    `json:"pending_transactions"`
+	EventTimestamp      int64  `json:"event_timestamp"` // 最近一个event在master上的时间(秒)
+}
+
+// StreamersStatus 所有正在运行的binlog streams
+func StreamersStatus() []*StreamerStatus {
+	streamersMutex.Lock()
+	defer streamersMutex.Unlock()
+
+	result := make([]*StreamerStatus, 0, len(streamers))
+	for _, streamer := range streamers {
+		status := &StreamerStatus{
+			Host:                streamer.connectionConfig.Key.String(),
+			PendingTransactions: streamer.checkpoint.PendingCount(),
+			EventTimestamp:      streamer.eventTimestamp.Get(),
+		}
+		if streamer.binlogReader != nil {
+			status.Current = streamer.GetCurrentBinlogCoordinates().DisplayString()
+		}
+		if watermark := streamer.checkpoint.Watermark(); watermark != nil {
+			status.Checkpoint = watermark.DisplayString()
+		}
+		result = append(result, status)
+	}
+	return result
 }
 
-func NewEventsStreamer(connectionConfig *mysql.ConnectionConfig, maxRetry int64, serverId uint, metaDir string) *EventsStreamer {
+// NewEventsStreamer metaName为源db的alias, 用于命名meta-dir中的master info和表结构历史
+func NewEventsStreamer(connectionConfig *mysql.ConnectionConfig, maxRetry int64, serverId uint, metaDir string,
+	metaName string) *EventsStreamer {
 	return &EventsStreamer{
 		connectionConfig: connectionConfig,
 		maxRetry:         maxRetry,
@@ -98,10 +176,25 @@ func NewEventsStreamer(connectionConfig *mysql.ConnectionConfig, maxRetry int64,
 		eventsChannel:    make(chan *binlog.BinlogEntry, EventsChannelBufferSize),
 		serverId:         serverId,
 		metaDir:          metaDir,
+		metaName:         metaName,
+		checkpoint:       NewCheckpointTracker(),
+	}
+}
+
+// Checkpoint 由listener在事务交给shards时记录, shards提交之后确认
+func (this *EventsStreamer) Checkpoint() *CheckpointTracker {
+	return this.checkpoint
+}
+
+// saveCheckpoint 保存low watermark, 而不是已经读取的位置
+func (this *EventsStreamer) saveCheckpoint() {
+	if watermark := this.checkpoint.Watermark(); watermark != nil {
+		this.masterInfo.Save(watermark)
 	}
 }
 
 // AddListener registers a new listener for binlog events, on a per-table basis
+// 事务结束时, 收到过DML的listener会收到binlogEntry.Commit为true的entry
 func (this *EventsStreamer) AddListener(
 	async bool, databaseName string, tableName string,
 	onDmlEvent func(binlogEntry *binlog.BinlogEntry) error) (err error) {
@@ -127,6 +220,19 @@ func (this *EventsStreamer) AddListener(
 	return nil
 }
 
+// hasListener 是否有listener关注给定的table
+func (this *EventsStreamer) hasListener(databaseName, tableName string) bool {
+	this.listenersMutex.Lock()
+	defer this.listenersMutex.Unlock()
+
+	for _, listener := range this.listeners {
+		if listener.Match(databaseName, tableName) {
+			return true
+		}
+	}
+	return false
+}
+
 // notifyListeners will notify relevant listeners with given DML event. Only
 // listeners registered for changes on the table on which the DML operates are notified.
 func (this *EventsStreamer) notifyListeners(binlogEntry *binlog.BinlogEntry) {
@@ -137,10 +243,19 @@ func (this *EventsStreamer) notifyListeners(binlogEntry *binlog.BinlogEntry) {
 	// 如何通知listeners呢?
 	for _, listener := range this.listeners {
 		listener := listener
-		// DB和Table一致，可以做一个预处理, 把listener的names都统一为小写
-		// 所有的db, 或者满足条件的db
-		if !listener.Match(binlogEvent.DatabaseName, binlogEvent.TableName) {
-			continue
+		if binlogEntry.Commit {
+			// 事务结束只通知收到过DML的listener
+			if !listener.inTransaction {
+				continue
+			}
+			listener.inTransaction = false
+		} else {
+			// DB和Table一致，可以做一个预处理, 把listener的names都统一为小写
+			// 所有的db, 或者满足条件的db
+			if !listener.Match(binlogEvent.DatabaseName, binlogEvent.TableName) {
+				continue
+			}
+			listener.inTransaction = true
 		}
 
 		// 同步和异步的区别?
@@ -155,7 +270,8 @@ func (this *EventsStreamer) notifyListeners(binlogEntry *binlog.BinlogEntry) {
 	}
 }
 
-func (this *EventsStreamer) InitDBConnections(binlogFile string, binlogPos int64) (err error) {
+// 起始位置的优先级: gtidSet > binlogFile:binlogPos > meta-dir中保存的位置 > master当前的位置
+func (this *EventsStreamer) InitDBConnections(binlogFile string, binlogPos int64, gtidSet string) (err error) {
 
 	// 1. Connection + DB 构成完整的Uri
 	EventsStreamerUri := this.connectionConfig.GetDBUri(this.DatabaseName)
@@ -163,25 +279,47 @@ func (this *EventsStreamer) InitDBConnections(binlogFile string, binlogPos int64
 		return err
 	}
 
-	this.masterInfo, _ = LoadMasterInfo(this.metaDir, this.connectionConfig.Key)
+	// 表结构的历史在重连之间共享, 只跟踪被listener关注的table
+	this.schemaHistory = binlog.NewSchemaHistory(func(databaseName, tableName string) (*sql.ColumnList, error) {
+		return mysql.GetTableColumns(this.db, databaseName, tableName)
+	}, this.hasListener)
+	// 和checkpoint保存在一起, 重启之后从checkpoint开始读取binlog时依然使用当时的表结构
+	if len(this.metaDir) > 0 {
+		for _, ext := range []string{"info", "schema"} {
+			if err := this.renameLegacyMetaFile(ext); err != nil {
+				return err
+			}
+		}
+		schemaFile := path.Join(this.metaDir, fmt.Sprintf("%s.schema", this.metaName))
+		if err := this.schemaHistory.Load(schemaFile); err != nil {
+			return err
+		}
+	}
+
+	this.masterInfo, _ = LoadMasterInfo(this.metaDir, this.metaName)
 	if this.masterInfo == nil {
 		log.Panicf("MasterInfo not found....")
 	}
 
 	// 获取当前的binlog的位置
 	// 如果没有有效的信息
-	if len(binlogFile) == 0 && len(this.masterInfo.Name) == 0 {
+	masterPosition := this.masterInfo.Position()
+	if len(gtidSet) == 0 && len(binlogFile) == 0 && masterPosition.IsEmpty() {
 		if err := this.readCurrentBinlogCoordinates(); err != nil {
 			return err
 		}
 	} else {
-		if len(binlogFile) > 0 {
+		if len(gtidSet) > 0 {
+			this.initialBinlogCoordinates = &mysql.BinlogCoordinates{
+				GTIDSet: gtidSet,
+			}
+		} else if len(binlogFile) > 0 {
 			this.initialBinlogCoordinates = &mysql.BinlogCoordinates{
 				LogFile: binlogFile,
 				LogPos:  binlogPos,
 			}
 		} else {
-			this.initialBinlogCoordinates = this.masterInfo.Position()
+			this.initialBinlogCoordinates = masterPosition
 		}
 		log.Printf("Get initial binlog coordinates from input: %s", this.initialBinlogCoordinates.String())
 	}
@@ -194,8 +332,30 @@ func (this *EventsStreamer) InitDBConnections(binlogFile string, binlogPos int64
 	return nil
 }
 
+// renameLegacyMetaFile 之前的版本按照hostname_port命名meta-dir中的文件, 升级之后继续使用其中的位置和表结构
+func (this *EventsStreamer) renameLegacyMetaFile(ext string) error {
+	legacyFile := path.Join(this.metaDir, fmt.Sprintf("%s_%d.%s", this.connectionConfig.Key.Hostname,
+		this.connectionConfig.Key.Port, ext))
+	metaFile := path.Join(this.metaDir, fmt.Sprintf("%s.%s", this.metaName, ext))
+	if _, err := os.Stat(metaFile); err == nil || !os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(legacyFile); err != nil {
+		return nil
+	}
+	log.Printf("Rename legacy meta file %s to %s", legacyFile, metaFile)
+	return os.Rename(legacyFile, metaFile)
+}
+
 // initBinlogReader creates and connects the reader: we hook up to a MySQL server as a replica
 func (this *EventsStreamer) initBinlogReader(binlogCoordinates *mysql.BinlogCoordinates) error {
+	// 重连时master可能已经切换(GTID模式), 表结构历史中的file:pos只在同一个server上有效
+	serverUUID, err := mysql.GetServerUUID(this.db)
+	if err != nil {
+		return err
+	}
+	this.schemaHistory.SetServer(serverUUID)
+
 	// binlog reader
 	goMySQLReader, err := binlog.NewGoMySQLReader(this.connectionConfig, this.serverId)
 	if err != nil {
@@ -209,6 +369,7 @@ func (this *EventsStreamer) initBinlogReader(binlogCoordinates *mysql.BinlogCoor
 	}
 
 	// 创建完毕
+	goMySQLReader.SchemaHistory = this.schemaHistory
 	this.binlogReader = goMySQLReader
 	return nil
 }
@@ -218,6 +379,10 @@ func (this *EventsStreamer) GetCurrentBinlogCoordinates() *mysql.BinlogCoordinat
 }
 
 func (this *EventsStreamer) GetReconnectBinlogCoordinates() *mysql.BinlogCoordinates {
+	if this.binlogReader.IsGTIDMode() {
+		// GTID模式: 从已经执行的GTID之后开始
+		return this.GetCurrentBinlogCoordinates()
+	}
 	return &mysql.BinlogCoordinates{LogFile: this.GetCurrentBinlogCoordinates().LogFile, LogPos: 4}
 }
 
@@ -230,11 +395,14 @@ func (this *EventsStreamer) readCurrentBinlogCoordinates() error {
 	// 除了使用gorm, 该如何使用其他的开始模式呢?
 	// 如何实现rows, row to map？
 	err := sqlutils.QueryRowsMap(this.db, query, func(m sqlutils.RowMap) error {
-		// 看来这个不支持gtid模式？
 		this.initialBinlogCoordinates = &mysql.BinlogCoordinates{
 			LogFile: m.GetString("File"),
 			LogPos:  m.GetInt64("Position"),
 		}
+		if this.UseGTID {
+			// GTID模式: Executed_Gtid_Set可能包含换行
+			this.initialBinlogCoordinates.GTIDSet = strings.Replace(m.GetString("Executed_Gtid_Set"), "\n", "", -1)
+		}
 		foundMasterStatus = true
 
 		return nil
@@ -245,6 +413,9 @@ func (this *EventsStreamer) readCurrentBinlogCoordinates() error {
 	if !foundMasterStatus {
 		return fmt.Errorf("Got no results from SHOW MASTER STATUS. Bailing out")
 	}
+	if this.UseGTID && !this.initialBinlogCoordinates.IsGTID() {
+		return fmt.Errorf("Got no Executed_Gtid_Set from SHOW MASTER STATUS, is gtid_mode enabled?")
+	}
 	log.Debugf("Streamer binlog coordinates: %+v", *this.initialBinlogCoordinates)
 	return nil
 }
@@ -254,11 +425,21 @@ func (this *EventsStreamer) readCurrentBinlogCoordinates() error {
 func (this *EventsStreamer) StreamEvents(canStopStreaming func() bool) error {
 	go func() {
 		for binlogEntry := range this.eventsChannel {
-			if binlogEntry.DmlEvent != nil {
+			if binlogEntry.Timestamp > 0 {
+				this.eventTimestamp.Set(binlogEntry.Timestamp)
+			}
+			if binlogEntry.DmlEvent != nil || binlogEntry.Commit {
 				this.notifyListeners(binlogEntry)
 			}
 		}
 	}()
+	// 没有新的binlog时, shards也可能提交了事务
+	go func() {
+		for !canStopStreaming() {
+			this.saveCheckpoint()
+			time.Sleep(time.Second)
+		}
+	}()
 	// The next should block and execute forever, unless there's a serious error
 	var successiveFailures int64
 	var lastAppliedRowsEventHint mysql.BinlogCoordinates
@@ -266,8 +447,8 @@ func (this *EventsStreamer) StreamEvents(canStopStreaming func() bool) error {
 		// 第一步: Streaming
 		//        如果失败，则等待5s
 		if err := this.binlogReader.StreamEvents(func() bool {
-			// 保存binlog的读取信息
-			this.masterInfo.Save(&this.binlogReader.LastAppliedRowsEventHint)
+			// 保存已经被shards提交的位置
+			this.saveCheckpoint()
 			return canStopStreaming()
 
 		}, this.eventsChannel); err != nil {
@@ -292,10 +473,18 @@ func (this *EventsStreamer) StreamEvents(canStopStreaming func() bool) error {
 
 			// 获取之前的binlogReader的binlog-coordinate
 			// 重新初始化binlog reader？
+			gtidMode := this.binlogReader.IsGTIDMode()
+			inTransaction := this.binlogReader.InTransaction()
 			if err := this.initBinlogReader(this.GetReconnectBinlogCoordinates()); err != nil {
 				return err
 			}
-			this.binlogReader.LastAppliedRowsEventHint = lastAppliedRowsEventHint
+			if !gtidMode {
+				// GTID模式下master可能已经切换, file:pos不可比较; 由GTID保证不会重复读取已经提交的事务
+				this.binlogReader.ResumeAfter(lastAppliedRowsEventHint, inTransaction)
+			}
+		} else {
+			// canStopStreaming, 正常结束
+			return nil
 		}
 	}
 }
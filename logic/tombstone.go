@@ -0,0 +1,135 @@
+package logic
+
+import (
+	"sync"
+
+	"github.com/fatih/color"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/db-sharding/binlog"
+	"github.com/wfxiang08/db-sharding/models"
+)
+
+// TombstoneTracker 批量拷贝期间(同时订阅binlog), 记录binlog中每一行数据最后的变化:
+// 1. delete: tombstone, 批量读取的数据直接跳过, 避免insert ignore将已经删除的数据重新插入
+// 2. insert/update: 最新的row image, 批量读取的数据(可能已经过期)替换为最新的row image(replace into)
+// binlog和批量读取的SQL在同一个临界区内检查并进入applier的队列, 因此队列中的顺序和检查的结果一致:
+// binlog的SQL在前, 批量读取的数据会被跳过或者替换; 批量读取的SQL在前, binlog的SQL会在其之后执行
+//
+// 只有读取之后, 进入队列之前的binlog才需要记录(批量读取和binlog来自同一台机器, 读取之前的变化已经包含在读取的数据中):
+// 1. Open之前(这个表还没有开始读取)不记录, Close之后(这个表的数据全部进入队列)不再记录
+// 2. 每一行只会被读取一次, 使用过的记录直接删除
+// 3. 直接apply的模式下, 每一批数据读取之后立即进入队列, 之前的记录都可以丢弃(Prune)
+type TombstoneTracker struct {
+	mutex   sync.Mutex
+	builder models.ModelBuilder
+	applier models.SqlApplier
+	rows    map[string]*models.ShardingSQL // row key --> 最新的row image, nil表示被删除
+
+	started     chan struct{}
+	startedOnce sync.Once
+	opened      bool
+	closed      bool
+
+	recorded int
+	skipped  int
+	replaced int
+}
+
+func NewTombstoneTracker(builder models.ModelBuilder, applier models.SqlApplier) *TombstoneTracker {
+	return &TombstoneTracker{
+		builder: builder,
+		applier: applier,
+		rows:    make(map[string]*models.ShardingSQL),
+		started: make(chan struct{}),
+	}
+}
+
+// Start binlog开始订阅之后, 批量拷贝才能开始
+func (this *TombstoneTracker) Start() {
+	this.startedOnce.Do(func() {
+		close(this.started)
+	})
+}
+
+func (this *TombstoneTracker) WaitStarted() {
+	<-this.started
+}
+
+// Open 这个表开始批量读取, 开始记录binlog
+func (this *TombstoneTracker) Open() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.opened = true
+}
+
+// Prune 直接apply的模式下, 在读取下一批数据之前调用: 之前记录的变化都已经包含在之后读取的数据中
+func (this *TombstoneTracker) Prune() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if len(this.rows) > 0 {
+		this.rows = make(map[string]*models.ShardingSQL)
+	}
+}
+
+// RecordAndPush 记录binlog中的event, 然后通过push将对应的SQL加入队列
+func (this *TombstoneTracker) RecordAndPush(event *binlog.BinlogDMLEvent, push func()) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.opened && !this.closed {
+		this.recorded++
+		switch event.DML {
+		case binlog.InsertDML:
+			image := this.builder.Insert(event.NewColumnValues.AbstractValues())
+			this.rows[image.RowKey] = image
+		case binlog.UpdateDML:
+			image := this.builder.Insert(event.NewColumnValues.AbstractValues())
+			// pk被修改了, 原来的行相当于被删除
+			if old := this.builder.Delete(event.WhereColumnValues.AbstractValues()); old.RowKey != image.RowKey {
+				this.rows[old.RowKey] = nil
+			}
+			this.rows[image.RowKey] = image
+		case binlog.DeleteDML:
+			old := this.builder.Delete(event.WhereColumnValues.AbstractValues())
+			this.rows[old.RowKey] = nil
+		}
+	}
+	push()
+}
+
+// PushSQL 批量读取的数据(insert ignore): 被删除的跳过, 被修改过的替换为最新的row image
+func (this *TombstoneTracker) PushSQL(sql *models.ShardingSQL) {
+	if sql == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if !this.closed && len(sql.RowKey) > 0 {
+		if image, ok := this.rows[sql.RowKey]; ok {
+			// 每一行只会被读取一次
+			delete(this.rows, sql.RowKey)
+			if image == nil {
+				this.skipped++
+				return
+			}
+			this.replaced++
+			sql = image
+		}
+	}
+	this.applier.PushSQL(sql)
+}
+
+// Close 这个表批量读取的数据全部进入队列之后, 不再需要记录binlog
+func (this *TombstoneTracker) Close() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if !this.closed {
+		this.closed = true
+		log.Printf(color.MagentaString("Tombstones closed")+", events recorded: %d, rows left: %d, skipped: %d, replaced: %d",
+			this.recorded, len(this.rows), this.skipped, this.replaced)
+		this.rows = nil
+	}
+}
@@ -0,0 +1,127 @@
+package logic
+
+import (
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+	"github.com/wfxiang08/db-sharding/binlog"
+	"github.com/wfxiang08/db-sharding/models"
+	"github.com/wfxiang08/db-sharding/sql"
+)
+
+type tombstoneModel struct {
+	Id   int64  `sharding:"id,ordinal=0,shard_key,pk"`
+	Name string `sharding:"name,ordinal=1"`
+}
+
+type sqlCollector struct {
+	sqls []*models.ShardingSQL
+}
+
+func (this *sqlCollector) PushSQL(sql *models.ShardingSQL) {
+	this.sqls = append(this.sqls, sql)
+}
+
+func newTombstoneEvent(dml binlog.EventDML, where []interface{}, values []interface{}) *binlog.BinlogDMLEvent {
+	event := binlog.NewBinlogDMLEvent("test", "t", dml)
+	if where != nil {
+		event.WhereColumnValues = sql.ToColumnValues(where)
+	}
+	if values != nil {
+		event.NewColumnValues = sql.ToColumnValues(values)
+	}
+	return event
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestTombstoneTracker$"
+func TestTombstoneTracker(t *testing.T) {
+	builder, err := models.NewStructModelBuilder("t", &tombstoneModel{}, 4)
+	test.S(t).ExpectNil(err)
+
+	collector := &sqlCollector{}
+	tombstones := NewTombstoneTracker(builder, collector)
+
+	pushed := 0
+	push := func() { pushed++ }
+	tombstones.Open()
+	tombstones.RecordAndPush(newTombstoneEvent(binlog.DeleteDML, []interface{}{int64(1), "a"}, nil), push)
+	tombstones.RecordAndPush(newTombstoneEvent(binlog.UpdateDML, []interface{}{int64(2), "b"}, []interface{}{int64(2), "b2"}), push)
+	// pk被修改
+	tombstones.RecordAndPush(newTombstoneEvent(binlog.UpdateDML, []interface{}{int64(3), "c"}, []interface{}{int64(4), "c"}), push)
+	test.S(t).ExpectEquals(pushed, 3)
+
+	for i, name := range []string{"a", "b", "c", "d", "e"} {
+		tombstones.PushSQL(builder.InsertIgnore(&tombstoneModel{Id: int64(i + 1), Name: name}))
+	}
+
+	// 1, 3被删除; 2, 4替换为最新的row image; 5没有变化
+	test.S(t).ExpectEquals(len(collector.sqls), 3)
+	test.S(t).ExpectEquals(collector.sqls[0].SQL, "replace into t (id, name) values (?, ?)")
+	test.S(t).ExpectEquals(collector.sqls[0].Args, []interface{}{int64(2), "b2"})
+	test.S(t).ExpectEquals(collector.sqls[1].Args, []interface{}{int64(4), "c"})
+	test.S(t).ExpectEquals(collector.sqls[2].SQL, "insert ignore into t (id, name) values (?, ?)")
+	test.S(t).ExpectEquals(collector.sqls[2].Args, []interface{}{int64(5), "e"})
+
+	// 使用过的记录被删除
+	test.S(t).ExpectEquals(len(tombstones.rows), 0)
+
+	// 关闭之后不再过滤
+	tombstones.Close()
+	tombstones.RecordAndPush(newTombstoneEvent(binlog.DeleteDML, []interface{}{int64(5), "e"}, nil), push)
+	tombstones.PushSQL(builder.InsertIgnore(&tombstoneModel{Id: 1, Name: "a"}))
+	test.S(t).ExpectEquals(len(collector.sqls), 4)
+	test.S(t).ExpectEquals(pushed, 4)
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestTombstoneTrackerPrune$"
+func TestTombstoneTrackerPrune(t *testing.T) {
+	builder, err := models.NewStructModelBuilder("t", &tombstoneModel{}, 4)
+	test.S(t).ExpectNil(err)
+
+	collector := &sqlCollector{}
+	tombstones := NewTombstoneTracker(builder, collector)
+	push := func() {}
+
+	// 表还没有开始读取, 读取的数据已经包含了这些变化
+	tombstones.RecordAndPush(newTombstoneEvent(binlog.DeleteDML, []interface{}{int64(1), "a"}, nil), push)
+	test.S(t).ExpectEquals(len(tombstones.rows), 0)
+
+	tombstones.Open()
+	tombstones.RecordAndPush(newTombstoneEvent(binlog.DeleteDML, []interface{}{int64(2), "b"}, nil), push)
+	tombstones.RecordAndPush(newTombstoneEvent(binlog.InsertDML, nil, []interface{}{int64(3), "c"}), push)
+	test.S(t).ExpectEquals(len(tombstones.rows), 2)
+
+	// 下一批数据读取之前丢弃
+	tombstones.Prune()
+	test.S(t).ExpectEquals(len(tombstones.rows), 0)
+	tombstones.PushSQL(builder.InsertIgnore(&tombstoneModel{Id: 3, Name: "c0"}))
+	test.S(t).ExpectEquals(len(collector.sqls), 1)
+	test.S(t).ExpectEquals(collector.sqls[0].SQL, "insert ignore into t (id, name) values (?, ?)")
+	tombstones.Close()
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestShardingApplierMixedTransaction$"
+func TestShardingApplierMixedTransaction(t *testing.T) {
+	applier := &ShardingApplier{}
+	acked := 0
+
+	// binlog事务中间插入了批量拷贝的SQL和标记, 需要等到事务结束
+	applier.bufferSQL(&models.ShardingSQL{SQL: "update", InTransaction: true})
+	applier.bufferSQL(&models.ShardingSQL{SQL: "insert ignore"})
+	marker := models.NewCommitSQL(0)
+	marker.OnCommitted = func() { acked++ }
+	applier.bufferSQL(marker)
+	test.S(t).ExpectEquals(applier.sqlsCommitted, 0)
+	test.S(t).ExpectEquals(len(applier.committedAcks), 0)
+
+	commit := models.NewCommitSQL(0)
+	commit.InTransaction = true
+	applier.bufferSQL(commit)
+	test.S(t).ExpectEquals(applier.sqlsCommitted, 2)
+	test.S(t).ExpectEquals(len(applier.committedAcks), 1)
+	applier.ackCommitted()
+	test.S(t).ExpectEquals(acked, 1)
+
+	test.S(t).ExpectFalse(canBatchInsert(applier.sqlsBuffered))
+	test.S(t).ExpectTrue(canBatchInsert(applier.sqlsBuffered[1:]))
+}
@@ -0,0 +1,611 @@
+package logic
+
+import (
+	gosql "database/sql"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/db-sharding/conf"
+	"github.com/wfxiang08/db-sharding/models"
+	"github.com/wfxiang08/db-sharding/mysql"
+	"github.com/wfxiang08/db-sharding/sql"
+)
+
+type RowDiffType string
+
+const (
+	RowMissing RowDiffType = "missing" // 源表中有, shard上没有
+	RowExtra   RowDiffType = "extra"   // shard上有, 源表中没有(或者在错误的shard上)
+	RowDiffer  RowDiffType = "differ"  // 两边都有, 数据不一致
+)
+
+type RowDiff struct {
+	Type   RowDiffType
+	Shard  int
+	Key    []interface{} // pk的值
+	Source []interface{} // 源表中的数据, 按照GetColumnNames的顺序
+	Target []interface{} // shard上的数据
+}
+
+func (this *RowDiff) String() string {
+	return fmt.Sprintf("%s shard%02d key: %s, source: %s, target: %s", this.Type, this.Shard,
+		rowString(this.Key), rowString(this.Source), rowString(this.Target))
+}
+
+type VerifyResult struct {
+	Chunks        int
+	Rows          int
+	DifferChunks  int
+	Missing       int
+	Extra         int
+	Differ        int
+	Diffs         []*RowDiff
+	DiffsOverflow bool // 差异太多, Diffs中只保留了MaxRowDiffs条
+}
+
+func (this *VerifyResult) HasDiff() bool {
+	return this.Missing+this.Extra+this.Differ > 0
+}
+
+const MaxRowDiffs = 100000
+
+// shardChecksum 一段数据在一个shard上的checksum
+type shardChecksum struct {
+	count uint64
+	crc   uint64
+}
+
+// Verifier 校验源表和各个shard上的数据是否一致
+// 1. 按照分片表的pk(源表上需要有对应的unique key)分段(chunk)读取源表, 每一段按照shard计算checksum: count, bit_xor(crc32(row))
+// 2. 在各个shard上计算同一段数据的checksum(在MySQL中计算, 不需要传输数据)
+// 3. checksum不一致时(binlog可能还没有同步完), 等待之后重新检查; 仍然不一致则逐行比较: missing, extra, differ
+// 每一段数据之前检查throttle(主从延迟), ShardFilter过滤掉的shard不参与校验
+// resharding时有多个源表(老的shards), 每一段数据为各个源表中(lower, upper]之间数据的合集
+type Verifier struct {
+	sourceDBs   []*gosql.DB
+	sourceTable string
+	builder     models.ModelBuilder
+	table       models.TableDescriber
+	filter      func(shard int) bool
+	chunkSize   int
+
+	shardDBs   []*gosql.DB
+	shardHosts []string
+	hostPauses map[string]*atomic2.Bool
+
+	columns    []string
+	primaryKey []string
+	uniqueKey  *sql.UniqueKey // 源表上和pk对应的unique key, 按照column的类型转换chunk的上下限
+	keyIndexes []int          // pk在columns中的位置
+	shardIndex int            // shard key在columns中的位置
+
+	Rechecks        int
+	RecheckInterval time.Duration
+}
+
+func NewVerifier(dbConfig *conf.DatabaseConfig, sourceDBAlias string, sourceTable string,
+	dbHelper models.DBHelper, chunkSize int) (*Verifier, error) {
+	return NewMultiSourceVerifier(dbConfig, []string{sourceDBAlias}, sourceTable, dbHelper, chunkSize)
+}
+
+// NewMultiSourceVerifier 多个源表, 例如: resharding时老的shards
+func NewMultiSourceVerifier(dbConfig *conf.DatabaseConfig, sourceDBAliases []string, sourceTable string,
+	dbHelper models.DBHelper, chunkSize int) (*Verifier, error) {
+
+	table, ok := dbHelper.GetBuilder().(models.TableDescriber)
+	if !ok {
+		return nil, fmt.Errorf("Verify not supported: TableDescriber not implemented by builder")
+	}
+
+	result := &Verifier{
+		sourceTable:     sourceTable,
+		builder:         dbHelper.GetBuilder(),
+		table:           table,
+		filter:          dbHelper.ShardFilter,
+		chunkSize:       chunkSize,
+		columns:         table.GetColumnNames(),
+		primaryKey:      table.GetPrimaryKeyNames(),
+		shardDBs:        make([]*gosql.DB, TotalShardNum),
+		shardHosts:      make([]string, TotalShardNum),
+		hostPauses:      ShardHostPauses(dbConfig),
+		Rechecks:        3,
+		RecheckInterval: time.Second * 2,
+	}
+
+	ordinals := sql.NewColumnList(result.columns).Ordinals
+	for _, name := range result.primaryKey {
+		ordinal, ok := ordinals[name]
+		if !ok {
+			return nil, fmt.Errorf("Primary key column %s not found in %v", name, result.columns)
+		}
+		result.keyIndexes = append(result.keyIndexes, ordinal)
+	}
+	if result.shardIndex, ok = ordinals[table.GetShardKeyName()]; !ok {
+		return nil, fmt.Errorf("Shard key column %s not found in %v", table.GetShardKeyName(), result.columns)
+	}
+
+	for _, alias := range sourceDBAliases {
+		sourceDB, err := openVerifyDB(dbConfig.GetDBUri(alias))
+		if err != nil {
+			return nil, err
+		}
+		result.sourceDBs = append(result.sourceDBs, sourceDB)
+	}
+	var err error
+	if result.uniqueKey, err = sourceUniqueKey(result.sourceDBs[0], sourceTable, result.primaryKey); err != nil {
+		return nil, err
+	}
+	for i := 0; i < TotalShardNum; i++ {
+		alias := ShardAlias(i)
+		_, result.shardHosts[i], _ = dbConfig.GetDB(alias)
+		if result.shardDBs[i], err = openVerifyDB(dbConfig.GetDBUri(alias)); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func openVerifyDB(uri string) (*gosql.DB, error) {
+	db, err := gosql.Open("mysql", uri)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(2)
+	db.SetMaxIdleConns(2)
+	return db, nil
+}
+
+// sourceUniqueKey 源表上和pk的column一致的unique key
+func sourceUniqueKey(db *gosql.DB, tableName string, primaryKey []string) (*sql.UniqueKey, error) {
+	var databaseName string
+	if err := db.QueryRow("select database()").Scan(&databaseName); err != nil {
+		return nil, err
+	}
+	uniqueKeys, err := mysql.GetUniqueKeys(db, databaseName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	for _, uniqueKey := range uniqueKeys {
+		if strings.EqualFold(strings.Join(uniqueKey.Columns.Names(), ","), strings.Join(primaryKey, ",")) {
+			return uniqueKey, nil
+		}
+	}
+	return nil, fmt.Errorf("No unique key (%s) found on %s.%s", strings.Join(primaryKey, ", "), databaseName, tableName)
+}
+
+// ShardHostPauses 每台shard机器一个暂停标记, 用于StartThrottleCheck
+func ShardHostPauses(dbConfig *conf.DatabaseConfig) map[string]*atomic2.Bool {
+	hostPauses := make(map[string]*atomic2.Bool)
+	for i := 0; i < TotalShardNum; i++ {
+		_, hostname, _ := dbConfig.GetDB(ShardAlias(i))
+		if _, ok := hostPauses[hostname]; !ok {
+			hostPauses[hostname] = &atomic2.Bool{}
+		}
+	}
+	return hostPauses
+}
+
+// HostPauses 每台shard机器的暂停标记, 用于StartThrottleCheck
+func (this *Verifier) HostPauses() map[string]*atomic2.Bool {
+	return this.hostPauses
+}
+
+// SetHostPauses 多个verifier共享暂停标记(以及throttle check), 例如: 依次校验多个表
+func (this *Verifier) SetHostPauses(hostPauses map[string]*atomic2.Bool) {
+	this.hostPauses = hostPauses
+}
+
+// Run 校验整个表, stopInput之后返回已经校验部分的结果
+func (this *Verifier) Run(stopInput *atomic2.Bool, pauseInput *atomic2.Bool) (*VerifyResult, error) {
+	result := &VerifyResult{}
+	start := time.Now()
+
+	var lower []interface{}
+	for !stopInput.Get() {
+		this.throttle(stopInput, pauseInput)
+
+		rows, upper, err := this.readChunk(lower)
+		if err != nil {
+			return result, err
+		}
+
+		if err := this.verifyChunk(lower, upper, rows, result); err != nil {
+			return result, err
+		}
+		result.Chunks++
+		result.Rows += len(rows)
+
+		if result.Chunks%100 == 0 || upper == nil {
+			log.Printf(color.GreenString("Verify progress")+": chunks: %d, rows: %d, differ chunks: %d, "+
+				"missing: %d, extra: %d, differ: %d, elapsed: %ds", result.Chunks, result.Rows, result.DifferChunks,
+				result.Missing, result.Extra, result.Differ, int(time.Now().Sub(start).Seconds()))
+		}
+		if upper == nil {
+			break
+		}
+		lower = upper
+	}
+	return result, nil
+}
+
+// throttle 主从延迟过大, 或者手动暂停时等待
+func (this *Verifier) throttle(stopInput *atomic2.Bool, pauseInput *atomic2.Bool) {
+	for !stopInput.Get() {
+		paused := pauseInput.Get()
+		for host, pause := range this.hostPauses {
+			if pause.Get() {
+				log.Printf(color.BlueString("Throttle Pause")+", sleep 1 second for host: %s", host)
+				paused = true
+			}
+		}
+		if !paused {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// verifyChunk 校验(lower, upper]这一段数据
+func (this *Verifier) verifyChunk(lower, upper []interface{}, rows [][]interface{}, result *VerifyResult) error {
+	var differShards []int
+	for i := 0; ; i++ {
+		sourceChecksums := this.sourceChecksums(rows)
+		targetChecksums, err := this.targetChecksums(lower, upper, differShards)
+		if err != nil {
+			return err
+		}
+
+		differShards = differShards[0:0]
+		for shard, checksum := range targetChecksums {
+			if checksum != sourceChecksums[shard] {
+				differShards = append(differShards, shard)
+			}
+		}
+		if len(differShards) == 0 {
+			return nil
+		}
+		if i >= this.Rechecks {
+			break
+		}
+
+		// binlog可能还在同步中, 等待之后重新读取这一段数据
+		time.Sleep(this.RecheckInterval)
+		if rows, err = this.readSource(lower, upper, 0); err != nil {
+			return err
+		}
+	}
+
+	result.DifferChunks++
+	log.Printf(color.RedString("Chunk differ")+": (%s, %s], shards: %v", rowString(lower), rowString(upper), differShards)
+
+	sourceRows := this.groupByShard(rows)
+	for _, shard := range differShards {
+		targetRows, err := this.readShard(shard, lower, upper)
+		if err != nil {
+			return err
+		}
+		for _, diff := range this.diffRows(shard, sourceRows[shard], targetRows) {
+			switch diff.Type {
+			case RowMissing:
+				result.Missing++
+			case RowExtra:
+				result.Extra++
+			case RowDiffer:
+				result.Differ++
+			}
+			log.Printf(color.RedString("Row differ")+": %s", diff.String())
+			if len(result.Diffs) < MaxRowDiffs {
+				result.Diffs = append(result.Diffs, diff)
+			} else {
+				result.DiffsOverflow = true
+			}
+		}
+	}
+	return nil
+}
+
+func (this *Verifier) rowKey(row []interface{}) []interface{} {
+	key := make([]interface{}, len(this.keyIndexes))
+	for i, index := range this.keyIndexes {
+		key[i] = row[index]
+	}
+	return key
+}
+
+func (this *Verifier) groupByShard(rows [][]interface{}) map[int][][]interface{} {
+	result := make(map[int][][]interface{})
+	for _, row := range rows {
+		shard := this.table.GetShardingIndex4Key(row[this.shardIndex])
+		if this.filter(shard) {
+			result[shard] = append(result[shard], row)
+		}
+	}
+	return result
+}
+
+func (this *Verifier) sourceChecksums(rows [][]interface{}) map[int]shardChecksum {
+	result := make(map[int]shardChecksum)
+	for shard, shardRows := range this.groupByShard(rows) {
+		var checksum shardChecksum
+		for _, row := range shardRows {
+			checksum.count++
+			checksum.crc ^= uint64(rowChecksum(row))
+		}
+		result[shard] = checksum
+	}
+	return result
+}
+
+// targetChecksums 各个shard上(lower, upper]这一段数据的checksum, shards为空时表示所有的shards
+func (this *Verifier) targetChecksums(lower, upper []interface{}, shards []int) (map[int]shardChecksum, error) {
+	if len(shards) == 0 {
+		for shard := 0; shard < TotalShardNum; shard++ {
+			if this.filter(shard) {
+				shards = append(shards, shard)
+			}
+		}
+	}
+
+	query, args := this.checksumSQL(lower, upper)
+	result := make(map[int]shardChecksum)
+	var mutex sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for _, shard := range shards {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			var checksum shardChecksum
+			err := this.shardDBs[shard].QueryRow(query, args...).Scan(&checksum.count, &checksum.crc)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("Checksum failed on shard%d: %s", shard, err.Error())
+			}
+			result[shard] = checksum
+		}(shard)
+	}
+	wg.Wait()
+	return result, firstErr
+}
+
+// readChunk 从lower开始读取一段数据, 返回这一段的上限; 最后一段没有上限(nil), 用于发现shard上多出来的数据
+// 多个源表时, 每个源表读取chunkSize行, 以最小的最后一行作为上限, 然后重新读取(lower, upper]之间的数据
+// 上限按照column的类型转换, 作为参数时才能和MySQL中的比较一致
+func (this *Verifier) readChunk(lower []interface{}) ([][]interface{}, []interface{}, error) {
+	var rows [][]interface{}
+	var upper []interface{}
+	query, args := this.selectSQL(this.sourceTable, lower, nil, this.chunkSize)
+	for _, sourceDB := range this.sourceDBs {
+		sourceRows, err := queryRows(sourceDB, len(this.columns), query, args...)
+		if err != nil {
+			return nil, nil, err
+		}
+		rows = append(rows, sourceRows...)
+		if len(sourceRows) == this.chunkSize {
+			last, err := this.keyValues(this.rowKey(sourceRows[len(sourceRows)-1]))
+			if err != nil {
+				return nil, nil, err
+			}
+			if upper == nil || compareKey(last, upper) < 0 {
+				upper = last
+			}
+		}
+	}
+
+	if upper == nil || len(this.sourceDBs) == 1 {
+		return rows, upper, nil
+	}
+	rows, err := this.readSource(lower, upper, 0)
+	return rows, upper, err
+}
+
+// keyValues 按照源表unique key的类型转换pk的值, 和KeysetBatchReader一致
+func (this *Verifier) keyValues(key []interface{}) ([]interface{}, error) {
+	return keyValues(this.sourceTable, this.uniqueKey, key)
+}
+
+// readSource 各个源表中(lower, upper]之间的数据
+func (this *Verifier) readSource(lower, upper []interface{}, limit int) ([][]interface{}, error) {
+	query, args := this.selectSQL(this.sourceTable, lower, upper, limit)
+	var result [][]interface{}
+	for _, sourceDB := range this.sourceDBs {
+		rows, err := queryRows(sourceDB, len(this.columns), query, args...)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rows...)
+	}
+	return result, nil
+}
+
+// compareKey 比较两个pk, 只用于选择chunk的上限, 数据的范围仍然由MySQL中的比较决定
+// 整数(int64/uint64范围内)按照数值比较, 其他按照字节比较
+// 限制: 字符串的字节顺序和collation可能不一致, 多个源表时选出的上限可能不是最小的,
+// 这一段在某些源表中会超过chunkSize行, 但是(lower, upper]重新读取, 不会遗漏数据
+func compareKey(a, b []interface{}) int {
+	for i := range a {
+		x, y := valueString(a[i]), valueString(b[i])
+		if x == y {
+			continue
+		}
+		xi, errX := strconv.ParseInt(x, 10, 64)
+		yi, errY := strconv.ParseInt(y, 10, 64)
+		if errX == nil && errY == nil {
+			if xi < yi {
+				return -1
+			}
+			return 1
+		}
+		xu, errX := strconv.ParseUint(x, 10, 64)
+		yu, errY := strconv.ParseUint(y, 10, 64)
+		if errX == nil && errY == nil {
+			if xu < yu {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(x, y)
+	}
+	return 0
+}
+
+func (this *Verifier) readShard(shard int, lower, upper []interface{}) ([][]interface{}, error) {
+	query, args := this.selectSQL(this.table.GetTableName(), lower, upper, 0)
+	return queryRows(this.shardDBs[shard], len(this.columns), query, args...)
+}
+
+// diffRows 逐行比较一个shard上的数据
+func (this *Verifier) diffRows(shard int, sourceRows, targetRows [][]interface{}) []*RowDiff {
+	targets := make(map[string][]interface{}, len(targetRows))
+	for _, row := range targetRows {
+		targets[models.RowKey(this.rowKey(row))] = row
+	}
+
+	var diffs []*RowDiff
+	for _, row := range sourceRows {
+		key := models.RowKey(this.rowKey(row))
+		target, ok := targets[key]
+		if !ok {
+			diffs = append(diffs, &RowDiff{Type: RowMissing, Shard: shard, Key: this.rowKey(row), Source: row})
+			continue
+		}
+		delete(targets, key)
+		if rowString(row) != rowString(target) {
+			diffs = append(diffs, &RowDiff{Type: RowDiffer, Shard: shard, Key: this.rowKey(row), Source: row, Target: target})
+		}
+	}
+	for _, row := range targetRows {
+		if _, ok := targets[models.RowKey(this.rowKey(row))]; ok {
+			diffs = append(diffs, &RowDiff{Type: RowExtra, Shard: shard, Key: this.rowKey(row), Target: row})
+		}
+	}
+	return diffs
+}
+
+func queryRows(db *gosql.DB, columnCount int, query string, args ...interface{}) ([][]interface{}, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result [][]interface{}
+	for rows.Next() {
+		values := sql.NewColumnValues(columnCount)
+		if err := rows.Scan(values.ValuesPointers...); err != nil {
+			return nil, err
+		}
+		result = append(result, values.AbstractValues())
+	}
+	return result, rows.Err()
+}
+
+// rangeWhere (lower, upper]的where条件, lower/upper为nil表示没有限制
+// 和KeysetBatchReader一样展开row constructor, lower/upper需要按照column的类型转换(keyValues)
+func (this *Verifier) rangeWhere(lower, upper []interface{}) (string, []interface{}) {
+	names := make([]string, len(this.primaryKey))
+	for i, name := range this.primaryKey {
+		names[i] = sql.EscapeName(name)
+	}
+
+	var conditions []string
+	var args []interface{}
+	if lower != nil {
+		conditions = append(conditions, keysetWhere(names, ">"))
+		args = append(args, keysetArgs(lower)...)
+	}
+	if upper != nil {
+		conditions = append(conditions, keysetWhere(names, "<="))
+		args = append(args, keysetArgs(upper)...)
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	if len(conditions) > 1 && len(names) > 1 {
+		for i := range conditions {
+			conditions[i] = "(" + conditions[i] + ")"
+		}
+	}
+	return " where " + strings.Join(conditions, " and "), args
+}
+
+func (this *Verifier) selectSQL(tableName string, lower, upper []interface{}, limit int) (string, []interface{}) {
+	columns := make([]string, len(this.columns))
+	for i, name := range this.columns {
+		columns[i] = sql.EscapeName(name)
+	}
+	keys := make([]string, len(this.primaryKey))
+	for i, name := range this.primaryKey {
+		keys[i] = sql.EscapeName(name)
+	}
+
+	where, args := this.rangeWhere(lower, upper)
+	query := fmt.Sprintf("select %s from %s%s order by %s", strings.Join(columns, ", "), sql.EscapeName(tableName),
+		where, strings.Join(keys, ", "))
+	if limit > 0 {
+		query = fmt.Sprintf("%s limit %d", query, limit)
+	}
+	return query, args
+}
+
+// checksumSQL 和rowChecksum的计算方法一致: crc32(concat_ws('#', columns..., concat(isnull(column)...)))
+func (this *Verifier) checksumSQL(lower, upper []interface{}) (string, []interface{}) {
+	columns := make([]string, len(this.columns))
+	nulls := make([]string, len(this.columns))
+	for i, name := range this.columns {
+		columns[i] = sql.EscapeName(name)
+		nulls[i] = fmt.Sprintf("isnull(%s)", sql.EscapeName(name))
+	}
+
+	where, args := this.rangeWhere(lower, upper)
+	query := fmt.Sprintf("select count(*), coalesce(bit_xor(crc32(concat_ws('#', %s, concat(%s)))), 0) from %s%s",
+		strings.Join(columns, ", "), strings.Join(nulls, ", "), sql.EscapeName(this.table.GetTableName()), where)
+	return query, args
+}
+
+// rowChecksum 文本协议读取的数据和MySQL中concat_ws的结果一致; NULL被concat_ws跳过, 通过isnull区分
+func rowChecksum(row []interface{}) uint32 {
+	var values []string
+	nulls := make([]byte, len(row))
+	for i, value := range row {
+		if value == nil {
+			nulls[i] = '1'
+			continue
+		}
+		nulls[i] = '0'
+		values = append(values, valueString(value))
+	}
+	values = append(values, string(nulls))
+	return crc32.ChecksumIEEE([]byte(strings.Join(values, "#")))
+}
+
+func valueString(value interface{}) string {
+	if data, ok := value.([]byte); ok {
+		return string(data)
+	}
+	return fmt.Sprint(value)
+}
+
+func rowString(row []interface{}) string {
+	if row == nil {
+		return "-"
+	}
+	values := make([]string, len(row))
+	for i, value := range row {
+		if value == nil {
+			values[i] = "NULL"
+		} else {
+			values[i] = valueString(value)
+		}
+	}
+	return strings.Join(values, ",")
+}
@@ -0,0 +1,127 @@
+package logic
+
+import (
+	"hash/crc32"
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+	"github.com/wfxiang08/db-sharding/sql"
+)
+
+func newTestVerifier() *Verifier {
+	columns := sql.ParseColumnList("user_id,recording_id")
+	columns.SetDataType("user_id", "bigint")
+	columns.SetDataType("recording_id", "varchar")
+	return &Verifier{
+		sourceTable: "user_recording_like",
+		columns:     []string{"user_id", "recording_id", "created_on"},
+		primaryKey:  []string{"user_id", "recording_id"},
+		uniqueKey:   &sql.UniqueKey{Name: "PRIMARY", Columns: *columns},
+		keyIndexes:  []int{0, 1},
+		shardIndex:  0,
+	}
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestVerifierSQL$"
+func TestVerifierSQL(t *testing.T) {
+	verifier := newTestVerifier()
+
+	query, args := verifier.selectSQL("user_recording_like", nil, nil, 2000)
+	test.S(t).ExpectEquals(query, "select `user_id`, `recording_id`, `created_on` from `user_recording_like` "+
+		"order by `user_id`, `recording_id` limit 2000")
+	test.S(t).ExpectEquals(len(args), 0)
+
+	query, args = verifier.selectSQL("user_recording_like", []interface{}{1, 2}, []interface{}{3, 4}, 0)
+	test.S(t).ExpectEquals(query, "select `user_id`, `recording_id`, `created_on` from `user_recording_like` "+
+		"where (`user_id` > ? or (`user_id` = ? and `recording_id` > ?)) "+
+		"and (`user_id` < ? or (`user_id` = ? and `recording_id` <= ?)) order by `user_id`, `recording_id`")
+	test.S(t).ExpectEquals(args, []interface{}{1, 1, 2, 3, 3, 4})
+
+	where, args := verifier.rangeWhere(nil, []interface{}{3, 4})
+	test.S(t).ExpectEquals(where, " where `user_id` < ? or (`user_id` = ? and `recording_id` <= ?)")
+	test.S(t).ExpectEquals(args, []interface{}{3, 3, 4})
+
+	verifier.primaryKey = []string{"id"}
+	where, args = verifier.rangeWhere([]interface{}{10}, nil)
+	test.S(t).ExpectEquals(where, " where `id` > ?")
+	test.S(t).ExpectEquals(args, []interface{}{10})
+
+	where, args = verifier.rangeWhere([]interface{}{10}, []interface{}{20})
+	test.S(t).ExpectEquals(where, " where `id` > ? and `id` <= ?")
+	test.S(t).ExpectEquals(args, []interface{}{10, 20})
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestVerifierKeyValues$"
+func TestVerifierKeyValues(t *testing.T) {
+	verifier := newTestVerifier()
+
+	// chunk的上下限按照column的类型转换, bigint超过2^53也不会丢失精度
+	key, err := verifier.keyValues(verifier.rowKey([]interface{}{[]byte("9007199254740993"), []byte("abc"), nil}))
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(key, []interface{}{int64(9007199254740993), "abc"})
+
+	_, err = verifier.keyValues([]interface{}{[]byte("abc"), []byte("abc")})
+	test.S(t).ExpectNotNil(err)
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestVerifierDiffRows$"
+func TestVerifierDiffRows(t *testing.T) {
+	verifier := newTestVerifier()
+
+	// 和MySQL中concat_ws的结果一致
+	test.S(t).ExpectEquals(rowChecksum([]interface{}{[]byte("1"), []byte("2"), nil}), crc32.ChecksumIEEE([]byte("1#2#001")))
+	test.S(t).ExpectEquals(rowChecksum([]interface{}{int64(1), "2", []byte("3")}), crc32.ChecksumIEEE([]byte("1#2#3#000")))
+
+	source := [][]interface{}{
+		{[]byte("1"), []byte("1"), []byte("100")},
+		{[]byte("1"), []byte("2"), []byte("100")},
+		{[]byte("1"), []byte("3"), []byte("100")},
+	}
+	target := [][]interface{}{
+		{[]byte("1"), []byte("1"), []byte("100")},
+		{[]byte("1"), []byte("2"), []byte("101")},
+		{[]byte("1"), []byte("4"), []byte("100")},
+	}
+	diffs := verifier.diffRows(3, source, target)
+	test.S(t).ExpectEquals(len(diffs), 3)
+	test.S(t).ExpectEquals(diffs[0].Type, RowDiffer)
+	test.S(t).ExpectEquals(rowString(diffs[0].Key), "1,2")
+	test.S(t).ExpectEquals(diffs[1].Type, RowMissing)
+	test.S(t).ExpectEquals(rowString(diffs[1].Key), "1,3")
+	test.S(t).ExpectEquals(diffs[2].Type, RowExtra)
+	test.S(t).ExpectEquals(diffs[2].String(), "extra shard03 key: 1,4, source: -, target: 1,4,100")
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestVerifierKeyWhere$"
+func TestVerifierKeyWhere(t *testing.T) {
+	verifier := newTestVerifier()
+	where, args := verifier.keyWhere([]interface{}{[]byte("1"), []byte("2")})
+	test.S(t).ExpectEquals(where, " where `user_id` = ? and `recording_id` = ?")
+	test.S(t).ExpectEquals(len(args), 2)
+
+	// _binary'9007199254740993'按照double比较时会匹配到9007199254740992
+	key, _ := verifier.keyValues([]interface{}{[]byte("9007199254740993"), []byte("abc")})
+	rowKey, _ := verifier.keyValues([]interface{}{[]byte("9007199254740992"), []byte("abc")})
+	test.S(t).ExpectFalse(sameKey(key, rowKey))
+	test.S(t).ExpectTrue(sameKey(key, key))
+
+	// 字符串由collation决定
+	rowKey, _ = verifier.keyValues([]interface{}{[]byte("9007199254740993"), []byte("ABC")})
+	test.S(t).ExpectTrue(sameKey(key, rowKey))
+}
+
+// go test github.com/wfxiang08/db-sharding/logic -v -run "TestVerifierCompareKey$"
+func TestVerifierCompareKey(t *testing.T) {
+	// 整数按照数值比较
+	test.S(t).ExpectEquals(compareKey([]interface{}{[]byte("9"), []byte("2")}, []interface{}{[]byte("10"), []byte("1")}), -1)
+	test.S(t).ExpectEquals(compareKey([]interface{}{[]byte("1"), []byte("2")}, []interface{}{[]byte("1"), []byte("2")}), 0)
+	test.S(t).ExpectEquals(compareKey([]interface{}{[]byte("1"), []byte("b")}, []interface{}{[]byte("1"), []byte("a")}), 1)
+
+	// 转换之后的bigint/bigint unsigned
+	test.S(t).ExpectEquals(compareKey([]interface{}{int64(9007199254740993)}, []interface{}{int64(9007199254740992)}), 1)
+	test.S(t).ExpectEquals(compareKey([]interface{}{uint64(18446744073709551615)}, []interface{}{uint64(9223372036854775808)}), 1)
+
+	// 限制: 字符串按照字节比较, 和collation的顺序可能不一致(例如: utf8mb4_general_ci中'a' < 'B')
+	// 多个源表时只会让选出的上限偏大, 数据范围仍然由MySQL决定
+	test.S(t).ExpectEquals(compareKey([]interface{}{"a"}, []interface{}{"B"}), 1)
+}
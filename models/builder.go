@@ -1,5 +1,7 @@
 package models
 
+import "github.com/wfxiang08/db-sharding/sql"
+
 //
 // 1. 实现model(interface{})到SQL转换
 // 2. 实现binlog的args, where到SQL转换
@@ -16,3 +18,25 @@ type ModelBuilder interface {
 	GetShardingIndex4Model(model interface{}) int
 	GetBatchInsertSegment() string
 }
+
+// 可选接口: 根据binlog中关联的表结构校验builder的ordinal是否正确
+// 防止表结构调整(column顺序变化)之后，数据被静默地写错column或shard
+type ColumnsChecker interface {
+	CheckColumns(columns *sql.ColumnList) error
+}
+
+// 可选接口: 分片表的结构, 用于数据校验(按照column name读取源表和shard上的数据)
+type TableDescriber interface {
+	GetTableName() string
+	GetColumnNames() []string
+	GetPrimaryKeyNames() []string
+	GetShardKeyName() string
+	GetShardingIndex4Key(key interface{}) int
+	// 按照pk删除, key按照GetPrimaryKeyNames的顺序
+	DeleteByKey(key []interface{}) *ShardingSQL
+}
+
+// 可选接口: 只同步满足条件的数据(例如: 配置中的filters), row为binlog的row image
+type RowMatcher interface {
+	MatchRow(row []interface{}) bool
+}
@@ -21,3 +21,17 @@ type DBHelper interface {
 	ClearShard(shard int)
 	GetShardLen(shard int) int
 }
+
+// ShardIterator 可选: 按照排序之后的顺序遍历shard内的数据(例如: 外部排序, 数据不在内存中)
+// 实现了该接口的DBHelper不再通过GetShardLen/GetShardItem访问数据
+type ShardIterator interface {
+	IterateShard(shard int, onItem func(item interface{}) error) error
+}
+
+// BatchSeeker 可选: 支持断点续传的DBHelper
+type BatchSeeker interface {
+	// 最后读取的unique key
+	BatchPosition() []interface{}
+	// 从给定的unique key之后开始读取
+	BatchSeek(lastValues []interface{})
+}
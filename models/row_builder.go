@@ -0,0 +1,127 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/wfxiang08/db-sharding/conf"
+)
+
+// RowModel 批量读取的一行数据, Values按照源表中column的顺序排列(和binlog的row image一致)
+type RowModel struct {
+	Values []interface{}
+}
+
+// RowModelBuilder 根据配置(conf.TableMapping)生成的ModelBuilder, 不需要定义struct
+// model为*RowModel, column的ordinal就是在源表中的位置
+type RowModelBuilder struct {
+	*StructModelBuilder
+
+	filters        []*conf.RowFilter
+	filterOrdinals []int
+	reorderKey     []int
+}
+
+// NewRowModelBuilder sourceColumns为源表的columns, 按照表结构中的顺序
+func NewRowModelBuilder(mapping *conf.TableMapping, sourceColumns []string, shardNum int) (*RowModelBuilder, error) {
+	ordinals := make(map[string]int, len(sourceColumns))
+	for i, name := range sourceColumns {
+		ordinals[name] = i
+	}
+	ordinalOf := func(name string) (int, error) {
+		ordinal, ok := ordinals[name]
+		if !ok {
+			return -1, fmt.Errorf("NewRowModelBuilder: column %s not found in %s", name, mapping.SourceTable)
+		}
+		return ordinal, nil
+	}
+
+	columns := mapping.Columns
+	if len(columns) == 0 {
+		columns = sourceColumns
+	}
+	primaryKey := make(map[string]bool)
+	for _, name := range mapping.PrimaryKey {
+		primaryKey[name] = true
+	}
+
+	fields := make([]*structField, len(columns))
+	for i, name := range columns {
+		ordinal, err := ordinalOf(name)
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = &structField{
+			name:       name,
+			fieldIndex: ordinal,
+			ordinal:    ordinal,
+			shardKey:   name == mapping.ShardKey,
+			primaryKey: primaryKey[name],
+		}
+	}
+
+	builder, err := newFieldsModelBuilder(mapping.TargetTable, fields, shardNum)
+	if err != nil {
+		return nil, fmt.Errorf("NewRowModelBuilder: %s in %s", err.Error(), mapping.Name)
+	}
+	result := &RowModelBuilder{
+		StructModelBuilder: builder,
+		filters:            mapping.RowFilters,
+	}
+	for _, filter := range mapping.RowFilters {
+		ordinal, err := ordinalOf(filter.Column)
+		if err != nil {
+			return nil, err
+		}
+		result.filterOrdinals = append(result.filterOrdinals, ordinal)
+	}
+	for _, name := range mapping.ReorderKey {
+		ordinal, err := ordinalOf(name)
+		if err != nil {
+			return nil, err
+		}
+		result.reorderKey = append(result.reorderKey, ordinal)
+	}
+	return result, nil
+}
+
+func (this *RowModelBuilder) rowValues(model interface{}) []interface{} {
+	return model.(*RowModel).Values
+}
+
+// InsertIgnore 从DB中读取的数据可能为[]byte(文本协议), shard key按照string处理
+func (this *RowModelBuilder) InsertIgnore(model interface{}) *ShardingSQL {
+	row := this.rowValues(model)
+	return &ShardingSQL{
+		ShardingIndex: this.GetShardingIndex4Key(row[this.shardKey.ordinal]),
+		SQL:           this.sqlInsertIgnore,
+		Args:          this.binlogArgs(this.columns, row),
+		RowKey:        RowKey(this.binlogArgs(this.primaryKey, row)),
+	}
+}
+
+func (this *RowModelBuilder) GetShardingIndex4Model(model interface{}) int {
+	return this.GetShardingIndex4Key(this.rowValues(model)[this.shardKey.ordinal])
+}
+
+// MatchRow 满足所有的filters
+func (this *RowModelBuilder) MatchRow(row []interface{}) bool {
+	for i, filter := range this.filters {
+		if !filter.Match(row[this.filterOrdinals[i]]) {
+			return false
+		}
+	}
+	return true
+}
+
+// ReorderKey 批量拷贝时shard内的排序key
+func (this *RowModelBuilder) ReorderKey(model interface{}) []interface{} {
+	return this.binlogValues(this.reorderKey, this.rowValues(model))
+}
+
+func (this *RowModelBuilder) binlogValues(ordinals []int, row []interface{}) []interface{} {
+	values := make([]interface{}, len(ordinals))
+	for i, ordinal := range ordinals {
+		values[i] = row[ordinal]
+	}
+	return values
+}
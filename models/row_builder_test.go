@@ -0,0 +1,42 @@
+package models
+
+import (
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+	"github.com/wfxiang08/db-sharding/conf"
+)
+
+// go test github.com/wfxiang08/db-sharding/models -v -run "TestRowModelBuilder$"
+func TestRowModelBuilder(t *testing.T) {
+	mapping := &conf.TableMapping{
+		SourceAlias: "final",
+		SourceTable: "user_recording_like",
+		ShardKey:    "user_id",
+		Columns:     []string{"user_id", "recording_id", "created_on"},
+		PrimaryKey:  []string{"user_id", "recording_id"},
+		Filters:     []string{"created_on > 0"},
+	}
+	test.S(t).ExpectNil(mapping.Validate())
+
+	builder, err := NewRowModelBuilder(mapping, []string{"id", "created_on", "user_id", "recording_id"}, 32)
+	test.S(t).ExpectNil(err)
+
+	// 批量读取的数据(文本协议)和binlog中的数据sharding的结果一致
+	row := []interface{}{[]byte("1"), []byte("100"), []byte("6755399444017774"), []byte("3")}
+	model := &RowModel{Values: row}
+	expected := builder.Insert([]interface{}{int64(1), int32(100), int64(6755399444017774), int64(3)})
+	sql := builder.InsertIgnore(model)
+	test.S(t).ExpectEquals(sql.SQL, "insert ignore into user_recording_like (user_id, recording_id, created_on) values (?, ?, ?)")
+	test.S(t).ExpectEquals(sql.ShardingIndex, expected.ShardingIndex)
+	test.S(t).ExpectEquals(sql.RowKey, expected.RowKey)
+	test.S(t).ExpectEquals(builder.GetShardingIndex4Model(model), expected.ShardingIndex)
+	test.S(t).ExpectEquals(len(builder.ReorderKey(model)), 2)
+
+	test.S(t).ExpectTrue(builder.MatchRow(row))
+	test.S(t).ExpectFalse(builder.MatchRow([]interface{}{int64(1), int32(0), int64(1), int64(1)}))
+
+	// 源表中没有的column
+	_, err = NewRowModelBuilder(mapping, []string{"id", "user_id", "recording_id"}, 32)
+	test.S(t).ExpectNotNil(err)
+}
@@ -0,0 +1,274 @@
+package models
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+
+	"github.com/wfxiang08/db-sharding/conf"
+)
+
+const (
+	ShardStrategySMHash         = "sm_hash"
+	ShardStrategyMod            = "mod"
+	ShardStrategyRange          = "range"
+	ShardStrategyConsistentHash = "consistent_hash"
+	ShardStrategyLookup         = "lookup"
+	ShardStrategyBucketMap      = "bucket_map"
+
+	DefaultConsistentHashReplicas = 160
+)
+
+// ShardStrategy 由shard key找到分片
+type ShardStrategy interface {
+	FindForKey(key interface{}) (int, error)
+}
+
+// NewShardStrategy 根据配置创建分片算法, 默认为SMHashShard
+func NewShardStrategy(config *conf.ShardingConfig, shardNum int) (ShardStrategy, error) {
+	if shardNum <= 0 {
+		return nil, fmt.Errorf("Invalid shard num: %d", shardNum)
+	}
+	if config == nil {
+		config = &conf.ShardingConfig{}
+	}
+
+	switch config.Strategy {
+	case "", ShardStrategySMHash:
+		// shardNum为table的总数: DB数 * Location
+		if config.Location < 2 {
+			return NewSMHashShard(shardNum, config.Location), nil
+		}
+		if shardNum%int(config.Location) != 0 {
+			return nil, fmt.Errorf("Shard num %d is not a multiple of location %d", shardNum, config.Location)
+		}
+		return NewSMHashShard(shardNum/int(config.Location), config.Location), nil
+	case ShardStrategyMod:
+		return NewModShard(shardNum), nil
+	case ShardStrategyRange:
+		ranges := make([]ShardRange, len(config.Ranges))
+		for i, item := range config.Ranges {
+			if len(item) != 3 {
+				return nil, fmt.Errorf("Invalid shard range: %v, expect: [start, end, shard]", item)
+			}
+			ranges[i] = ShardRange{Start: item[0], End: item[1], Shard: int(item[2])}
+		}
+		return NewRangeShard(ranges, shardNum)
+	case ShardStrategyConsistentHash:
+		return NewConsistentHashShard(shardNum, config.Replicas), nil
+	case ShardStrategyLookup:
+		return NewLookupShard(config.Lookup, shardNum)
+	case ShardStrategyBucketMap:
+		if config.BucketMap == nil {
+			return nil, fmt.Errorf("Bucket map not loaded, bucket_map: %s", config.BucketMapFile)
+		}
+		aliasFormat := config.ShardAliasFormat
+		if len(aliasFormat) == 0 {
+			aliasFormat = conf.DefaultShardAliasFormat
+		}
+		return NewBucketMapShard(config.BucketMap, aliasFormat, shardNum)
+	}
+	return nil, fmt.Errorf("Unknown shard strategy: %s", config.Strategy)
+}
+
+// normalizeShardKey binlog中的整数为int8/int16/int32/int64(或者对应的unsigned类型), DB中读取的为[]byte,
+// 统一为int64/uint64/string, 保证批量拷贝和binlog中的同一行数据得到相同的shard
+func normalizeShardKey(key interface{}) interface{} {
+	switch val := key.(type) {
+	case int:
+		return int64(val)
+	case int8:
+		return int64(val)
+	case int16:
+		return int64(val)
+	case int32:
+		return int64(val)
+	case uint:
+		return uint64(val)
+	case uint8:
+		return uint64(val)
+	case uint16:
+		return uint64(val)
+	case uint32:
+		return uint64(val)
+	case []byte:
+		return string(val)
+	}
+	return key
+}
+
+// keyString 从DB中读取的[]byte和string按照相同的方式处理
+func keyString(key interface{}) string {
+	if data, ok := key.([]byte); ok {
+		return string(data)
+	}
+	return fmt.Sprint(key)
+}
+
+// ModShard HashValue(key) % ShardNum
+type ModShard struct {
+	ShardNum int
+}
+
+func NewModShard(shardNum int) *ModShard {
+	return &ModShard{ShardNum: shardNum}
+}
+
+func (s *ModShard) FindForKey(key interface{}) (int, error) {
+	key = normalizeShardKey(key)
+	return int(HashValue(key) % uint64(s.ShardNum)), nil
+}
+
+// ShardRange 整数key的区间: [Start, End)
+type ShardRange struct {
+	Start int64
+	End   int64
+	Shard int
+}
+
+// RangeShard 按照区间分片, key必须是整数
+type RangeShard struct {
+	Ranges []ShardRange // 按照Start升序排列, 没有重叠
+}
+
+func NewRangeShard(ranges []ShardRange, shardNum int) (*RangeShard, error) {
+	sorted := append([]ShardRange{}, ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+	for i, item := range sorted {
+		if item.Start >= item.End {
+			return nil, fmt.Errorf("Invalid shard range: [%d, %d)", item.Start, item.End)
+		}
+		if item.Shard < 0 || item.Shard >= shardNum {
+			return nil, fmt.Errorf("Invalid shard %d of range [%d, %d)", item.Shard, item.Start, item.End)
+		}
+		if i > 0 && item.Start < sorted[i-1].End {
+			return nil, fmt.Errorf("Overlapped shard ranges: [%d, %d), [%d, %d)", sorted[i-1].Start, sorted[i-1].End,
+				item.Start, item.End)
+		}
+	}
+	return &RangeShard{Ranges: sorted}, nil
+}
+
+func (s *RangeShard) FindForKey(key interface{}) (int, error) {
+	var value int64
+	switch val := key.(type) {
+	case int:
+		value = int64(val)
+	case int32:
+		value = int64(val)
+	case int64:
+		value = val
+	case uint64:
+		value = int64(val)
+	default:
+		v, err := strconv.ParseInt(keyString(key), 10, 64)
+		if err != nil {
+			return -1, fmt.Errorf("Unexpected key for range shard: %v", key)
+		}
+		value = v
+	}
+
+	// 第一个End > value的区间
+	index := sort.Search(len(s.Ranges), func(i int) bool {
+		return s.Ranges[i].End > value
+	})
+	if index == len(s.Ranges) || s.Ranges[index].Start > value {
+		return -1, fmt.Errorf("No shard range found for key: %d", value)
+	}
+	return s.Ranges[index].Shard, nil
+}
+
+// ConsistentHashShard 一致性hash, 每个shard在环上有Replicas个虚拟节点
+// 增加shard时只有少量的key需要迁移
+type ConsistentHashShard struct {
+	points []uint32
+	shards map[uint32]int
+}
+
+func NewConsistentHashShard(shardNum int, replicas int) *ConsistentHashShard {
+	if replicas <= 0 {
+		replicas = DefaultConsistentHashReplicas
+	}
+	result := &ConsistentHashShard{
+		shards: make(map[uint32]int, shardNum*replicas),
+	}
+	for shard := 0; shard < shardNum; shard++ {
+		for i := 0; i < replicas; i++ {
+			point := crc32.ChecksumIEEE([]byte(fmt.Sprintf("shard%d#%d", shard, i)))
+			if _, ok := result.shards[point]; ok {
+				// hash冲突, 保留第一个
+				continue
+			}
+			result.shards[point] = shard
+			result.points = append(result.points, point)
+		}
+	}
+	sort.Slice(result.points, func(i, j int) bool {
+		return result.points[i] < result.points[j]
+	})
+	return result
+}
+
+func (s *ConsistentHashShard) FindForKey(key interface{}) (int, error) {
+	h := crc32.ChecksumIEEE([]byte(keyString(key)))
+	index := sort.Search(len(s.points), func(i int) bool {
+		return s.points[i] >= h
+	})
+	if index == len(s.points) {
+		index = 0
+	}
+	return s.shards[s.points[index]], nil
+}
+
+// LookupShard 明确指定每一个key所在的shard(例如: 少量的大客户单独部署)
+type LookupShard struct {
+	Table map[string]int
+}
+
+func NewLookupShard(table map[string]int, shardNum int) (*LookupShard, error) {
+	for key, shard := range table {
+		if shard < 0 || shard >= shardNum {
+			return nil, fmt.Errorf("Invalid shard %d for key: %s", shard, key)
+		}
+	}
+	return &LookupShard{Table: table}, nil
+}
+
+func (s *LookupShard) FindForKey(key interface{}) (int, error) {
+	shard, ok := s.Table[keyString(key)]
+	if !ok {
+		return -1, fmt.Errorf("No shard found for key: %s", keyString(key))
+	}
+	return shard, nil
+}
+
+// BucketMapShard SMShard的4096个bucket通过bucket map映射到shard上
+// 修改bucket map即可在shard之间迁移数据, 不需要修改hash
+type BucketMapShard struct {
+	buckets [conf.BucketNum]int
+}
+
+func NewBucketMapShard(bucketMap *conf.BucketMap, aliasFormat string, shardNum int) (*BucketMapShard, error) {
+	result := &BucketMapShard{}
+	for _, r := range bucketMap.Ranges {
+		shard, err := r.ShardIndex(aliasFormat)
+		if err != nil {
+			return nil, err
+		}
+		if shard >= shardNum {
+			return nil, fmt.Errorf("Invalid shard %s of buckets [%d, %d]", r.Shard, r.Start, r.End)
+		}
+		for bucket := r.Start; bucket <= r.End; bucket++ {
+			result.buckets[bucket] = shard
+		}
+	}
+	return result, nil
+}
+
+func (s *BucketMapShard) FindForKey(key interface{}) (int, error) {
+	key = normalizeShardKey(key)
+	return s.buckets[SMShard(HashValue(key))], nil
+}
@@ -0,0 +1,173 @@
+package models
+
+import (
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+	"github.com/wfxiang08/db-sharding/conf"
+)
+
+// go test github.com/wfxiang08/db-sharding/models -v -run "TestShardStrategy$"
+func TestShardStrategy(t *testing.T) {
+	// 默认为SMHashShard
+	strategy, err := NewShardStrategy(nil, 32)
+	test.S(t).ExpectNil(err)
+	shard, _ := strategy.FindForKey(int64(6755399444017774))
+	expected, _ := NewSMHashShard(32, 1).FindForKey(int64(6755399444017774))
+	test.S(t).ExpectEquals(shard, expected)
+
+	strategy, err = NewShardStrategy(&conf.ShardingConfig{Strategy: ShardStrategyMod}, 4)
+	test.S(t).ExpectNil(err)
+	shard, _ = strategy.FindForKey(int64(10))
+	test.S(t).ExpectEquals(shard, 2)
+	// 从DB中读取的[]byte和string一致
+	shard, _ = strategy.FindForKey([]byte("10"))
+	test.S(t).ExpectEquals(shard, 2)
+
+	_, err = NewShardStrategy(&conf.ShardingConfig{Strategy: "unknown"}, 4)
+	test.S(t).ExpectNotNil(err)
+	_, err = NewShardStrategy(&conf.ShardingConfig{Strategy: ShardStrategySMHash, Location: 3}, 32)
+	test.S(t).ExpectNotNil(err)
+}
+
+// go test github.com/wfxiang08/db-sharding/models -v -run "TestShardStrategyBinlogKeys$"
+func TestShardStrategyBinlogKeys(t *testing.T) {
+	// binlog中INT为int32, VARBINARY为[]byte; 批量拷贝中从DB读取的为[]byte
+	type intKey struct {
+		UserId int64 `sharding:"user_id,ordinal=0,shard_key,pk"`
+	}
+	type binaryKey struct {
+		Name string `sharding:"name,ordinal=0,shard_key,pk"`
+	}
+	configs := []*conf.ShardingConfig{
+		{Strategy: ShardStrategySMHash},
+		{Strategy: ShardStrategyMod},
+		{Strategy: ShardStrategyBucketMap, BucketMap: conf.NewBucketMap("shard%d", 32)},
+	}
+	for _, config := range configs {
+		strategy, err := NewShardStrategy(config, 32)
+		test.S(t).ExpectNil(err)
+
+		builder, err := NewStructModelBuilder("t", &intKey{}, 32)
+		test.S(t).ExpectNil(err)
+		builder.SetShardStrategy(strategy)
+		for _, key := range []interface{}{int8(-7), int16(1234), int32(1234567), uint32(4000000000)} {
+			stream := builder.Insert([]interface{}{key}).ShardingIndex
+			test.S(t).ExpectEquals(builder.GetShardingIndex4Key([]byte(keyString(key))), stream)
+		}
+		stream := builder.Insert([]interface{}{int32(1234567)}).ShardingIndex
+		test.S(t).ExpectEquals(builder.GetShardingIndex4Model(&intKey{UserId: 1234567}), stream)
+
+		builder, err = NewStructModelBuilder("t", &binaryKey{}, 32)
+		test.S(t).ExpectNil(err)
+		builder.SetShardStrategy(strategy)
+		for _, key := range []string{"abc", "12345"} {
+			stream := builder.Delete([]interface{}{[]byte(key)}).ShardingIndex
+			test.S(t).ExpectEquals(builder.GetShardingIndex4Key([]byte(key)), stream)
+			test.S(t).ExpectEquals(builder.GetShardingIndex4Model(&binaryKey{Name: key}), stream)
+		}
+	}
+}
+
+// go test github.com/wfxiang08/db-sharding/models -v -run "TestRangeShard$"
+func TestRangeShard(t *testing.T) {
+	strategy, err := NewShardStrategy(&conf.ShardingConfig{
+		Strategy: ShardStrategyRange,
+		Ranges:   [][]int64{{100, 200, 1}, {0, 100, 0}},
+	}, 2)
+	test.S(t).ExpectNil(err)
+
+	shard, err := strategy.FindForKey(int64(0))
+	test.S(t).ExpectNil(err)
+	test.S(t).ExpectEquals(shard, 0)
+	shard, _ = strategy.FindForKey(int64(100))
+	test.S(t).ExpectEquals(shard, 1)
+	shard, _ = strategy.FindForKey("199")
+	test.S(t).ExpectEquals(shard, 1)
+	_, err = strategy.FindForKey(int64(200))
+	test.S(t).ExpectNotNil(err)
+	_, err = strategy.FindForKey("abc")
+	test.S(t).ExpectNotNil(err)
+
+	// 区间重叠, shard越界
+	_, err = NewRangeShard([]ShardRange{{0, 100, 0}, {50, 200, 1}}, 2)
+	test.S(t).ExpectNotNil(err)
+	_, err = NewRangeShard([]ShardRange{{0, 100, 2}}, 2)
+	test.S(t).ExpectNotNil(err)
+}
+
+// go test github.com/wfxiang08/db-sharding/models -v -run "TestConsistentHashShard$"
+func TestConsistentHashShard(t *testing.T) {
+	strategy4 := NewConsistentHashShard(4, 0)
+	strategy5 := NewConsistentHashShard(5, 0)
+
+	counts := make([]int, 4)
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		shard4, _ := strategy4.FindForKey(i)
+		shard5, _ := strategy5.FindForKey(i)
+		counts[shard4]++
+		if shard4 != shard5 {
+			test.S(t).ExpectEquals(shard5, 4)
+			moved++
+		}
+	}
+	// 增加一个shard, 只有新的shard上的key发生迁移
+	test.S(t).ExpectTrue(moved > 1000 && moved < 3000)
+	for _, count := range counts {
+		test.S(t).ExpectTrue(count > 1500)
+	}
+}
+
+// go test github.com/wfxiang08/db-sharding/models -v -run "TestLookupShard$"
+func TestLookupShard(t *testing.T) {
+	strategy, err := NewShardStrategy(&conf.ShardingConfig{
+		Strategy: ShardStrategyLookup,
+		Lookup:   map[string]int{"1001": 1, "abc": 0},
+	}, 2)
+	test.S(t).ExpectNil(err)
+
+	shard, _ := strategy.FindForKey(int64(1001))
+	test.S(t).ExpectEquals(shard, 1)
+	shard, _ = strategy.FindForKey([]byte("abc"))
+	test.S(t).ExpectEquals(shard, 0)
+	_, err = strategy.FindForKey(int64(1002))
+	test.S(t).ExpectNotNil(err)
+
+	_, err = NewLookupShard(map[string]int{"1": 2}, 2)
+	test.S(t).ExpectNotNil(err)
+}
+
+// go test github.com/wfxiang08/db-sharding/models -v -run "TestBucketMapShard$"
+func TestBucketMapShard(t *testing.T) {
+	key := int64(6755399444017774)
+	bucket := SMShard(HashValue(key))
+
+	// 默认的bucket map和SMHashShard一致
+	strategy, err := NewShardStrategy(&conf.ShardingConfig{
+		Strategy:  ShardStrategyBucketMap,
+		BucketMap: conf.NewBucketMap("shard%d", 32),
+	}, 32)
+	test.S(t).ExpectNil(err)
+	shard, _ := strategy.FindForKey(key)
+	expected, _ := NewSMHashShard(32, 1).FindForKey(key)
+	test.S(t).ExpectEquals(shard, expected)
+
+	bucketMap := conf.NewBucketMap("shard%d", 32)
+	test.S(t).ExpectNil(bucketMap.Move(bucket, bucket, "shard32", "shard%d"))
+	strategy, err = NewShardStrategy(&conf.ShardingConfig{Strategy: ShardStrategyBucketMap, BucketMap: bucketMap}, 33)
+	test.S(t).ExpectNil(err)
+	shard, _ = strategy.FindForKey([]byte("6755399444017774"))
+	test.S(t).ExpectEquals(shard, 32)
+
+	// shard越界, 没有加载bucket map
+	_, err = NewShardStrategy(&conf.ShardingConfig{Strategy: ShardStrategyBucketMap, BucketMap: bucketMap}, 32)
+	test.S(t).ExpectNotNil(err)
+	_, err = NewShardStrategy(&conf.ShardingConfig{Strategy: ShardStrategyBucketMap}, 32)
+	test.S(t).ExpectNotNil(err)
+
+	// shard alias按照ShardAliasFormat解析
+	_, err = NewShardStrategy(&conf.ShardingConfig{Strategy: ShardStrategyBucketMap, BucketMap: bucketMap,
+		ShardAliasFormat: "new_shard%d"}, 33)
+	test.S(t).ExpectNotNil(err)
+}
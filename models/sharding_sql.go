@@ -9,9 +9,26 @@ type ShardingSQL struct {
 	ShardingIndex int
 	SQL           string
 	Args          []interface{}
+	RowKey        string // 行的唯一标识(pk), 用于关联批量读取的数据和binlog中的events; 可以为空
+
+	InTransaction bool   // 来自binlog事务, 只有等到Commit之后才能提交到shard
+	Commit        bool   // binlog事务结束的标记(InTransaction为true), 或者队列中的标记; 没有SQL
+	OnCommitted   func() // Commit标记: shard上的事务提交之后的回调
+	Timestamp     int64  // binlog事务的Commit标记: 事务在master上的时间(秒), 用于计算延迟
+}
+
+// NewCommitSQL 队列中的标记, 之前的SQL都提交之后回调OnCommitted; binlog事务的结束需要设置InTransaction
+func NewCommitSQL(shardingIndex int) *ShardingSQL {
+	return &ShardingSQL{
+		ShardingIndex: shardingIndex,
+		Commit:        true,
+	}
 }
 
 func (this *ShardingSQL) String() string {
+	if this.Commit {
+		return "COMMIT"
+	}
 	args, _ := json.Marshal(this.Args)
 	return fmt.Sprintf("%s --> %s", this.SQL, string(args))
 }
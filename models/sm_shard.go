@@ -23,10 +23,13 @@ func HashValue(value interface{}) uint64 {
 	case int64:
 		return uint64(val)
 	case string:
-		if v, err := strconv.ParseUint(val, 10, 64); err != nil {
-			return uint64(crc32.ChecksumIEEE(hack.Slice(val)))
-		} else {
+		// 负数和int64一致
+		if v, err := strconv.ParseUint(val, 10, 64); err == nil {
+			return uint64(v)
+		} else if v, err := strconv.ParseInt(val, 10, 64); err == nil {
 			return uint64(v)
+		} else {
+			return uint64(crc32.ChecksumIEEE(hack.Slice(val)))
 		}
 	case []byte:
 		return uint64(crc32.ChecksumIEEE(val))
@@ -48,7 +51,7 @@ func NewSMHashShard(ShardNum int, Location uint64) *SMHashShard {
 }
 
 func (s *SMHashShard) FindForKey(key interface{}) (int, error) {
-	h := HashValue(key)
+	h := HashValue(normalizeShardKey(key))
 	smShardNum := int((h>>48)&((1<<12)-1)) % s.ShardNum
 	if s.Location < 2 {
 		return smShardNum, nil
@@ -0,0 +1,338 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/db-sharding/sql"
+)
+
+const (
+	// struct tag的名字
+	ShardingTagName = "sharding"
+)
+
+type structField struct {
+	name       string // column name
+	fieldIndex int    // field在struct中的index
+	ordinal    int    // binlog中的位置
+	shardKey   bool
+	primaryKey bool
+}
+
+// StructModelBuilder 根据struct tag自动实现ModelBuilder
+// 通过struct tag来描述一个model和sharding表之间的映射关系, 例如:
+//
+//	type UserRecordingLike struct {
+//		Id          int64
+//		UserId      int64 `sharding:"user_id,ordinal=2,shard_key,pk"`
+//		RecordingId int64 `sharding:"recording_id,ordinal=3,pk"`
+//		CreatedOn   int32 `sharding:"created_on,ordinal=1"`
+//	}
+//
+// 1. 第一项为column name, 没有tag的field不参与SQL的生成(例如: 源表中的自增id)
+// 2. ordinal:     column在binlog row image中的位置(@1, @2, ...从0开始计数)
+// 3. shard_key:   用于计算sharding index的column, 有且只有一个
+// 4. pk:          用于update/delete的where条件, 可以有多个
+type StructModelBuilder struct {
+	strategy ShardStrategy
+
+	tableName  string
+	modelType  reflect.Type
+	columns    []*structField
+	shardKey   *structField
+	primaryKey []*structField
+
+	sqlInsert       string
+	sqlInsertIgnore string
+	sqlUpdate       string
+	sqlDelete       string
+	insertSegment   string
+}
+
+func NewStructModelBuilder(tableName string, model interface{}, shardNum int) (*StructModelBuilder, error) {
+	modelType := reflect.TypeOf(model)
+	if modelType.Kind() == reflect.Ptr {
+		modelType = modelType.Elem()
+	}
+	if modelType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("NewStructModelBuilder: expect struct, got %s", modelType.Kind())
+	}
+
+	var fields []*structField
+	for i := 0; i < modelType.NumField(); i++ {
+		tag, ok := modelType.Field(i).Tag.Lookup(ShardingTagName)
+		if !ok || tag == "-" {
+			continue
+		}
+		field, err := parseStructField(tag)
+		if err != nil {
+			return nil, fmt.Errorf("NewStructModelBuilder: field %s: %s", modelType.Field(i).Name, err.Error())
+		}
+		field.fieldIndex = i
+		fields = append(fields, field)
+	}
+
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("NewStructModelBuilder: no `%s` tag found in %s", ShardingTagName, modelType.Name())
+	}
+	result, err := newFieldsModelBuilder(tableName, fields, shardNum)
+	if err != nil {
+		return nil, fmt.Errorf("NewStructModelBuilder: %s in %s", err.Error(), modelType.Name())
+	}
+	result.modelType = modelType
+	return result, nil
+}
+
+// newFieldsModelBuilder 根据columns的描述生成SQL
+func newFieldsModelBuilder(tableName string, fields []*structField, shardNum int) (*StructModelBuilder, error) {
+	result := &StructModelBuilder{
+		strategy:  NewSMHashShard(shardNum, 0),
+		tableName: tableName,
+		columns:   fields,
+	}
+	for _, field := range fields {
+		if field.shardKey {
+			if result.shardKey != nil {
+				return nil, fmt.Errorf("duplicated shard_key: %s, %s", result.shardKey.name, field.name)
+			}
+			result.shardKey = field
+		}
+		if field.primaryKey {
+			result.primaryKey = append(result.primaryKey, field)
+		}
+	}
+
+	if result.shardKey == nil {
+		return nil, fmt.Errorf("no shard_key found")
+	}
+	if len(result.primaryKey) == 0 {
+		return nil, fmt.Errorf("no pk found")
+	}
+
+	result.buildSQL()
+	return result, nil
+}
+
+// 格式: column_name,ordinal=N,shard_key,pk
+func parseStructField(tag string) (*structField, error) {
+	items := strings.Split(tag, ",")
+	field := &structField{
+		name:    strings.TrimSpace(items[0]),
+		ordinal: -1,
+	}
+	if len(field.name) == 0 {
+		return nil, fmt.Errorf("empty column name")
+	}
+
+	for _, item := range items[1:] {
+		item = strings.TrimSpace(item)
+		switch {
+		case item == "shard_key":
+			field.shardKey = true
+		case item == "pk":
+			field.primaryKey = true
+		case strings.HasPrefix(item, "ordinal="):
+			ordinal, err := strconv.Atoi(item[len("ordinal="):])
+			if err != nil || ordinal < 0 {
+				return nil, fmt.Errorf("invalid ordinal: %s", item)
+			}
+			field.ordinal = ordinal
+		default:
+			return nil, fmt.Errorf("unknown tag option: %s", item)
+		}
+	}
+
+	if field.ordinal < 0 {
+		return nil, fmt.Errorf("ordinal not found for column: %s", field.name)
+	}
+	return field, nil
+}
+
+func (this *StructModelBuilder) buildSQL() {
+	names := make([]string, len(this.columns))
+	sets := make([]string, len(this.columns))
+	placeholders := make([]string, len(this.columns))
+	for i, column := range this.columns {
+		names[i] = column.name
+		sets[i] = fmt.Sprintf("%s=?", column.name)
+		placeholders[i] = "?"
+	}
+
+	wheres := make([]string, len(this.primaryKey))
+	for i, column := range this.primaryKey {
+		wheres[i] = fmt.Sprintf("%s=?", column.name)
+	}
+
+	this.insertSegment = fmt.Sprintf("(%s)", strings.Join(placeholders, ", "))
+	this.sqlInsert = fmt.Sprintf("replace into %s (%s) values %s", this.tableName, strings.Join(names, ", "), this.insertSegment)
+	this.sqlInsertIgnore = fmt.Sprintf("insert ignore into %s (%s) values %s", this.tableName, strings.Join(names, ", "), this.insertSegment)
+	this.sqlUpdate = fmt.Sprintf("update %s SET %s where %s", this.tableName, strings.Join(sets, ", "), strings.Join(wheres, " and "))
+	this.sqlDelete = fmt.Sprintf("delete from %s where %s", this.tableName, strings.Join(wheres, " and "))
+}
+
+// CheckColumns 校验tag中的ordinal和真实的表结构是否一致
+func (this *StructModelBuilder) CheckColumns(columns *sql.ColumnList) error {
+	for _, column := range this.columns {
+		ordinal, ok := columns.Ordinals[column.name]
+		if !ok {
+			return fmt.Errorf("column %s not found in %s: %s", column.name, this.tableName, columns.String())
+		}
+		if ordinal != column.ordinal {
+			return fmt.Errorf("column %s ordinal mismatch in %s, expect: %d, got: %d", column.name, this.tableName, column.ordinal, ordinal)
+		}
+	}
+	return nil
+}
+
+// SetShardStrategy 替换默认的SMHashShard
+func (this *StructModelBuilder) SetShardStrategy(strategy ShardStrategy) {
+	this.strategy = strategy
+}
+
+// FindForKey binlog和DB中读取的key类型不同(int32 vs. int64, []byte vs. string), 统一之后再计算shard
+func (this *StructModelBuilder) FindForKey(key interface{}) (int, error) {
+	return this.strategy.FindForKey(normalizeShardKey(key))
+}
+
+// getShardingIndex 找不到shard时(例如: range/lookup没有覆盖这个key)直接中断, 不能返回-1作为shard index
+func (this *StructModelBuilder) getShardingIndex(key interface{}) int {
+	shard, err := this.FindForKey(key)
+	if err != nil {
+		log.PanicErrorf(err, "No shard found for %s: %v, table: %s", this.shardKey.name, keyString(key), this.tableName)
+	}
+	return shard
+}
+
+// 从binlog row image中按照ordinal读取数据
+func (this *StructModelBuilder) binlogArgs(fields []*structField, row []interface{}) []interface{} {
+	args := make([]interface{}, len(fields))
+	for i, field := range fields {
+		args[i] = row[field.ordinal]
+	}
+	return args
+}
+
+// 从model中按照field index读取数据
+func (this *StructModelBuilder) modelValue(model interface{}) reflect.Value {
+	value := reflect.Indirect(reflect.ValueOf(model))
+	if value.Type() != this.modelType {
+		log.Panicf("StructModelBuilder: expect model %s, got %s", this.modelType.Name(), value.Type().Name())
+	}
+	return value
+}
+
+func (this *StructModelBuilder) Delete(where []interface{}) *ShardingSQL {
+	return &ShardingSQL{
+		ShardingIndex: this.getShardingIndex(where[this.shardKey.ordinal]),
+		SQL:           this.sqlDelete,
+		Args:          this.binlogArgs(this.primaryKey, where),
+		RowKey:        RowKey(this.binlogArgs(this.primaryKey, where)),
+	}
+}
+
+func (this *StructModelBuilder) Update(args []interface{}, where []interface{}) *ShardingSQL {
+	return &ShardingSQL{
+		ShardingIndex: this.getShardingIndex(args[this.shardKey.ordinal]),
+		SQL:           this.sqlUpdate,
+		Args:          append(this.binlogArgs(this.columns, args), this.binlogArgs(this.primaryKey, where)...),
+		RowKey:        RowKey(this.binlogArgs(this.primaryKey, args)),
+	}
+}
+
+func (this *StructModelBuilder) Insert(args []interface{}) *ShardingSQL {
+	return &ShardingSQL{
+		ShardingIndex: this.getShardingIndex(args[this.shardKey.ordinal]),
+		SQL:           this.sqlInsert,
+		Args:          this.binlogArgs(this.columns, args),
+		RowKey:        RowKey(this.binlogArgs(this.primaryKey, args)),
+	}
+}
+
+func (this *StructModelBuilder) InsertIgnore(model interface{}) *ShardingSQL {
+	value := this.modelValue(model)
+	args := make([]interface{}, len(this.columns))
+	for i, column := range this.columns {
+		args[i] = value.Field(column.fieldIndex).Interface()
+	}
+	keys := make([]interface{}, len(this.primaryKey))
+	for i, column := range this.primaryKey {
+		keys[i] = value.Field(column.fieldIndex).Interface()
+	}
+	return &ShardingSQL{
+		ShardingIndex: this.getShardingIndex(value.Field(this.shardKey.fieldIndex).Interface()),
+		SQL:           this.sqlInsertIgnore,
+		Args:          args,
+		RowKey:        RowKey(keys),
+	}
+}
+
+func (this *StructModelBuilder) GetShardingIndex4Model(model interface{}) int {
+	value := this.modelValue(model)
+	return this.getShardingIndex(value.Field(this.shardKey.fieldIndex).Interface())
+}
+
+func (this *StructModelBuilder) GetBatchInsertSegment() string {
+	return this.insertSegment
+}
+
+func (this *StructModelBuilder) GetTableName() string {
+	return this.tableName
+}
+
+func (this *StructModelBuilder) GetColumnNames() []string {
+	return fieldNames(this.columns)
+}
+
+func (this *StructModelBuilder) GetPrimaryKeyNames() []string {
+	return fieldNames(this.primaryKey)
+}
+
+func (this *StructModelBuilder) GetShardKeyName() string {
+	return this.shardKey.name
+}
+
+// GetShardingIndex4Key 从DB中读取的key可能为[]byte(文本协议), 和binlog中的key一样统一类型之后计算shard
+func (this *StructModelBuilder) GetShardingIndex4Key(key interface{}) int {
+	return this.getShardingIndex(key)
+}
+
+// DeleteByKey shard key不在pk中时, ShardingIndex为-1, 需要调用者指定
+func (this *StructModelBuilder) DeleteByKey(key []interface{}) *ShardingSQL {
+	shardingIndex := -1
+	for i, column := range this.primaryKey {
+		if column == this.shardKey {
+			shardingIndex = this.GetShardingIndex4Key(key[i])
+		}
+	}
+	return &ShardingSQL{
+		ShardingIndex: shardingIndex,
+		SQL:           this.sqlDelete,
+		Args:          key,
+		RowKey:        RowKey(key),
+	}
+}
+
+func fieldNames(fields []*structField) []string {
+	names := make([]string, len(fields))
+	for i, field := range fields {
+		names[i] = field.name
+	}
+	return names
+}
+
+// RowKey pk的值拼接成为字符串; binlog和model中的类型可能不一样(int32 vs. int64, []byte vs. string), 因此按照文本比较
+func RowKey(values []interface{}) string {
+	items := make([]string, len(values))
+	for i, value := range values {
+		if data, ok := value.([]byte); ok {
+			items[i] = string(data)
+		} else {
+			items[i] = fmt.Sprint(value)
+		}
+	}
+	return strings.Join(items, "\x00")
+}
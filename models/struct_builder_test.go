@@ -0,0 +1,114 @@
+package models
+
+import (
+	"testing"
+
+	test "github.com/outbrain/golib/tests"
+	"github.com/wfxiang08/db-sharding/sql"
+)
+
+type testLike struct {
+	Id          int64
+	UserId      int64 `sharding:"user_id,ordinal=2,shard_key,pk"`
+	RecordingId int64 `sharding:"recording_id,ordinal=3,pk"`
+	CreatedOn   int32 `sharding:"created_on,ordinal=1"`
+}
+
+// go test github.com/wfxiang08/db-sharding/models -v -run "TestStructModelBuilder$"
+func TestStructModelBuilder(t *testing.T) {
+	builder, err := NewStructModelBuilder("user_recording_like", &testLike{}, 32)
+	test.S(t).ExpectNil(err)
+
+	userId := int64(6755399444017774)
+	shard, _ := NewSMHashShard(32, 1).FindForKey(userId)
+
+	row := []interface{}{int64(1), int32(100), userId, int64(200)}
+	newRow := []interface{}{int64(1), int32(101), userId, int64(201)}
+
+	sql := builder.Insert(row)
+	test.S(t).ExpectEquals(sql.ShardingIndex, shard)
+	test.S(t).ExpectEquals(sql.SQL, "replace into user_recording_like (user_id, recording_id, created_on) values (?, ?, ?)")
+	test.S(t).ExpectEquals(sql.Args, []interface{}{userId, int64(200), int32(100)})
+
+	sql = builder.Update(newRow, row)
+	test.S(t).ExpectEquals(sql.SQL, "update user_recording_like SET user_id=?, recording_id=?, created_on=? where user_id=? and recording_id=?")
+	test.S(t).ExpectEquals(sql.Args, []interface{}{userId, int64(201), int32(101), userId, int64(200)})
+
+	sql = builder.Delete(row)
+	test.S(t).ExpectEquals(sql.SQL, "delete from user_recording_like where user_id=? and recording_id=?")
+	test.S(t).ExpectEquals(sql.Args, []interface{}{userId, int64(200)})
+
+	model := &testLike{Id: 1, UserId: userId, RecordingId: 200, CreatedOn: 100}
+	sql = builder.InsertIgnore(model)
+	test.S(t).ExpectEquals(sql.ShardingIndex, shard)
+	test.S(t).ExpectEquals(sql.SQL, "insert ignore into user_recording_like (user_id, recording_id, created_on) values (?, ?, ?)")
+	test.S(t).ExpectEquals(sql.Args, []interface{}{userId, int64(200), int32(100)})
+	test.S(t).ExpectEquals(builder.GetShardingIndex4Model(model), shard)
+	test.S(t).ExpectEquals(builder.GetBatchInsertSegment(), "(?, ?, ?)")
+
+	// binlog和model中的同一行数据, RowKey相同
+	test.S(t).ExpectEquals(sql.RowKey, builder.Delete(row).RowKey)
+	test.S(t).ExpectEquals(sql.RowKey, builder.Insert(row).RowKey)
+	test.S(t).ExpectNotEquals(sql.RowKey, builder.Update(newRow, row).RowKey)
+	test.S(t).ExpectEquals(RowKey([]interface{}{int32(5), []byte("a")}), RowKey([]interface{}{int64(5), "a"}))
+
+	test.S(t).ExpectEquals(builder.GetColumnNames(), []string{"user_id", "recording_id", "created_on"})
+	test.S(t).ExpectEquals(builder.GetPrimaryKeyNames(), []string{"user_id", "recording_id"})
+	test.S(t).ExpectEquals(builder.GetShardKeyName(), "user_id")
+	test.S(t).ExpectEquals(builder.GetShardingIndex4Key([]byte("6755399444017774")), shard)
+
+	sql = builder.DeleteByKey([]interface{}{[]byte("6755399444017774"), []byte("200")})
+	test.S(t).ExpectEquals(sql.ShardingIndex, shard)
+	test.S(t).ExpectEquals(sql.SQL, "delete from user_recording_like where user_id=? and recording_id=?")
+	test.S(t).ExpectEquals(sql.RowKey, builder.Delete(row).RowKey)
+}
+
+func TestStructModelBuilderInvalidTags(t *testing.T) {
+	type noShardKey struct {
+		UserId int64 `sharding:"user_id,ordinal=0,pk"`
+	}
+	_, err := NewStructModelBuilder("t", noShardKey{}, 32)
+	test.S(t).ExpectNotNil(err)
+
+	type noOrdinal struct {
+		UserId int64 `sharding:"user_id,shard_key,pk"`
+	}
+	_, err = NewStructModelBuilder("t", noOrdinal{}, 32)
+	test.S(t).ExpectNotNil(err)
+
+	type unknownOption struct {
+		UserId int64 `sharding:"user_id,ordinal=0,shard_key,pk,unique"`
+	}
+	_, err = NewStructModelBuilder("t", unknownOption{}, 32)
+	test.S(t).ExpectNotNil(err)
+}
+
+func TestStructModelBuilderCheckColumns(t *testing.T) {
+	builder, err := NewStructModelBuilder("user_recording_like", &testLike{}, 32)
+	test.S(t).ExpectNil(err)
+
+	test.S(t).ExpectNil(builder.CheckColumns(sql.ParseColumnList("id,created_on,user_id,recording_id")))
+	// column顺序调整
+	test.S(t).ExpectNotNil(builder.CheckColumns(sql.ParseColumnList("id,user_id,created_on,recording_id")))
+	// column被删除
+	test.S(t).ExpectNotNil(builder.CheckColumns(sql.ParseColumnList("id,created_on,user_id")))
+}
+
+// go test github.com/wfxiang08/db-sharding/models -v -run "TestStructModelBuilderNoShard$"
+func TestStructModelBuilderNoShard(t *testing.T) {
+	builder, err := NewStructModelBuilder("user_recording_like", &testLike{}, 32)
+	test.S(t).ExpectNil(err)
+	strategy, err := NewLookupShard(map[string]int{"1001": 3}, 32)
+	test.S(t).ExpectNil(err)
+	builder.SetShardStrategy(strategy)
+
+	test.S(t).ExpectEquals(builder.Insert([]interface{}{int64(1), int32(100), int64(1001), int64(200)}).ShardingIndex, 3)
+
+	// 没有覆盖的key不能得到-1的shard index
+	var recovered interface{}
+	func() {
+		defer func() { recovered = recover() }()
+		builder.Insert([]interface{}{int64(1), int32(100), int64(1002), int64(200)})
+	}()
+	test.S(t).ExpectNotNil(recovered)
+}
@@ -27,10 +27,13 @@ const (
 )
 
 // BinlogCoordinates described binary log coordinates in the form of log file & log position.
+// GTIDSet is the executed GTID set at this position; it is only tracked when streaming in GTID mode,
+// where it (and not file:pos) is what identifies the position across a failover.
 type BinlogCoordinates struct {
 	LogFile string
 	LogPos  int64
 	Type    BinlogType
+	GTIDSet string
 }
 
 // ParseInstanceKey will parse an InstanceKey from a string representation such as 127.0.0.1:3306
@@ -49,6 +52,9 @@ func ParseBinlogCoordinates(logFileLogPos string) (*BinlogCoordinates, error) {
 
 // DisplayString returns a user-friendly string representation of these coordinates
 func (this *BinlogCoordinates) DisplayString() string {
+	if this.IsGTID() {
+		return fmt.Sprintf("%s:%d (gtid: %s)", this.LogFile, this.LogPos, this.GTIDSet)
+	}
 	return fmt.Sprintf("%s:%d", this.LogFile, this.LogPos)
 }
 
@@ -65,9 +71,14 @@ func (this *BinlogCoordinates) Equals(other *BinlogCoordinates) bool {
 	return this.LogFile == other.LogFile && this.LogPos == other.LogPos && this.Type == other.Type
 }
 
-// IsEmpty returns true if the log file is empty, unnamed
+// IsEmpty returns true if the log file is empty, unnamed, and there is no GTID set
 func (this *BinlogCoordinates) IsEmpty() bool {
-	return this.LogFile == ""
+	return this.LogFile == "" && this.GTIDSet == ""
+}
+
+// IsGTID returns true if these coordinates carry an executed GTID set
+func (this *BinlogCoordinates) IsGTID() bool {
+	return this.GTIDSet != ""
 }
 
 // SmallerThan returns true if this coordinate is strictly smaller than the other.
@@ -115,3 +115,15 @@ func TestBinlogFileNumberDistance(t *testing.T) {
 	test.S(t).ExpectEquals(fileNum, 17)
 	test.S(t).ExpectEquals(numLen, 5)
 }
+
+func TestBinlogCoordinatesGTID(t *testing.T) {
+	c1 := BinlogCoordinates{LogFile: "mysql-bin.00017", LogPos: 104}
+	c2 := BinlogCoordinates{GTIDSet: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-100"}
+	c3 := BinlogCoordinates{}
+
+	test.S(t).ExpectFalse(c1.IsGTID())
+	test.S(t).ExpectTrue(c2.IsGTID())
+	test.S(t).ExpectFalse(c2.IsEmpty())
+	test.S(t).ExpectTrue(c3.IsEmpty())
+	test.S(t).ExpectEquals(c2.DisplayString(), ":0 (gtid: 3e11fa47-71ca-11e1-9e33-c80aa9429562:1-100)")
+}
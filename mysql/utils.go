@@ -11,6 +11,7 @@ import (
 	"github.com/outbrain/golib/log"
 	"github.com/outbrain/golib/sqlutils"
 	"github.com/wfxiang08/db-sharding/sql"
+	"strings"
 	"time"
 )
 
@@ -39,7 +40,9 @@ func GetReplicationLag(connectionConfig *ConnectionConfig) (replicationLag time.
 		return replicationLag, err
 	}
 
+	found := false
 	err = sqlutils.QueryRowsMap(db, `show slave status`, func(m sqlutils.RowMap) error {
+		found = true
 		slaveIORunning := m.GetString("Slave_IO_Running")
 		slaveSQLRunning := m.GetString("Slave_SQL_Running")
 		secondsBehindMaster := m.GetNullInt64("Seconds_Behind_Master")
@@ -49,6 +52,9 @@ func GetReplicationLag(connectionConfig *ConnectionConfig) (replicationLag time.
 		replicationLag = time.Duration(secondsBehindMaster.Int64) * time.Second
 		return nil
 	})
+	if err == nil && !found {
+		err = fmt.Errorf("empty slave status, %s is not a replica", connectionConfig.Key.String())
+	}
 	return replicationLag, err
 }
 
@@ -155,6 +161,7 @@ func GetSelfBinlogCoordinates(db *gosql.DB) (selfBinlogCoordinates *BinlogCoordi
 		selfBinlogCoordinates = &BinlogCoordinates{
 			LogFile: m.GetString("File"),
 			LogPos:  m.GetInt64("Position"),
+			GTIDSet: strings.Replace(m.GetString("Executed_Gtid_Set"), "\n", "", -1),
 		}
 		return nil
 	})
@@ -169,6 +176,21 @@ func GetInstanceKey(db *gosql.DB) (instanceKey *InstanceKey, err error) {
 	return instanceKey, err
 }
 
+// GetBinaryLogs reads the binlog files still kept on given DB, 按照show binary logs的顺序(从旧到新)
+func GetBinaryLogs(db *gosql.DB) (logFiles []string, err error) {
+	err = sqlutils.QueryRowsMap(db, `show binary logs`, func(m sqlutils.RowMap) error {
+		logFiles = append(logFiles, m.GetString("Log_name"))
+		return nil
+	})
+	return logFiles, err
+}
+
+// GetServerUUID reads server_uuid on given DB, 主从切换之后binlog的file:pos不可比较
+func GetServerUUID(db *gosql.DB) (serverUUID string, err error) {
+	err = db.QueryRow(`select @@global.server_uuid`).Scan(&serverUUID)
+	return serverUUID, err
+}
+
 // GetTableColumns reads column list from given table
 func GetTableColumns(db *gosql.DB, databaseName, tableName string) (*sql.ColumnList, error) {
 	query := fmt.Sprintf(`
@@ -178,8 +200,10 @@ func GetTableColumns(db *gosql.DB, databaseName, tableName string) (*sql.ColumnL
 		sql.EscapeName(tableName),
 	)
 	columnNames := []string{}
+	dataTypes := []string{}
 	err := sqlutils.QueryRowsMap(db, query, func(rowMap sqlutils.RowMap) error {
 		columnNames = append(columnNames, rowMap.GetString("Field"))
+		dataTypes = append(dataTypes, sql.ParseDataType(rowMap.GetString("Type")))
 		return nil
 	})
 	if err != nil {
@@ -191,5 +215,62 @@ func GetTableColumns(db *gosql.DB, databaseName, tableName string) (*sql.ColumnL
 			sql.EscapeName(tableName),
 		)
 	}
-	return sql.NewColumnList(columnNames), nil
+	columns := sql.NewColumnList(columnNames)
+	for i, name := range columnNames {
+		columns.SetDataType(name, dataTypes[i])
+	}
+	return columns, nil
+}
+
+// Queryer is satisfied by *sql.DB, *sql.Tx and gorm.SQLCommon
+type Queryer interface {
+	Query(query string, args ...interface{}) (*gosql.Rows, error)
+}
+
+// GetUniqueKeys reads the unique keys of given table, PRIMARY first
+func GetUniqueKeys(db Queryer, databaseName, tableName string) ([]*sql.UniqueKey, error) {
+	query := `
+		select s.INDEX_NAME, s.COLUMN_NAME, s.NULLABLE, c.COLUMN_TYPE
+		from information_schema.STATISTICS s
+		join information_schema.COLUMNS c
+			on c.TABLE_SCHEMA = s.TABLE_SCHEMA and c.TABLE_NAME = s.TABLE_NAME and c.COLUMN_NAME = s.COLUMN_NAME
+		where s.TABLE_SCHEMA = ? and s.TABLE_NAME = ? and s.NON_UNIQUE = 0
+		order by s.INDEX_NAME = 'PRIMARY' desc, s.INDEX_NAME, s.SEQ_IN_INDEX
+		`
+	rows, err := db.Query(query, databaseName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uniqueKeys := []*sql.UniqueKey{}
+	columnNames := make(map[string][]string)
+	columnTypes := make(map[string]string) // column --> COLUMN_TYPE, 例如: bigint(20) unsigned
+	for rows.Next() {
+		var indexName, columnName, nullable, columnType string
+		if err := rows.Scan(&indexName, &columnName, &nullable, &columnType); err != nil {
+			return nil, err
+		}
+		if _, ok := columnNames[indexName]; !ok {
+			uniqueKeys = append(uniqueKeys, &sql.UniqueKey{Name: indexName})
+		}
+		columnNames[indexName] = append(columnNames[indexName], columnName)
+		columnTypes[columnName] = columnType
+		if nullable == "YES" {
+			uniqueKeys[len(uniqueKeys)-1].HasNullable = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, uniqueKey := range uniqueKeys {
+		uniqueKey.Columns = *sql.NewColumnList(columnNames[uniqueKey.Name])
+		for _, name := range columnNames[uniqueKey.Name] {
+			uniqueKey.Columns.SetDataType(name, sql.ParseDataType(columnTypes[name]))
+			if strings.Contains(strings.ToLower(columnTypes[name]), "unsigned") {
+				uniqueKey.Columns.SetUnsigned(name)
+			}
+		}
+	}
+	return uniqueKeys, nil
 }
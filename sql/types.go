@@ -33,9 +33,19 @@ type Column struct {
 	IsUnsigned         bool
 	Charset            string
 	Type               ColumnType
+	DataType           string // 小写的MySQL类型, 例如: bigint, varchar; 空表示未知
 	timezoneConversion *TimezoneConvertion
 }
 
+// ParseDataType 从column的定义中得到类型, 例如: "bigint(20) unsigned" --> "bigint"
+func ParseDataType(columnType string) string {
+	columnType = strings.ToLower(strings.TrimSpace(columnType))
+	if index := strings.IndexAny(columnType, "( \t"); index >= 0 {
+		columnType = columnType[:index]
+	}
+	return columnType
+}
+
 func (this *Column) convertArg(arg interface{}) interface{} {
 	if s, ok := arg.(string); ok {
 		// string, charset conversion
@@ -169,6 +179,14 @@ func (this *ColumnList) GetColumnType(columnName string) ColumnType {
 	return this.GetColumn(columnName).Type
 }
 
+func (this *ColumnList) SetDataType(columnName string, dataType string) {
+	this.GetColumn(columnName).DataType = dataType
+}
+
+func (this *ColumnList) GetDataType(columnName string) string {
+	return this.GetColumn(columnName).DataType
+}
+
 func (this *ColumnList) SetConvertDatetimeToTimestamp(columnName string, toTimezone string) {
 	this.GetColumn(columnName).timezoneConversion = &TimezoneConvertion{ToTimezone: toTimezone}
 }